@@ -7,6 +7,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/stats"
 	"github.com/hashicorp/memberlist"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -19,6 +20,7 @@ var core app.Core
 var queues *app.Queues
 var duration time.Duration
 var memberList *memberlist.Memberlist
+var statsClient *stats.MemoryClient
 var testQueueName = "test_queue"
 var RDtMap *riak.RDtMap
 
@@ -68,8 +70,12 @@ var _ = BeforeSuite(func() {
 	cfg.Core = core
 	cfg.Queues = queues
 
+	// Keep stats in memory so specs can assert against them
+	statsClient = stats.NewMemoryClient()
+	cfg.Stats.Client = statsClient
+
 	// Create a memberlist, aka the list of possible RiaQ processes to communicate with
-	memberList, _, _ = app.InitMemberList(core.Name, core.Port, core.SeedServers, core.SeedPort)
+	memberList, _, _ = app.InitMemberList(core.Name, core.Port, core.SeedServers, core.SeedPort, core.ClusterProfile, nil, nil)
 
 	// Disable log output during tests
 	logrus.SetOutput(ioutil.Discard)
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// DefaultAutoscaleHighFill is the average fill ratio at or above which a sync counts as busy
+const DefaultAutoscaleHighFill = 90
+
+// DefaultAutoscaleLowFill is the average fill ratio at or below which a sync counts as idle
+const DefaultAutoscaleLowFill = 10
+
+// DefaultAutoscaleSustain is how many syncs in a row must be busy, or idle, before scaling
+const DefaultAutoscaleSustain = 3
+
+// DefaultAutoscaleCooldown is the least time between two scalings of the same queue
+const DefaultAutoscaleCooldown = 5 * time.Minute
+
+// AutoscalePolicy holds the thresholds a queue's partitions are scaled by
+type AutoscalePolicy struct {
+	// HighFill and LowFill are percentages of the requested batches that receives filled
+	HighFill int64
+	LowFill  int64
+	// Sustain is how many syncs in a row must be busy, or idle, before the partitions are scaled
+	Sustain int
+	// Cooldown is the least time between two scalings of the same queue
+	Cooldown time.Duration
+}
+
+// autoscalePolicy returns the configured autoscale thresholds, or their defaults
+func (cfg *Config) autoscalePolicy() AutoscalePolicy {
+	return autoscalePolicyOf(cfg.Core)
+}
+
+func autoscalePolicyOf(core Core) AutoscalePolicy {
+	policy := AutoscalePolicy{
+		HighFill: DefaultAutoscaleHighFill,
+		LowFill:  DefaultAutoscaleLowFill,
+		Sustain:  DefaultAutoscaleSustain,
+		Cooldown: DefaultAutoscaleCooldown,
+	}
+	if core.AutoscaleHighFill > 0 {
+		policy.HighFill = core.AutoscaleHighFill
+	}
+	if core.AutoscaleLowFill > 0 {
+		policy.LowFill = core.AutoscaleLowFill
+	}
+	if core.AutoscaleSustain > 0 {
+		policy.Sustain = core.AutoscaleSustain
+	}
+	if core.AutoscaleCooldown > 0 {
+		policy.Cooldown = core.AutoscaleCooldown * time.Millisecond
+	}
+	return policy
+}
+
+func validateAutoscale(core Core) error {
+	policy := autoscalePolicyOf(core)
+	if policy.HighFill > 100 || policy.LowFill >= policy.HighFill {
+		return fmt.Errorf("autoscalelowfill must be below autoscalehighfill, and both at most 100, got %d and %d", policy.LowFill, policy.HighFill)
+	}
+	return nil
+}
+
+// autoscaler tracks how busy a queue's receives were between syncs
+type autoscaler struct {
+	requested int64
+	received  int64
+	depth     int64
+	// busy and idle count the syncs in a row which were past the thresholds
+	busy       int
+	idle       int
+	lastScaled time.Time
+	sync.Mutex
+}
+
+func (a *autoscaler) observeReceive(requested int64, received int64) {
+	a.Lock()
+	defer a.Unlock()
+	a.requested += requested
+	a.received += received
+}
+
+func (a *autoscaler) observeDepth(depth int64) {
+	a.Lock()
+	defer a.Unlock()
+	a.depth = depth
+}
+
+// receiveSample is what a queue's receives on this node saw between two syncs
+type receiveSample struct {
+	requested int64
+	received  int64
+	// depth is the latest estimate of the queue's depth
+	depth int64
+}
+
+// takeSample closes the sample gathered since the last sync, and starts the next one
+func (a *autoscaler) takeSample() receiveSample {
+	a.Lock()
+	defer a.Unlock()
+	sample := receiveSample{requested: a.requested, received: a.received, depth: a.depth}
+	a.requested, a.received = 0, 0
+	return sample
+}
+
+// stats returns the sample as the stats of the named queue
+func (sample receiveSample) stats(queueName string) QueueStats {
+	stats := QueueStats{Name: queueName, Received: sample.received, ApproxDepth: sample.depth}
+	if sample.requested > 0 {
+		stats.FillRatio = sample.received * 100 / sample.requested
+	}
+	return stats
+}
+
+// evaluate returns 1 if the partitions should grow, -1 if they should shrink, or 0
+func (a *autoscaler) evaluate(policy AutoscalePolicy, sample receiveSample, now time.Time) int {
+	a.Lock()
+	defer a.Unlock()
+	if sample.requested == 0 {
+		return 0
+	}
+	fill := sample.received * 100 / sample.requested
+	switch {
+	case fill >= policy.HighFill && sample.depth > 0:
+		a.busy++
+		a.idle = 0
+	case fill <= policy.LowFill:
+		a.idle++
+		a.busy = 0
+	default:
+		a.busy, a.idle = 0, 0
+	}
+	if !a.lastScaled.IsZero() && now.Sub(a.lastScaled) < policy.Cooldown {
+		return 0
+	}
+	step := 0
+	if a.busy >= policy.Sustain {
+		step = 1
+	} else if a.idle >= policy.Sustain {
+		step = -1
+	}
+	if step != 0 {
+		a.busy, a.idle = 0, 0
+		a.lastScaled = now
+	}
+	return step
+}
+
+// sample hands what the queue's receives saw since the last sync to observers, then autoscales on it
+func (queue *Queue) sample(cfg *Config, observers []QueueObserver, now time.Time) {
+	sample := queue.autoscaler.takeSample()
+	if len(observers) > 0 {
+		stats := sample.stats(queue.Name)
+		for _, observer := range observers {
+			observer.OnMetrics(stats)
+		}
+	}
+	queue.autoscale(cfg, sample, now)
+}
+
+// autoscale grows or shrinks the queue's partitions on this node by one, if need be
+func (queue *Queue) autoscale(cfg *Config, sample receiveSample, now time.Time) {
+	if !cfg.Core.Autoscale {
+		return
+	}
+	step := queue.autoscaler.evaluate(cfg.autoscalePolicy(), sample, now)
+	if step == 0 {
+		return
+	}
+	minPartitions, _ := cfg.GetMinPartitions(queue.Name)
+	maxPartitions, _ := cfg.GetMaxPartitions(queue.Name)
+	count := queue.Parts.PartitionCount() + step
+	if count < minPartitions || count > maxPartitions {
+		return
+	}
+	logrus.Infof("Autoscaling queue %s to %d partitions", queue.Name, count)
+	queue.Parts.Resize(cfg, queue.Name, count)
+}
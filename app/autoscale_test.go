@@ -0,0 +1,92 @@
+package app_test
+
+import (
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Autoscale", func() {
+
+	var (
+		queue *app.Queue
+		now   time.Time
+	)
+
+	// syncs runs n syncs a minute apart, each after receives filling the given share of their batches
+	syncs := func(n int, fill int64, depth int64) {
+		for i := 0; i < n; i++ {
+			queue.ObserveReceive(100, fill, depth)
+			now = now.Add(time.Minute)
+			queue.AutoscaleAt(cfg, now)
+		}
+	}
+
+	BeforeEach(func() {
+		cfg.Core.Autoscale = true
+		cfg.Core.AutoscaleSustain = 3
+		// Syncs are a minute apart, so only a longer cooldown holds anything back
+		cfg.Core.AutoscaleCooldown = 1
+		queue = &app.Queue{Name: testQueueName, Parts: app.InitPartitions(cfg, testQueueName)}
+		now = time.Now()
+	})
+
+	AfterEach(func() {
+		cfg.Core.Autoscale = false
+		cfg.Core.AutoscaleSustain = 0
+		cfg.Core.AutoscaleCooldown = 0
+	})
+
+	It("should grow only once the fill has stayed high", func() {
+		Expect(queue.Parts.PartitionCount()).To(Equal(1))
+		syncs(2, 95, 1000)
+		Expect(queue.Parts.PartitionCount()).To(Equal(1))
+		syncs(1, 95, 1000)
+		Expect(queue.Parts.PartitionCount()).To(Equal(2))
+		syncs(3, 95, 1000)
+		Expect(queue.Parts.PartitionCount()).To(Equal(3))
+	})
+
+	It("should start over when a sync falls between the thresholds", func() {
+		syncs(2, 95, 1000)
+		syncs(1, 50, 1000)
+		syncs(2, 95, 1000)
+		Expect(queue.Parts.PartitionCount()).To(Equal(1))
+		syncs(2, 5, 0)
+		syncs(1, 50, 0)
+		syncs(2, 5, 0)
+		Expect(queue.Parts.PartitionCount()).To(Equal(1))
+	})
+
+	It("should not grow while the depth says the queue is empty", func() {
+		syncs(5, 100, 0)
+		Expect(queue.Parts.PartitionCount()).To(Equal(1))
+	})
+
+	It("should shrink once the fill has stayed low, but not below min_partitions", func() {
+		syncs(6, 95, 1000)
+		Expect(queue.Parts.PartitionCount()).To(Equal(3))
+		syncs(3, 5, 0)
+		Expect(queue.Parts.PartitionCount()).To(Equal(2))
+		syncs(9, 5, 0)
+		Expect(queue.Parts.PartitionCount()).To(Equal(1))
+	})
+
+	It("should wait out the cooldown before scaling again", func() {
+		cfg.Core.AutoscaleCooldown = 10 * 60 * 1000
+		syncs(3, 95, 1000)
+		Expect(queue.Parts.PartitionCount()).To(Equal(2))
+		syncs(6, 95, 1000)
+		Expect(queue.Parts.PartitionCount()).To(Equal(2))
+		syncs(4, 95, 1000)
+		Expect(queue.Parts.PartitionCount()).To(Equal(3))
+	})
+
+	It("should leave the partitions alone unless enabled", func() {
+		cfg.Core.Autoscale = false
+		syncs(6, 95, 1000)
+		Expect(queue.Parts.PartitionCount()).To(Equal(1))
+	})
+})
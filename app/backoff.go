@@ -0,0 +1,54 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// BackoffMinDelay is the delay GetBackoff suggests after the first receive in a row to come up empty
+const BackoffMinDelay = ReceivePollInterval
+
+// BackoffMaxDelay is the longest delay GetBackoff suggests, however long the queue has been empty
+const BackoffMaxDelay = 5 * time.Second
+
+// backoff counts the receives in a row which came up empty, for suggesting when to poll next
+type backoff struct {
+	empty int
+	sync.Mutex
+}
+
+// next returns how long to wait before polling again, after a receive of batchsize got received messages
+func (b *backoff) next(batchsize int64, received int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	if received > 0 {
+		b.empty = 0
+		if batchsize <= 0 || int64(received) >= batchsize {
+			return 0
+		}
+		return time.Duration(float64(BackoffMinDelay) * (1 - float64(received)/float64(batchsize)))
+	}
+	b.empty++
+	delay := BackoffMinDelay
+	for i := 1; i < b.empty && delay < BackoffMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > BackoffMaxDelay {
+		delay = BackoffMaxDelay
+	}
+	return delay
+}
+
+// GetBackoff gets messages as Get does, along with how long to wait before polling again
+func (queue *Queue) GetBackoff(cfg *Config, list *memberlist.Memberlist, batchsize int64) ([]Message, time.Duration, error) {
+	return queue.getBackoff(func() ([]Message, error) {
+		return queue.Get(cfg, list, batchsize)
+	}, batchsize)
+}
+
+func (queue *Queue) getBackoff(fetch func() ([]Message, error), batchsize int64) ([]Message, time.Duration, error) {
+	messages, err := fetch()
+	return messages, queue.backoff.next(batchsize, len(messages)), err
+}
@@ -0,0 +1,63 @@
+package app_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GetBackoff", func() {
+
+	var queue *app.Queue
+	messages := []app.Message{{ID: "1", Body: []byte("one")}, {ID: "2", Body: []byte("two")}}
+
+	fetch := func(received []app.Message, err error) func() ([]app.Message, error) {
+		return func() ([]app.Message, error) {
+			return received, err
+		}
+	}
+
+	BeforeEach(func() {
+		queue = &app.Queue{Name: "backoff"}
+	})
+
+	It("should suggest polling again right away after a full batch, and sooner the fuller it was", func() {
+		received, delay, err := queue.GetBackoffWith(fetch(messages, nil), 2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(messages))
+		Expect(delay).To(BeZero())
+
+		_, partial, _ := queue.GetBackoffWith(fetch(messages, nil), 4)
+		_, sparse, _ := queue.GetBackoffWith(fetch(messages[:1], nil), 4)
+		Expect(partial).To(BeNumerically(">", 0))
+		Expect(partial).To(BeNumerically("<", sparse))
+		Expect(sparse).To(BeNumerically("<", app.BackoffMinDelay))
+	})
+
+	It("should grow the delay after each empty get in a row, and reset it once messages arrive", func() {
+		delays := []time.Duration{}
+		for i := 0; i < 10; i++ {
+			_, delay, _ := queue.GetBackoffWith(fetch([]app.Message{}, nil), 10)
+			delays = append(delays, delay)
+		}
+		Expect(delays[0]).To(Equal(app.BackoffMinDelay))
+		Expect(delays[1]).To(Equal(2 * app.BackoffMinDelay))
+		Expect(delays[2]).To(Equal(4 * app.BackoffMinDelay))
+		Expect(delays[9]).To(Equal(app.BackoffMaxDelay))
+
+		_, delay, _ := queue.GetBackoffWith(fetch(messages, nil), 2)
+		Expect(delay).To(BeZero())
+		_, delay, _ = queue.GetBackoffWith(fetch([]app.Message{}, nil), 10)
+		Expect(delay).To(Equal(app.BackoffMinDelay))
+	})
+
+	It("should back off from a failed get, and return its error", func() {
+		queue.GetBackoffWith(fetch([]app.Message{}, nil), 10)
+		_, delay, err := queue.GetBackoffWith(fetch(nil, errors.New(app.NoPartitions)), 10)
+		Expect(err).To(MatchError(app.NoPartitions))
+		Expect(delay).To(Equal(2 * app.BackoffMinDelay))
+	})
+})
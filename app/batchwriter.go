@@ -0,0 +1,144 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/stats"
+)
+
+// ErrBatchWriterClosed represents the condition that occurs if a closed BatchWriter is written to
+var ErrBatchWriterClosed = errors.New("The batch writer is closed")
+
+// BatchWriter buffers the messages written to it, putting them onto the queue in batches
+type BatchWriter struct {
+	put      func(messages []string) ([]string, error)
+	maxBatch int
+	maxWait  time.Duration
+	pending  []string
+	timer    *time.Timer
+	// batch counts the batches flushed, so a timer which fires as its batch is flushed leaves the
+	// next one alone
+	batch  int
+	closed bool
+	// onClose is called once the writer is closed
+	onClose func()
+	sync.Mutex
+}
+
+// NewBatchWriter returns a BatchWriter putting onto the queue in batches of up to maxBatch
+func (queue *Queue) NewBatchWriter(cfg *Config, maxBatch int, maxWait time.Duration) (*BatchWriter, error) {
+	return queue.newBatchWriter(func(messages []string) ([]string, error) {
+		return queue.BatchPut(cfg, messages)
+	}, maxBatch, maxWait)
+}
+
+func (queue *Queue) newBatchWriter(put func(messages []string) ([]string, error), maxBatch int, maxWait time.Duration) (*BatchWriter, error) {
+	if maxBatch <= 0 {
+		return nil, ErrInvalidBatchSize
+	}
+	w := &BatchWriter{put: put, maxBatch: maxBatch, maxWait: maxWait, pending: make([]string, 0, maxBatch)}
+	queue.writers.Lock()
+	defer queue.writers.Unlock()
+	if queue.writers.open == nil {
+		queue.writers.open = make(map[*BatchWriter]struct{})
+	}
+	queue.writers.open[w] = struct{}{}
+	w.onClose = func() {
+		queue.writers.Lock()
+		defer queue.writers.Unlock()
+		delete(queue.writers.open, w)
+	}
+	return w, nil
+}
+
+// openWriters returns the queue's BatchWriters which aren't closed yet
+func (queue *Queue) openWriters() []*BatchWriter {
+	queue.writers.Lock()
+	defer queue.writers.Unlock()
+	writers := make([]*BatchWriter, 0, len(queue.writers.open))
+	for w := range queue.writers.open {
+		writers = append(writers, w)
+	}
+	return writers
+}
+
+// Write buffers the message, flushing the batch once it is full
+func (w *BatchWriter) Write(message string) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return ErrBatchWriterClosed
+	}
+	w.pending = append(w.pending, message)
+	if len(w.pending) >= w.maxBatch {
+		return w.flush()
+	}
+	if len(w.pending) == 1 && w.maxWait > 0 {
+		batch := w.batch
+		w.timer = time.AfterFunc(w.maxWait, func() {
+			w.flushBatch(batch)
+		})
+	}
+	return nil
+}
+
+// Flush puts whatever is buffered onto the queue straight away
+func (w *BatchWriter) Flush() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.flush()
+}
+
+// Close flushes whatever is buffered, after which nothing more can be written
+func (w *BatchWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.onClose != nil {
+		w.onClose()
+	}
+	return w.flush()
+}
+
+// flushBatch flushes the buffer once maxWait has passed, unless the batch was flushed already
+func (w *BatchWriter) flushBatch(batch int) {
+	w.Lock()
+	defer w.Unlock()
+	if batch != w.batch {
+		return
+	}
+	if err := w.flush(); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (w *BatchWriter) flush() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.pending) == 0 {
+		return nil
+	}
+	messages := w.pending
+	w.pending = make([]string, 0, w.maxBatch)
+	w.batch++
+	_, err := w.put(messages)
+	return err
+}
+
+// Flush puts whatever the queue's BatchWriters buffered, and flushes the stats client
+func (queue *Queue) Flush(cfg *Config) error {
+	var errs stats.Errors
+	for _, w := range queue.openWriters() {
+		errs.Add(w.Flush())
+	}
+	errs.Add(stats.Flush(queue.statsClient(cfg)))
+	return errs.Err()
+}
@@ -0,0 +1,104 @@
+package app_test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("BatchWriter", func() {
+
+	var (
+		batches [][]string
+		lock    sync.Mutex
+		queue   *app.Queue
+	)
+
+	put := func(messages []string) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		batches = append(batches, messages)
+		return make([]string, len(messages)), nil
+	}
+	flushed := func() [][]string {
+		lock.Lock()
+		defer lock.Unlock()
+		return batches
+	}
+
+	BeforeEach(func() {
+		batches = nil
+		queue = &app.Queue{Name: "batched"}
+	})
+
+	It("should flush once the batch is full", func() {
+		writer, err := queue.NewBatchWriterWith(put, 2, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Write("one")).To(Succeed())
+		Expect(flushed()).To(BeEmpty())
+		Expect(writer.Write("two")).To(Succeed())
+		Expect(writer.Write("three")).To(Succeed())
+		Expect(flushed()).To(Equal([][]string{{"one", "two"}}))
+	})
+
+	It("should flush a partial batch once the wait is up", func() {
+		writer, _ := queue.NewBatchWriterWith(put, 10, 20*time.Millisecond)
+		Expect(writer.Write("one")).To(Succeed())
+		Expect(writer.Write("two")).To(Succeed())
+		Eventually(flushed).Should(Equal([][]string{{"one", "two"}}))
+		// The next batch waits its own window
+		Expect(writer.Write("three")).To(Succeed())
+		Expect(flushed()).To(HaveLen(1))
+		Eventually(flushed).Should(Equal([][]string{{"one", "two"}, {"three"}}))
+	})
+
+	It("should flush what's left on Close, and refuse writes after", func() {
+		writer, _ := queue.NewBatchWriterWith(put, 10, time.Hour)
+		Expect(writer.Write("one")).To(Succeed())
+		Expect(writer.Close()).To(Succeed())
+		Expect(flushed()).To(Equal([][]string{{"one"}}))
+		Expect(writer.Write("two")).To(Equal(app.ErrBatchWriterClosed))
+		Expect(writer.Close()).To(Succeed())
+		Expect(flushed()).To(HaveLen(1))
+	})
+
+	It("should hand back the error of a failed flush", func() {
+		writer, _ := queue.NewBatchWriterWith(func(messages []string) ([]string, error) {
+			return nil, app.ErrQueueDisabled
+		}, 1, 0)
+		Expect(writer.Write("one")).To(Equal(app.ErrQueueDisabled))
+	})
+
+	It("should reject an empty batch size", func() {
+		_, err := queue.NewBatchWriterWith(put, 0, time.Second)
+		Expect(err).To(Equal(app.ErrInvalidBatchSize))
+	})
+
+	Context("Queue.Flush", func() {
+		It("should put what open writers buffered, and flush the stats client", func() {
+			client := &flushingClient{MemoryClient: stats.NewMemoryClient()}
+			flushCfg := &app.Config{Stats: app.Stats{Client: client}}
+			sent := queue.Name + "." + app.QueueSentStatsSuffix
+			// Count what was stored, as BatchPut does
+			counted := func(messages []string) ([]string, error) {
+				client.Incr(sent, int64(len(messages)))
+				return put(messages)
+			}
+			writer, _ := queue.NewBatchWriterWith(counted, 10, time.Hour)
+			closed, _ := queue.NewBatchWriterWith(counted, 10, time.Hour)
+			Expect(writer.Write("one")).To(Succeed())
+			Expect(writer.Write("two")).To(Succeed())
+			Expect(closed.Close()).To(Succeed())
+			Expect(client.Counter(sent)).To(BeZero())
+
+			Expect(queue.Flush(flushCfg)).To(Succeed())
+			Expect(flushed()).To(Equal([][]string{{"one", "two"}}))
+			Expect(client.Counter(sent)).To(Equal(int64(2)))
+			Expect(client.flushes).To(Equal(1))
+		})
+	})
+})
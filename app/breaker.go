@@ -0,0 +1,175 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/tpjg/goriakpbc"
+)
+
+// BreakerClosed means calls are flowing to Riak normally
+const BreakerClosed = "closed"
+
+// BreakerOpen means Riak failed repeatedly, and calls fail fast until the backoff passes
+const BreakerOpen = "open"
+
+// BreakerHalfOpen means the backoff passed, and calls are probing to see if Riak recovered
+const BreakerHalfOpen = "half-open"
+
+// DefaultBreakerThreshold is the number of consecutive failures which opens the breaker
+const DefaultBreakerThreshold = 5
+
+// DefaultBreakerBackoff is how long the breaker stays open after first tripping
+const DefaultBreakerBackoff = time.Second
+
+// DefaultBreakerMaxBackoff is the longest the breaker will stay open, no matter how often it trips
+const DefaultBreakerMaxBackoff = 30 * time.Second
+
+// ErrBreakerOpen represents the condition that occurs if calls to Riak are failed fast by the breaker
+var ErrBreakerOpen = errors.New("Riak is unavailable, backing off")
+
+// ErrRiakUnavailable represents the condition that occurs if a call to Riak failed
+var ErrRiakUnavailable = errors.New("Riak is unavailable")
+
+// IsRiakUnavailable returns true if err means Riak couldn't be reached
+func IsRiakUnavailable(err error) bool {
+	return err == ErrRiakUnavailable || err == ErrBreakerOpen
+}
+
+// Breaker is a circuit breaker around the Riak connection pool
+type Breaker struct {
+	threshold   int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	state       string
+	failures    int
+	trips       uint
+	openedAt    time.Time
+	sync.Mutex
+}
+
+// BreakerStatus is a point in time view of a Breaker
+type BreakerStatus struct {
+	State    string        `json:"state"`
+	Failures int           `json:"failures"`
+	Backoff  time.Duration `json:"backoff"`
+}
+
+// NewBreaker returns a closed Breaker. Non-positive values fall back to the defaults
+func NewBreaker(threshold int, baseBackoff time.Duration, maxBackoff time.Duration) *Breaker {
+	if threshold <= 0 {
+		threshold = DefaultBreakerThreshold
+	}
+	if baseBackoff <= 0 {
+		baseBackoff = DefaultBreakerBackoff
+	}
+	if maxBackoff < baseBackoff {
+		maxBackoff = DefaultBreakerMaxBackoff
+		if maxBackoff < baseBackoff {
+			maxBackoff = baseBackoff
+		}
+	}
+	return &Breaker{
+		threshold:   threshold,
+		baseBackoff: baseBackoff,
+		maxBackoff:  maxBackoff,
+		state:       BreakerClosed,
+	}
+}
+
+// Allow returns ErrBreakerOpen if calls should fail fast, or nil if they may go through
+func (b *Breaker) Allow() error {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == BreakerOpen {
+		if time.Since(b.openedAt) < b.backoff() {
+			return ErrBreakerOpen
+		}
+		b.state = BreakerHalfOpen
+	}
+	return nil
+}
+
+// Record tracks the result of a call that Allow let through
+func (b *Breaker) Record(err error) {
+	b.Lock()
+	defer b.Unlock()
+	if err == nil {
+		if b.state != BreakerClosed {
+			logrus.Info("Riak recovered, closing the circuit breaker")
+		}
+		b.state = BreakerClosed
+		b.failures = 0
+		b.trips = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		if b.state != BreakerOpen {
+			b.trips++
+		}
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+		logrus.Warnf("Riak failed %d times in a row, backing off for %s", b.failures, b.backoff())
+	}
+}
+
+// Status returns the current state of the breaker
+func (b *Breaker) Status() BreakerStatus {
+	b.Lock()
+	defer b.Unlock()
+	status := BreakerStatus{State: b.state, Failures: b.failures}
+	if b.state != BreakerClosed {
+		status.Backoff = b.backoff()
+	}
+	return status
+}
+
+func (b *Breaker) backoff() time.Duration {
+	if b.trips == 0 {
+		return 0
+	}
+	backoff := b.baseBackoff
+	for i := uint(1); i < b.trips && backoff < b.maxBackoff; i++ {
+		backoff = backoff * 2
+	}
+	if backoff > b.maxBackoff {
+		backoff = b.maxBackoff
+	}
+	return backoff
+}
+
+// RiakBucket returns the given bucket through the breaker, along with the func releasing its connection
+func (cfg *Config) RiakBucket(bucketType string, name string) (*riak.Bucket, func(), error) {
+	client, release, err := cfg.RiakConnection()
+	if err != nil {
+		return nil, release, err
+	}
+	bucket, err := cfg.riakBucketOn(client, bucketType, name)
+	if err != nil {
+		release()
+		return nil, func() {}, err
+	}
+	return bucket, release, nil
+}
+
+// riakBucketOn is RiakBucket, for callers already holding a connection from RiakConnection
+func (cfg *Config) riakBucketOn(client *riak.Client, bucketType string, name string) (*riak.Bucket, error) {
+	// Configs built by hand, rather than through GetCoreConfig, won't have a breaker
+	if cfg.RiakBreaker != nil {
+		if err := cfg.RiakBreaker.Allow(); err != nil {
+			return nil, err
+		}
+	}
+	bucket, err := client.NewBucketType(bucketType, name)
+	if cfg.RiakBreaker != nil {
+		cfg.RiakBreaker.Record(err)
+	}
+	if err != nil {
+		logrus.Error(err)
+		return nil, ErrRiakUnavailable
+	}
+	return bucket, nil
+}
@@ -0,0 +1,73 @@
+package app_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Breaker", func() {
+
+	var (
+		breaker   *app.Breaker
+		riakError = errors.New("dial tcp 127.0.0.1:8087: connection refused")
+	)
+
+	BeforeEach(func() {
+		breaker = app.NewBreaker(3, 20*time.Millisecond, 40*time.Millisecond)
+	})
+
+	It("should stay closed below the threshold", func() {
+		breaker.Record(riakError)
+		breaker.Record(riakError)
+		Expect(breaker.Allow()).To(Succeed())
+		Expect(breaker.Status().State).To(Equal(app.BreakerClosed))
+	})
+
+	It("should open once the cluster is down, and recover once it is back", func() {
+		for i := 0; i < 3; i++ {
+			breaker.Record(riakError)
+		}
+		Expect(breaker.Status().State).To(Equal(app.BreakerOpen))
+		Expect(breaker.Allow()).To(Equal(app.ErrBreakerOpen))
+
+		// After the backoff, a probe is let through
+		Eventually(breaker.Allow, 100*time.Millisecond, 5*time.Millisecond).Should(Succeed())
+		Expect(breaker.Status().State).To(Equal(app.BreakerHalfOpen))
+
+		breaker.Record(nil)
+		Expect(breaker.Status().State).To(Equal(app.BreakerClosed))
+		Expect(breaker.Status().Failures).To(Equal(0))
+	})
+
+	It("should leave messages out of a receive rather than fail while open", func() {
+		for i := 0; i < 3; i++ {
+			breaker.Record(riakError)
+		}
+		openCfg := &app.Config{Stats: app.Stats{Client: stats.NewMemoryClient()}, RiakBreaker: breaker}
+		queue := &app.Queue{Name: testQueueName}
+		Expect(queue.RetrieveMessages([]string{"1", "2"}, openCfg)).To(BeEmpty())
+		Expect((&app.Queues{}).Exists(openCfg, testQueueName)).To(BeFalse())
+	})
+
+	It("should back off longer each time a probe fails", func() {
+		for i := 0; i < 3; i++ {
+			breaker.Record(riakError)
+		}
+		Expect(breaker.Status().Backoff).To(Equal(20 * time.Millisecond))
+
+		Eventually(breaker.Allow, 100*time.Millisecond, 5*time.Millisecond).Should(Succeed())
+		breaker.Record(riakError)
+		Expect(breaker.Status().State).To(Equal(app.BreakerOpen))
+		Expect(breaker.Status().Backoff).To(Equal(40 * time.Millisecond))
+
+		// Capped at the max backoff
+		Eventually(breaker.Allow, 100*time.Millisecond, 5*time.Millisecond).Should(Succeed())
+		breaker.Record(riakError)
+		Expect(breaker.Status().Backoff).To(Equal(40 * time.Millisecond))
+	})
+})
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"github.com/Sirupsen/logrus"
+)
+
+// bucketProps is the part of a Riak bucket holding the properties dynamiq relies on
+type bucketProps interface {
+	AllowMult() bool
+	SetAllowMult(allowMult bool) error
+	NVal() uint32
+	SetNVal(nval uint32) error
+}
+
+// applyBucketProps sets the properties a queue's messages bucket needs
+func applyBucketProps(core Core, bucket bucketProps) error {
+	if !bucket.AllowMult() {
+		if err := bucket.SetAllowMult(true); err != nil {
+			return err
+		}
+	}
+	if core.RiakNVal > 0 && bucket.NVal() != uint32(core.RiakNVal) {
+		return bucket.SetNVal(uint32(core.RiakNVal))
+	}
+	return nil
+}
+
+// checkBucketProps warns about each property of the queue's messages bucket applyBucketProps would change
+func checkBucketProps(core Core, queueName string, bucket bucketProps) bool {
+	ok := true
+	if !bucket.AllowMult() {
+		logrus.Warnf("The messages bucket of queue %s has allow_mult off, so conflicting writes aren't read repaired", queueName)
+		ok = false
+	}
+	if core.RiakNVal > 0 && bucket.NVal() != uint32(core.RiakNVal) {
+		logrus.Warnf("The messages bucket of queue %s has an n_val of %d, rather than riaknval %d", queueName, bucket.NVal(), core.RiakNVal)
+		ok = false
+	}
+	return ok
+}
+
+// prepareMessageBucket sets the properties of the named queue's messages bucket
+func (cfg *Config) prepareMessageBucket(queueName string) error {
+	bucket, release, err := cfg.RiakBucket("messages", queueName)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := applyBucketProps(cfg.Core, bucket); err != nil {
+		logrus.Error(err)
+		return ErrRiakUnavailable
+	}
+	return nil
+}
+
+// checkMessageBuckets warns about every known queue whose messages bucket is misconfigured
+func (cfg *Config) checkMessageBuckets() {
+	cfg.Queues.RLock()
+	names := make([]string, 0, len(cfg.Queues.QueueMap))
+	for name := range cfg.Queues.QueueMap {
+		names = append(names, name)
+	}
+	cfg.Queues.RUnlock()
+	for _, name := range names {
+		bucket, release, err := cfg.RiakBucket("messages", name)
+		if err != nil {
+			logrus.Errorf("Couldn't check the messages bucket of queue %s: %s", name, err)
+			continue
+		}
+		checkBucketProps(cfg.Core, name, bucket)
+		release()
+	}
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"bufio"
+	"io"
+)
+
+// DefaultBulkChunkSize is how many records PutBatchFromReader puts at a time, if bulkchunksize isn't set
+const DefaultBulkChunkSize = 100
+
+// bulkChunkSize returns how many records PutBatchFromReader puts at a time
+func (cfg *Config) bulkChunkSize() int {
+	if cfg.Core.BulkChunkSize > 0 {
+		return cfg.Core.BulkChunkSize
+	}
+	return DefaultBulkChunkSize
+}
+
+// PutBatchFromReader puts every delimiter separated record read from r onto the queue
+func (queue *Queue) PutBatchFromReader(cfg *Config, r io.Reader, delimiter byte) (int, error) {
+	return putBatchFromReader(r, delimiter, cfg.bulkChunkSize(), func(messages []string) ([]string, error) {
+		return queue.BatchPut(cfg, messages)
+	})
+}
+
+func putBatchFromReader(r io.Reader, delimiter byte, chunkSize int, put func(messages []string) ([]string, error)) (int, error) {
+	reader := bufio.NewReader(r)
+	chunk := make([]string, 0, chunkSize)
+	stored := 0
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		ids, err := put(chunk)
+		for _, id := range ids {
+			if id != "" {
+				stored++
+			}
+		}
+		chunk = chunk[:0]
+		return err
+	}
+	for {
+		record, readErr := reader.ReadBytes(delimiter)
+		if readErr != nil && readErr != io.EOF {
+			return stored, readErr
+		}
+		if len(record) > 0 && record[len(record)-1] == delimiter {
+			record = record[:len(record)-1]
+		}
+		if len(record) > 0 {
+			chunk = append(chunk, string(record))
+		}
+		if len(chunk) >= chunkSize || readErr == io.EOF {
+			if err := flush(); err != nil {
+				return stored, err
+			}
+		}
+		if readErr == io.EOF {
+			return stored, nil
+		}
+	}
+}
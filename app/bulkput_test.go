@@ -0,0 +1,60 @@
+package app_test
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PutBatchFromReader", func() {
+
+	var (
+		stored []string
+		chunks []int
+	)
+
+	put := func(messages []string) ([]string, error) {
+		chunks = append(chunks, len(messages))
+		ids := make([]string, len(messages))
+		for i, message := range messages {
+			stored = append(stored, message)
+			ids[i] = strconv.Itoa(len(stored))
+		}
+		return ids, nil
+	}
+
+	BeforeEach(func() {
+		stored = nil
+		chunks = nil
+	})
+
+	It("should put every record in chunks, skipping empty ones", func() {
+		records := strings.NewReader("one\ntwo\n\nthree\nfour\nfive\n")
+		count, err := app.PutBatchFromReaderWith(records, '\n', 2, put)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(5))
+		Expect(stored).To(Equal([]string{"one", "two", "three", "four", "five"}))
+		Expect(chunks).To(Equal([]int{2, 2, 1}))
+	})
+
+	It("should put a last record without a trailing delimiter", func() {
+		count, err := app.PutBatchFromReaderWith(strings.NewReader("a|b|c"), '|', 10, put)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(3))
+		Expect(stored).To(Equal([]string{"a", "b", "c"}))
+	})
+
+	It("should stop at a chunk which wasn't stored whole, counting what was", func() {
+		count, err := app.PutBatchFromReaderWith(strings.NewReader("one\ntwo\nthree\nfour\n"), '\n', 2, func(messages []string) ([]string, error) {
+			if messages[0] == "three" {
+				return []string{"3", ""}, app.ErrRiakUnavailable
+			}
+			return put(messages)
+		})
+		Expect(err).To(Equal(app.ErrRiakUnavailable))
+		Expect(count).To(Equal(3))
+	})
+})
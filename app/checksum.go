@@ -0,0 +1,73 @@
+package app
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	"github.com/tpjg/goriakpbc"
+)
+
+// ChecksumNone stores messages without a checksum
+const ChecksumNone = "none"
+
+// ChecksumCRC32 stores messages with the CRC-32 (IEEE) of their body
+const ChecksumCRC32 = "crc32"
+
+// ChecksumSHA256 stores messages with the SHA-256 of their body
+const ChecksumSHA256 = "sha256"
+
+// ChecksumMetaKey is the meta key holding the checksum of a stored message's body
+const ChecksumMetaKey = "checksum"
+
+// QueueChecksumMismatchStatsSuffix is the counter of messages received with a bad checksum
+const QueueChecksumMismatchStatsSuffix = "get.corrupt"
+
+// ErrInvalidChecksum represents the condition that occurs if a queue is configured with a body_checksum which isn't known
+var ErrInvalidChecksum = errors.New("body_checksum must be one of none | crc32 | sha256")
+
+// bodyChecksum returns the ChecksumMetaKey value of body under algorithm, or "" if algorithm is none
+func bodyChecksum(algorithm string, body []byte) (string, error) {
+	switch algorithm {
+	case "", ChecksumNone:
+		return "", nil
+	case ChecksumCRC32:
+		return fmt.Sprintf("%s:%08x", ChecksumCRC32, crc32.ChecksumIEEE(body)), nil
+	case ChecksumSHA256:
+		return fmt.Sprintf("%s:%x", ChecksumSHA256, sha256.Sum256(body)), nil
+	}
+	return "", ErrInvalidChecksum
+}
+
+// checksumMatches returns whether an opened message's body matches its checksum
+func checksumMatches(rObject riak.RObject) bool {
+	stored := rObject.Meta[ChecksumMetaKey]
+	if stored == "" {
+		return true
+	}
+	algorithm := strings.SplitN(stored, ":", 2)[0]
+	computed, err := bodyChecksum(algorithm, rObject.Data)
+	return err == nil && computed == stored
+}
+
+// checkBodies counts the opened messages whose body doesn't match their checksum
+func (queue *Queue) checkBodies(c stats.Client, rObjects []riak.RObject) int {
+	corrupt := 0
+	for _, rObject := range rObjects {
+		if !checksumMatches(rObject) {
+			logrus.Errorf("Message %s in queue %s doesn't match its %s", rObject.Key, queue.Name, rObject.Meta[ChecksumMetaKey])
+			corrupt++
+		}
+	}
+	if corrupt > 0 {
+		err := c.Incr(fmt.Sprintf("%s.%s", queue.Name, QueueChecksumMismatchStatsSuffix), int64(corrupt))
+		if err != nil {
+			logrus.Error(err)
+		}
+	}
+	return corrupt
+}
@@ -0,0 +1,149 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// JSONContentType is the content type of messages stored as JSON envelopes
+const JSONContentType = "application/vnd.dynamiq.envelope+json"
+
+// MsgpackContentType is the content type of messages stored as msgpack envelopes
+const MsgpackContentType = "application/vnd.dynamiq.envelope+msgpack"
+
+// Envelope is a message body, along with everything stored about it
+type Envelope struct {
+	Body        []byte            `json:"body"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Timestamp   time.Time         `json:"timestamp"`
+	ContentType string            `json:"content_type"`
+}
+
+// Codec represents the set of actions needed to store an Envelope as a single value
+type Codec interface {
+	Marshal(envelope Envelope) ([]byte, error)
+	Unmarshal(value []byte) (Envelope, error)
+	// ContentType is stored alongside the value, so it can be decoded with the right Codec
+	ContentType() string
+}
+
+// NewCodec returns the Codec with the given name, one of json or msgpack
+func NewCodec(name string) (Codec, error) {
+	switch name {
+	case "json":
+		return NewJSONCodec(), nil
+	case "msgpack":
+		return NewMsgpackCodec(), nil
+	}
+	return nil, fmt.Errorf("Unknown message codec %s", name)
+}
+
+// ForContentType returns the Codec which stores values of the given content type, if there is one
+func ForContentType(contentType string) (Codec, bool) {
+	switch contentType {
+	case JSONContentType:
+		return NewJSONCodec(), true
+	case MsgpackContentType:
+		return NewMsgpackCodec(), true
+	}
+	return nil, false
+}
+
+// JSONCodec stores Envelopes as JSON. Bodies are base64 encoded, so any bytes are safe
+
+// NewJSONCodec returns a new instance of a Codec using JSON
+func NewJSONCodec() JSONCodec {
+	return JSONCodec{}
+}
+
+// JSONCodec represents a Codec using JSON
+type JSONCodec struct {
+}
+
+// Marshal encodes an Envelope as JSON
+func (j JSONCodec) Marshal(envelope Envelope) ([]byte, error) {
+	return json.Marshal(envelope)
+}
+
+// Unmarshal decodes an Envelope from JSON
+func (j JSONCodec) Unmarshal(value []byte) (Envelope, error) {
+	var envelope Envelope
+	err := json.Unmarshal(value, &envelope)
+	return envelope, err
+}
+
+// ContentType returns JSONContentType
+func (j JSONCodec) ContentType() string {
+	return JSONContentType
+}
+
+// Msgpack Codec is more compact than JSON, and stores bodies as raw bytes
+
+// NewMsgpackCodec returns a new instance of a Codec using msgpack
+func NewMsgpackCodec() MsgpackCodec {
+	return MsgpackCodec{}
+}
+
+// MsgpackCodec represents a Codec using msgpack
+type MsgpackCodec struct {
+}
+
+// Marshal encodes an Envelope as a msgpack map
+func (m MsgpackCodec) Marshal(envelope Envelope) ([]byte, error) {
+	var w msgpackWriter
+	w.writeMapHeader(4)
+	w.writeString("body")
+	w.writeBinary(envelope.Body)
+	w.writeString("attributes")
+	w.writeMapHeader(len(envelope.Attributes))
+	for key, value := range envelope.Attributes {
+		w.writeString(key)
+		w.writeString(value)
+	}
+	w.writeString("timestamp")
+	w.writeInt(envelope.Timestamp.UnixNano())
+	w.writeString("content_type")
+	w.writeString(envelope.ContentType)
+	return w.bytes(), nil
+}
+
+// Unmarshal decodes an Envelope from a msgpack map, ignoring any keys it doesn't know
+func (m MsgpackCodec) Unmarshal(value []byte) (Envelope, error) {
+	var envelope Envelope
+	r := msgpackReader{data: value}
+	fields, err := r.readMapHeader()
+	if err != nil {
+		return envelope, err
+	}
+	for i := 0; i < fields; i++ {
+		var key string
+		key, err = r.readString()
+		if err != nil {
+			return envelope, err
+		}
+		switch key {
+		case "body":
+			envelope.Body, err = r.readBinary()
+		case "attributes":
+			envelope.Attributes, err = r.readStringMap()
+		case "timestamp":
+			var nanos int64
+			nanos, err = r.readInt()
+			envelope.Timestamp = time.Unix(0, nanos)
+		case "content_type":
+			envelope.ContentType, err = r.readString()
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return envelope, err
+		}
+	}
+	return envelope, nil
+}
+
+// ContentType returns MsgpackContentType
+func (m MsgpackCodec) ContentType() string {
+	return MsgpackContentType
+}
@@ -0,0 +1,66 @@
+package codec_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app/codec"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Codec", func() {
+
+	var envelope codec.Envelope
+
+	BeforeEach(func() {
+		envelope = codec.Envelope{
+			Body:        []byte(`{"event": "signup"}`),
+			Attributes:  map[string]string{"source": "web", "trace": strings.Repeat("t", 40)},
+			Timestamp:   time.Unix(0, 1444000000123456789),
+			ContentType: "application/json",
+		}
+	})
+
+	roundTrip := func(c codec.Codec) {
+		value, err := c.Marshal(envelope)
+		Expect(err).ToNot(HaveOccurred())
+		decoded, err := c.Unmarshal(value)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(decoded.Body).To(Equal(envelope.Body))
+		Expect(decoded.Attributes).To(Equal(envelope.Attributes))
+		Expect(decoded.Timestamp.Equal(envelope.Timestamp)).To(BeTrue())
+		Expect(decoded.ContentType).To(Equal(envelope.ContentType))
+	}
+
+	It("should round trip an envelope through JSON", func() {
+		roundTrip(codec.NewJSONCodec())
+	})
+
+	It("should round trip an envelope through msgpack", func() {
+		roundTrip(codec.NewMsgpackCodec())
+	})
+
+	It("should round trip large bodies through msgpack", func() {
+		envelope.Body = []byte(strings.Repeat("b", 70000))
+		roundTrip(codec.NewMsgpackCodec())
+	})
+
+	It("should reject truncated msgpack values", func() {
+		value, _ := codec.NewMsgpackCodec().Marshal(envelope)
+		_, err := codec.NewMsgpackCodec().Unmarshal(value[:len(value)-3])
+		Expect(err).To(Equal(codec.ErrTruncated))
+	})
+
+	It("should find each codec by the content type it stores", func() {
+		for _, name := range []string{"json", "msgpack"} {
+			c, err := codec.NewCodec(name)
+			Expect(err).ToNot(HaveOccurred())
+			found, ok := codec.ForContentType(c.ContentType())
+			Expect(ok).To(BeTrue())
+			Expect(found).To(Equal(c))
+		}
+		_, ok := codec.ForContentType("application/json")
+		Expect(ok).To(BeFalse())
+	})
+})
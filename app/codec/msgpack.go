@@ -0,0 +1,313 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrTruncated represents the condition that occurs if a msgpack value ends early
+var ErrTruncated = errors.New("msgpack value is truncated")
+
+// msgpackWriter encodes the subset of msgpack an Envelope needs: maps, strings, binary and ints
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (w *msgpackWriter) bytes() []byte {
+	return w.buf
+}
+
+func (w *msgpackWriter) writeMapHeader(size int) {
+	switch {
+	case size < 16:
+		w.buf = append(w.buf, 0x80|byte(size))
+	case size <= 0xffff:
+		w.buf = append(w.buf, 0xde)
+		w.buf = appendUint(w.buf, uint64(size), 2)
+	default:
+		w.buf = append(w.buf, 0xdf)
+		w.buf = appendUint(w.buf, uint64(size), 4)
+	}
+}
+
+func (w *msgpackWriter) writeString(value string) {
+	size := len(value)
+	switch {
+	case size < 32:
+		w.buf = append(w.buf, 0xa0|byte(size))
+	case size <= 0xff:
+		w.buf = append(w.buf, 0xd9, byte(size))
+	case size <= 0xffff:
+		w.buf = append(w.buf, 0xda)
+		w.buf = appendUint(w.buf, uint64(size), 2)
+	default:
+		w.buf = append(w.buf, 0xdb)
+		w.buf = appendUint(w.buf, uint64(size), 4)
+	}
+	w.buf = append(w.buf, value...)
+}
+
+func (w *msgpackWriter) writeBinary(value []byte) {
+	size := len(value)
+	switch {
+	case size <= 0xff:
+		w.buf = append(w.buf, 0xc4, byte(size))
+	case size <= 0xffff:
+		w.buf = append(w.buf, 0xc5)
+		w.buf = appendUint(w.buf, uint64(size), 2)
+	default:
+		w.buf = append(w.buf, 0xc6)
+		w.buf = appendUint(w.buf, uint64(size), 4)
+	}
+	w.buf = append(w.buf, value...)
+}
+
+func (w *msgpackWriter) writeInt(value int64) {
+	w.buf = append(w.buf, 0xd3)
+	w.buf = appendUint(w.buf, uint64(value), 8)
+}
+
+// appendUint appends the lowest width bytes of value, big endian
+func appendUint(buf []byte, value uint64, width int) []byte {
+	for shift := uint(width-1) * 8; ; shift -= 8 {
+		buf = append(buf, byte(value>>shift))
+		if shift == 0 {
+			return buf
+		}
+	}
+}
+
+// msgpackReader decodes the values msgpackWriter writes, and skips over the other basic types
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, ErrTruncated
+	}
+	value := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return value, nil
+}
+
+func (r *msgpackReader) readByte() (byte, error) {
+	value, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return value[0], nil
+}
+
+// readLength reads a big endian length of the given number of bytes
+func (r *msgpackReader) readLength(width int) (int, error) {
+	value, err := r.next(width)
+	if err != nil {
+		return 0, err
+	}
+	switch width {
+	case 1:
+		return int(value[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(value)), nil
+	}
+	return int(binary.BigEndian.Uint32(value)), nil
+}
+
+func (r *msgpackReader) readMapHeader() (int, error) {
+	prefix, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case prefix&0xf0 == 0x80:
+		return int(prefix & 0x0f), nil
+	case prefix == 0xde:
+		return r.readLength(2)
+	case prefix == 0xdf:
+		return r.readLength(4)
+	case prefix == 0xc0:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("msgpack: expected a map, got 0x%x", prefix)
+}
+
+func (r *msgpackReader) readString() (string, error) {
+	prefix, err := r.readByte()
+	if err != nil {
+		return "", err
+	}
+	size := 0
+	switch {
+	case prefix&0xe0 == 0xa0:
+		size = int(prefix & 0x1f)
+	case prefix == 0xd9:
+		size, err = r.readLength(1)
+	case prefix == 0xda:
+		size, err = r.readLength(2)
+	case prefix == 0xdb:
+		size, err = r.readLength(4)
+	case prefix == 0xc0:
+		return "", nil
+	default:
+		return "", fmt.Errorf("msgpack: expected a string, got 0x%x", prefix)
+	}
+	if err != nil {
+		return "", err
+	}
+	value, err := r.next(size)
+	return string(value), err
+}
+
+func (r *msgpackReader) readBinary() ([]byte, error) {
+	prefix, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	size := 0
+	switch prefix {
+	case 0xc4:
+		size, err = r.readLength(1)
+	case 0xc5:
+		size, err = r.readLength(2)
+	case 0xc6:
+		size, err = r.readLength(4)
+	case 0xc0:
+		return nil, nil
+	default:
+		// Other encoders may have written the body as a string instead
+		r.pos--
+		var value string
+		value, err = r.readString()
+		return []byte(value), err
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := r.next(size)
+	if err != nil {
+		return nil, err
+	}
+	// Copy, so the envelope doesn't hold on to the whole encoded value
+	return append([]byte(nil), value...), nil
+}
+
+func (r *msgpackReader) readInt() (int64, error) {
+	prefix, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case prefix <= 0x7f:
+		return int64(prefix), nil
+	case prefix >= 0xe0:
+		return int64(int8(prefix)), nil
+	}
+	widths := map[byte]int{0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, 0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8}
+	width, ok := widths[prefix]
+	if !ok {
+		return 0, fmt.Errorf("msgpack: expected an int, got 0x%x", prefix)
+	}
+	value, err := r.next(width)
+	if err != nil {
+		return 0, err
+	}
+	signed := prefix >= 0xd0
+	switch width {
+	case 1:
+		if signed {
+			return int64(int8(value[0])), nil
+		}
+		return int64(value[0]), nil
+	case 2:
+		if signed {
+			return int64(int16(binary.BigEndian.Uint16(value))), nil
+		}
+		return int64(binary.BigEndian.Uint16(value)), nil
+	case 4:
+		if signed {
+			return int64(int32(binary.BigEndian.Uint32(value))), nil
+		}
+		return int64(binary.BigEndian.Uint32(value)), nil
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
+
+func (r *msgpackReader) readStringMap() (map[string]string, error) {
+	size, err := r.readMapHeader()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, size)
+	for i := 0; i < size; i++ {
+		key, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		values[key], err = r.readString()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// skip steps over one value of any of the basic types, so unknown fields can be ignored
+func (r *msgpackReader) skip() error {
+	prefix, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	switch {
+	case prefix <= 0x7f, prefix >= 0xe0, prefix == 0xc0, prefix == 0xc2, prefix == 0xc3:
+		return nil
+	case prefix&0xe0 == 0xa0:
+		_, err = r.next(int(prefix & 0x1f))
+		return err
+	case prefix&0xf0 == 0x80, prefix == 0xde, prefix == 0xdf:
+		r.pos--
+		size, err := r.readMapHeader()
+		for i := 0; err == nil && i < size*2; i++ {
+			err = r.skip()
+		}
+		return err
+	case prefix&0xf0 == 0x90:
+		return r.skipItems(int(prefix & 0x0f))
+	case prefix == 0xdc, prefix == 0xdd:
+		width := 2
+		if prefix == 0xdd {
+			width = 4
+		}
+		size, err := r.readLength(width)
+		if err != nil {
+			return err
+		}
+		return r.skipItems(size)
+	}
+	fixed := map[byte]int{0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, 0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8, 0xca: 4, 0xcb: 8}
+	if width, ok := fixed[prefix]; ok {
+		_, err = r.next(width)
+		return err
+	}
+	sized := map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}
+	if width, ok := sized[prefix]; ok {
+		size, err := r.readLength(width)
+		if err != nil {
+			return err
+		}
+		_, err = r.next(size)
+		return err
+	}
+	return fmt.Errorf("msgpack: can't skip values of type 0x%x", prefix)
+}
+
+func (r *msgpackReader) skipItems(count int) error {
+	for i := 0; i < count; i++ {
+		if err := r.skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"compress/lzw"
 	"compress/zlib"
+	"fmt"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 )
@@ -15,6 +17,37 @@ type Compressor interface {
 	Decompress(value []byte) ([]byte, error)
 }
 
+var (
+	registry = map[string]func() Compressor{
+		"zlib": func() Compressor { return NewZlibCompressor() },
+		"lzw":  func() Compressor { return NewLZWCompressor(8) },
+		"zstd": func() Compressor {
+			// Without a dictionary there's nothing to look up, so this can't fail
+			c, _ := NewZstdCompressor(0)
+			return c
+		},
+	}
+	registryLock sync.RWMutex
+)
+
+// RegisterCompressor makes a Compressor available to queues under the given name
+func RegisterCompressor(name string, factory func() Compressor) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[name] = factory
+}
+
+// NewCompressor returns the Compressor registered under the given name
+func NewCompressor(name string) (Compressor, error) {
+	registryLock.RLock()
+	factory, ok := registry[name]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown compression algorithm %s", name)
+	}
+	return factory(), nil
+}
+
 // ZLib Compressor performs decently in terms of speed, but the real
 // gain is how well it compresses data
 
@@ -30,6 +63,15 @@ type ZlibCompressor struct {
 
 // Compress compresses a series of bytes, and returns the compressed data in bytes
 func (z ZlibCompressor) Compress(value []byte) ([]byte, error) {
+	if pooled() {
+		b := getBuffer()
+		defer putBuffer(b)
+		w := getZlibWriter(b)
+		_, err := w.Write(value)
+		w.Close()
+		zlibWriters.Put(w)
+		return copyBuffer(b), err
+	}
 	var b bytes.Buffer
 	w := zlib.NewWriter(&b)
 	_, err := w.Write(value)
@@ -40,6 +82,18 @@ func (z ZlibCompressor) Compress(value []byte) ([]byte, error) {
 // Decompress decompresses a series of bytes, and returns the compressed data in bytes
 func (z ZlibCompressor) Decompress(value []byte) ([]byte, error) {
 	b := bytes.NewReader(value)
+	if pooled() {
+		r, err := getZlibReader(b)
+		if err != nil {
+			logrus.Error("Error decompressing data: ", err)
+			return make([]byte, 0), err
+		}
+		buf := getBuffer()
+		defer putBuffer(buf)
+		buf.ReadFrom(r)
+		putZlibReader(r)
+		return copyBuffer(buf), nil
+	}
 
 	r, err := zlib.NewReader(b)
 	if err != nil {
@@ -70,6 +124,15 @@ func NewLZWCompressor(width int) LZWCompressor {
 
 // Compress compresses a series of bytes, and returns the compressed data in bytes
 func (l LZWCompressor) Compress(value []byte) ([]byte, error) {
+	if pooled() {
+		b := getBuffer()
+		defer putBuffer(b)
+		w := getLZWWriter(b, l.litWidth)
+		_, _ = w.Write(value)
+		w.Close()
+		lzwWriters.Put(w)
+		return copyBuffer(b), nil
+	}
 	var b bytes.Buffer
 	w := lzw.NewWriter(&b, lzw.LSB, l.litWidth)
 	_, _ = w.Write(value)
@@ -80,6 +143,15 @@ func (l LZWCompressor) Compress(value []byte) ([]byte, error) {
 // Decompress decompresses a series of bytes, and returns the compressed data in bytes
 func (l LZWCompressor) Decompress(value []byte) ([]byte, error) {
 	b := bytes.NewReader(value)
+	if pooled() {
+		r := getLZWReader(b, l.litWidth)
+		buf := getBuffer()
+		defer putBuffer(buf)
+		buf.ReadFrom(r)
+		r.Close()
+		lzwReaders.Put(r)
+		return copyBuffer(buf), nil
+	}
 	r := lzw.NewReader(b, lzw.LSB, l.litWidth)
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(r)
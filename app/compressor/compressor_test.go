@@ -0,0 +1,91 @@
+package compressor_test
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/Tapjoy/dynamiq/app/compressor"
+)
+
+var message = bytes.Repeat([]byte(`{"user_id":12345,"event":"purchase","amount":"9.99"}`), 20)
+
+func compressors() map[string]compressor.Compressor {
+	return map[string]compressor.Compressor{
+		"zlib": compressor.NewZlibCompressor(),
+		"lzw":  compressor.NewLZWCompressor(8),
+	}
+}
+
+func TestPooledRoundTrip(t *testing.T) {
+	compressor.SetPooling(true)
+	defer compressor.SetPooling(false)
+	for name, c := range compressors() {
+		var wg sync.WaitGroup
+		errs := make(chan error, 16)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				value := append([]byte(fmt.Sprintf("%d:", i)), message...)
+				for j := 0; j < 50; j++ {
+					compressed, err := c.Compress(value)
+					if err != nil {
+						errs <- err
+						return
+					}
+					decompressed, err := c.Decompress(compressed)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if !bytes.Equal(decompressed, value) {
+						errs <- fmt.Errorf("%s got back %q", name, decompressed)
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPooledResultsAreOwned(t *testing.T) {
+	compressor.SetPooling(true)
+	defer compressor.SetPooling(false)
+	for name, c := range compressors() {
+		first, _ := c.Compress([]byte("first"))
+		c.Compress([]byte("second, which is longer"))
+		decompressed, err := c.Decompress(first)
+		if err != nil || string(decompressed) != "first" {
+			t.Errorf("%s got back %q, %v", name, decompressed, err)
+		}
+	}
+}
+
+func benchmarkRoundTrip(b *testing.B, c compressor.Compressor, pooling bool) {
+	compressor.SetPooling(pooling)
+	defer compressor.SetPooling(false)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			compressed, _ := c.Compress(message)
+			c.Decompress(compressed)
+		}
+	})
+}
+
+func BenchmarkZlib(b *testing.B) {
+	b.Run("unpooled", func(b *testing.B) { benchmarkRoundTrip(b, compressor.NewZlibCompressor(), false) })
+	b.Run("pooled", func(b *testing.B) { benchmarkRoundTrip(b, compressor.NewZlibCompressor(), true) })
+}
+
+func BenchmarkLZW(b *testing.B) {
+	b.Run("unpooled", func(b *testing.B) { benchmarkRoundTrip(b, compressor.NewLZWCompressor(8), false) })
+	b.Run("pooled", func(b *testing.B) { benchmarkRoundTrip(b, compressor.NewLZWCompressor(8), true) })
+}
@@ -0,0 +1,96 @@
+package compressor
+
+import (
+	"bytes"
+	"compress/lzw"
+	"compress/zlib"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPooledBuffer is the largest buffer handed back to the pool
+const maxPooledBuffer = 1 << 20
+
+var (
+	// pooling is 1 while the zlib and lzw compressors reuse their buffers, readers and writers
+	pooling int32
+	buffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	// zlibWriters, zlibReaders, lzwWriters and lzwReaders are reset onto each value in turn. zlib
+	// writers are by far the costliest, each setting up its own deflate state
+	zlibWriters sync.Pool
+	zlibReaders sync.Pool
+	lzwWriters  sync.Pool
+	lzwReaders  sync.Pool
+)
+
+// SetPooling turns reusing buffers, readers and writers between calls on or off
+func SetPooling(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&pooling, value)
+}
+
+// pooled returns whether compressors reuse their buffers, readers and writers
+func pooled() bool {
+	return atomic.LoadInt32(&pooling) == 1
+}
+
+func getBuffer() *bytes.Buffer {
+	b := buffers.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() <= maxPooledBuffer {
+		buffers.Put(b)
+	}
+}
+
+// copyBuffer returns a copy of what's in the buffer, so it can go back to the pool
+func copyBuffer(b *bytes.Buffer) []byte {
+	return append(make([]byte, 0, b.Len()), b.Bytes()...)
+}
+
+func getZlibWriter(dst io.Writer) *zlib.Writer {
+	if w, ok := zlibWriters.Get().(*zlib.Writer); ok {
+		w.Reset(dst)
+		return w
+	}
+	return zlib.NewWriter(dst)
+}
+
+// getZlibReader returns a reader of src, to be handed back with putZlibReader
+func getZlibReader(src io.Reader) (io.ReadCloser, error) {
+	if r, ok := zlibReaders.Get().(io.ReadCloser); ok {
+		if err := r.(zlib.Resetter).Reset(src, nil); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	return zlib.NewReader(src)
+}
+
+func putZlibReader(r io.ReadCloser) {
+	r.Close()
+	zlibReaders.Put(r)
+}
+
+func getLZWWriter(dst io.Writer, litWidth int) *lzw.Writer {
+	if w, ok := lzwWriters.Get().(*lzw.Writer); ok {
+		w.Reset(dst, lzw.LSB, litWidth)
+		return w
+	}
+	return lzw.NewWriter(dst, lzw.LSB, litWidth).(*lzw.Writer)
+}
+
+func getLZWReader(src io.Reader, litWidth int) *lzw.Reader {
+	if r, ok := lzwReaders.Get().(*lzw.Reader); ok {
+		r.Reset(src, lzw.LSB, litWidth)
+		return r
+	}
+	return lzw.NewReader(src, lzw.LSB, litWidth).(*lzw.Reader)
+}
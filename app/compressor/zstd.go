@@ -0,0 +1,133 @@
+package compressor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrNoDictionaryID represents the condition that occurs if a zstd dictionary has an ID of 0
+var ErrNoDictionaryID = errors.New("zstd dictionaries need an ID other than 0")
+
+var (
+	// zstdDictionaries holds every registered dictionary by its ID
+	zstdDictionaries = map[uint32][]byte{}
+	// zstdDictionaryPaths holds the ID of each dictionary loaded by LoadZstdDictionary, by its path
+	zstdDictionaryPaths = map[string]uint32{}
+	// zstdEncoders holds an encoder for each dictionary, and one under 0 for none. Encoders and
+	// decoders are costly to set up, and are safe to share
+	zstdEncoders = map[uint32]*zstd.Encoder{}
+	// zstdDecoder knows of every registered dictionary, set up again once another is registered
+	zstdDecoder *zstd.Decoder
+	zstdLock    sync.Mutex
+)
+
+// RegisterZstdDictionary makes a trained zstd dictionary available to NewZstdCompressor, and returns its ID
+func RegisterZstdDictionary(dict []byte) (uint32, error) {
+	info, err := zstd.InspectDictionary(dict)
+	if err != nil {
+		return 0, err
+	}
+	id := info.ID()
+	if id == 0 {
+		return 0, ErrNoDictionaryID
+	}
+	zstdLock.Lock()
+	defer zstdLock.Unlock()
+	zstdDictionaries[id] = dict
+	delete(zstdEncoders, id)
+	zstdDecoder = nil
+	return id, nil
+}
+
+// LoadZstdDictionary registers the zstd dictionary in the file at path, returning its ID
+func LoadZstdDictionary(path string) (uint32, error) {
+	zstdLock.Lock()
+	id, ok := zstdDictionaryPaths[path]
+	zstdLock.Unlock()
+	if ok {
+		return id, nil
+	}
+	dict, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	id, err = RegisterZstdDictionary(dict)
+	if err != nil {
+		return 0, fmt.Errorf("%s isn't a zstd dictionary: %s", path, err)
+	}
+	zstdLock.Lock()
+	zstdDictionaryPaths[path] = id
+	zstdLock.Unlock()
+	return id, nil
+}
+
+// ZstdCompressor represents a Compressor using zstd, with a dictionary if it has one
+type ZstdCompressor struct {
+	encoder *zstd.Encoder
+	dictID  uint32
+}
+
+// NewZstdCompressor returns a compressor using zstd, with the dictionary registered under dictID
+func NewZstdCompressor(dictID uint32) (ZstdCompressor, error) {
+	zstdLock.Lock()
+	defer zstdLock.Unlock()
+	if encoder, ok := zstdEncoders[dictID]; ok {
+		return ZstdCompressor{encoder: encoder, dictID: dictID}, nil
+	}
+	var options []zstd.EOption
+	if dictID != 0 {
+		dict, ok := zstdDictionaries[dictID]
+		if !ok {
+			return ZstdCompressor{}, fmt.Errorf("No zstd dictionary is registered with ID %d", dictID)
+		}
+		options = append(options, zstd.WithEncoderDict(dict))
+	}
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		return ZstdCompressor{}, err
+	}
+	zstdEncoders[dictID] = encoder
+	return ZstdCompressor{encoder: encoder, dictID: dictID}, nil
+}
+
+// DictionaryID returns the ID of the dictionary the compressor compresses with, or 0 for none
+func (z ZstdCompressor) DictionaryID() uint32 {
+	return z.dictID
+}
+
+// Compress compresses a series of bytes, and returns the compressed data in bytes
+func (z ZstdCompressor) Compress(value []byte) ([]byte, error) {
+	return z.encoder.EncodeAll(value, nil), nil
+}
+
+// Decompress decompresses a series of bytes, and returns the compressed data in bytes
+func (z ZstdCompressor) Decompress(value []byte) ([]byte, error) {
+	decoder, err := getZstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+	return decoder.DecodeAll(value, nil)
+}
+
+// getZstdDecoder returns a decoder knowing of every registered dictionary
+func getZstdDecoder() (*zstd.Decoder, error) {
+	zstdLock.Lock()
+	defer zstdLock.Unlock()
+	if zstdDecoder != nil {
+		return zstdDecoder, nil
+	}
+	dicts := make([][]byte, 0, len(zstdDictionaries))
+	for _, dict := range zstdDictionaries {
+		dicts = append(dicts, dict)
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dicts...))
+	if err != nil {
+		return nil, err
+	}
+	zstdDecoder = decoder
+	return decoder, nil
+}
@@ -1,32 +1,51 @@
 package app
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"code.google.com/p/gcfg"
 	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/codec"
 	"github.com/Tapjoy/dynamiq/app/compressor"
 	"github.com/Tapjoy/dynamiq/app/stats"
+	"github.com/Tapjoy/dynamiq/app/tracing"
 	"github.com/tpjg/goriakpbc"
+	"github.com/tpjg/goriakpbc/pb"
 )
 
 var (
 	// ErrConfigurationOptionNotFound represents the condition that occurs if an invalid
 	// location is specified for the config file
 	ErrConfigurationOptionNotFound = errors.New("Configuration Value Not Found")
+	// ErrInvalidPartitionCount represents the condition that occurs if a partition count is
+	// non-positive, or would put max_partitions below min_partitions
+	ErrInvalidPartitionCount = errors.New("Partition counts must be positive, and max_partitions may not be less than min_partitions")
+	// ErrInvalidTenant represents the condition that occurs if a queue's tenant holds anything but
+	// letters, digits, underscores and dashes
+	ErrInvalidTenant = errors.New("Tenants may only hold letters, digits, underscores and dashes")
 )
 
+// validTenant matches the tenants which can start a stats key without adding levels to it
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 // ConfigurationBucket is the name of the riak bucket holding the config
 const ConfigurationBucket = "config"
 
 // QueueConfigName is the key in the riak bucket holding the config
 const QueueConfigName = "queue_config"
 
+// TopicsConfigName is the key in the riak bucket holding the set of all topics
+const TopicsConfigName = "topicsConfig"
+
 // QueueSetName is the crdt key holding the set of all queues
 const QueueSetName = "queues"
 
@@ -48,11 +67,65 @@ const MaxPartitionAge = "max_partition_age"
 // CompressedMessages is the name of the config setting name for controlling if the queue is using compression or not
 const CompressedMessages = "compressed_messages"
 
+// MaxBatchSize is the name of the config setting name for controlling the most messages a single receive may return
+const MaxBatchSize = "max_batch_size"
+
+// Enabled is the name of the config setting name for controlling if the queue serves messages at all
+const Enabled = "enabled"
+
+// RejectPutsWhenDisabled is the name of the config setting name for controlling if a disabled queue also refuses new messages
+const RejectPutsWhenDisabled = "reject_puts_when_disabled"
+
+// CompressionAlgorithm is the name of the config setting name for controlling which registered compressor the queue compresses messages with
+const CompressionAlgorithm = "compression_algorithm"
+
+// CompressionDictionary is the name of the config setting name for controlling which zstd dictionary file the queue compresses messages with
+const CompressionDictionary = "compression_dictionary"
+
+// ConflictPolicy is the name of the config setting name for controlling which siblings of a conflicted message are put onto the queue again
+const ConflictPolicy = "conflict_policy"
+
+// Fifo is the name of the config setting name for controlling if the queue numbers its messages in the order they were put
+const Fifo = "fifo"
+
+// Tenant is the name of the config setting name for controlling the prefix the queue's stats are namespaced under
+const Tenant = "tenant"
+
+// MessageTTL is the name of the config setting name for controlling how many seconds a message is kept before it expires
+const MessageTTL = "message_ttl"
+
+// DeleteRetention is the name of the config setting name for controlling how many seconds deleted messages are kept for Replay
+const DeleteRetention = "delete_retention"
+
+// BodyChecksum is the name of the config setting name for controlling which checksum messages are stored with, to catch corruption
+const BodyChecksum = "body_checksum"
+
+// IdempotencyTTL is the name of the config setting name for controlling how many seconds an idempotency key stops a message being put again
+const IdempotencyTTL = "idempotency_ttl"
+
+// MessageCodec is the name of the config setting name for controlling how messages are wrapped in an envelope before being stored
+const MessageCodec = "message_codec"
+
+// MaxPutRate is the name of the config setting name for controlling how many messages per second each node accepts for the queue
+const MaxPutRate = "max_put_rate"
+
+// MaxGetRate is the name of the config setting name for controlling how many receives per second each node serves for the queue
+const MaxGetRate = "max_get_rate"
+
+// MaxDepth is the name of the config setting name for controlling how many messages a queue may hold before puts are rejected
+const MaxDepth = "max_depth"
+
 // Settings Arrays and maps cannot be made immutable in golang
-var Settings = [...]string{VisibilityTimeout, PartitionCount, MinPartitions, MaxPartitions, MaxPartitionAge, CompressedMessages}
+var Settings = [...]string{VisibilityTimeout, PartitionCount, MinPartitions, MaxPartitions, MaxPartitionAge, CompressedMessages, MaxBatchSize, Enabled, RejectPutsWhenDisabled, MessageCodec, MaxPutRate, MaxGetRate, MaxDepth, CompressionAlgorithm, IdempotencyTTL, MessageTTL, BodyChecksum, CompressionDictionary, Tenant, ConflictPolicy, Fifo, DeleteRetention}
 
 // DefaultSettings is
-var DefaultSettings = map[string]string{VisibilityTimeout: "30", PartitionCount: "5", MinPartitions: "1", MaxPartitions: "10", MaxPartitionAge: "432000", CompressedMessages: "false"}
+var DefaultSettings = map[string]string{VisibilityTimeout: "30", PartitionCount: "5", MinPartitions: "1", MaxPartitions: "10", MaxPartitionAge: "432000", CompressedMessages: "false", MaxBatchSize: "100", Enabled: "true", RejectPutsWhenDisabled: "false", MessageCodec: "none", MaxPutRate: "0", MaxGetRate: "0", MaxDepth: "0", CompressionAlgorithm: "zlib", IdempotencyTTL: "300", MessageTTL: "0", BodyChecksum: "none", CompressionDictionary: "", Tenant: "", ConflictPolicy: "split", Fifo: "false", DeleteRetention: "0"}
+
+// LogFormatText writes log entries as key=value text, the logrus default
+const LogFormatText = "text"
+
+// LogFormatJSON writes each log entry as a line of JSON, for log shippers
+const LogFormatJSON = "json"
 
 // Config is
 type Config struct {
@@ -61,7 +134,19 @@ type Config struct {
 	Compressor compressor.Compressor
 	Queues     *Queues
 	RiakPool   *riak.Client
-	Topics     *Topics
+	// RiakBreaker fails calls to Riak fast while the cluster is down
+	RiakBreaker *Breaker
+	// RiakPoolMeter reports how much of the connection pool is in use
+	RiakPoolMeter *PoolMeter
+	Topics        *Topics
+	// PartitionStrategy is resolved from Core.PartitionStrategy
+	PartitionStrategy PartitionStrategy
+	// ConfigMaps caches reads from the config bucket
+	ConfigMaps *ConfigMapCache
+	// Tracer starts spans around queue operations. Tracing is off while it is nil
+	Tracer tracing.Tracer
+	// Storage is what queue settings are written through. They go through RiakPool while it is nil
+	Storage Storage
 }
 
 // Core is
@@ -71,12 +156,76 @@ type Core struct {
 	SeedServer            string
 	SeedPort              int
 	SeedServers           []string
+	SeedSRV               string
+	SeedResolveInterval   time.Duration
 	HTTPPort              int
 	RiakNodes             string
 	BackendConnectionPool int
 	SyncConfigInterval    time.Duration
 	LogLevel              logrus.Level
 	LogLevelString        string
+	LogFormat             string
+	PartitionStrategy     string
+	ClusterProfile        string
+	RiakBreakerThreshold  int
+	RiakBreakerBackoff    time.Duration
+	RiakBreakerMaxBackoff time.Duration
+	DeadNodeCleanup       bool
+	MissingWarnRatio      float64
+	RiakTLS               bool
+	RiakTLSCACert         string
+	RiakTLSCert           string
+	RiakTLSKey            string
+	RiakTLSServerName     string
+	RiakNVal              int
+	MessageIDWidth        int
+	MessageIndex          string
+	ConfigCacheTTL        time.Duration
+	StatsFlavor           string
+	FillRatioRounding     string
+	FillRatioPrecise      bool
+	Autoscale             bool
+	AutoscaleHighFill     int64
+	AutoscaleLowFill      int64
+	AutoscaleSustain      int
+	AutoscaleCooldown     time.Duration
+	ExpireInterval        time.Duration
+	PartitionStarvation   time.Duration
+	DeleteGracePeriod     time.Duration
+	BulkChunkSize         int
+	CompressorPooling     bool
+	EmptyQueueError       bool
+	ConnAcquireTimeout    time.Duration
+	MaxPutRetries         int
+	IndexPageSize         int
+	FetchTimeout          time.Duration
+	KeySpaceMin           int64
+	KeySpaceMax           int64
+	DefaultTopic          string
+}
+
+// statsSuffixTags maps the suffix of every stat to the datadog tag its name is sent under
+var statsSuffixTags = map[string]string{
+	QueueSentStatsSuffix:                 "queue",
+	QueueReceivedStatsSuffix:             "queue",
+	QueueDeletedStatsSuffix:              "queue",
+	QueueDepthStatsSuffix:                "queue",
+	QueueDepthAprStatsSuffix:             "queue",
+	QueueDepthAvailableStatsSuffix:       "queue",
+	QueueFillDeltaStatsSuffix:            "queue",
+	QueueFillPreciseStatsSuffix:          "queue",
+	QueueGetMissingStatsSuffix:           "queue",
+	QueueConflictsStatsSuffix:            "queue",
+	QueueReadRepairSiblingsStatsSuffix:   "queue",
+	QueueConfigChangedStatsSuffix:        "queue",
+	QueueExpiredStatsSuffix:              "queue",
+	QueueChecksumMismatchStatsSuffix:     "queue",
+	QueuePartitionsAvailableStatsSuffix:  "queue",
+	QueuePutCollisionsStatsSuffix:        "queue",
+	TopicBroadcastStatsSuffix:            "topic",
+	TopicBroadcastQueueWritesStatsSuffix: "topic",
+	TopicBroadcastFailuresStatsSuffix:    "topic",
+	TopicBroadcastSkippedStatsSuffix:     "topic",
 }
 
 // Stats is
@@ -88,51 +237,188 @@ type Stats struct {
 	Client        stats.Client
 }
 
-func initRiakPool(cfg *Config) *riak.Client {
+func initRiakPool(cfg *Config) (*riak.Client, error) {
 	rand.Seed(time.Now().UnixNano())
 	// TODO this should just be 1 HAProxy
 	hosts := []string{cfg.Core.RiakNodes}
 	host := hosts[rand.Intn(len(hosts))]
-	return riak.NewClientPool(host, cfg.Core.BackendConnectionPool)
+	addr, err := riakPoolAddress(cfg.Core, host, dialRiakTLS)
+	if err != nil {
+		return nil, err
+	}
+	return riak.NewClientPool(addr, cfg.Core.BackendConnectionPool), nil
 }
 
 // GetCoreConfig is
 func GetCoreConfig(configFile *string) (*Config, error) {
-	var cfg Config
-	err := gcfg.ReadFileInto(&cfg, *configFile)
+	cfg, err := LoadConfig(*configFile)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	if len(cfg.Core.SeedServer) == 0 {
-		logrus.Fatal("The list of seedservers was empty")
+	cfg.RiakPool, err = initRiakPool(cfg)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	cfg.ConfigMaps = NewConfigMapCache(cfg.Core.ConfigCacheTTL * time.Millisecond)
+	cfg.RiakPoolMeter = NewPoolMeter(cfg.Core.BackendConnectionPool)
+	cfg.RiakBreaker = NewBreaker(cfg.Core.RiakBreakerThreshold, cfg.Core.RiakBreakerBackoff*time.Millisecond, cfg.Core.RiakBreakerMaxBackoff*time.Millisecond)
+	cfg.Queues = loadQueuesConfig(cfg)
+	cfg.checkMessageBuckets()
+
+	cfg.Queues.scheduleSync(cfg)
+	return cfg, err
+}
+
+// LoadConfig reads and validates the config file at path, as JSON or gcfg
+func LoadConfig(path string) (*Config, error) {
+	var cfg Config
+	var err error
+	if strings.HasSuffix(path, ".json") {
+		var contents []byte
+		contents, err = ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(contents, &cfg)
+		}
+	} else {
+		err = gcfg.ReadFileInto(&cfg, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateCore(cfg.Core)
+	if err != nil {
+		return nil, err
 	}
 
-	cfg.Core.SeedServers = strings.Split(cfg.Core.SeedServer, ",")
-	for i, x := range cfg.Core.SeedServers {
-		cfg.Core.SeedServers[i] = x + ":" + strconv.Itoa(cfg.Core.SeedPort)
+	if cfg.Core.SeedServer != "" {
+		cfg.Core.SeedServers = strings.Split(cfg.Core.SeedServer, ",")
+		for i, x := range cfg.Core.SeedServers {
+			cfg.Core.SeedServers[i] = x + ":" + strconv.Itoa(cfg.Core.SeedPort)
+		}
+	}
+
+	cfg.PartitionStrategy, err = NewPartitionStrategy(cfg.Core.PartitionStrategy)
+	if err != nil {
+		return nil, err
 	}
 
-	cfg.RiakPool = initRiakPool(&cfg)
-	cfg.Queues = loadQueuesConfig(&cfg)
 	switch cfg.Stats.Type {
 	case "statsd":
-		cfg.Stats.Client = stats.NewStatsdClient(cfg.Stats.Address, cfg.Stats.Prefix, time.Second*time.Duration(cfg.Stats.FlushInterval))
+		// Only stats sent on are flavored. The memory client is read back by its flat keys
+		client := stats.NewStatsdClient(cfg.Stats.Address, cfg.Stats.Prefix, time.Second*time.Duration(cfg.Stats.FlushInterval))
+		cfg.Stats.Client, err = stats.NewFlavoredClient(client, cfg.Core.StatsFlavor, statsSuffixTags)
+		if err != nil {
+			return nil, err
+		}
+	case "memory":
+		cfg.Stats.Client = stats.NewMemoryClient()
 	default:
 		cfg.Stats.Client = stats.NewNOOPClient()
 	}
 
-	// Currently we only support zlib, but we may support others
-	// Here is where we'd detect and inject
+	// Queues pick their own algorithm through compression_algorithm. This one reads back messages
+	// compressed before the algorithm was recorded on them, which were always zlib
 	cfg.Compressor = compressor.NewZlibCompressor()
+	compressor.SetPooling(cfg.Core.CompressorPooling)
 
 	cfg.Core.LogLevel, err = logrus.ParseLevel(cfg.Core.LogLevelString)
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, err
 	}
+	return &cfg, nil
+}
 
-	go cfg.Queues.scheduleSync(&cfg)
-	return &cfg, err
+func validateCore(core Core) error {
+	if len(core.SeedServer) == 0 && core.SeedSRV == "" {
+		return errors.New("The list of seedservers was empty, and no seedsrv was set")
+	}
+	if len(core.RiakNodes) == 0 {
+		return errors.New("The list of riaknodes was empty")
+	}
+	names := []string{"port", "seedport", "httpport"}
+	for i, port := range []int{core.Port, core.SeedPort, core.HTTPPort} {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("%s must be between 1 and 65535, got %d", names[i], port)
+		}
+	}
+	if core.RiakNVal < 0 {
+		return fmt.Errorf("riaknval must be 0 or greater, got %d", core.RiakNVal)
+	}
+	if core.MessageIDWidth != 0 && (core.MessageIDWidth < MessageIDDigits || core.MessageIDWidth > 64) {
+		return fmt.Errorf("messageidwidth must be 0, or between %d and 64, got %d", MessageIDDigits, core.MessageIDWidth)
+	}
+	switch core.MessageIndex {
+	case "", MessageIndexIDInt:
+	case MessageIndexKey:
+		// $key is a binary index, so ids of different lengths would sort out of order
+		if core.MessageIDWidth == 0 {
+			return errors.New("messageindex $key needs messageidwidth set, so ids sort as strings")
+		}
+	default:
+		return fmt.Errorf("messageindex must be one of id_int | $key, got %s", core.MessageIndex)
+	}
+	switch core.StatsFlavor {
+	case "", stats.FlavorGraphite, stats.FlavorDatadog:
+	default:
+		return fmt.Errorf("statsflavor must be one of graphite | datadog, got %s", core.StatsFlavor)
+	}
+	switch core.LogFormat {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		return fmt.Errorf("logformat must be one of text | json, got %s", core.LogFormat)
+	}
+	switch core.FillRatioRounding {
+	case "", FillRatioFloor, FillRatioRound, FillRatioCeil:
+	default:
+		return fmt.Errorf("fillratiorounding must be one of floor | round | ceil, got %s", core.FillRatioRounding)
+	}
+	if core.Autoscale {
+		if err := validateAutoscale(core); err != nil {
+			return err
+		}
+	}
+	if core.BackendConnectionPool <= 0 {
+		return fmt.Errorf("backendconnectionpool must be positive, got %d", core.BackendConnectionPool)
+	}
+	if core.SyncConfigInterval <= 0 {
+		return fmt.Errorf("syncconfiginterval must be positive, got %d", core.SyncConfigInterval)
+	}
+	if core.ExpireInterval < 0 {
+		return fmt.Errorf("expireinterval must be 0 or greater, got %d", core.ExpireInterval)
+	}
+	if core.PartitionStarvation < 0 {
+		return fmt.Errorf("partitionstarvation must be 0 or greater, got %d", core.PartitionStarvation)
+	}
+	if core.DeleteGracePeriod < 0 {
+		return fmt.Errorf("deletegraceperiod must be 0 or greater, got %d", core.DeleteGracePeriod)
+	}
+	if core.BulkChunkSize < 0 {
+		return fmt.Errorf("bulkchunksize must be 0 or greater, got %d", core.BulkChunkSize)
+	}
+	if core.MaxPutRetries < 0 {
+		return fmt.Errorf("maxputretries must be 0 or greater, got %d", core.MaxPutRetries)
+	}
+	if core.IndexPageSize < 0 {
+		return fmt.Errorf("indexpagesize must be 0 or greater, got %d", core.IndexPageSize)
+	}
+	if core.FetchTimeout < 0 {
+		return fmt.Errorf("fetchtimeout must be 0 or greater, got %d", core.FetchTimeout)
+	}
+	if core.ConnAcquireTimeout < 0 {
+		return fmt.Errorf("connacquiretimeout must be 0 or greater, got %d", core.ConnAcquireTimeout)
+	}
+	if core.SeedResolveInterval < 0 {
+		return fmt.Errorf("seedresolveinterval must be 0 or greater, got %d", core.SeedResolveInterval)
+	}
+	if core.KeySpaceMin < 0 || core.KeySpaceMax < 0 {
+		return fmt.Errorf("keyspacemin and keyspacemax must be 0 or greater, got %d and %d", core.KeySpaceMin, core.KeySpaceMax)
+	}
+	if min, max := core.keySpace(); min >= max {
+		return fmt.Errorf("keyspacemin must be below keyspacemax, got %d and %d", min, max)
+	}
+	return nil
 }
 
 func loadQueuesConfig(cfg *Config) *Queues {
@@ -141,10 +427,9 @@ func loadQueuesConfig(cfg *Config) *Queues {
 		QueueMap: make(map[string]*Queue),
 	}
 	// Get the queues
-	client := cfg.RiakConnection()
 	// TODO: We should be handling errors here
 	// Get the bucket holding the map of config data
-	configBucket, err := client.NewBucketType("maps", ConfigurationBucket)
+	configBucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
 	if err != nil {
 		// most commonly, the error here relates to a fundamental issue talking to riak
 		// likely, the connection pool is larger than the allowable number of file handles
@@ -161,15 +446,20 @@ func loadQueuesConfig(cfg *Config) *Queues {
 	queueSet := config.AddSet(QueueSetName)
 	if queueSet == nil {
 		queueSet.Add([]byte("default_queue"))
-		config.Store()
+		cfg.ConfigMaps.storeConfigMap(QueueConfigName, config)
 		config, _ = configBucket.FetchMap(QueueConfigName)
 	}
 	// For each queue we have in the system
+	configMaps := make(map[string]*riak.RDtMap)
 	for _, elem := range queueSet.GetValue() {
 		// Convert it's name into a string
 		name := string(elem[:])
 		// Get the Riak RdtMap of Settings for this queue
-		configMap, _ := configBucket.FetchMap(queueConfigRecordName(name))
+		configMaps[name], _ = configBucket.FetchMap(queueConfigRecordName(name))
+	}
+	// InitPartitions reads the settings from Riak while booting, on a connection of its own
+	release()
+	for name, configMap := range configMaps {
 		// Pre-warm the Settings object
 		queue := &Queue{
 			Name:   name,
@@ -186,51 +476,132 @@ func loadQueuesConfig(cfg *Config) *Queues {
 
 // InitializeQueue is
 func (cfg *Config) InitializeQueue(queueName string) error {
+	queue, err := cfg.initializeQueue(queueName)
+	if queue != nil {
+		cfg.Queues.Lock()
+		cfg.Queues.QueueMap[queueName] = queue
+		cfg.Queues.Unlock()
+	}
+	return err
+}
+
+// initializeQueue creates the queue in Riak, without adding it to the known queues
+func (cfg *Config) initializeQueue(queueName string) (*Queue, error) {
+	if err := checkQueueName(queueName); err != nil {
+		return nil, err
+	}
+	// Set up the messages bucket before anything else, so a queue is never served without it
+	if err := cfg.prepareMessageBucket(queueName); err != nil {
+		return nil, err
+	}
 	// Create the configuration data in Riak first
 	// This way it'll be there once the queue is added to the known set
 	configMap, err := cfg.createConfigForQueue(queueName)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// Add to the known set of queues
 	err = cfg.addToKnownQueues(queueName)
 	// Now, add the queue into our memory-cache of data
-	cfg.Queues.QueueMap[queueName] = &Queue{
+	queue := &Queue{
 		Name:   queueName,
 		Parts:  InitPartitions(cfg, queueName),
 		Config: configMap,
 	}
-	return err
+	return queue, err
 }
 
 func (cfg *Config) addToKnownQueues(queueName string) error {
 	// If we disallow topicless-queues, we can remove this and put it into Topic.AddQueue
-	client := cfg.RiakConnection()
 	// We purposefully read from Riak here, we'll enventually-consist with the in memory cache
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
+	bucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return err
+	}
+	defer release()
 	queueConfig, _ := bucket.FetchMap(QueueConfigName)
 	queueSet := queueConfig.AddSet(QueueSetName)
 	queueSet.Add([]byte(queueName))
-	return queueConfig.Store()
+	return cfg.ConfigMaps.storeConfigMap(QueueConfigName, queueConfig)
+}
+
+// isKnownQueue returns whether name is in the known queues, as read from Riak
+func (cfg *Config) isKnownQueue(name string) (bool, error) {
+	bucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	queuesConfig, err := bucket.FetchMap(QueueConfigName)
+	if err == riak.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	queueSet := queuesConfig.FetchSet(QueueSetName)
+	if queueSet == nil {
+		return false, nil
+	}
+	for _, value := range queueSet.GetValue() {
+		if string(value) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// destroyQueue drops the queue from the known queues, then destroys its config
+func (cfg *Config) destroyQueue(name string) error {
+	err := cfg.removeFromKnownQueues(name)
+	if err != nil {
+		return err
+	}
+	bucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return err
+	}
+	defer release()
+	config, err := bucket.FetchMap(queueConfigRecordName(name))
+	if err == riak.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return cfg.ConfigMaps.destroyConfigMap(queueConfigRecordName(name), config)
 }
 
 func (cfg *Config) removeFromKnownQueues(queueName string) error {
 	// If we disallow topicless-queues, we can remove this and put it into Topic.RemoveQueue
-	client := cfg.RiakConnection()
 	// We purposefully read from Riak here, we'll enventually-consist with the in memory cache
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	queueConfig, _ := bucket.FetchMap(QueueConfigName)
+	bucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return err
+	}
+	defer release()
+	queueConfig, err := bucket.FetchMap(QueueConfigName)
+	if err == riak.NotFound {
+		// No queues are known at all, so there's nothing to remove it from
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 	queueSet := queueConfig.AddSet(QueueSetName)
 	queueSet.Remove([]byte(queueName))
-	return queueConfig.Store()
+	return cfg.ConfigMaps.storeConfigMap(QueueConfigName, queueConfig)
 }
 
 // TODO: Take in a map which overrides the defaults
 func (cfg *Config) createConfigForQueue(queueName string) (*riak.RDtMap, error) {
-	client := cfg.RiakConnection()
 	// Get the bucket for holding maps of config data
 	// TODO: Find a nice way to DRY this up - it's a lil copy/pasty
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
+	bucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	// Get the object for this queues Settings
 	obj, _ := bucket.FetchMap(queueConfigRecordName(queueName))
 	// For each known setting
@@ -241,11 +612,24 @@ func (cfg *Config) createConfigForQueue(queueName string) (*riak.RDtMap, error)
 		reg.Update([]byte(DefaultSettings[elem]))
 	}
 	// Save the object, returns an error up the callchain if needed
-	return obj, obj.Store()
+	return obj, cfg.ConfigMaps.storeConfigMap(queueConfigRecordName(queueName), obj)
 }
 
 // SETTERS AND GETTERS FOR QUEUE CONFIG
 
+// missingWarnRatio returns the share of a receive's messages which may be missing before a warning
+func (cfg *Config) missingWarnRatio() float64 {
+	if cfg.Core.MissingWarnRatio <= 0 {
+		return DefaultMissingWarnRatio
+	}
+	return cfg.Core.MissingWarnRatio
+}
+
+// fetchTimeout returns how long a receive waits on its message fetches
+func (cfg *Config) fetchTimeout() time.Duration {
+	return cfg.Core.FetchTimeout * time.Millisecond
+}
+
 // GetVisibilityTimeout is
 func (cfg *Config) GetVisibilityTimeout(queueName string) (float64, error) {
 	val, err := cfg.getQueueSetting(VisibilityTimeout, queueName)
@@ -304,6 +688,242 @@ func (cfg *Config) SetCompressedMessages(queueName string, compressedMessages bo
 	return cfg.setQueueSetting(CompressedMessages, queueName, strconv.FormatBool(compressedMessages))
 }
 
+// GetMaxBatchSize is
+func (cfg *Config) GetMaxBatchSize(queueName string) (int64, error) {
+	val, _ := cfg.getQueueSetting(MaxBatchSize, queueName)
+	return strconv.ParseInt(val, 10, 64)
+}
+
+// SetMaxBatchSize is
+func (cfg *Config) SetMaxBatchSize(queueName string, size int64) error {
+	return cfg.setQueueSetting(MaxBatchSize, queueName, strconv.FormatInt(size, 10))
+}
+
+// GetQueueEnabled is
+func (cfg *Config) GetQueueEnabled(queueName string) (bool, error) {
+	val, _ := cfg.getQueueSetting(Enabled, queueName)
+	return strconv.ParseBool(val)
+}
+
+// SetQueueEnabled is
+func (cfg *Config) SetQueueEnabled(queueName string, enabled bool) error {
+	return cfg.setQueueSetting(Enabled, queueName, strconv.FormatBool(enabled))
+}
+
+// GetRejectPutsWhenDisabled is
+func (cfg *Config) GetRejectPutsWhenDisabled(queueName string) (bool, error) {
+	val, _ := cfg.getQueueSetting(RejectPutsWhenDisabled, queueName)
+	return strconv.ParseBool(val)
+}
+
+// SetRejectPutsWhenDisabled is
+func (cfg *Config) SetRejectPutsWhenDisabled(queueName string, reject bool) error {
+	return cfg.setQueueSetting(RejectPutsWhenDisabled, queueName, strconv.FormatBool(reject))
+}
+
+// GetCompressor returns the registered compressor named by the queue's compression_algorithm
+func (cfg *Config) GetCompressor(queueName string) (compressor.Compressor, string, error) {
+	val, _ := cfg.getQueueSetting(CompressionAlgorithm, queueName)
+	if val == "" {
+		val = DefaultSettings[CompressionAlgorithm]
+	}
+	c, err := compressor.NewCompressor(val)
+	if err != nil {
+		return nil, "", fmt.Errorf("Queue %s has an invalid compression_algorithm: %s", queueName, err)
+	}
+	if _, ok := c.(compressor.ZstdCompressor); ok {
+		dictID, err := cfg.GetCompressionDictionary(queueName)
+		if err != nil {
+			return nil, "", fmt.Errorf("Queue %s has an invalid compression_dictionary: %s", queueName, err)
+		}
+		if dictID != 0 {
+			c, err = compressor.NewZstdCompressor(dictID)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	return c, val, nil
+}
+
+// GetCompressionDictionary returns the ID of the zstd dictionary the queue compresses messages with
+func (cfg *Config) GetCompressionDictionary(queueName string) (uint32, error) {
+	path, _ := cfg.getQueueSetting(CompressionDictionary, queueName)
+	if path == "" {
+		return 0, nil
+	}
+	return compressor.LoadZstdDictionary(path)
+}
+
+// SetCompressionDictionary is
+func (cfg *Config) SetCompressionDictionary(queueName string, path string) error {
+	if path != "" {
+		if _, err := compressor.LoadZstdDictionary(path); err != nil {
+			return err
+		}
+	}
+	return cfg.setQueueSetting(CompressionDictionary, queueName, path)
+}
+
+// SetCompressionAlgorithm is
+func (cfg *Config) SetCompressionAlgorithm(queueName string, algorithm string) error {
+	_, err := compressor.NewCompressor(algorithm)
+	if err != nil {
+		return err
+	}
+	return cfg.setQueueSetting(CompressionAlgorithm, queueName, algorithm)
+}
+
+// GetMessageCodec returns the codec new messages are wrapped with, or nil if they are stored as is
+func (cfg *Config) GetMessageCodec(queueName string) (codec.Codec, error) {
+	val, _ := cfg.getQueueSetting(MessageCodec, queueName)
+	if val == "" || val == "none" {
+		return nil, nil
+	}
+	return codec.NewCodec(val)
+}
+
+// SetMessageCodec is
+func (cfg *Config) SetMessageCodec(queueName string, codecName string) error {
+	if codecName != "none" {
+		_, err := codec.NewCodec(codecName)
+		if err != nil {
+			return err
+		}
+	}
+	return cfg.setQueueSetting(MessageCodec, queueName, codecName)
+}
+
+// GetMaxPutRate is
+func (cfg *Config) GetMaxPutRate(queueName string) (float64, error) {
+	val, _ := cfg.getQueueSetting(MaxPutRate, queueName)
+	return strconv.ParseFloat(val, 64)
+}
+
+// SetMaxPutRate is
+func (cfg *Config) SetMaxPutRate(queueName string, rate float64) error {
+	return cfg.setQueueSetting(MaxPutRate, queueName, strconv.FormatFloat(rate, 'f', -1, 64))
+}
+
+// GetMaxGetRate is
+func (cfg *Config) GetMaxGetRate(queueName string) (float64, error) {
+	val, _ := cfg.getQueueSetting(MaxGetRate, queueName)
+	return strconv.ParseFloat(val, 64)
+}
+
+// SetMaxGetRate is
+func (cfg *Config) SetMaxGetRate(queueName string, rate float64) error {
+	return cfg.setQueueSetting(MaxGetRate, queueName, strconv.FormatFloat(rate, 'f', -1, 64))
+}
+
+// GetMaxDepth is
+func (cfg *Config) GetMaxDepth(queueName string) (int64, error) {
+	val, _ := cfg.getQueueSetting(MaxDepth, queueName)
+	return strconv.ParseInt(val, 10, 64)
+}
+
+// SetMaxDepth is
+func (cfg *Config) SetMaxDepth(queueName string, depth int64) error {
+	return cfg.setQueueSetting(MaxDepth, queueName, strconv.FormatInt(depth, 10))
+}
+
+// GetIdempotencyTTL returns how many seconds an idempotency key stops a message being put again
+func (cfg *Config) GetIdempotencyTTL(queueName string) (float64, error) {
+	val, _ := cfg.getQueueSetting(IdempotencyTTL, queueName)
+	return strconv.ParseFloat(val, 64)
+}
+
+// SetIdempotencyTTL is
+func (cfg *Config) SetIdempotencyTTL(queueName string, ttl float64) error {
+	return cfg.setQueueSetting(IdempotencyTTL, queueName, strconv.FormatFloat(ttl, 'f', -1, 64))
+}
+
+// GetMessageTTL returns how many seconds a message is kept before it expires, or 0 if it never does
+func (cfg *Config) GetMessageTTL(queueName string) (float64, error) {
+	val, _ := cfg.getQueueSetting(MessageTTL, queueName)
+	return strconv.ParseFloat(val, 64)
+}
+
+// SetMessageTTL is
+func (cfg *Config) SetMessageTTL(queueName string, ttl float64) error {
+	return cfg.setQueueSetting(MessageTTL, queueName, strconv.FormatFloat(ttl, 'f', -1, 64))
+}
+
+// GetDeleteRetention returns how many seconds deleted messages are kept for Replay, or 0 if they aren't kept
+func (cfg *Config) GetDeleteRetention(queueName string) (float64, error) {
+	val, _ := cfg.getQueueSetting(DeleteRetention, queueName)
+	return strconv.ParseFloat(val, 64)
+}
+
+// SetDeleteRetention is
+func (cfg *Config) SetDeleteRetention(queueName string, retention float64) error {
+	return cfg.setQueueSetting(DeleteRetention, queueName, strconv.FormatFloat(retention, 'f', -1, 64))
+}
+
+// GetBodyChecksum returns the checksum new messages are stored with
+func (cfg *Config) GetBodyChecksum(queueName string) (string, error) {
+	val, _ := cfg.getQueueSetting(BodyChecksum, queueName)
+	if val == "" {
+		val = ChecksumNone
+	}
+	if _, err := bodyChecksum(val, nil); err != nil {
+		return "", err
+	}
+	return val, nil
+}
+
+// SetBodyChecksum is
+func (cfg *Config) SetBodyChecksum(queueName string, algorithm string) error {
+	if _, err := bodyChecksum(algorithm, nil); err != nil {
+		return err
+	}
+	return cfg.setQueueSetting(BodyChecksum, queueName, algorithm)
+}
+
+// GetConflictPolicy returns how conflicted messages are read repaired
+func (cfg *Config) GetConflictPolicy(queueName string) (string, error) {
+	val, _ := cfg.getQueueSetting(ConflictPolicy, queueName)
+	if val == "" {
+		val = ConflictSplit
+	}
+	if _, err := resolveSiblings(val, nil); err != nil {
+		return "", err
+	}
+	return val, nil
+}
+
+// SetConflictPolicy is
+func (cfg *Config) SetConflictPolicy(queueName string, policy string) error {
+	if _, err := resolveSiblings(policy, nil); err != nil {
+		return err
+	}
+	return cfg.setQueueSetting(ConflictPolicy, queueName, policy)
+}
+
+// GetFifo is
+func (cfg *Config) GetFifo(queueName string) (bool, error) {
+	val, _ := cfg.getQueueSetting(Fifo, queueName)
+	return strconv.ParseBool(val)
+}
+
+// SetFifo is
+func (cfg *Config) SetFifo(queueName string, fifo bool) error {
+	return cfg.setQueueSetting(Fifo, queueName, strconv.FormatBool(fifo))
+}
+
+// GetTenant returns the prefix the queue's stats are namespaced under
+func (cfg *Config) GetTenant(queueName string) (string, error) {
+	return cfg.getQueueSetting(Tenant, queueName)
+}
+
+// SetTenant is
+func (cfg *Config) SetTenant(queueName string, tenant string) error {
+	if tenant != "" && !validTenant.MatchString(tenant) {
+		return ErrInvalidTenant
+	}
+	return cfg.setQueueSetting(Tenant, queueName, tenant)
+}
+
 // TODO Find a proper way to scope this to a queue VS a topic
 func (cfg *Config) getQueueSetting(paramName string, queueName string) (string, error) {
 	// Read from local cache
@@ -317,8 +937,8 @@ func (cfg *Config) getQueueSetting(paramName string, queueName string) (string,
 	// If cfg.Queues.QueueMap[queuename] is nil, it means this server hasn't yet synced with Riak
 	// While we wait, go and read from Riak directly
 	if cfg.Queues != nil {
-		if _, ok := cfg.Queues.QueueMap[queueName]; ok {
-			regValue := cfg.Queues.QueueMap[queueName].getConfig().FetchRegister(paramName)
+		if queue, err := cfg.Queues.GetQueue(queueName); err == nil {
+			regValue := queue.getConfig().FetchRegister(paramName)
 			if regValue != nil {
 				value, err = registerValueToString(regValue)
 				if err != nil {
@@ -334,10 +954,13 @@ func (cfg *Config) getQueueSetting(paramName string, queueName string) (string,
 	}
 
 	if value == "" {
-		// Read from riak
-		client := cfg.RiakConnection()
-		bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-		obj, err := bucket.FetchMap(queueConfigRecordName(queueName))
+		// Read from riak. Settings are read by operations already holding a connection, so this
+		// runs on theirs, rather than wait on the pool for another
+		bucket, err := cfg.riakBucketOn(cfg.RiakPool, "maps", ConfigurationBucket)
+		if err != nil {
+			return "", err
+		}
+		obj, err := cfg.ConfigMaps.fetchConfigMap(bucket, queueConfigRecordName(queueName))
 
 		// if not found... no config existed for that queue - should not happen hashtagcrossfingers
 		if err == riak.NotFound {
@@ -357,23 +980,96 @@ func (cfg *Config) getQueueSetting(paramName string, queueName string) (string,
 
 // TODO Find a proper way to scope this to a queue VS a topic
 func (cfg *Config) setQueueSetting(paramName string, queueName string, value string) error {
-	// Write to Riak
-	client := cfg.RiakConnection()
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	obj, err := bucket.FetchMap(queueConfigRecordName(queueName))
+	storage := cfg.storage()
+	recordName := queueConfigRecordName(queueName)
 	// if not found... no config existed for that queue - should not happen hashtagcrossfingers
-	if err == riak.NotFound {
-		// Log out an error here
+	if _, err := storage.FetchMap(ConfigBucket, recordName); err != nil {
 		return err
 	}
-	val := obj.AddRegister(paramName)
-	val.NewValue = []byte(value)
 	// Write to Riak
-	return obj.Store()
+	return storage.StoreMap(ConfigBucket, recordName, map[string]string{paramName: value})
+}
+
+// storage returns the configured Storage, or one over RiakPool if there is none
+func (cfg *Config) storage() Storage {
+	if cfg.Storage == nil {
+		return NewRiakStorage(cfg)
+	}
+	return cfg.Storage
 }
 
 // HELPERS
 
+// configChanges describes each register and set which differs between two versions of a config map
+func configChanges(old *riak.RDtMap, current *riak.RDtMap) []string {
+	if old == nil || current == nil || old == current {
+		return nil
+	}
+	keys := make(map[riak.MapKey]bool)
+	for key := range old.Values {
+		keys[key] = true
+	}
+	for key := range current.Values {
+		keys[key] = true
+	}
+	changes := make([]string, 0)
+	for key := range keys {
+		switch key.Type {
+		case pb.MapField_REGISTER:
+			was, is := registerValue(old.Values[key]), registerValue(current.Values[key])
+			if was != is {
+				changes = append(changes, fmt.Sprintf("%s %s -> %s", key.Key, was, is))
+			}
+		case pb.MapField_SET:
+			added, removed := setDifference(old.Values[key], current.Values[key])
+			for _, member := range added {
+				changes = append(changes, fmt.Sprintf("%s added %s", key.Key, member))
+			}
+			for _, member := range removed {
+				changes = append(changes, fmt.Sprintf("%s removed %s", key.Key, member))
+			}
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// registerValue returns the value of a register read out of a config map, or "unset" if there isn't one
+func registerValue(value interface{}) string {
+	register, ok := value.(*riak.RDtRegister)
+	if !ok || register == nil {
+		return "unset"
+	}
+	return string(register.Value)
+}
+
+// setDifference returns the members added to and removed from a set
+func setDifference(old interface{}, current interface{}) ([]string, []string) {
+	was, is := setMembers(old), setMembers(current)
+	added, removed := make([]string, 0), make([]string, 0)
+	for member := range is {
+		if !was[member] {
+			added = append(added, member)
+		}
+	}
+	for member := range was {
+		if !is[member] {
+			removed = append(removed, member)
+		}
+	}
+	return added, removed
+}
+
+func setMembers(value interface{}) map[string]bool {
+	members := make(map[string]bool)
+	if set, ok := value.(*riak.RDtSet); ok && set != nil {
+		for _, member := range set.GetValue() {
+			members[string(member)] = true
+		}
+	}
+	return members
+}
+
 func registerValueToString(reg *riak.RDtRegister) (string, error) {
 	// The register might have been deleted at this point, so handle nil case.
 	if reg == nil {
@@ -382,12 +1078,41 @@ func registerValueToString(reg *riak.RDtRegister) (string, error) {
 	return string(reg.Value[:]), nil
 }
 
-// RiakConnection returns a pointer to the current pool of riak connections, which
-// is abstracted inside of the riak.Client object
-func (cfg *Config) RiakConnection() *riak.Client {
-	return cfg.RiakPool
+// StatsClient returns the configured stats client, or a NOOPClient
+func (cfg *Config) StatsClient() stats.Client {
+	if cfg.Stats.Client == nil {
+		return stats.NewNOOPClient()
+	}
+	return cfg.Stats.Client
+}
+
+// ConfigureLogger sets logger to the configured level, and writes its entries in the configured format
+func (cfg *Config) ConfigureLogger(logger *logrus.Logger) {
+	logger.Level = cfg.Core.LogLevel
+	if cfg.Core.LogFormat == LogFormatJSON {
+		logger.Formatter = &logrus.JSONFormatter{}
+	} else {
+		logger.Formatter = &logrus.TextFormatter{}
+	}
+}
+
+// maxPutRetries returns how many more ids a put draws after its first one was taken
+func (cfg *Config) maxPutRetries() int {
+	if cfg.Core.MaxPutRetries > 0 {
+		return cfg.Core.MaxPutRetries
+	}
+	return DefaultMaxPutRetries
+}
+
+// tracer returns the configured Tracer, or a NOOPTracer if tracing is off
+func (cfg *Config) tracer() tracing.Tracer {
+	if cfg.Tracer == nil {
+		return tracing.NewNOOPTracer()
+	}
+	return cfg.Tracer
 }
 
+// queueConfigRecordName returns the key of the queue's own config record
 func queueConfigRecordName(queueName string) string {
 	return fmt.Sprintf("queue_%s_config", queueName)
 }
@@ -1,11 +1,23 @@
 package app_test
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
 	"strconv"
+	"strings"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/stats"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
 )
 
 var _ = Describe("Config", func() {
@@ -24,10 +36,233 @@ var _ = Describe("Config", func() {
 		})
 	})
 
-	Context("GetMinPartitions", func() {
+	Context("GetMaxPartitions", func() {
 		It("should return the configured MaxPartitions for the given queue", func() {
-			intMinPartitions, _ := strconv.Atoi(app.DefaultSettings[app.MaxPartitions])
-			Expect(cfg.GetMinPartitions(testQueueName)).To(Equal(intMinPartitions))
+			intMaxPartitions, _ := strconv.Atoi(app.DefaultSettings[app.MaxPartitions])
+			Expect(cfg.GetMaxPartitions(testQueueName)).To(Equal(intMaxPartitions))
+		})
+	})
+
+	Context("SetVisibilityTimeout", func() {
+		It("should write the setting to the queue's config through the configured Storage", func() {
+			storage := app.NewMemoryStorage()
+			stored := &app.Config{Storage: storage}
+			Expect(stored.SetVisibilityTimeout("stored_queue", 45)).To(Equal(riak.NotFound))
+
+			recordName := "queue_stored_queue_config"
+			Expect(storage.StoreMap(app.ConfigBucket, recordName, map[string]string{app.VisibilityTimeout: "30", app.MaxDepth: "100"})).To(Succeed())
+			Expect(stored.SetVisibilityTimeout("stored_queue", 45)).To(Succeed())
+			registers, err := storage.FetchMap(app.ConfigBucket, recordName)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(registers).To(Equal(map[string]string{app.VisibilityTimeout: "45", app.MaxDepth: "100"}))
+		})
+	})
+
+	Context("LoadConfig", func() {
+		var path string
+
+		writeConfig := func(contents string) {
+			file, err := ioutil.TempFile("", "dynamiq-config")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = file.WriteString(contents)
+			Expect(err).ToNot(HaveOccurred())
+			file.Close()
+			path = file.Name() + ".json"
+			Expect(os.Rename(file.Name(), path)).To(Succeed())
+		}
+
+		AfterEach(func() {
+			os.Remove(path)
+		})
+
+		It("should load a valid file", func() {
+			writeConfig(`{"core": {"name": "test0", "port": 7001, "seedserver": "test1,test2", "seedport": 7000,
+				"httpport": 8081, "riaknodes": "127.0.0.1:8087", "backendconnectionpool": 16,
+				"syncconfiginterval": 30000, "loglevelstring": "info"}, "stats": {"type": "memory"}}`)
+			loaded, err := app.LoadConfig(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(loaded.Core.RiakNodes).To(Equal("127.0.0.1:8087"))
+			Expect(loaded.Core.SeedServers).To(Equal([]string{"test1:7000", "test2:7000"}))
+			Expect(loaded.StatsClient()).To(BeAssignableToTypeOf(stats.NewMemoryClient()))
+		})
+
+		It("should reject a file without riaknodes", func() {
+			writeConfig(`{"core": {"name": "test0", "port": 7001, "seedserver": "test1", "seedport": 7000,
+				"httpport": 8081, "backendconnectionpool": 16, "syncconfiginterval": 30000, "loglevelstring": "info"}}`)
+			_, err := app.LoadConfig(path)
+			Expect(err).To(MatchError("The list of riaknodes was empty"))
+		})
+
+		It("should reject a message id width too narrow for every id", func() {
+			writeConfig(`{"core": {"name": "test0", "port": 7001, "seedserver": "test1", "seedport": 7000,
+				"httpport": 8081, "riaknodes": "127.0.0.1:8087", "backendconnectionpool": 16,
+				"syncconfiginterval": 30000, "loglevelstring": "info", "messageidwidth": 10}}`)
+			_, err := app.LoadConfig(path)
+			Expect(err).To(MatchError("messageidwidth must be 0, or between 19 and 64, got 10"))
+		})
+
+		It("should reject reading $key without padded message ids", func() {
+			writeConfig(`{"core": {"name": "test0", "port": 7001, "seedserver": "test1", "seedport": 7000,
+				"httpport": 8081, "riaknodes": "127.0.0.1:8087", "backendconnectionpool": 16,
+				"syncconfiginterval": 30000, "loglevelstring": "info", "messageindex": "$key"}}`)
+			_, err := app.LoadConfig(path)
+			Expect(err).To(MatchError("messageindex $key needs messageidwidth set, so ids sort as strings"))
+		})
+
+		It("should reject an unknown stats flavor", func() {
+			writeConfig(`{"core": {"name": "test0", "port": 7001, "seedserver": "test1", "seedport": 7000,
+				"httpport": 8081, "riaknodes": "127.0.0.1:8087", "backendconnectionpool": 16,
+				"syncconfiginterval": 30000, "loglevelstring": "info", "statsflavor": "influx"}}`)
+			_, err := app.LoadConfig(path)
+			Expect(err).To(MatchError("statsflavor must be one of graphite | datadog, got influx"))
+		})
+
+		It("should reject an unknown fill ratio rounding", func() {
+			writeConfig(`{"core": {"name": "test0", "port": 7001, "seedserver": "test1", "seedport": 7000,
+				"httpport": 8081, "riaknodes": "127.0.0.1:8087", "backendconnectionpool": 16,
+				"syncconfiginterval": 30000, "loglevelstring": "info", "fillratiorounding": "truncate"}}`)
+			_, err := app.LoadConfig(path)
+			Expect(err).To(MatchError("fillratiorounding must be one of floor | round | ceil, got truncate"))
+		})
+
+		It("should reject an unknown log format", func() {
+			writeConfig(`{"core": {"name": "test0", "port": 7001, "seedserver": "test1", "seedport": 7000,
+				"httpport": 8081, "riaknodes": "127.0.0.1:8087", "backendconnectionpool": 16,
+				"syncconfiginterval": 30000, "loglevelstring": "info", "logformat": "xml"}}`)
+			_, err := app.LoadConfig(path)
+			Expect(err).To(MatchError("logformat must be one of text | json, got xml"))
+		})
+
+		It("should reject autoscale thresholds which leave no band between them", func() {
+			writeConfig(`{"core": {"name": "test0", "port": 7001, "seedserver": "test1", "seedport": 7000,
+				"httpport": 8081, "riaknodes": "127.0.0.1:8087", "backendconnectionpool": 16,
+				"syncconfiginterval": 30000, "loglevelstring": "info", "autoscale": true, "autoscalelowfill": 95}}`)
+			_, err := app.LoadConfig(path)
+			Expect(err).To(MatchError("autoscalelowfill must be below autoscalehighfill, and both at most 100, got 95 and 90"))
+		})
+
+		It("should reject a port out of range", func() {
+			writeConfig(`{"core": {"name": "test0", "port": 70001, "seedserver": "test1", "seedport": 7000,
+				"httpport": 8081, "riaknodes": "127.0.0.1:8087", "backendconnectionpool": 16,
+				"syncconfiginterval": 30000, "loglevelstring": "info"}}`)
+			_, err := app.LoadConfig(path)
+			Expect(err).To(MatchError("port must be between 1 and 65535, got 70001"))
+		})
+	})
+
+	Context("InitializeQueue", func() {
+		It("should refuse names reserved for the config records", func() {
+			for _, name := range []string{app.TopicsConfigName, app.QueueConfigName} {
+				Expect(cfg.InitializeQueue(name)).To(Equal(app.ErrReservedQueueName))
+				_, created := cfg.Queues.QueueMap[name]
+				Expect(created).To(BeFalse())
+			}
+			Expect(cfg.InitializeQueue("a b")).To(Equal(app.ErrInvalidQueueName))
+		})
+	})
+
+	Context("ConfigureLogger", func() {
+		It("should leave out entries below the level, and write the rest as JSON", func() {
+			var logged bytes.Buffer
+			logger := logrus.New()
+			logger.Out = &logged
+			configured := &app.Config{Core: app.Core{LogLevel: logrus.InfoLevel, LogFormat: app.LogFormatJSON}}
+			configured.ConfigureLogger(logger)
+
+			logger.Debug("hidden")
+			logger.WithField("queue", "orders").Info("shown")
+			lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+			Expect(lines).To(HaveLen(1))
+			entry := make(map[string]interface{})
+			Expect(json.Unmarshal([]byte(lines[0]), &entry)).To(Succeed())
+			Expect(entry["msg"]).To(Equal("shown"))
+			Expect(entry["level"]).To(Equal("info"))
+			Expect(entry["queue"]).To(Equal("orders"))
+		})
+	})
+
+	Context("bucket properties", func() {
+		It("should turn on allow_mult, and set n_val only once it's configured", func() {
+			bucket := &app.MemoryBucketProps{NValValue: 3}
+			Expect(app.ApplyBucketPropsWith(app.Core{}, bucket)).To(Succeed())
+			Expect(bucket.Set).To(Equal([]string{"allow_mult"}))
+			Expect(bucket.AllowMultValue).To(BeTrue())
+			Expect(bucket.NValValue).To(Equal(uint32(3)))
+
+			bucket.Set = nil
+			Expect(app.ApplyBucketPropsWith(app.Core{RiakNVal: 5}, bucket)).To(Succeed())
+			Expect(bucket.Set).To(Equal([]string{"n_val"}))
+			Expect(bucket.NValValue).To(Equal(uint32(5)))
+		})
+
+		It("should fail when a property can't be set", func() {
+			bucket := &app.MemoryBucketProps{Err: errors.New("riak is down")}
+			Expect(app.ApplyBucketPropsWith(app.Core{}, bucket)).To(MatchError("riak is down"))
+		})
+
+		It("should flag a bucket which isn't set up, without changing it", func() {
+			bucket := &app.MemoryBucketProps{NValValue: 3}
+			Expect(app.CheckBucketPropsWith(app.Core{}, testQueueName, bucket)).To(BeFalse())
+			bucket.AllowMultValue = true
+			Expect(app.CheckBucketPropsWith(app.Core{}, testQueueName, bucket)).To(BeTrue())
+			Expect(app.CheckBucketPropsWith(app.Core{RiakNVal: 5}, testQueueName, bucket)).To(BeFalse())
+			Expect(bucket.Set).To(BeEmpty())
+		})
+	})
+
+	Context("Riak TLS", func() {
+		It("should connect straight to Riak by default", func() {
+			addr, err := app.RiakPoolAddressWith(app.Core{}, "127.0.0.1:8087", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(addr).To(Equal("127.0.0.1:8087"))
+		})
+
+		It("should pass the TLS config through to the dialer", func() {
+			dialed := make(chan *tls.Config, 1)
+			received := make(chan []byte, 1)
+			dial := func(network string, addr string, config *tls.Config) (net.Conn, error) {
+				Expect(addr).To(Equal("riak.internal:8087"))
+				dialed <- config
+				client, server := net.Pipe()
+				go func() {
+					buf := make([]byte, 4)
+					io.ReadFull(server, buf)
+					received <- buf
+					server.Close()
+				}()
+				return client, nil
+			}
+			core := app.Core{RiakTLS: true, RiakTLSServerName: "riak.internal"}
+			addr, err := app.RiakPoolAddressWith(core, "riak.internal:8087", dial)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(addr).ToNot(Equal("riak.internal:8087"))
+
+			conn, err := net.Dial("tcp", addr)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			conn.Write([]byte("ping"))
+			var config *tls.Config
+			Eventually(dialed).Should(Receive(&config))
+			Expect(config.ServerName).To(Equal("riak.internal"))
+			Eventually(received).Should(Receive(Equal([]byte("ping"))))
+		})
+
+		It("should reject a client cert without its key", func() {
+			core := app.Core{RiakTLS: true, RiakTLSCert: "client.pem"}
+			_, err := app.RiakPoolAddressWith(core, "riak.internal:8087", nil)
+			Expect(err).To(Equal(app.ErrRiakTLSKeyPair))
+		})
+	})
+
+	Context("StatsClient", func() {
+		It("should fall back to a NOOPClient when stats aren't configured", func() {
+			unconfigured := &app.Config{}
+			Expect(unconfigured.StatsClient()).To(Equal(stats.NewNOOPClient()))
+			Expect(unconfigured.StatsClient().Incr("test.count", 1)).To(Succeed())
+		})
+
+		It("should return the configured client", func() {
+			Expect(cfg.StatsClient()).To(Equal(statsClient))
 		})
 	})
 })
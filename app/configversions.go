@@ -0,0 +1,139 @@
+package app
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// configVersionMessage tags the gossip messages carrying a node's config version
+const configVersionMessage byte = 1
+
+// configVersionRetransmits scales how many times each version is gossiped
+const configVersionRetransmits = 3
+
+// ConfigVersions is a memberlist.Delegate gossiping a version number for each node's config
+type ConfigVersions struct {
+	name    string
+	version uint64
+	// seen is the latest version heard from each other node
+	seen       map[string]uint64
+	list       *memberlist.Memberlist
+	broadcasts *memberlist.TransmitLimitedQueue
+	// changes wakes the sync handler. It holds at most one wake up, so versions heard while a sync
+	// is waiting are covered by it
+	changes chan struct{}
+	sync.Mutex
+}
+
+// NewConfigVersions returns a ConfigVersions calling onChange whenever another node bumps its version
+func NewConfigVersions(onChange func()) *ConfigVersions {
+	versions := &ConfigVersions{seen: make(map[string]uint64), changes: make(chan struct{}, 1)}
+	versions.broadcasts = &memberlist.TransmitLimitedQueue{NumNodes: versions.numNodes, RetransmitMult: configVersionRetransmits}
+	go func() {
+		for range versions.changes {
+			onChange()
+		}
+	}()
+	return versions
+}
+
+// attach gossips over list, which the ConfigVersions was made the delegate of
+func (versions *ConfigVersions) attach(list *memberlist.Memberlist) {
+	versions.Lock()
+	defer versions.Unlock()
+	versions.list = list
+	versions.name = list.LocalNode().Name
+}
+
+func (versions *ConfigVersions) numNodes() int {
+	versions.Lock()
+	defer versions.Unlock()
+	if versions.list == nil {
+		return 1
+	}
+	return versions.list.NumMembers()
+}
+
+// Bump moves this node's config version on, and gossips it
+func (versions *ConfigVersions) Bump() {
+	versions.Lock()
+	version := uint64(time.Now().UnixNano())
+	if version <= versions.version {
+		version = versions.version + 1
+	}
+	versions.version = version
+	name := versions.name
+	versions.Unlock()
+	versions.broadcasts.QueueBroadcast(configVersionBroadcast(encodeConfigVersion(name, version)))
+}
+
+// NodeMeta has nothing to add to this node's meta
+func (versions *ConfigVersions) NodeMeta(limit int) []byte {
+	return nil
+}
+
+// NotifyMsg syncs for each newer version heard from another node
+func (versions *ConfigVersions) NotifyMsg(message []byte) {
+	name, version, ok := decodeConfigVersion(message)
+	if !ok {
+		return
+	}
+	versions.Lock()
+	changed := name != versions.name && version > versions.seen[name]
+	if changed {
+		versions.seen[name] = version
+	}
+	versions.Unlock()
+	if !changed {
+		return
+	}
+	select {
+	case versions.changes <- struct{}{}:
+	default:
+		// A sync is already waiting to run
+	}
+}
+
+// GetBroadcasts hands memberlist the versions waiting to be gossiped
+func (versions *ConfigVersions) GetBroadcasts(overhead, limit int) [][]byte {
+	return versions.broadcasts.GetBroadcasts(overhead, limit)
+}
+
+// LocalState has no state to exchange, every node reads its config from Riak
+func (versions *ConfigVersions) LocalState(join bool) []byte {
+	return nil
+}
+
+// MergeRemoteState has no state to merge
+func (versions *ConfigVersions) MergeRemoteState(buf []byte, join bool) {}
+
+func encodeConfigVersion(name string, version uint64) []byte {
+	message := make([]byte, 9, 9+len(name))
+	message[0] = configVersionMessage
+	binary.BigEndian.PutUint64(message[1:], version)
+	return append(message, name...)
+}
+
+func decodeConfigVersion(message []byte) (string, uint64, bool) {
+	if len(message) <= 9 || message[0] != configVersionMessage {
+		return "", 0, false
+	}
+	return string(message[9:]), binary.BigEndian.Uint64(message[1:9]), true
+}
+
+// configVersionBroadcast is a config version waiting to be gossiped
+type configVersionBroadcast []byte
+
+func (b configVersionBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	_, ok := other.(configVersionBroadcast)
+	return ok
+}
+
+func (b configVersionBroadcast) Message() []byte {
+	return b
+}
+
+func (b configVersionBroadcast) Finished() {}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/tpjg/goriakpbc"
+)
+
+// ConflictSplit puts every sibling of a conflicted message onto the queue again as a message of its own
+const ConflictSplit = "split"
+
+// ConflictFirst puts only the first sibling of a conflicted message onto the queue again, discarding the rest
+const ConflictFirst = "first"
+
+// ConflictLastWriteWins puts only the sibling which was put last onto the queue again, discarding the rest
+const ConflictLastWriteWins = "last-write-wins"
+
+// ErrInvalidConflictPolicy represents the condition that occurs if a queue is configured with an unknown conflict_policy
+var ErrInvalidConflictPolicy = errors.New("conflict_policy must be one of split | first | last-write-wins")
+
+// resolveSiblings returns the siblings with data which the policy keeps
+func resolveSiblings(policy string, siblings []riak.Sibling) ([]riak.Sibling, error) {
+	kept := make([]riak.Sibling, 0, len(siblings))
+	for _, sibling := range siblings {
+		if len(sibling.Data) > 0 {
+			kept = append(kept, sibling)
+		}
+	}
+	switch policy {
+	case "", ConflictSplit:
+		return kept, nil
+	case ConflictFirst:
+		if len(kept) > 1 {
+			kept = kept[:1]
+		}
+		return kept, nil
+	case ConflictLastWriteWins:
+		if len(kept) < 2 {
+			return kept, nil
+		}
+		last, lastPut := 0, int64(-1)
+		for i, sibling := range kept {
+			if putAt := siblingPutAt(sibling); putAt >= lastPut {
+				last, lastPut = i, putAt
+			}
+		}
+		return kept[last : last+1], nil
+	}
+	return nil, ErrInvalidConflictPolicy
+}
+
+// siblingPutAt returns the time, in nanoseconds, the sibling was put at, or 0 if it doesn't say
+func siblingPutAt(sibling riak.Sibling) int64 {
+	terms := sibling.Indexes[MessageCreatedIndex]
+	if len(terms) == 0 {
+		return 0
+	}
+	putAt, _ := strconv.ParseInt(terms[0], 10, 64)
+	return putAt
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	"github.com/hashicorp/memberlist"
+)
+
+// ErrInvalidMessageTTL represents the condition that occurs if a queue is configured with a negative message_ttl
+var ErrInvalidMessageTTL = errors.New("message_ttl must be 0 or greater")
+
+// MessageCreatedIndex is the 2i holding the time, in nanoseconds, every message was put at
+const MessageCreatedIndex = "created_int"
+
+// QueueExpiredStatsSuffix is the counter of messages deleted for outliving the queue's message_ttl
+const QueueExpiredStatsSuffix = "expired.count"
+
+// DefaultExpireInterval is how often each node sweeps for expired messages, if expireinterval isn't set
+const DefaultExpireInterval = time.Minute
+
+// expireInterval returns how often each node sweeps for expired messages
+func (cfg *Config) expireInterval() time.Duration {
+	if cfg.Core.ExpireInterval > 0 {
+		return cfg.Core.ExpireInterval * time.Millisecond
+	}
+	return DefaultExpireInterval
+}
+
+// createdTerm returns the MessageCreatedIndex term for a message put at putAt
+func createdTerm(putAt time.Time) string {
+	return strconv.FormatInt(putAt.UnixNano(), 10)
+}
+
+// ExpireMessages deletes the messages put onto the queue more than its message_ttl ago
+func (queue *Queue) ExpireMessages(cfg *Config, list *memberlist.Memberlist) (int, error) {
+	ttl, err := cfg.GetMessageTTL(queue.Name)
+	if err != nil || ttl <= 0 {
+		return 0, err
+	}
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	bottom, top := expiryRange(cfg, list)
+	query := func(min string, max string, continuation string) ([]string, string, error) {
+		return bucket.IndexQueryRangePage(MessageCreatedIndex, min, max, reconcilePageSize, continuation)
+	}
+	return queue.expire(queue.statsClient(cfg), ttl, time.Now(), bottom, top, query, riakMessages{bucket})
+}
+
+// expiryRange returns the ids whose expiry this node is responsible for
+func expiryRange(cfg *Config, list *memberlist.Memberlist) (int64, int64) {
+	bottom, top := GetNodePartitionRange(cfg, list)
+	if position, count := getNodePosition(cfg, list); position == count-1 {
+		return int64(bottom), math.MaxInt64
+	}
+	return int64(bottom), int64(top)
+}
+
+func (queue *Queue) expire(c stats.Client, ttl float64, now time.Time, bottom int64, top int64, query func(min string, max string, continuation string) ([]string, string, error), messages messageStore) (int, error) {
+	cutoff := createdTerm(now.Add(-time.Duration(ttl * float64(time.Second))))
+	expired := 0
+	var err error
+	continuation := ""
+	for {
+		var ids []string
+		ids, continuation, err = query("0", cutoff, continuation)
+		if err != nil {
+			break
+		}
+		for _, id := range ids {
+			value, parseErr := strconv.ParseInt(id, 10, 64)
+			if parseErr != nil || value < bottom || (value >= top && top != math.MaxInt64) {
+				continue
+			}
+			deleted, deleteErr := deleteMessage(id, messages)
+			if deleteErr != nil {
+				// Leave it for the next sweep
+				logrus.Error(deleteErr)
+				continue
+			}
+			if deleted {
+				expired++
+			}
+		}
+		if continuation == "" {
+			break
+		}
+	}
+	if expired > 0 {
+		// Expired messages were never acknowledged, so they aren't counted as deleted
+		var errs stats.Errors
+		errs.Add(c.DecrGauge(fmt.Sprintf("%s.%s", queue.Name, QueueDepthStatsSuffix), int64(expired)))
+		errs.Add(c.Incr(fmt.Sprintf("%s.%s", queue.Name, QueueExpiredStatsSuffix), int64(expired)))
+		if statsErr := errs.Err(); statsErr != nil {
+			logrus.Error(statsErr)
+		}
+	}
+	return expired, err
+}
+
+// ScheduleExpiry sweeps every queue for expired messages and keys every expireinterval
+func (queues *Queues) ScheduleExpiry(cfg *Config, list *memberlist.Memberlist) {
+	ticker := time.NewTicker(cfg.expireInterval())
+	queues.expireKiller = make(chan struct{})
+	queues.expireStopped = make(chan struct{})
+	go func() {
+		defer close(queues.expireStopped)
+		for {
+			select {
+			case <-ticker.C:
+				queues.expireMessages(cfg, list)
+				queues.PurgeDeletedQueues(cfg, list)
+			case <-queues.expireKiller:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (queues *Queues) expireMessages(cfg *Config, list *memberlist.Memberlist) {
+	queues.RLock()
+	swept := make([]*Queue, 0, len(queues.QueueMap))
+	for _, queue := range queues.QueueMap {
+		swept = append(swept, queue)
+	}
+	queues.RUnlock()
+	for _, queue := range swept {
+		expired, err := queue.ExpireMessages(cfg, list)
+		if err != nil {
+			logrus.Error(err)
+		}
+		if expired > 0 {
+			logrus.Infof("Expired %d messages from queue %s", expired, queue.Name)
+		}
+		if err := queue.PruneArchive(cfg); err != nil {
+			logrus.Error(err)
+		}
+		if err := queue.PruneIdempotencyKeys(cfg); err != nil {
+			logrus.Error(err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package app_test
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
+)
+
+var _ = Describe("Expiry", func() {
+
+	var (
+		// created maps the id of each stored message to its created_int term
+		created map[string]string
+		bucket  *app.MemoryMessages
+		client  *stats.MemoryClient
+		now     time.Time
+		queue   = &app.Queue{Name: "expiring"}
+	)
+
+	query := func(min string, max string, continuation string) ([]string, string, error) {
+		low, _ := strconv.ParseInt(min, 10, 64)
+		high, _ := strconv.ParseInt(max, 10, 64)
+		ids := make([]string, 0)
+		for id, term := range created {
+			value, _ := strconv.ParseInt(term, 10, 64)
+			if value >= low && value <= high {
+				ids = append(ids, id)
+			}
+		}
+		return ids, "", nil
+	}
+
+	BeforeEach(func() {
+		now = time.Now()
+		client = stats.NewMemoryClient()
+		client.SetGauge("expiring."+app.QueueDepthStatsSuffix, 2)
+		created = map[string]string{
+			"100": app.CreatedTerm(now.Add(-2 * time.Second)),
+			"200": app.CreatedTerm(now),
+		}
+		bucket = &app.MemoryMessages{Objects: map[string]riak.RObject{"100": {Key: "100"}, "200": {Key: "200"}}}
+	})
+
+	It("should delete the messages older than the ttl", func() {
+		expired, err := queue.ExpireWith(client, 1, now, 0, math.MaxInt64, query, bucket)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(expired).To(Equal(1))
+		Expect(bucket.Objects).ToNot(HaveKey("100"))
+		Expect(bucket.Objects).To(HaveKey("200"))
+		Expect(client.Gauge("expiring." + app.QueueDepthStatsSuffix)).To(Equal(int64(1)))
+		Expect(client.Counter("expiring." + app.QueueExpiredStatsSuffix)).To(Equal(int64(1)))
+		Expect(client.Counter("expiring." + app.QueueDeletedStatsSuffix)).To(BeZero())
+	})
+
+	It("should leave messages outside of this node's share of the keyspace", func() {
+		expired, err := queue.ExpireWith(client, 1, now, 150, 300, query, bucket)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(expired).To(BeZero())
+		Expect(bucket.Objects).To(HaveKey("100"))
+	})
+
+	It("should not count a message its consumer deleted first", func() {
+		delete(bucket.Objects, "100")
+		expired, err := queue.ExpireWith(client, 1, now, 0, math.MaxInt64, query, bucket)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(expired).To(BeZero())
+		Expect(client.Gauge("expiring." + app.QueueDepthStatsSuffix)).To(Equal(int64(2)))
+	})
+})
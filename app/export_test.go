@@ -0,0 +1,820 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app/codec"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	"github.com/hashicorp/memberlist"
+	"github.com/martini-contrib/render"
+	"github.com/tpjg/goriakpbc"
+	"github.com/tpjg/goriakpbc/pb"
+)
+
+// The unexported functions the specs call as they are
+var (
+	ApplyBucketPropsWith   = applyBucketProps
+	AttachReceipts         = attachReceipts
+	ByPriority             = byPriority
+	CheckBucketPropsWith   = checkBucketProps
+	CountMessagesWith      = countMessages
+	CreatedTerm            = createdTerm
+	DrawSequenceWith       = drawSequence
+	FetchAllWith           = fetchAll
+	FilterGroupHeadsWith   = filterGroupHeads
+	ForwardReceipt         = forwardReceipt
+	GroupIndexTerm         = groupIndexTerm
+	NewConfigMapCacheWith  = newConfigMapCache
+	NewMessage             = newMessage
+	NewRateLimiterWith     = newRateLimiter
+	OpenEnvelope           = openEnvelope
+	OpenMessage            = openMessage
+	PadMessageID           = padMessageID
+	PageIDsWith            = pageIDs
+	PriorityQueryWith      = priorityQuery
+	PriorityTerm           = priorityTerm
+	PruneArchiveWith       = pruneArchive
+	PutBatchFromReaderWith = putBatchFromReader
+	PutOnceWith            = putOnce
+	ReceiptIssuer          = receiptIssuer
+	ReceiveWith            = receive
+	ReconcileDepthWith     = reconcileDepth
+	RecordFillRatio        = recordFillRatio
+	RecordMissing          = recordMissing
+	RejoinSeedsWith        = rejoinSeeds
+	ReplayWith             = replay
+	RiakPoolAddressWith    = riakPoolAddress
+	SeedServersWith        = seedServers
+	StreamMessagesWith     = streamMessages
+)
+
+// ScheduleSync exposes the queue config sync to the specs
+func (queues *Queues) ScheduleSync(cfg *Config) {
+	queues.scheduleSync(cfg)
+}
+
+// ScheduleSync exposes the topic config sync to the specs
+func (topics *Topics) ScheduleSync(cfg *Config) {
+	topics.scheduleSync(cfg)
+}
+
+// UpdateConfigWith exposes swapping in a queue's latest config to the specs, with the given stats client
+func (queue *Queue) UpdateConfigWith(c stats.Client, rCfg *riak.RDtMap) {
+	queue.updateConfig(c, rCfg)
+}
+
+// ExpireWith exposes sweeping the queue for expired messages to the specs, with a fake created_int query
+func (queue *Queue) ExpireWith(c stats.Client, ttl float64, now time.Time, bottom int64, top int64, query func(min string, max string, continuation string) ([]string, string, error), messages *MemoryMessages) (int, error) {
+	return queue.expire(c, ttl, now, bottom, top, query, messages)
+}
+
+// CheckBodies exposes verifying opened messages against their checksums to the specs
+func (queue *Queue) CheckBodies(c stats.Client, rObjects []riak.RObject) int {
+	return queue.checkBodies(c, rObjects)
+}
+
+// NewTopicWith builds a Topic subscribed to the given queues, without going through Riak
+func NewTopicWith(name string, config *riak.RDtMap, queues *Queues) *Topic {
+	return &Topic{Name: name, Config: config, queues: queues}
+}
+
+// BroadcastWith exposes fanning a broadcast out to the subscribed queues to the specs, with a fake put
+func (topic *Topic) BroadcastWith(cfg *Config, put func(queue *Queue) (string, error)) map[string]BroadcastResult {
+	return topic.broadcast(cfg, put)
+}
+
+// BroadcastPreparedWith exposes a compress_once broadcast to the specs, counting the bodies prepared
+func (topic *Topic) BroadcastPreparedWith(cfg *Config, message string, put func(queue *Queue, body []byte) (string, error)) (map[string]BroadcastResult, int) {
+	prepares := 0
+	prepare := prepareBroadcast(cfg, message)
+	results := topic.broadcastPrepared(cfg, func(queue *Queue) (*preparedBody, error) {
+		prepares++
+		return prepare(queue)
+	}, func(queue *Queue, opts putOptions) (string, error) {
+		if opts.prepared == nil {
+			return put(queue, nil)
+		}
+		return put(queue, opts.prepared.data)
+	})
+	return results, prepares
+}
+
+// PurgeQueuesWith exposes purging every subscribed queue to the specs, with a fake Purge
+func (topic *Topic) PurgeQueuesWith(purge func(queue *Queue) (int, error)) (map[string]int, error) {
+	return topic.purgeQueues(purge)
+}
+
+// PurgeWith exposes purging a queue to the specs, paging through its ids with page
+func (queue *Queue) PurgeWith(c stats.Client, page func(continuation string) ([]string, string, error), messages *MemoryMessages) (int, error) {
+	return queue.purge(c, page, messages)
+}
+
+// SyncTopicsWith exposes syncing the topics to the specs, initializing new ones without subscribers
+func (topics *Topics) SyncTopicsWith(names []string) {
+	topics.syncTopics(names, func(name string) {
+		topics.addTopic(&Topic{Name: name, Config: &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}, queues: topics.queues})
+	})
+}
+
+// GetByIDWith exposes fetching a message by its id to the specs
+func (queue *Queue) GetByIDWith(cfg *Config, id string, messages *MemoryMessages) (*Message, error) {
+	rObject, err := messages.get(id)
+	return queue.openByID(cfg, rObject, err)
+}
+
+// DeleteWith exposes deleting a message to the specs
+func (queue *Queue) DeleteWith(c stats.Client, id string, messages *MemoryMessages) error {
+	return queue.deleteWith(c, id, messages)
+}
+
+// BatchDeleteWith exposes deleting several messages at once to the specs
+func (queue *Queue) BatchDeleteWith(c stats.Client, ids []string, messages *MemoryMessages) int {
+	return queue.batchDeleteWith(c, ids, messages)
+}
+
+// SyncNowWith exposes SyncNow to the specs, initializing the queues in names with an empty config
+func (queues *Queues) SyncNowWith(cfg *Config, names []string) {
+	queues.syncLock.Lock()
+	defer queues.syncLock.Unlock()
+	queues.syncQueues(cfg, names, func(name string) {
+		queues.Lock()
+		queues.QueueMap[name] = &Queue{Name: name, Config: &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}}
+		queues.Unlock()
+	})
+}
+
+// StatsClient exposes the view of the stats client the queue's stats go through to the specs
+func (queue *Queue) StatsClient(cfg *Config) stats.Client {
+	return queue.statsClient(cfg)
+}
+
+// GetOrCreateWith exposes GetOrCreate to the specs, creating missing queues with create
+func (queues *Queues) GetOrCreateWith(name string, create func() (*Queue, error)) (*Queue, bool, error) {
+	return queues.getOrCreate(name, create)
+}
+
+// NewBatchWriterWith exposes a BatchWriter for the queue to the specs, with a fake BatchPut
+func (queue *Queue) NewBatchWriterWith(put func(messages []string) ([]string, error), maxBatch int, maxWait time.Duration) (*BatchWriter, error) {
+	return queue.newBatchWriter(put, maxBatch, maxWait)
+}
+
+// CheckStarvationAt exposes checking the queue for starvation to the specs, as if it were now
+func (queue *Queue) CheckStarvationAt(cfg *Config, now time.Time) {
+	queue.checkStarvation(cfg, now)
+}
+
+// GetBackoffWith exposes GetBackoff to the specs, over a stubbed fetch
+func (queue *Queue) GetBackoffWith(fetch func() ([]Message, error), batchsize int64) ([]Message, time.Duration, error) {
+	return queue.getBackoff(fetch, batchsize)
+}
+
+// GetMultiWith exposes receiving from several queues at once to the specs, with a fake Get
+func (queues *Queues) GetMultiWith(names []string, get func(queue *Queue) ([]Message, error)) (map[string][]Message, error) {
+	return queues.getMulti(names, get)
+}
+
+// CollectPartitionsWith exposes how GetParallel gathers ids from every free partition to the specs
+func (queue *Queue) CollectPartitionsWith(cfg *Config, list *memberlist.Memberlist, batchsize int64, messages *MemoryMessages) ([]string, error) {
+	ids, _, err := queue.collectPartitions(cfg, list, batchsize, messages.query)
+	return ids, err
+}
+
+// ObserveReceive exposes feeding a receive's fill to the autoscaler to the specs
+func (queue *Queue) ObserveReceive(requested int64, received int64, depth int64) {
+	queue.autoscaler.observeReceive(requested, received)
+	queue.autoscaler.observeDepth(depth)
+}
+
+// Claim exposes marking ids in flight until visibleAt to the specs
+func (part *Partitions) Claim(ids []string, visibleAt time.Time) []string {
+	return part.claim(ids, len(ids), visibleAt)
+}
+
+// DrainedWith runs during with every partition popped off the heap under the lock
+func (part *Partitions) DrainedWith(during func()) {
+	part.Lock()
+	defer part.Unlock()
+	drained := make([]*Partition, 0, part.partitionCount)
+	for part.partitions.Size() > 0 {
+		poppedPartition, _ := part.partitions.Pop()
+		drained = append(drained, poppedPartition.(*Partition))
+	}
+	during()
+	for _, partition := range drained {
+		part.partitions.Push(partition, partition.LastUsed.UnixNano())
+	}
+}
+
+// AutoscaleAt exposes the autoscaling done on each config sync to the specs, as if run at now
+func (queue *Queue) AutoscaleAt(cfg *Config, now time.Time) {
+	queue.sample(cfg, nil, now)
+}
+
+// SampleAt exposes sampling the queue for the observers of queues to the specs, as if at now
+func (queues *Queues) SampleAt(cfg *Config, queue *Queue, now time.Time) {
+	queue.sample(cfg, queues.getObservers(), now)
+}
+
+// CompressBody exposes compressing a message body with its queue's algorithm to the specs
+func CompressBody(cfg *Config, queueName string, body []byte) ([]byte, string, error) {
+	body, algorithm, _, err := compressBody(cfg, queueName, body)
+	return body, algorithm, err
+}
+
+// NewMessageObjectWith exposes preparing the Riak object a put stores to the specs
+func (queue *Queue) NewMessageObjectWith(cfg *Config, message string, messageCodec codec.Codec, shouldCompress bool) (*riak.RObject, Message, error) {
+	return queue.newMessageObject(cfg, &riak.Bucket{}, message, putOptions{}, cfg.randomIDs(), messageCodec, shouldCompress)
+}
+
+// NewTracedMessageObjectWith is NewMessageObjectWith, for a put made as part of the trace in ctx
+func (queue *Queue) NewTracedMessageObjectWith(ctx context.Context, cfg *Config, message string, messageCodec codec.Codec) (*riak.RObject, Message, error) {
+	return queue.newMessageObject(cfg, &riak.Bucket{}, message, putOptions{ctx: ctx}, cfg.randomIDs(), messageCodec, false)
+}
+
+// InspectWith exposes breaking down the queue's partitions to the specs, counting messages with count
+func (queue *Queue) InspectWith(cfg *Config, list *memberlist.Memberlist, count func(bottom int, top int) (int64, error)) ([]PartitionInfo, error) {
+	return queue.inspect(cfg, list, count)
+}
+
+// PeekPartitionWith exposes peeking at a partition to the specs
+func (queue *Queue) PeekPartitionWith(cfg *Config, list *memberlist.Memberlist, partitionID int, batchsize int64, messages *MemoryMessages) ([]Message, error) {
+	return queue.peekPartition(cfg, list, partitionID, batchsize, messages.query, messages)
+}
+
+// ReserveWith exposes reserving messages to the specs
+func (queue *Queue) ReserveWith(cfg *Config, list *memberlist.Memberlist, batchsize int64, messages *MemoryMessages) ([]string, error) {
+	batchsize, ok, err := queue.receivable(cfg, batchsize)
+	if !ok {
+		return nil, err
+	}
+	return queue.reserve(cfg, list, batchsize, messages.query)
+}
+
+// GetWith exposes receiving messages to the specs
+func (queue *Queue) GetWith(cfg *Config, list *memberlist.Memberlist, batchsize int64, messages *MemoryMessages) ([]Message, error) {
+	return queue.getFrom(cfg, list, batchsize, messages)
+}
+
+// MemoryMessages keeps a queue's messages in memory, standing in for its Riak bucket
+type MemoryMessages struct {
+	// Objects maps each stored message to its object, by id
+	Objects map[string]riak.RObject
+	// Query, if set, reads the ids within a range in place of the stored ones
+	Query func(bottom int, top int, limit uint32) ([]string, error)
+	// Raced holds the ids deleted by someone else between being looked up and removed
+	Raced map[string]bool
+	// Err fails every read and write, if it isn't nil
+	Err error
+}
+
+func (m *MemoryMessages) query(bottom int, top int, limit uint32) ([]string, error) {
+	if m.Query != nil {
+		return m.Query(bottom, top, limit)
+	}
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	ids := []string{}
+	for id := range m.Objects {
+		value, err := strconv.Atoi(id)
+		if err == nil && value >= bottom && value <= top {
+			ids = append(ids, id)
+		}
+	}
+	// Lowest first, as the message index returns them
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+	if uint32(len(ids)) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+func (m *MemoryMessages) fetch(ids []string) []riak.RObject {
+	objects := make([]riak.RObject, 0, len(ids))
+	for _, id := range ids {
+		if object, ok := m.Objects[id]; ok {
+			objects = append(objects, object)
+		}
+	}
+	return objects
+}
+
+func (m *MemoryMessages) groupHead(group string) (string, error) {
+	head, oldest := "", ""
+	for id, object := range m.Objects {
+		for _, term := range object.Indexes[GroupIndex] {
+			if strings.HasPrefix(term, group+":") && (head == "" || term < oldest) {
+				head, oldest = id, term
+			}
+		}
+	}
+	return head, m.Err
+}
+
+func (m *MemoryMessages) get(id string) (*riak.RObject, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	object, ok := m.Objects[id]
+	if !ok {
+		return nil, riak.NotFound
+	}
+	return &object, nil
+}
+
+func (m *MemoryMessages) exists(id string) (bool, error) {
+	_, ok := m.Objects[id]
+	return ok, m.Err
+}
+
+func (m *MemoryMessages) store(object *riak.RObject) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	if m.Objects == nil {
+		m.Objects = make(map[string]riak.RObject)
+	}
+	m.Objects[object.Key] = *object
+	return nil
+}
+
+func (m *MemoryMessages) remove(id string) error {
+	if m.Err != nil {
+		return m.Err
+	}
+	delete(m.Objects, id)
+	if m.Raced[id] {
+		return riak.NotFound
+	}
+	return nil
+}
+
+// MemoryRenameStore keeps everything a rename touches in memory, standing in for Riak
+type MemoryRenameStore struct {
+	// Queues maps each known queue to its settings
+	Queues map[string]map[string]string
+	// Topics maps each topic to the queues subscribed to it
+	Topics map[string][]string
+	// Messages maps each queue to its messages, by id
+	Messages map[string]map[string]string
+	// Tombstones maps each queue to the ids its index still lists once their messages are gone
+	Tombstones map[string][]string
+	// FailMovesAfter makes moveMessage fail once this many messages were moved, if positive
+	FailMovesAfter int
+	moves          int
+}
+
+// RenameQueueWith exposes renaming a queue against a MemoryRenameStore to the specs
+func (queues *Queues) RenameQueueWith(cfg *Config, store *MemoryRenameStore, oldName string, newName string) error {
+	return queues.renameQueue(cfg, store, oldName, newName)
+}
+
+// MemoryPurgeStore keeps the known queues, their messages and the pending purges in memory
+type MemoryPurgeStore struct {
+	// Queues holds the known queues
+	Queues map[string]bool
+	// Messages maps each queue to its messages, by id
+	Messages map[string]map[string]string
+	// Purges maps each deleted queue to when its messages are purged
+	Purges map[string]time.Time
+}
+
+// DeleteQueueWith exposes deleting a queue from a MemoryPurgeStore to the specs, at now
+func (queues *Queues) DeleteQueueWith(store *MemoryPurgeStore, name string, gracePeriod time.Duration, now time.Time) (bool, error) {
+	return queues.deleteQueue(store, name, gracePeriod, now)
+}
+
+// PurgeDeletedQueuesWith exposes purging deleted queues from a MemoryPurgeStore to the specs, at now
+func (queues *Queues) PurgeDeletedQueuesWith(store *MemoryPurgeStore, now time.Time) {
+	queues.purgeDeletedQueues(store, now)
+}
+
+func (s *MemoryPurgeStore) queueExists(name string) (bool, error) {
+	return s.Queues[name], nil
+}
+
+func (s *MemoryPurgeStore) removeQueue(name string) error {
+	delete(s.Queues, name)
+	return nil
+}
+
+func (s *MemoryPurgeStore) schedulePurge(name string, purgeAt time.Time) error {
+	if s.Purges == nil {
+		s.Purges = make(map[string]time.Time)
+	}
+	s.Purges[name] = purgeAt
+	return nil
+}
+
+func (s *MemoryPurgeStore) pendingPurges() (map[string]time.Time, error) {
+	pending := make(map[string]time.Time, len(s.Purges))
+	for name, purgeAt := range s.Purges {
+		pending[name] = purgeAt
+	}
+	return pending, nil
+}
+
+func (s *MemoryPurgeStore) cancelPurge(name string) error {
+	delete(s.Purges, name)
+	return nil
+}
+
+func (s *MemoryPurgeStore) purgeMessages(name string) (int, error) {
+	purged := len(s.Messages[name])
+	delete(s.Messages, name)
+	return purged, nil
+}
+
+func (s *MemoryRenameStore) queueExists(name string) (bool, error) {
+	_, ok := s.Queues[name]
+	return ok, nil
+}
+
+func (s *MemoryRenameStore) renamedFrom(name string) (string, error) {
+	return s.Queues[name][RenamedFrom], nil
+}
+
+func (s *MemoryRenameStore) copyConfig(oldName string, newName string) (*riak.RDtMap, error) {
+	settings := make(map[string]string)
+	config := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+	for name, value := range s.Queues[oldName] {
+		settings[name] = value
+	}
+	settings[RenamedFrom] = oldName
+	for name, value := range settings {
+		config.Values[riak.MapKey{Key: name, Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte(value)}
+	}
+	s.Queues[newName] = settings
+	return config, nil
+}
+
+func (s *MemoryRenameStore) addQueue(name string) error {
+	if _, ok := s.Queues[name]; !ok {
+		s.Queues[name] = make(map[string]string)
+	}
+	return nil
+}
+
+func (s *MemoryRenameStore) removeQueue(name string) error {
+	delete(s.Queues, name)
+	return nil
+}
+
+func (s *MemoryRenameStore) topicNames() ([]string, error) {
+	names := make([]string, 0, len(s.Topics))
+	for name := range s.Topics {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *MemoryRenameStore) repointTopic(topicName string, oldName string, newName string) error {
+	for i, queueName := range s.Topics[topicName] {
+		if queueName == oldName {
+			s.Topics[topicName][i] = newName
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRenameStore) messageIDs(queueName string, continuation string) ([]string, string, error) {
+	ids := append([]string{}, s.Tombstones[queueName]...)
+	for id := range s.Messages[queueName] {
+		ids = append(ids, id)
+	}
+	// Pages of two, each carrying on after the last id of the one before, as a 2i continuation does
+	sort.Strings(ids)
+	page := make([]string, 0, 2)
+	for _, id := range ids {
+		if id > continuation {
+			page = append(page, id)
+		}
+		if len(page) == 2 {
+			return page, id, nil
+		}
+	}
+	return page, "", nil
+}
+
+func (s *MemoryRenameStore) moveMessage(oldName string, newName string, id string) error {
+	if s.FailMovesAfter > 0 && s.moves >= s.FailMovesAfter {
+		return errors.New("riak went away")
+	}
+	if _, ok := s.Messages[oldName][id]; !ok {
+		// Already gone, as a message Riak reports not found is
+		return nil
+	}
+	if s.Messages[newName] == nil {
+		s.Messages[newName] = make(map[string]string)
+	}
+	s.Messages[newName][id] = s.Messages[oldName][id]
+	delete(s.Messages[oldName], id)
+	s.moves++
+	return nil
+}
+
+// IDRange exposes the message index terms a receive queries between two partition bounds to the specs
+func (cfg *Config) IDRange(bottom int64, top int64) (string, string) {
+	return cfg.idRange(bottom, top)
+}
+
+// RepairConflictWith exposes read repairing a conflicted message to the specs, with a fake put and destroy
+func (queue *Queue) RepairConflictWith(cfg *Config, rObject *riak.RObject, put func(body string) (string, error), destroy func() error) {
+	queue.repair(cfg, rObject, put, destroy)
+}
+
+// SetQueueDepthAprWith exposes estimating the queue's depth, from the ids of a receive, to the specs
+func (queue *Queue) SetQueueDepthAprWith(cfg *Config, list *memberlist.Memberlist, ids []string) error {
+	return queue.setQueueDepthApr(cfg, list, ids)
+}
+
+// AckWith exposes acknowledging a message by its receipt to the specs
+func (queue *Queue) AckWith(cfg *Config, receipt string, messages *MemoryMessages) error {
+	id, err := queue.receiptID(cfg, receipt)
+	if err != nil {
+		return err
+	}
+	return queue.deleteWith(cfg.StatsClient(), id, messages)
+}
+
+// MemoryTopicStore keeps the topics and queues the topic API manages in memory, standing in for Riak
+type MemoryTopicStore struct {
+	// Topics maps each topic to the queues subscribed to it
+	Topics map[string][]string
+	// Queues is the set of known queues
+	Queues map[string]bool
+}
+
+// TopicRoutesWith returns a handler serving the topic API against a MemoryTopicStore, for the specs
+func TopicRoutesWith(cfg *Config, store *MemoryTopicStore) http.Handler {
+	m := dynamiqMartini(cfg)
+	m.Use(render.Renderer())
+	topicRoutes(m, store)
+	return m
+}
+
+func (s *MemoryTopicStore) topicExists(name string) bool {
+	_, ok := s.Topics[name]
+	return ok
+}
+
+func (s *MemoryTopicStore) queueExists(name string) bool {
+	return s.Queues[name]
+}
+
+func (s *MemoryTopicStore) createTopic(name string) error {
+	s.Topics[name] = make([]string, 0)
+	return nil
+}
+
+func (s *MemoryTopicStore) deleteTopic(name string) error {
+	delete(s.Topics, name)
+	return nil
+}
+
+func (s *MemoryTopicStore) subscriptions(topicName string) []string {
+	return s.Topics[topicName]
+}
+
+func (s *MemoryTopicStore) subscribe(topicName string, queueName string) error {
+	for _, subscribed := range s.Topics[topicName] {
+		if subscribed == queueName {
+			return nil
+		}
+	}
+	s.Topics[topicName] = append(s.Topics[topicName], queueName)
+	return nil
+}
+
+func (s *MemoryTopicStore) unsubscribe(topicName string, queueName string) error {
+	kept := make([]string, 0, len(s.Topics[topicName]))
+	for _, subscribed := range s.Topics[topicName] {
+		if subscribed != queueName {
+			kept = append(kept, subscribed)
+		}
+	}
+	s.Topics[topicName] = kept
+	return nil
+}
+
+// NewTopicsWith builds an empty Topics over queues, publishing to defaultTopic, for the specs
+func NewTopicsWith(queues *Queues, defaultTopic string) *Topics {
+	return &Topics{TopicMap: make(map[string]*Topic), queues: queues, defaultTopic: defaultTopic}
+}
+
+// PublishWith exposes publishing to the defaulttopic to the specs, with a fake put
+func (topics *Topics) PublishWith(cfg *Config, put func(queue *Queue) (string, error)) (map[string]BroadcastResult, error) {
+	topic, err := topics.getDefaultTopic()
+	if err != nil {
+		return nil, err
+	}
+	return topic.broadcast(cfg, put), nil
+}
+
+// StoreUniqueWith exposes storing a message under an unused id to the specs, drawing ids from newID
+func (queue *Queue) StoreUniqueWith(cfg *Config, object *riak.RObject, newID func() (string, error), messages *MemoryMessages) (string, error) {
+	return queue.storeUnique(cfg, object, newID, messages)
+}
+
+// MemoryBucketProps holds a bucket's properties in memory, recording every property set on it
+type MemoryBucketProps struct {
+	AllowMultValue bool
+	NValValue      uint32
+	// Set names each property set, in order
+	Set []string
+	// Err fails every set, if it isn't nil
+	Err error
+}
+
+func (b *MemoryBucketProps) AllowMult() bool { return b.AllowMultValue }
+
+func (b *MemoryBucketProps) SetAllowMult(allowMult bool) error {
+	if b.Err != nil {
+		return b.Err
+	}
+	b.AllowMultValue = allowMult
+	b.Set = append(b.Set, "allow_mult")
+	return nil
+}
+
+func (b *MemoryBucketProps) NVal() uint32 { return b.NValValue }
+
+func (b *MemoryBucketProps) SetNVal(nval uint32) error {
+	if b.Err != nil {
+		return b.Err
+	}
+	b.NValValue = nval
+	b.Set = append(b.Set, "n_val")
+	return nil
+}
+
+// SequenceIDsWith exposes numbering a fifo queue's messages to the specs, with a fake sequence counter
+func (queue *Queue) SequenceIDsWith(cfg *Config, next func() (int64, error)) func() (string, error) {
+	return queue.sequenceIDs(cfg, next)
+}
+
+// SetSettingWith exposes changing one of the queue's settings to the specs, with a fake store and sync
+func (queue *Queue) SetSettingWith(name string, value string, store func(name string, value string) error, sync func()) error {
+	return queue.setSetting(name, value, store, sync)
+}
+
+// MemoryArchive keeps a queue's messages, and those archived as they were deleted, in memory
+type MemoryArchive struct {
+	MemoryMessages
+	// Archived maps each deleted message to its body and when it was deleted, by id
+	Archived map[string]ArchivedMessage
+}
+
+// ArchivedMessage is a message kept in a MemoryArchive once deleted
+type ArchivedMessage struct {
+	Body      string
+	DeletedAt time.Time
+}
+
+// DeleteArchivingWith exposes deleting a message from a queue with a delete_retention to the specs, at now
+func (queue *Queue) DeleteArchivingWith(c stats.Client, archive *MemoryArchive, id string, now time.Time) error {
+	return queue.deleteWith(c, id, archivingMessages{archive, archive, func() time.Time { return now }})
+}
+
+func (a *MemoryArchive) archive(id string, deletedAt time.Time) error {
+	object, err := a.get(id)
+	if err != nil {
+		return nil
+	}
+	if a.Archived == nil {
+		a.Archived = make(map[string]ArchivedMessage)
+	}
+	a.Archived[id] = ArchivedMessage{Body: string(object.Data), DeletedAt: deletedAt}
+	return nil
+}
+
+func (a *MemoryArchive) archived(from time.Time, until time.Time) ([]string, error) {
+	ids := []string{}
+	for id, archived := range a.Archived {
+		if !archived.DeletedAt.Before(from) && !archived.DeletedAt.After(until) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return a.Archived[ids[i]].DeletedAt.Before(a.Archived[ids[j]].DeletedAt) })
+	return ids, nil
+}
+
+func (a *MemoryArchive) body(id string) (string, error) {
+	archived, ok := a.Archived[id]
+	if !ok {
+		return "", riak.NotFound
+	}
+	return archived.Body, nil
+}
+
+func (a *MemoryArchive) drop(id string) error {
+	delete(a.Archived, id)
+	return nil
+}
+
+// MemoryStorage is Storage kept in memory, standing in for a second client behind the interface
+type MemoryStorage struct {
+	objects map[StorageBucket]map[string]StoredObject
+	maps    map[StorageBucket]map[string]map[string]string
+}
+
+// NewMemoryStorage returns an empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		objects: make(map[StorageBucket]map[string]StoredObject),
+		maps:    make(map[StorageBucket]map[string]map[string]string),
+	}
+}
+
+// Store keeps object at key in the bucket
+func (s *MemoryStorage) Store(bucket StorageBucket, key string, object StoredObject) error {
+	if s.objects[bucket] == nil {
+		s.objects[bucket] = make(map[string]StoredObject)
+	}
+	s.objects[bucket][key] = object
+	return nil
+}
+
+// Fetch returns the object at key in the bucket
+func (s *MemoryStorage) Fetch(bucket StorageBucket, key string) (StoredObject, error) {
+	object, ok := s.objects[bucket][key]
+	if !ok {
+		return StoredObject{}, riak.NotFound
+	}
+	return object, nil
+}
+
+// Delete drops the object at key in the bucket
+func (s *MemoryStorage) Delete(bucket StorageBucket, key string) error {
+	delete(s.objects[bucket], key)
+	return nil
+}
+
+// IndexRange pages through the keys whose terms fall in range, comparing _int terms as numbers as Riak does
+func (s *MemoryStorage) IndexRange(bucket StorageBucket, index string, min string, max string, limit uint32, continuation string) ([]string, string, error) {
+	inRange := func(term string) bool { return term >= min && term <= max }
+	if strings.HasSuffix(index, "_int") {
+		low, _ := strconv.ParseInt(min, 10, 64)
+		high, _ := strconv.ParseInt(max, 10, 64)
+		inRange = func(term string) bool {
+			value, err := strconv.ParseInt(term, 10, 64)
+			return err == nil && value >= low && value <= high
+		}
+	}
+	keys := []string{}
+	for key, object := range s.objects[bucket] {
+		for _, term := range object.Indexes[index] {
+			if inRange(term) {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	sort.Strings(keys)
+	offset, _ := strconv.Atoi(continuation)
+	if offset > len(keys) {
+		offset = len(keys)
+	}
+	keys = keys[offset:]
+	if uint32(len(keys)) <= limit {
+		return keys, "", nil
+	}
+	return keys[:limit], strconv.Itoa(offset + int(limit)), nil
+}
+
+// FetchMap returns a copy of the registers of the map at key
+func (s *MemoryStorage) FetchMap(bucket StorageBucket, key string) (map[string]string, error) {
+	registers, ok := s.maps[bucket][key]
+	if !ok {
+		return nil, riak.NotFound
+	}
+	copied := make(map[string]string, len(registers))
+	for name, value := range registers {
+		copied[name] = value
+	}
+	return copied, nil
+}
+
+// StoreMap sets the given registers of the map at key
+func (s *MemoryStorage) StoreMap(bucket StorageBucket, key string, registers map[string]string) error {
+	if s.maps[bucket] == nil {
+		s.maps[bucket] = make(map[string]map[string]string)
+	}
+	if s.maps[bucket][key] == nil {
+		s.maps[bucket][key] = make(map[string]string)
+	}
+	for name, value := range registers {
+		s.maps[bucket][key][name] = value
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"errors"
+	"strconv"
+)
+
+// CountersBucketType is the Riak bucket type holding counters, as set up by setup.sh
+const CountersBucketType = "counters"
+
+// SequenceBucket holds the sequence counter of every fifo queue, keyed by queue name
+const SequenceBucket = "sequences"
+
+// ErrSequenceExhausted represents the condition that occurs if a fifo queue's sequence passed the top of the key space
+var ErrSequenceExhausted = errors.New("The queue's sequence has run past the top of the key space")
+
+// newIDs returns what the queue draws the ids of new messages from
+func (queue *Queue) newIDs(cfg *Config) func() (string, error) {
+	if fifo, _ := cfg.GetFifo(queue.Name); !fifo {
+		return cfg.randomIDs()
+	}
+	return queue.sequenceIDs(cfg, func() (int64, error) {
+		return queue.nextSequence(cfg)
+	})
+}
+
+// randomIDs returns random message ids within the key space
+func (cfg *Config) randomIDs() func() (string, error) {
+	return func() (string, error) {
+		return cfg.newMessageID(), nil
+	}
+}
+
+// sequenceIDs returns message ids numbered by next, counting up from the bottom of the key space
+func (queue *Queue) sequenceIDs(cfg *Config, next func() (int64, error)) func() (string, error) {
+	return func() (string, error) {
+		queue.sequence.Lock()
+		defer queue.sequence.Unlock()
+		seq, err := next()
+		if err != nil {
+			return "", err
+		}
+		min, max := cfg.Core.keySpace()
+		if seq < 0 || seq >= max-min {
+			return "", ErrSequenceExhausted
+		}
+		return padMessageID(strconv.FormatInt(min+seq, 10), cfg.Core.MessageIDWidth), nil
+	}
+}
+
+// nextSequence increments the queue's sequence counter in Riak, returning its new value
+func (queue *Queue) nextSequence(cfg *Config) (int64, error) {
+	bucket, err := cfg.riakBucketOn(cfg.RiakPool, CountersBucketType, SequenceBucket)
+	if err != nil {
+		return 0, err
+	}
+	return drawSequence(func() error {
+		counter, err := bucket.FetchCounter(queue.Name)
+		if err != nil {
+			return err
+		}
+		counter.Increment(1)
+		return counter.Store()
+	}, func() (int64, error) {
+		counter, err := bucket.FetchCounter(queue.Name)
+		if err != nil {
+			return 0, err
+		}
+		return counter.GetValue(), nil
+	})
+}
+
+// drawSequence increments a sequence counter, and reads back what it was incremented to
+func drawSequence(increment func() error, fetch func() (int64, error)) (int64, error) {
+	if err := increment(); err != nil {
+		return 0, err
+	}
+	return fetch()
+}
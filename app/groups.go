@@ -0,0 +1,105 @@
+package app
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/memberlist"
+	"github.com/tpjg/goriakpbc"
+)
+
+// GroupIndex is the 2i holding the message group, and put time, of grouped messages
+const GroupIndex = "group_bin"
+
+// groupIndexTerm returns the GroupIndex term for a message put into groupID at putAt
+func groupIndexTerm(groupID string, putAt time.Time) string {
+	return fmt.Sprintf("%x:%020d", sha1.Sum([]byte(groupID)), putAt.UnixNano())
+}
+
+// messageGroup returns the hashed group a message was put into, or "" if it is ungrouped
+func messageGroup(object riak.RObject) string {
+	terms := object.Indexes[GroupIndex]
+	if len(terms) == 0 {
+		return ""
+	}
+	split := strings.LastIndex(terms[0], ":")
+	if split < 0 {
+		return ""
+	}
+	return terms[0][:split]
+}
+
+// groupHead returns the id of the oldest message still stored in the hashed group
+func groupHead(bucket *riak.Bucket, group string) (string, error) {
+	// ; sorts directly after :, so this range holds exactly the group's terms
+	ids, _, err := bucket.IndexQueryRangePage(GroupIndex, group+":", group+";", 1, "")
+	if err != nil || len(ids) == 0 {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// groupHeads returns groupHead for the queue's groups
+func (queue *Queue) groupHeads(cfg *Config) func(groupID string) (string, error) {
+	return func(group string) (string, error) {
+		bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+		return groupHead(bucket, group)
+	}
+}
+
+// receiveHeads keeps the received messages at the heads of their groups, and unclaims the rest
+func (queue *Queue) receiveHeads(cfg *Config, list *memberlist.Memberlist, messages []riak.RObject, head func(group string) (string, error)) []riak.RObject {
+	read := make([]string, 0, len(messages))
+	for _, object := range messages {
+		read = append(read, object.Key)
+	}
+	heads := filterGroupHeads(messages, head)
+	kept := make(map[string]bool, len(heads))
+	for _, object := range heads {
+		kept[object.Key] = true
+	}
+	held := make([]string, 0, len(read)-len(heads))
+	for _, id := range read {
+		if !kept[id] {
+			held = append(held, id)
+		}
+	}
+	visTimeout, _ := cfg.GetVisibilityTimeout(queue.Name)
+	nodeBottom, nodeTop := GetNodePartitionRange(cfg, list)
+	queue.Parts.unclaim(nodeBottom, nodeTop, held, visTimeout)
+	return heads
+}
+
+// filterGroupHeads drops grouped messages which aren't the oldest left in their group
+func filterGroupHeads(messages []riak.RObject, head func(group string) (string, error)) []riak.RObject {
+	heads := make(map[string]string)
+	filtered := messages[:0]
+	for _, object := range messages {
+		group := messageGroup(object)
+		if group == "" {
+			filtered = append(filtered, object)
+			continue
+		}
+		id, checked := heads[group]
+		if !checked {
+			var err error
+			id, err = head(group)
+			if err != nil {
+				// Without knowing the head we can't keep the group in order, so hold it back
+				logrus.Error(err)
+			}
+			heads[group] = id
+		}
+		if id == object.Key {
+			filtered = append(filtered, object)
+		}
+	}
+	return filtered
+}
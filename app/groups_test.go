@@ -0,0 +1,75 @@
+package app_test
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
+)
+
+var _ = Describe("Message groups", func() {
+
+	var (
+		stored map[string][]string
+		head   func(groupID string) (string, error)
+	)
+
+	grouped := func(id string, groupID string) riak.RObject {
+		return riak.RObject{Key: id, Indexes: map[string][]string{app.GroupIndex: {app.GroupIndexTerm(groupID, time.Now())}}}
+	}
+
+	keys := func(messages []riak.RObject) []string {
+		ids := make([]string, 0, len(messages))
+		for _, object := range messages {
+			ids = append(ids, object.Key)
+		}
+		return ids
+	}
+
+	// group returns the hashed group the index holds a message of groupID under
+	group := func(groupID string) string {
+		term := app.GroupIndexTerm(groupID, time.Now())
+		return term[:strings.LastIndex(term, ":")]
+	}
+
+	BeforeEach(func() {
+		// The messages left in each group, oldest first
+		stored = map[string][]string{group("a"): {"a1", "a2"}, group("b"): {"b1", "b2"}}
+		head = func(group string) (string, error) {
+			if len(stored[group]) == 0 {
+				return "", nil
+			}
+			return stored[group][0], nil
+		}
+	})
+
+	It("should hold back the rest of a group until its head is deleted", func() {
+		received := app.FilterGroupHeadsWith([]riak.RObject{grouped("a2", "a"), grouped("a1", "a")}, head)
+		Expect(keys(received)).To(Equal([]string{"a1"}))
+
+		// a2 stays held back while a1 is in flight
+		received = app.FilterGroupHeadsWith([]riak.RObject{grouped("a2", "a")}, head)
+		Expect(received).To(BeEmpty())
+
+		// Deleting a1 makes a2 the head
+		stored[group("a")] = stored[group("a")][1:]
+		received = app.FilterGroupHeadsWith([]riak.RObject{grouped("a2", "a")}, head)
+		Expect(keys(received)).To(Equal([]string{"a2"}))
+	})
+
+	It("should serve different groups, and ungrouped messages, together", func() {
+		messages := []riak.RObject{grouped("b1", "b"), {Key: "plain"}, grouped("a1", "a"), grouped("b2", "b")}
+		received := app.FilterGroupHeadsWith(messages, head)
+		Expect(keys(received)).To(Equal([]string{"b1", "plain", "a1"}))
+	})
+
+	It("should keep groups apart when one's id starts with the other's", func() {
+		// - sorts before the digits of the put time, so unhashed, order:-1 would sort inside order
+		term := app.GroupIndexTerm("order:-1", time.Now())
+		Expect(term >= group("order")+":" && term <= group("order")+";").To(BeFalse())
+		Expect(term).To(MatchRegexp("^[0-9a-f]{40}:[0-9]{20}$"))
+	})
+})
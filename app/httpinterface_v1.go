@@ -13,6 +13,9 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/compressor"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	"github.com/Tapjoy/dynamiq/app/tracing"
 	"github.com/go-martini/martini"
 	"github.com/hashicorp/memberlist"
 	"github.com/martini-contrib/binding"
@@ -26,15 +29,59 @@ import (
 
 // ConfigRequest is
 type ConfigRequest struct {
-	VisibilityTimeout  *float64 `json:"visibility_timeout,omitempty"`
-	MinPartitions      *int     `json:"min_partitions,omitempty"`
-	MaxPartitions      *int     `json:"max_partitions,omitempty"`
-	MaxPartitionAge    *float64 `json:"max_partition_age,omitempty"`
-	CompressedMessages *bool    `json:"compressed_messages,omitempty"`
+	VisibilityTimeout      *float64 `json:"visibility_timeout,omitempty"`
+	MinPartitions          *int     `json:"min_partitions,omitempty"`
+	MaxPartitions          *int     `json:"max_partitions,omitempty"`
+	MaxPartitionAge        *float64 `json:"max_partition_age,omitempty"`
+	CompressedMessages     *bool    `json:"compressed_messages,omitempty"`
+	MaxBatchSize           *int64   `json:"max_batch_size,omitempty"`
+	Enabled                *bool    `json:"enabled,omitempty"`
+	RejectPutsWhenDisabled *bool    `json:"reject_puts_when_disabled,omitempty"`
+	MessageCodec           *string  `json:"message_codec,omitempty"`
+	MaxPutRate             *float64 `json:"max_put_rate,omitempty"`
+	MaxGetRate             *float64 `json:"max_get_rate,omitempty"`
+	MaxDepth               *int64   `json:"max_depth,omitempty"`
+	CompressionAlgorithm   *string  `json:"compression_algorithm,omitempty"`
+	CompressionDictionary  *string  `json:"compression_dictionary,omitempty"`
+	IdempotencyTTL         *float64 `json:"idempotency_ttl,omitempty"`
+	MessageTTL             *float64 `json:"message_ttl,omitempty"`
+	BodyChecksum           *string  `json:"body_checksum,omitempty"`
+	Tenant                 *string  `json:"tenant,omitempty"`
+	ConflictPolicy         *string  `json:"conflict_policy,omitempty"`
+	Fifo                   *bool    `json:"fifo,omitempty"`
+	DeleteRetention        *float64 `json:"delete_retention,omitempty"`
+}
+
+// SettingRequest is the body of PATCH /queues/:queue/settings/:setting
+type SettingRequest struct {
+	Value *string `json:"value"`
+}
+
+// TopicConfigRequest is
+type TopicConfigRequest struct {
+	CompressOnce   *bool `json:"compress_once,omitempty"`
+	SkipFullQueues *bool `json:"skip_full_queues,omitempty"`
 }
 
 // TODO make message definitions more explicit
 
+// errorStatus maps an error returned by a queue operation onto the status code to answer with
+func errorStatus(err error) int {
+	switch err {
+	case ErrQueueNotFound, ErrMessageNotFound, ErrTopicNotFound, ErrInvalidPartition:
+		return 404
+	case ErrQueueDisabled:
+		return 403
+	case ErrThrottled:
+		return 429
+	case ErrInvalidQueueName, ErrReservedQueueName, ErrInvalidPriority, ErrRetentionDisabled:
+		return 422
+	case ErrRiakUnavailable, ErrBreakerOpen, ErrQueueFull, ErrPoolExhausted:
+		return 503
+	}
+	return 500
+}
+
 func logrusLogger() martini.Handler {
 	return func(res http.ResponseWriter, req *http.Request, c martini.Context, log *logrus.Logger) {
 		start := time.Now()
@@ -62,7 +109,7 @@ func dynamiqMartini(cfg *Config) *martini.ClassicMartini {
 	m := martini.New()
 
 	log := logrus.New()
-	log.Level = cfg.Core.LogLevel
+	cfg.ConfigureLogger(log)
 
 	m.Map(log)
 	m.Use(logrusLogger())
@@ -77,6 +124,80 @@ func dynamiqMartini(cfg *Config) *martini.ClassicMartini {
 type HTTPApiV1 struct {
 }
 
+// topicRoutes adds the handlers for topics and their subscriptions to m
+func topicRoutes(m martini.Router, store topicStore) {
+	create := func(r render.Render, params martini.Params) {
+		// Topic names follow the same rules as queue names
+		if !validQueueName.MatchString(params["topic"]) {
+			r.JSON(422, map[string]interface{}{"error": ErrInvalidTopicName.Error()})
+			return
+		}
+		if store.topicExists(params["topic"]) {
+			r.JSON(422, map[string]interface{}{"error": ErrTopicExists.Error()})
+			return
+		}
+		if err := store.createTopic(params["topic"]); err != nil {
+			logrus.Error(err)
+			r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+			return
+		}
+		r.JSON(201, map[string]interface{}{"Queues": store.subscriptions(params["topic"])})
+	}
+	m.Post("/topics/:topic", create)
+	m.Put("/topics/:topic", create)
+
+	m.Delete("/topics/:topic", func(r render.Render, params martini.Params) {
+		if !store.topicExists(params["topic"]) {
+			r.JSON(404, map[string]interface{}{"error": ErrTopicNotFound.Error()})
+			return
+		}
+		if err := store.deleteTopic(params["topic"]); err != nil {
+			logrus.Error(err)
+			r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+			return
+		}
+		r.JSON(200, map[string]interface{}{"Deleted": true})
+	})
+
+	m.Get("/topics/:topic/queues", func(r render.Render, params martini.Params) {
+		if !store.topicExists(params["topic"]) {
+			r.JSON(404, map[string]interface{}{"error": ErrTopicNotFound.Error()})
+			return
+		}
+		r.JSON(200, map[string]interface{}{"Queues": store.subscriptions(params["topic"])})
+	})
+
+	m.Put("/topics/:topic/queues/:queue", func(r render.Render, params martini.Params) {
+		if !store.topicExists(params["topic"]) {
+			r.JSON(422, map[string]interface{}{"error": "Topic does not exist. Please create it first."})
+			return
+		}
+		if !store.queueExists(params["queue"]) {
+			r.JSON(422, map[string]interface{}{"error": "Queue does not exist. Please create it first"})
+			return
+		}
+		if err := store.subscribe(params["topic"], params["queue"]); err != nil {
+			logrus.Error(err)
+			r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+			return
+		}
+		r.JSON(200, map[string]interface{}{"Queues": store.subscriptions(params["topic"])})
+	})
+
+	m.Delete("/topics/:topic/queues/:queue", func(r render.Render, params martini.Params) {
+		if !store.topicExists(params["topic"]) {
+			r.JSON(404, map[string]interface{}{"error": ErrTopicNotFound.Error()})
+			return
+		}
+		if err := store.unsubscribe(params["topic"], params["queue"]); err != nil {
+			logrus.Error(err)
+			r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+			return
+		}
+		r.JSON(200, map[string]interface{}{"Queues": store.subscriptions(params["topic"])})
+	})
+}
+
 // InitWebserver is
 func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 	// tieing our Queue to HTTP interface == bad we should move this somewhere else
@@ -98,6 +219,14 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 			return status
 		})
 
+		m.Get("/status/riak", func(r render.Render) {
+			if cfg.RiakBreaker == nil {
+				r.JSON(200, BreakerStatus{State: BreakerClosed})
+				return
+			}
+			r.JSON(200, cfg.RiakBreaker.Status())
+		})
+
 		m.Get("/status/partitionrange", func(r render.Render, params martini.Params) {
 			bottom, top := GetNodePartitionRange(cfg, list)
 			r.JSON(200, map[string]interface{}{"bottom": strconv.Itoa(bottom), "top": strconv.Itoa(top)})
@@ -106,23 +235,17 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 
 		// CONFIGURATION API BLOCK
 
-		m.Delete("/topics/:topic", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = topics.TopicMap[params["topic"]]
-			if present == true {
-				deleted := topics.DeleteTopic(cfg, params["topic"])
-				r.JSON(200, map[string]interface{}{"Deleted": deleted})
-			} else {
-				r.JSON(404, map[string]interface{}{"error": "Topic did not exist."})
-			}
-		})
+		topicRoutes(m, riakTopicStore{cfg: cfg})
 
 		m.Delete("/queues/:queue", func(r render.Render, params martini.Params) {
 			var present bool
 			_, present = queues.QueueMap[params["queue"]]
 			if present == true {
-				queues.DeleteQueue(params["queue"], cfg)
-				deleted := true
+				deleted, err := queues.DeleteQueue(params["queue"], cfg)
+				if err != nil {
+					r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+					return
+				}
 				r.JSON(200, map[string]interface{}{"Deleted": deleted})
 			} else {
 				r.JSON(404, map[string]interface{}{"error": "Queue did not exist."})
@@ -130,52 +253,147 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 		})
 
 		m.Put("/queues/:queue", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = queues.QueueMap[params["queue"]]
-			if present != true {
-				cfg.InitializeQueue(params["queue"])
+			_, created, err := queues.getOrCreate(params["queue"], func() (*Queue, error) {
+				return cfg.initializeQueue(params["queue"])
+			})
+			if err != nil {
+				r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+				return
+			}
+			if created {
 				r.JSON(201, "created")
 			} else {
 				r.JSON(422, map[string]interface{}{"error": "Queue already exists."})
 			}
 		})
 
-		m.Put("/topics/:topic", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = topics.TopicMap[params["topic"]]
-			if present != true {
-				topics.InitTopic(params["topic"])
-				r.JSON(201, map[string]interface{}{"Queues": topics.TopicMap[params["topic"]].ListQueues()})
-			} else {
-				r.JSON(422, map[string]interface{}{"error": "Topic already exists."})
+		m.Patch("/topics/:topic", binding.Json(TopicConfigRequest{}), func(configRequest TopicConfigRequest, r render.Render, params martini.Params) {
+			topic, err := topics.GetTopic(params["topic"])
+			if err != nil {
+				r.JSON(404, map[string]interface{}{"error": err.Error()})
+				return
 			}
+			if configRequest.CompressOnce != nil {
+				err = topic.SetCompressOnce(cfg, *configRequest.CompressOnce)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+			if configRequest.SkipFullQueues != nil {
+				err = topic.SetSkipFullQueues(cfg, *configRequest.SkipFullQueues)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+			r.JSON(200, map[string]interface{}{"Queues": topic.ListQueues(), TopicCompressOnce: topic.CompressOnce(), TopicSkipFullQueues: topic.SkipFullQueues()})
 		})
 
-		m.Put("/topics/:topic/queues/:queue", func(r render.Render, params martini.Params) {
+		m.Put("/queues/:queue/partitions/:maxPartitions", func(r render.Render, params martini.Params) {
 			var present bool
-			_, present = topics.TopicMap[params["topic"]]
+			_, present = queues.QueueMap[params["queue"]]
 			if present != true {
-				r.JSON(422, map[string]interface{}{"error": "Topic does not exist. Please create it first."})
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
+			}
+			maxPartitions, err := strconv.Atoi(params["maxPartitions"])
+			if err != nil {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			err = queues.ResizeQueue(cfg, params["queue"], maxPartitions)
+			if err == ErrInvalidPartitionCount {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+			} else if err != nil {
+				logrus.Error(err)
+				r.JSON(500, map[string]interface{}{"error": err.Error()})
 			} else {
-				_, present = queues.QueueMap[params["queue"]]
-				if present != true {
-					r.JSON(422, map[string]interface{}{"error": "Queue does not exist. Please create it first"})
-				} else {
-					topics.TopicMap[params["topic"]].AddQueue(cfg, params["queue"])
-					r.JSON(200, map[string]interface{}{"Queues": topics.TopicMap[params["topic"]].ListQueues()})
-				}
+				r.JSON(200, map[string]interface{}{"MaxPartitions": maxPartitions})
 			}
 		})
 
-		// neeeds a little work....
-		m.Delete("/topics/:topic/queues/:queue", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = topics.TopicMap[params["topic"]]
-			if present != true {
-				topics.InitTopic(params["topic"])
+		m.Get("/queues/:queue/partitions", func(r render.Render, params martini.Params) {
+			queue, err := queues.GetQueue(params["queue"])
+			if err != nil {
+				r.JSON(404, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			infos, err := queue.Inspect(cfg, list)
+			if err != nil {
+				r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+				return
+			}
+			r.JSON(200, infos)
+		})
+
+		m.Get("/queues/:queue/partitions/:partition/messages/:batchSize", func(r render.Render, params martini.Params) {
+			queue, err := queues.GetQueue(params["queue"])
+			if err != nil {
+				r.JSON(404, map[string]interface{}{"error": err.Error()})
+				return
 			}
-			topics.TopicMap[params["topic"]].DeleteQueue(cfg, params["queue"])
-			r.JSON(200, map[string]interface{}{"Queues": topics.TopicMap[params["topic"]].ListQueues()})
+			partitionID, err := strconv.Atoi(params["partition"])
+			if err != nil {
+				r.JSON(404, map[string]interface{}{"error": ErrInvalidPartition.Error()})
+				return
+			}
+			batchSize, err := strconv.ParseInt(params["batchSize"], 10, 64)
+			if err != nil {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			messages, err := queue.PeekPartition(cfg, list, partitionID, batchSize)
+			if err == ErrInvalidBatchSize {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+				return
+			}
+			messageList := make([]map[string]interface{}, 0, len(messages))
+			for _, message := range messages {
+				messageList = append(messageList, formatMessage(message))
+			}
+			r.JSON(200, messageList)
+		})
+
+		m.Post("/queues/:queue/reconcile", func(r render.Render, params martini.Params) {
+			queue, ok := queues.QueueMap[params["queue"]]
+			if !ok {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
+			}
+			err := queue.ReconcileDepth(cfg)
+			if err != nil {
+				r.JSON(500, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			r.JSON(200, "ok")
+		})
+
+		m.Post("/queues/:queue/rename/:newName", func(r render.Render, params martini.Params) {
+			err := queues.RenameQueue(cfg, params["queue"], params["newName"])
+			switch err {
+			case nil:
+				r.JSON(200, map[string]interface{}{"Renamed": params["newName"]})
+			case ErrQueueNotFound:
+				r.JSON(404, map[string]interface{}{"error": err.Error()})
+			case ErrInvalidQueueName, ErrReservedQueueName, ErrQueueExists:
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+			default:
+				logrus.Error(err)
+				r.JSON(500, map[string]interface{}{"error": err.Error()})
+			}
+		})
+
+		m.Post("/sync", func(r render.Render) {
+			queues.SyncNow(cfg)
+			topics.SyncNow(cfg)
+			r.JSON(200, map[string]interface{}{"Queues": len(queues.QueueMap), "Topics": len(topics.TopicNames())})
 		})
 
 		m.Patch("/queues/:queue", binding.Json(ConfigRequest{}), func(configRequest ConfigRequest, r render.Render, params martini.Params) {
@@ -210,8 +428,12 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 				}
 			}
 
-			if configRequest.MinPartitions != nil {
-				err = cfg.SetMinPartitions(params["queue"], *configRequest.MinPartitions)
+			if configRequest.MaxPartitions != nil {
+				err = queues.ResizeQueue(cfg, params["queue"], *configRequest.MaxPartitions)
+				if err == ErrInvalidPartitionCount {
+					r.JSON(422, map[string]interface{}{"error": err.Error()})
+					return
+				}
 				if err != nil {
 					logrus.Println(err)
 					r.JSON(500, map[string]interface{}{"error": err.Error()})
@@ -236,41 +458,315 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 				}
 			}
 
+			if configRequest.MaxBatchSize != nil {
+				if *configRequest.MaxBatchSize <= 0 {
+					r.JSON(422, map[string]interface{}{"error": ErrInvalidBatchSize.Error()})
+					return
+				}
+				err = cfg.SetMaxBatchSize(params["queue"], *configRequest.MaxBatchSize)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.Enabled != nil {
+				err = cfg.SetQueueEnabled(params["queue"], *configRequest.Enabled)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.RejectPutsWhenDisabled != nil {
+				err = cfg.SetRejectPutsWhenDisabled(params["queue"], *configRequest.RejectPutsWhenDisabled)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.MessageCodec != nil {
+				err = cfg.SetMessageCodec(params["queue"], *configRequest.MessageCodec)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.CompressionAlgorithm != nil {
+				if _, err := compressor.NewCompressor(*configRequest.CompressionAlgorithm); err != nil {
+					r.JSON(422, map[string]interface{}{"error": err.Error()})
+					return
+				}
+				err = cfg.SetCompressionAlgorithm(params["queue"], *configRequest.CompressionAlgorithm)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.CompressionDictionary != nil {
+				if *configRequest.CompressionDictionary != "" {
+					if _, err := compressor.LoadZstdDictionary(*configRequest.CompressionDictionary); err != nil {
+						r.JSON(422, map[string]interface{}{"error": err.Error()})
+						return
+					}
+				}
+				err = cfg.SetCompressionDictionary(params["queue"], *configRequest.CompressionDictionary)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.MaxPutRate != nil {
+				if *configRequest.MaxPutRate < 0 {
+					r.JSON(422, map[string]interface{}{"error": ErrInvalidRate.Error()})
+					return
+				}
+				err = cfg.SetMaxPutRate(params["queue"], *configRequest.MaxPutRate)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.MaxGetRate != nil {
+				if *configRequest.MaxGetRate < 0 {
+					r.JSON(422, map[string]interface{}{"error": ErrInvalidRate.Error()})
+					return
+				}
+				err = cfg.SetMaxGetRate(params["queue"], *configRequest.MaxGetRate)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.MaxDepth != nil {
+				if *configRequest.MaxDepth < 0 {
+					r.JSON(422, map[string]interface{}{"error": ErrInvalidMaxDepth.Error()})
+					return
+				}
+				err = cfg.SetMaxDepth(params["queue"], *configRequest.MaxDepth)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.IdempotencyTTL != nil {
+				if *configRequest.IdempotencyTTL < 0 {
+					r.JSON(422, map[string]interface{}{"error": ErrInvalidIdempotencyTTL.Error()})
+					return
+				}
+				err = cfg.SetIdempotencyTTL(params["queue"], *configRequest.IdempotencyTTL)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.MessageTTL != nil {
+				if *configRequest.MessageTTL < 0 {
+					r.JSON(422, map[string]interface{}{"error": ErrInvalidMessageTTL.Error()})
+					return
+				}
+				err = cfg.SetMessageTTL(params["queue"], *configRequest.MessageTTL)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.ConflictPolicy != nil {
+				err = cfg.SetConflictPolicy(params["queue"], *configRequest.ConflictPolicy)
+				if err == ErrInvalidConflictPolicy {
+					r.JSON(422, map[string]interface{}{"error": err.Error()})
+					return
+				}
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.Fifo != nil {
+				err = cfg.SetFifo(params["queue"], *configRequest.Fifo)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.DeleteRetention != nil {
+				if *configRequest.DeleteRetention < 0 {
+					r.JSON(422, map[string]interface{}{"error": ErrInvalidDeleteRetention.Error()})
+					return
+				}
+				err = cfg.SetDeleteRetention(params["queue"], *configRequest.DeleteRetention)
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.Tenant != nil {
+				err = cfg.SetTenant(params["queue"], *configRequest.Tenant)
+				if err == ErrInvalidTenant {
+					r.JSON(422, map[string]interface{}{"error": err.Error()})
+					return
+				}
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
+			if configRequest.BodyChecksum != nil {
+				err = cfg.SetBodyChecksum(params["queue"], *configRequest.BodyChecksum)
+				if err == ErrInvalidChecksum {
+					r.JSON(422, map[string]interface{}{"error": err.Error()})
+					return
+				}
+				if err != nil {
+					logrus.Println(err)
+					r.JSON(500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+
 			r.JSON(200, "ok")
 		})
 
+		m.Get("/queues/:queue/settings/:setting", func(r render.Render, params martini.Params) {
+			queue, ok := queues.QueueMap[params["queue"]]
+			if !ok {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
+			}
+			value, ok := queue.GetSetting(params["setting"])
+			if !ok {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue setting named %s", params["setting"])})
+				return
+			}
+			r.JSON(200, map[string]interface{}{params["setting"]: value})
+		})
+
+		m.Patch("/queues/:queue/settings/:setting", binding.Json(SettingRequest{}), func(settingRequest SettingRequest, r render.Render, params martini.Params) {
+			queue, ok := queues.QueueMap[params["queue"]]
+			if !ok {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
+			}
+			if settingRequest.Value == nil {
+				r.JSON(422, map[string]interface{}{"error": ErrInvalidSettingValue.Error()})
+				return
+			}
+			// Tell a bad value apart from Riak failing, before anything is written
+			if _, err := checkSetting(params["setting"], *settingRequest.Value); err != nil {
+				if err == ErrUnknownSetting {
+					r.JSON(404, map[string]interface{}{"error": err.Error()})
+				} else {
+					r.JSON(422, map[string]interface{}{"error": err.Error()})
+				}
+				return
+			}
+			if err := queue.SetSetting(cfg, params["setting"], *settingRequest.Value); err != nil {
+				logrus.Println(err)
+				r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+				return
+			}
+			value, _ := queue.GetSetting(params["setting"])
+			r.JSON(200, map[string]interface{}{params["setting"]: value})
+		})
+
 		// END CONFIGURATION API BLOCK
 
 		// DATA INTERACTION API BLOCK
 
 		m.Get("/topics", func(r render.Render) {
-			topicList := make([]string, 0, 10)
-			for topicName := range topics.TopicMap {
-				topicList = append(topicList, topicName)
-			}
-			r.JSON(200, map[string]interface{}{"topics": topicList})
+			r.JSON(200, map[string]interface{}{"topics": topics.TopicNames()})
 		})
 
 		m.Get("/topics/:topic", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = topics.TopicMap[params["topic"]]
-			if present != true {
-				topics.InitTopic(params["topic"])
-			}
+			topic := topics.getOrInitTopic(params["topic"])
+			r.JSON(200, map[string]interface{}{"Queues": topic.ListQueues(), TopicCompressOnce: topic.CompressOnce(), TopicSkipFullQueues: topic.SkipFullQueues()})
+		})
 
-			r.JSON(200, map[string]interface{}{"Queues": topics.TopicMap[params["topic"]].ListQueues()})
+		m.Get("/topics/:topic/subscribers", func(r render.Render, params martini.Params) {
+			topic, err := topics.GetTopic(params["topic"])
+			if err != nil {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no topic named %s", params["topic"])})
+				return
+			}
+			subscribers, err := topic.ListSubscribers(cfg)
+			if err != nil {
+				// The subscribers are still worth returning, just without their depths
+				logrus.Error(err)
+			}
+			r.JSON(200, map[string]interface{}{"subscribers": subscribers})
 		})
 
 		m.Put("/topics/:topic/message", func(r render.Render, params martini.Params, req *http.Request) {
-			var present bool
-			_, present = topics.TopicMap[params["topic"]]
-			if present != true {
-				topics.InitTopic(params["topic"])
+			topic := topics.getOrInitTopic(params["topic"])
+			var buf bytes.Buffer
+			buf.ReadFrom(req.Body)
+
+			response := make(map[string]string)
+			for queueName, result := range topic.Broadcast(cfg, buf.String()) {
+				response[queueName] = result.UUID
 			}
+			r.JSON(200, response)
+		})
+
+		m.Put("/message", func(r render.Render, req *http.Request) {
 			var buf bytes.Buffer
 			buf.ReadFrom(req.Body)
 
-			response := topics.TopicMap[params["topic"]].Broadcast(cfg, buf.String())
+			results, err := topics.Publish(cfg, buf.String())
+			if err != nil {
+				r.JSON(404, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			response := make(map[string]string)
+			for queueName, result := range results {
+				response[queueName] = result.UUID
+			}
+			r.JSON(200, response)
+		})
+
+		m.Delete("/topics/:topic/messages", func(r render.Render, params martini.Params) {
+			topic, err := topics.GetTopic(params["topic"])
+			if err != nil {
+				r.JSON(404, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			purged, err := topic.PurgeQueues(cfg)
+			response := map[string]interface{}{"purged": purged}
+			if errs, ok := err.(QueueErrors); ok {
+				failed := make(map[string]string, len(errs))
+				for queueName, queueErr := range errs {
+					failed[queueName] = queueErr.Error()
+				}
+				response["errors"] = failed
+			}
 			r.JSON(200, response)
 		})
 
@@ -290,9 +786,25 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 				queueReturn := make(map[string]interface{})
 				queueReturn["VisibilityTimeout"], _ = cfg.GetVisibilityTimeout(params["queue"])
 				queueReturn["MinPartitions"], _ = cfg.GetMinPartitions(params["queue"])
-				queueReturn["MaxPartitions"], _ = cfg.GetMinPartitions(params["queue"])
+				queueReturn["MaxPartitions"], _ = cfg.GetMaxPartitions(params["queue"])
 				queueReturn["MaxPartitionAge"], _ = cfg.GetMaxPartitionAge(params["queue"])
 				queueReturn["CompressedMessages"], _ = cfg.GetCompressedMessages(params["queue"])
+				queueReturn["CompressionAlgorithm"], _ = cfg.getQueueSetting(CompressionAlgorithm, params["queue"])
+				queueReturn["CompressionDictionary"], _ = cfg.getQueueSetting(CompressionDictionary, params["queue"])
+				queueReturn["MaxBatchSize"], _ = cfg.GetMaxBatchSize(params["queue"])
+				queueReturn["Enabled"], _ = cfg.GetQueueEnabled(params["queue"])
+				queueReturn["RejectPutsWhenDisabled"], _ = cfg.GetRejectPutsWhenDisabled(params["queue"])
+				queueReturn["MessageCodec"], _ = cfg.getQueueSetting(MessageCodec, params["queue"])
+				queueReturn["MaxPutRate"], _ = cfg.GetMaxPutRate(params["queue"])
+				queueReturn["MaxGetRate"], _ = cfg.GetMaxGetRate(params["queue"])
+				queueReturn["MaxDepth"], _ = cfg.GetMaxDepth(params["queue"])
+				queueReturn["IdempotencyTTL"], _ = cfg.GetIdempotencyTTL(params["queue"])
+				queueReturn["MessageTTL"], _ = cfg.GetMessageTTL(params["queue"])
+				queueReturn["BodyChecksum"], _ = cfg.getQueueSetting(BodyChecksum, params["queue"])
+				queueReturn["Tenant"], _ = cfg.GetTenant(params["queue"])
+				queueReturn["ConflictPolicy"], _ = cfg.GetConflictPolicy(params["queue"])
+				queueReturn["Fifo"], _ = cfg.GetFifo(params["queue"])
+				queueReturn["DeleteRetention"], _ = cfg.GetDeleteRetention(params["queue"])
 				queueReturn["partitions"] = queues.QueueMap[params["queue"]].Parts.PartitionCount()
 				r.JSON(200, queueReturn)
 			} else {
@@ -300,21 +812,88 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 			}
 		})
 
-		m.Get("/queues/:queue/message/:messageId", func(r render.Render, params martini.Params) {
-			queue := queues.QueueMap[params["queue"]]
-			if queue != nil {
-				messages := queue.RetrieveMessages(strings.Fields(params["messageId"]), cfg)
-				if (len(messages)) > 0 {
-					r.JSON(200, map[string]interface{}{"messages": messages})
-				} else {
-					r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("Messages with id: %s not found.", params["message"])})
+		m.Post("/queues/:queue/requeue", func(r render.Render, params martini.Params) {
+			queue, err := queues.GetQueue(params["queue"])
+			if err == nil {
+				var requeued int
+				requeued, err = queue.RequeueInFlight(cfg)
+				if err == nil {
+					r.JSON(200, map[string]interface{}{"Requeued": requeued})
+					return
+				}
+			}
+			r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+		})
+
+		m.Post("/queues/:queue/reset_inflight", func(r render.Render, params martini.Params) {
+			queue, err := queues.GetQueue(params["queue"])
+			if err == nil {
+				var inFlight int
+				inFlight, err = queue.ResetInflightStats(cfg)
+				if err == nil {
+					r.JSON(200, map[string]interface{}{"InFlight": inFlight})
+					return
 				}
+			}
+			r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+		})
+
+		m.Post("/queues/:queue/replay", func(r render.Render, req *http.Request, params martini.Params) {
+			queue, err := queues.GetQueue(params["queue"])
+			if err != nil {
+				r.JSON(404, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			var since time.Time
+			if value := req.URL.Query().Get("since"); value != "" {
+				since, err = time.Parse(time.RFC3339, value)
+				if err != nil {
+					r.JSON(422, map[string]interface{}{"error": err.Error()})
+					return
+				}
+			}
+			replayed, err := queue.Replay(cfg, since)
+			if err != nil {
+				r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error(), "Replayed": replayed})
+				return
+			}
+			r.JSON(200, map[string]interface{}{"Replayed": replayed})
+		})
+
+		m.Get("/queues/:queue/stats", func(r render.Render, params martini.Params) {
+			queue, present := queues.QueueMap[params["queue"]]
+			if present != true {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
+			}
+			queueStats, err := queue.Stats(cfg)
+			if err == stats.ErrSnapshotUnsupported {
+				r.JSON(501, map[string]interface{}{"error": err.Error()})
+			} else if err != nil {
+				r.JSON(500, map[string]interface{}{"error": err.Error()})
 			} else {
+				r.JSON(200, queueStats)
+			}
+		})
+
+		m.Get("/queues/:queue/message/:messageId", func(r render.Render, params martini.Params) {
+			queue, err := queues.GetQueue(params["queue"])
+			if err != nil {
 				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
+			}
+			message, err := queue.GetByID(cfg, params["messageId"])
+			if err == nil {
+				r.JSON(200, map[string]interface{}{"messages": []interface{}{formatMessage(*message)}})
+			} else if err == ErrMessageNotFound {
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("Messages with id: %s not found.", params["messageId"])})
+			} else {
+				logrus.Error(err)
+				r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
 			}
 		})
 
-		m.Get("/queues/:queue/messages/:batchSize", func(r render.Render, params martini.Params) {
+		m.Get("/queues/:queue/messages/:batchSize", func(r render.Render, params martini.Params, req *http.Request) {
 			//check if we've initialized this queue yet
 			var present bool
 			_, present = queues.QueueMap[params["queue"]]
@@ -324,11 +903,34 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 					//log the error for unparsable input
 					logrus.Error(err)
 					r.JSON(422, err.Error())
+					return
 				}
-				if batchSize <= 0 {
-					r.JSON(422, fmt.Sprint("Batchsizes must be non-negative integers greater than 0"))
+				waitTime := time.Duration(0)
+				if wait := req.URL.Query().Get("wait_time"); wait != "" {
+					seconds, err := strconv.ParseFloat(wait, 64)
+					if err != nil {
+						r.JSON(422, err.Error())
+						return
+					}
+					waitTime = time.Duration(seconds * float64(time.Second))
+				}
+				receiveMessages := queues.QueueMap[params["queue"]].Receive
+				if req.URL.Query().Get("by_priority") == "true" {
+					receiveMessages = queues.QueueMap[params["queue"]].ReceiveByPriority
+				}
+				messages, err := receiveMessages(cfg, list, batchSize, waitTime)
+				if err == ErrInvalidBatchSize || err == ErrInvalidWaitTime {
+					r.JSON(422, err.Error())
+					return
+				}
+				if err == ErrThrottled {
+					r.JSON(429, err.Error())
+					return
+				}
+				if err == ErrQueueEmpty {
+					// emptyqueueerror is for callers of Get, an empty queue still answers with an empty list
+					err = nil
 				}
-				messages, err := queues.QueueMap[params["queue"]].Get(cfg, list, batchSize)
 
 				if err != nil && err.Error() != NoPartitions {
 					// We're choosing to ignore nopartitions issues for now and treat them as normal 200s
@@ -339,11 +941,8 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 				//TODO move this into the Queue.Get code
 				messageList := make([]map[string]interface{}, 0, 10)
 				//Format response
-				for _, object := range messages {
-					message := make(map[string]interface{})
-					message["id"] = object.Key
-					message["body"] = string(object.Data[:])
-					messageList = append(messageList, message)
+				for _, message := range messages {
+					messageList = append(messageList, formatMessage(message))
 				}
 				if err != nil && err.Error() != NoPartitions {
 					logrus.Error(err)
@@ -357,30 +956,121 @@ func (h HTTPApiV1) InitWebserver(list *memberlist.Memberlist, cfg *Config) {
 			}
 		})
 
-		m.Put("/queues/:queue/message", func(params martini.Params, req *http.Request) string {
-			var present bool
-			_, present = queues.QueueMap[params["queue"]]
-			if present == true {
-				// parse the request body into a sting
-				// TODO clean this up, full json api?
-				var buf bytes.Buffer
-				buf.ReadFrom(req.Body)
-				uuid := queues.QueueMap[params["queue"]].Put(cfg, buf.String())
+		m.Get("/queues/:queue/stream/:batchSize", func(res http.ResponseWriter, req *http.Request, params martini.Params) {
+			queue, present := queues.QueueMap[params["queue"]]
+			if present != true {
+				http.Error(res, fmt.Sprintf("There is no queue named %s", params["queue"]), 404)
+				return
+			}
+			batchSize, err := strconv.ParseInt(params["batchSize"], 10, 64)
+			if err == nil {
+				_, err = queue.ClampBatchSize(cfg, batchSize)
+			}
+			if err != nil {
+				http.Error(res, err.Error(), 422)
+				return
+			}
+			streamMessages(res, req, func() ([]Message, error) {
+				return queue.Get(cfg, list, batchSize)
+			})
+		})
 
-				return uuid
+		m.Put("/queues/:queue/message", func(params martini.Params, req *http.Request) (int, string) {
+			queue, err := queues.GetQueue(params["queue"])
+			if err != nil {
+				return errorStatus(err), err.Error()
+			}
+			// parse the request body into a sting
+			// TODO clean this up, full json api?
+			var buf bytes.Buffer
+			buf.ReadFrom(req.Body)
+			exact := req.URL.Query().Get("exact_depth") == "true"
+			opts := putOptions{groupID: req.URL.Query().Get("group_id"), idempotencyKey: req.URL.Query().Get("idempotency_key")}
+			if priority := req.URL.Query().Get("priority"); priority != "" {
+				opts.priority, err = strconv.Atoi(priority)
+				if err != nil {
+					return 422, ErrInvalidPriority.Error()
+				}
 			}
-			// V2 TODO - proper response code
-			return ""
+			// Continue the producer's trace, if it sent one
+			opts.ctx = cfg.tracer().Extract(req.Context(), map[string]string{tracing.TraceParentKey: req.Header.Get(tracing.TraceParentKey)})
+			uuid, err := queue.putIfNotFull(cfg, buf.String(), opts, exact)
+			if err != nil {
+				return errorStatus(err), err.Error()
+			}
+			return 200, uuid
 		})
 
 		m.Delete("/queues/:queue/message/:messageId", func(r render.Render, params martini.Params) {
-			var present bool
-			_, present = queues.QueueMap[params["queue"]]
+			queue, err := queues.GetQueue(params["queue"])
+			if err == nil {
+				err = queue.Delete(cfg, params["messageId"])
+			}
+			if err != nil {
+				r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+				return
+			}
+			r.JSON(200, true)
+		})
+
+		m.Delete("/queues/:queue/receipts/:receipt", func(r render.Render, params martini.Params, w http.ResponseWriter, req *http.Request) {
+			queue, present := queues.QueueMap[params["queue"]]
 			if present != true {
-				cfg.InitializeQueue(params["queue"])
+				r.JSON(404, map[string]interface{}{"error": fmt.Sprintf("There is no queue named %s", params["queue"])})
+				return
+			}
+			issuer, err := receiptIssuer(list.Members(), list.LocalNode().Name, cfg.Core.HTTPPort, params["receipt"])
+			if issuer != "" {
+				forwardReceipt(w, req, issuer)
+				return
+			}
+			if err == nil {
+				err = queue.DeleteByReceipt(cfg, params["receipt"])
+			}
+			if err == ErrInvalidReceipt || err == ErrReceiptExpired || err == ErrReceiptSuperseded {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+			} else if err != nil {
+				logrus.Error(err)
+				r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+			} else {
+				r.JSON(200, map[string]interface{}{"Deleted": true})
 			}
+		})
 
-			r.JSON(200, queues.QueueMap[params["queue"]].Delete(cfg, params["messageId"]))
+		m.Post("/queues/:queue/receipts/:receipt/nack", func(r render.Render, params martini.Params, w http.ResponseWriter, req *http.Request) {
+			queue, err := queues.GetQueue(params["queue"])
+			if err != nil {
+				r.JSON(404, map[string]interface{}{"error": err.Error()})
+				return
+			}
+			issuer, err := receiptIssuer(list.Members(), list.LocalNode().Name, cfg.Core.HTTPPort, params["receipt"])
+			if issuer != "" {
+				forwardReceipt(w, req, issuer)
+				return
+			}
+			if err == ErrReceiptSuperseded {
+				// The node it was received through has left, and its claims went with it
+				r.JSON(200, map[string]interface{}{"Requeued": false})
+				return
+			}
+			delay := time.Duration(0)
+			if seconds := req.URL.Query().Get("delay"); seconds != "" {
+				parsed, err := strconv.ParseFloat(seconds, 64)
+				if err != nil {
+					r.JSON(422, map[string]interface{}{"error": err.Error()})
+					return
+				}
+				delay = time.Duration(parsed * float64(time.Second))
+			}
+			requeued, err := queue.Nack(cfg, list, params["receipt"], delay)
+			if err == ErrInvalidReceipt || err == ErrInvalidRequeueDelay {
+				r.JSON(422, map[string]interface{}{"error": err.Error()})
+			} else if err != nil {
+				logrus.Error(err)
+				r.JSON(errorStatus(err), map[string]interface{}{"error": err.Error()})
+			} else {
+				r.JSON(200, map[string]interface{}{"Requeued": requeued})
+			}
 		})
 
 		m.Delete("/queues/:queue/messages/:messageIds", func(r render.Render, params martini.Params) {
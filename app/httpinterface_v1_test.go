@@ -0,0 +1,83 @@
+package app_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTPApiV1", func() {
+
+	Context("topic routes", func() {
+		var store *app.MemoryTopicStore
+		var handler http.Handler
+
+		request := func(method string, path string) (int, map[string]interface{}) {
+			recorder := httptest.NewRecorder()
+			req, err := http.NewRequest(method, path, nil)
+			Expect(err).ToNot(HaveOccurred())
+			handler.ServeHTTP(recorder, req)
+			body := make(map[string]interface{})
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &body)).To(Succeed())
+			return recorder.Code, body
+		}
+
+		BeforeEach(func() {
+			store = &app.MemoryTopicStore{Topics: make(map[string][]string), Queues: map[string]bool{"first": true, "second": true}}
+			handler = app.TopicRoutesWith(cfg, store)
+		})
+
+		It("should create, subscribe, list, unsubscribe and delete a topic", func() {
+			code, body := request("POST", "/topics/orders")
+			Expect(code).To(Equal(201))
+			Expect(body["Queues"]).To(BeEmpty())
+
+			code, _ = request("PUT", "/topics/orders/queues/first")
+			Expect(code).To(Equal(200))
+			code, body = request("PUT", "/topics/orders/queues/second")
+			Expect(code).To(Equal(200))
+			Expect(body["Queues"]).To(ConsistOf("first", "second"))
+
+			code, body = request("GET", "/topics/orders/queues")
+			Expect(code).To(Equal(200))
+			Expect(body["Queues"]).To(ConsistOf("first", "second"))
+
+			code, body = request("DELETE", "/topics/orders/queues/first")
+			Expect(code).To(Equal(200))
+			Expect(body["Queues"]).To(ConsistOf("second"))
+
+			code, body = request("DELETE", "/topics/orders")
+			Expect(code).To(Equal(200))
+			Expect(body["Deleted"]).To(BeTrue())
+			Expect(store.Topics).To(BeEmpty())
+		})
+
+		It("should reject creating a topic which already exists", func() {
+			store.Topics["orders"] = []string{}
+			code, body := request("POST", "/topics/orders")
+			Expect(code).To(Equal(422))
+			Expect(body["error"]).To(Equal(app.ErrTopicExists.Error()))
+		})
+
+		It("should reject subscribing a queue which doesn't exist", func() {
+			store.Topics["orders"] = []string{}
+			code, _ := request("PUT", "/topics/orders/queues/missing")
+			Expect(code).To(Equal(422))
+			Expect(store.Topics["orders"]).To(BeEmpty())
+		})
+
+		It("should answer 404 for a topic which doesn't exist", func() {
+			for _, route := range [][]string{{"GET", "/topics/missing/queues"}, {"DELETE", "/topics/missing/queues/first"}, {"DELETE", "/topics/missing"}} {
+				code, body := request(route[0], route[1])
+				Expect(code).To(Equal(404))
+				Expect(body["error"]).To(Equal(app.ErrTopicNotFound.Error()))
+			}
+			// Unsubscribing from a missing topic doesn't create it
+			Expect(store.Topics).To(BeEmpty())
+		})
+	})
+})
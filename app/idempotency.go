@@ -0,0 +1,113 @@
+package app
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/tpjg/goriakpbc"
+)
+
+// ErrInvalidIdempotencyTTL represents the condition that occurs if a queue is configured with a negative idempotency_ttl
+var ErrInvalidIdempotencyTTL = errors.New("idempotency_ttl must be 0 or greater")
+
+// IdempotencyIndex is the 2i holding the idempotency key, and put time, of a put
+const IdempotencyIndex = "idempotency_bin"
+
+// idempotencyBucketName returns the name of the bucket a queue's idempotency keys are kept in
+func idempotencyBucketName(queueName string) string {
+	return queueName + "/idempotency"
+}
+
+// idempotencyTerm returns the IdempotencyIndex term for a message put with key at putAt
+func idempotencyTerm(key string, putAt time.Time) string {
+	return fmt.Sprintf("%x:%020d", sha1.Sum([]byte(key)), putAt.UnixNano())
+}
+
+// idempotencyRange returns the range of IdempotencyIndex terms for messages put with key since since
+func idempotencyRange(key string, since time.Time) (string, string) {
+	hashed := sha1.Sum([]byte(key))
+	return fmt.Sprintf("%x:%020d", hashed, since.UnixNano()), fmt.Sprintf("%x:%s", hashed, strings.Repeat("9", 20))
+}
+
+// idempotentID returns the id of a message recorded with an IdempotencyIndex term in the given range
+func idempotentID(keys *riak.Bucket, min string, max string) (string, error) {
+	ids, _, err := keys.IndexQueryRangePage(IdempotencyIndex, min, max, 1, "")
+	if err != nil || len(ids) == 0 {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// rememberIdempotent records that the message with id was put with term at putAt
+func rememberIdempotent(keys *riak.Bucket, term string, id string, putAt time.Time) error {
+	record := keys.NewObject(id)
+	record.ContentType = "text/plain"
+	record.Data = []byte(term)
+	record.Indexes = map[string][]string{IdempotencyIndex: {term}, MessageCreatedIndex: {createdTerm(putAt)}}
+	return record.Store()
+}
+
+// PruneIdempotencyKeys drops the queue's idempotency keys which outlived its idempotency_ttl
+func (queue *Queue) PruneIdempotencyKeys(cfg *Config) error {
+	ttl, err := cfg.GetIdempotencyTTL(queue.Name)
+	if err != nil {
+		return err
+	}
+	keys, release, err := cfg.RiakBucket("messages", idempotencyBucketName(queue.Name))
+	if err != nil {
+		return err
+	}
+	defer release()
+	cutoff := createdTerm(time.Now().Add(-time.Duration(ttl * float64(time.Second))))
+	continuation := ""
+	for {
+		var ids []string
+		ids, continuation, err = keys.IndexQueryRangePage(MessageCreatedIndex, "0", cutoff, reconcilePageSize, continuation)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			// Every node sweeps every record, so another may have dropped it first
+			if err := keys.Delete(id); err != nil && err != riak.NotFound {
+				return err
+			}
+		}
+		if continuation == "" {
+			return nil
+		}
+	}
+}
+
+// PutIdempotent puts a Message onto the queue, unless one was put with the same key within idempotency_ttl
+func (queue *Queue) PutIdempotent(cfg *Config, message string, idempotencyKey string) (string, error) {
+	stored, err := queue.putInGroup(cfg, message, putOptions{idempotencyKey: idempotencyKey})
+	if err != nil {
+		return "", err
+	}
+	return stored.ID, nil
+}
+
+// putOnce puts a message unless lookup finds one put with key since since
+func putOnce(key string, since time.Time, now time.Time, lookup func(min string, max string) (string, error), put func() (Message, error), remember func(term string, id string) error) (Message, bool, error) {
+	id, err := lookup(idempotencyRange(key, since))
+	if err != nil {
+		// Storing without knowing would risk the duplicate the key is there to prevent
+		return Message{}, false, err
+	}
+	if id != "" {
+		return Message{ID: id}, false, nil
+	}
+	stored, err := put()
+	if err != nil {
+		return Message{}, false, err
+	}
+	if err := remember(idempotencyTerm(key, now), stored.ID); err != nil {
+		// The message is stored all the same, failing the put would only have it retried
+		logrus.Error(err)
+	}
+	return stored, true, nil
+}
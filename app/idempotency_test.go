@@ -0,0 +1,125 @@
+package app_test
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Idempotency", func() {
+
+	var (
+		// index maps the idempotency terms recorded so far to the ids of their messages
+		index map[string]string
+		// messages maps the ids of the messages stored so far to their bodies
+		messages map[string]string
+		// puts counts the messages stored, giving each its id
+		puts int
+		now  time.Time
+		ttl  = 5 * time.Minute
+	)
+
+	lookup := func(min string, max string) (string, error) {
+		for term, id := range index {
+			if term >= min && term <= max {
+				return id, nil
+			}
+		}
+		return "", nil
+	}
+	put := func() (app.Message, error) {
+		puts++
+		id := strconv.Itoa(puts)
+		messages[id] = "body"
+		return app.Message{ID: id, Body: []byte("body")}, nil
+	}
+	remember := func(term string, id string) error {
+		index[term] = id
+		return nil
+	}
+	putOnce := func(key string) (app.Message, bool, error) {
+		return app.PutOnceWith(key, now.Add(-ttl), now, lookup, put, remember)
+	}
+
+	BeforeEach(func() {
+		index = make(map[string]string)
+		messages = make(map[string]string)
+		puts = 0
+		now = time.Now()
+	})
+
+	It("should store a message once however often it is put with the same key", func() {
+		first, stored, err := putOnce("order-42")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stored).To(BeTrue())
+
+		now = now.Add(time.Minute)
+		second, stored, err := putOnce("order-42")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stored).To(BeFalse())
+		Expect(second.ID).To(Equal(first.ID))
+		Expect(index).To(HaveLen(1))
+	})
+
+	It("should remember the key once the message put with it was deleted", func() {
+		first, _, _ := putOnce("order-42")
+		delete(messages, first.ID)
+
+		now = now.Add(time.Minute)
+		second, stored, err := putOnce("order-42")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stored).To(BeFalse())
+		Expect(second.ID).To(Equal(first.ID))
+		Expect(messages).To(BeEmpty())
+	})
+
+	It("should store the message again once the key has expired", func() {
+		first, _, _ := putOnce("order-42")
+		now = now.Add(ttl + time.Second)
+		second, stored, err := putOnce("order-42")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stored).To(BeTrue())
+		Expect(second.ID).ToNot(Equal(first.ID))
+	})
+
+	It("should keep keys which prefix each other apart", func() {
+		putOnce("order-4")
+		_, stored, _ := putOnce("order-42")
+		Expect(stored).To(BeTrue())
+		_, stored, _ = putOnce("order-4:2")
+		Expect(stored).To(BeTrue())
+		Expect(index).To(HaveLen(3))
+	})
+
+	It("should not store when it can't tell whether the key was already put", func() {
+		_, stored, err := app.PutOnceWith("order-42", now.Add(-ttl), now, func(string, string) (string, error) {
+			return "", app.ErrRiakUnavailable
+		}, put, remember)
+		Expect(err).To(Equal(app.ErrRiakUnavailable))
+		Expect(stored).To(BeFalse())
+		Expect(index).To(BeEmpty())
+	})
+
+	It("should fail the put when the store does", func() {
+		riakError := errors.New("riak is down")
+		_, stored, err := app.PutOnceWith("order-42", now.Add(-ttl), now, lookup, func() (app.Message, error) {
+			return app.Message{}, riakError
+		}, remember)
+		Expect(err).To(Equal(riakError))
+		Expect(stored).To(BeFalse())
+		Expect(index).To(BeEmpty())
+	})
+
+	It("should keep the message stored when its key can't be recorded", func() {
+		stored, isNew, err := app.PutOnceWith("order-42", now.Add(-ttl), now, lookup, put, func(string, string) error {
+			return errors.New("riak is down")
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(isNew).To(BeTrue())
+		Expect(messages).To(HaveKey(stored.ID))
+	})
+})
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/stats"
+)
+
+// QueueInFlightStatsSuffix is the gauge of messages this node has in flight
+const QueueInFlightStatsSuffix = "inflight.count"
+
+// ResetInflightStats recounts the messages this node has in flight and resets the gauges to match
+func (queue *Queue) ResetInflightStats(cfg *Config) (int, error) {
+	visTimeout, err := cfg.GetVisibilityTimeout(queue.Name)
+	if err != nil {
+		return 0, err
+	}
+	inFlight, cleared := queue.Parts.resetInFlight(visTimeout, time.Now())
+	logrus.Infof("Queue %s has %d messages in flight, cleared %d orphaned leases", queue.Name, inFlight, cleared)
+
+	queue.autoscaler.Lock()
+	depth := queue.autoscaler.depth
+	queue.autoscaler.Unlock()
+	available := depth - int64(inFlight)
+	if available < 0 {
+		available = 0
+	}
+	c := queue.statsClient(cfg)
+	var errs stats.Errors
+	errs.Add(c.SetGauge(fmt.Sprintf("%s.%s", queue.Name, QueueInFlightStatsSuffix), int64(inFlight)))
+	errs.Add(c.SetGauge(fmt.Sprintf("%s.%s", queue.Name, QueueDepthAvailableStatsSuffix), available))
+	return inFlight, errs.Err()
+}
+
+// resetInFlight drops the claims which are visible again, and returns how many are left and how many leases it cleared
+func (part *Partitions) resetInFlight(visibilityTimeout float64, now time.Time) (int, int) {
+	part.Lock()
+	defer part.Unlock()
+	cleared := 0
+	for id, until := range part.claims {
+		if !until.After(now) {
+			delete(part.claims, id)
+			cleared++
+		}
+	}
+	inFlight := len(part.claims)
+	lockedFor := time.Duration(visibilityTimeout * float64(time.Second))
+	checked := make([]*Partition, 0, part.partitionCount)
+	for part.partitions.Size() > 0 {
+		poppedPartition, _ := part.partitions.Pop()
+		partition := poppedPartition.(*Partition)
+		locked := now.Sub(partition.LastUsed) <= lockedFor
+		if !locked && partition.InFlight > 0 {
+			partition.InFlight = 0
+			cleared++
+		} else if locked && inFlight == 0 {
+			// The same backdating UnlockAll gives it
+			partition.LastUsed = now.Add(-lockedFor)
+			partition.InFlight = 0
+			cleared++
+		}
+		checked = append(checked, partition)
+	}
+	for _, partition := range checked {
+		part.partitions.Push(partition, partition.LastUsed.UnixNano())
+	}
+	return inFlight, cleared
+}
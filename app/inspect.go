@@ -0,0 +1,93 @@
+package app
+
+import (
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// PartitionInfo describes one partition of a queue on this node, for debugging skew
+type PartitionInfo struct {
+	ID int `json:"id"`
+	// Bottom and Top are the range of ids the partition serves
+	Bottom int `json:"bottom"`
+	Top    int `json:"top"`
+	// Count is how many messages were stored within the range when it was counted
+	Count int64 `json:"count"`
+	// Owner is the node serving the partition
+	Owner string `json:"owner"`
+	// Leased is whether the partition is locked, either by a receive in progress or because the
+	// messages it served are still within the visibility timeout
+	Leased bool `json:"leased"`
+	// LeasedUntil is when a leased partition is served again, or zero if a receive has it checked out
+	LeasedUntil time.Time `json:"leased_until"`
+	// InFlight is the number of messages served from the partition when it was last used
+	InFlight int `json:"in_flight"`
+}
+
+// Inspect returns a breakdown of the queue's partitions on this node
+func (queue *Queue) Inspect(cfg *Config, list *memberlist.Memberlist) ([]PartitionInfo, error) {
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return queue.inspect(cfg, list, func(bottom int, top int) (int64, error) {
+		return countMessages(func(continuation string) ([]string, string, error) {
+			return cfg.queryIDs(bucket, int64(bottom), int64(top), reconcilePageSize, continuation)
+		}, 0)
+	})
+}
+
+func (queue *Queue) inspect(cfg *Config, list *memberlist.Memberlist, count func(bottom int, top int) (int64, error)) ([]PartitionInfo, error) {
+	nodeBottom, nodeTop := GetNodePartitionRange(cfg, list)
+	held, total := queue.Parts.held()
+	visTimeout, _ := cfg.GetVisibilityTimeout(queue.Name)
+	infos := make([]PartitionInfo, 0, total)
+	for id := 0; id < total; id++ {
+		bottom, top := partitionRange(nodeBottom, nodeTop, id, total)
+		info := PartitionInfo{ID: id, Bottom: bottom, Top: top, Owner: list.LocalNode().Name, Leased: true}
+		if partition, ok := held[id]; ok {
+			info.InFlight = partition.InFlight
+			leasedUntil := partition.LastUsed.Add(time.Duration(visTimeout * float64(time.Second)))
+			info.Leased = time.Now().Before(leasedUntil)
+			if info.Leased {
+				info.LeasedUntil = leasedUntil
+			}
+		}
+		var err error
+		info.Count, err = count(partitionIDRange(nodeBottom, nodeTop, id, total))
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// partitionIDRange returns the ids from bottom to top the partition holds alone
+func partitionIDRange(nodeBottom int, nodeTop int, id int, total int) (int, int) {
+	bottom, top := partitionRange(nodeBottom, nodeTop, id, total)
+	if id < total-1 {
+		top--
+	}
+	return bottom, top
+}
+
+// held returns a copy of each partition which isn't checked out, and how many there are
+func (part *Partitions) held() (map[int]Partition, int) {
+	part.Lock()
+	defer part.Unlock()
+	held := make(map[int]Partition, part.partitionCount)
+	checked := make([]*Partition, 0, part.partitionCount)
+	for part.partitions.Size() > 0 {
+		poppedPartition, _ := part.partitions.Pop()
+		partition := poppedPartition.(*Partition)
+		held[partition.ID] = *partition
+		checked = append(checked, partition)
+	}
+	for _, partition := range checked {
+		part.partitions.Push(partition, partition.LastUsed.UnixNano())
+	}
+	return held, part.partitionCount
+}
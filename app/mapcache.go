@@ -0,0 +1,110 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tpjg/goriakpbc"
+)
+
+// DefaultConfigCacheTTL is how long a map read from the config bucket is reused for
+const DefaultConfigCacheTTL = time.Second
+
+// ConfigMapCache holds maps recently read from the config bucket
+type ConfigMapCache struct {
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]cachedMap
+	// stored is called after each map is stored or deleted through the cache
+	stored func()
+	sync.Mutex
+}
+
+type cachedMap struct {
+	config    *riak.RDtMap
+	fetchedAt time.Time
+}
+
+// NewConfigMapCache returns an empty ConfigMapCache. A non-positive ttl falls back to the default
+func NewConfigMapCache(ttl time.Duration) *ConfigMapCache {
+	return newConfigMapCache(ttl, time.Now)
+}
+
+func newConfigMapCache(ttl time.Duration, now func() time.Time) *ConfigMapCache {
+	if ttl <= 0 {
+		ttl = DefaultConfigCacheTTL
+	}
+	return &ConfigMapCache{ttl: ttl, now: now, entries: make(map[string]cachedMap)}
+}
+
+// Fetch returns the map with the given name, calling fetch only if it wasn't read within the ttl
+func (c *ConfigMapCache) Fetch(name string, fetch func() (*riak.RDtMap, error)) (*riak.RDtMap, error) {
+	if c == nil {
+		return fetch()
+	}
+	c.Lock()
+	entry, ok := c.entries[name]
+	c.Unlock()
+	if ok && c.now().Sub(entry.fetchedAt) < c.ttl {
+		return entry.config, nil
+	}
+	config, err := fetch()
+	if err == nil {
+		c.Lock()
+		c.entries[name] = cachedMap{config: config, fetchedAt: c.now()}
+		c.Unlock()
+	}
+	return config, err
+}
+
+// Invalidate drops the map with the given name, so the next Fetch reads it from Riak
+func (c *ConfigMapCache) Invalidate(name string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	delete(c.entries, name)
+	c.Unlock()
+}
+
+// OnStore calls stored after each map is stored or deleted through the cache
+func (c *ConfigMapCache) OnStore(stored func()) {
+	c.Lock()
+	defer c.Unlock()
+	c.stored = stored
+}
+
+// changed drops the map with the given name, and calls the OnStore callback if the change was made
+func (c *ConfigMapCache) changed(name string, err error) {
+	if c == nil {
+		return
+	}
+	c.Invalidate(name)
+	c.Lock()
+	stored := c.stored
+	c.Unlock()
+	if err == nil && stored != nil {
+		stored()
+	}
+}
+
+// fetchConfigMap reads a shared map from the config bucket through the cache
+func (c *ConfigMapCache) fetchConfigMap(bucket *riak.Bucket, name string) (*riak.RDtMap, error) {
+	return c.Fetch(name, func() (*riak.RDtMap, error) {
+		return bucket.FetchMap(name)
+	})
+}
+
+// storeConfigMap stores a map in the config bucket, and drops any cached copy of it
+func (c *ConfigMapCache) storeConfigMap(name string, config *riak.RDtMap) error {
+	err := config.Store()
+	c.changed(name, err)
+	return err
+}
+
+// destroyConfigMap deletes a map from the config bucket, and drops any cached copy of it
+func (c *ConfigMapCache) destroyConfigMap(name string, config *riak.RDtMap) error {
+	err := config.Destroy()
+	c.changed(name, err)
+	return err
+}
@@ -0,0 +1,74 @@
+package app_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
+)
+
+var _ = Describe("ConfigMapCache", func() {
+	var now time.Time
+	var cache *app.ConfigMapCache
+	var fetches int
+	var fetchErr error
+
+	fetch := func() (*riak.RDtMap, error) {
+		fetches++
+		return &riak.RDtMap{}, fetchErr
+	}
+
+	BeforeEach(func() {
+		now = time.Now()
+		cache = app.NewConfigMapCacheWith(time.Second, func() time.Time { return now })
+		fetches = 0
+		fetchErr = nil
+	})
+
+	It("should serve repeated fetches within the ttl from the cache", func() {
+		first, _ := cache.Fetch("queue_test_config", fetch)
+		now = now.Add(500 * time.Millisecond)
+		second, _ := cache.Fetch("queue_test_config", fetch)
+		Expect(fetches).To(Equal(1))
+		Expect(second).To(BeIdenticalTo(first))
+	})
+
+	It("should read from Riak again once the ttl passed", func() {
+		cache.Fetch("queue_test_config", fetch)
+		now = now.Add(time.Second)
+		cache.Fetch("queue_test_config", fetch)
+		Expect(fetches).To(Equal(2))
+	})
+
+	It("should keep maps apart by name", func() {
+		cache.Fetch("queue_one_config", fetch)
+		cache.Fetch("queue_two_config", fetch)
+		Expect(fetches).To(Equal(2))
+	})
+
+	It("should read from Riak again once invalidated", func() {
+		cache.Fetch("queue_test_config", fetch)
+		cache.Invalidate("queue_test_config")
+		cache.Fetch("queue_test_config", fetch)
+		Expect(fetches).To(Equal(2))
+	})
+
+	It("should not cache failed reads", func() {
+		fetchErr = errors.New("riak is down")
+		cache.Fetch("queue_test_config", fetch)
+		fetchErr = nil
+		_, err := cache.Fetch("queue_test_config", fetch)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fetches).To(Equal(2))
+	})
+
+	It("should always read from Riak when nil", func() {
+		var nilCache *app.ConfigMapCache
+		nilCache.Fetch("queue_test_config", fetch)
+		nilCache.Fetch("queue_test_config", fetch)
+		Expect(fetches).To(Equal(2))
+	})
+})
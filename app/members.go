@@ -1,25 +1,97 @@
 package app
 
 import (
+	"fmt"
+	"net"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/hashicorp/memberlist"
 )
 
-// InitMemberList created a memberlist, and joins it to the network
+// ClusterProfileLAN tunes the memberlist for nodes on the same local network. This is the default
+const ClusterProfileLAN = "lan"
+
+// ClusterProfileWAN tunes the memberlist for nodes spread across datacenters
+const ClusterProfileWAN = "wan"
+
+// ClusterProfileLocal tunes the memberlist for nodes all running on the same host
+const ClusterProfileLocal = "local"
+
+// MemberListConfig returns the base memberlist configuration for the given cluster profile
+func MemberListConfig(profile string) (*memberlist.Config, error) {
+	switch profile {
+	case "", ClusterProfileLAN:
+		return memberlist.DefaultLANConfig(), nil
+	case ClusterProfileWAN:
+		return memberlist.DefaultWANConfig(), nil
+	case ClusterProfileLocal:
+		return memberlist.DefaultLocalConfig(), nil
+	}
+	return nil, fmt.Errorf("Unknown cluster profile %s", profile)
+}
+
+// memberEventBuffer is how many leave events can wait for the handler before new ones are dropped
+const memberEventBuffer = 64
+
+// MemberEvents is a memberlist.EventDelegate handing nodes leaving the cluster off to a handler
+type MemberEvents struct {
+	leaves chan string
+}
+
+// NewMemberEvents returns a MemberEvents which calls onLeave with the name of each node that leaves
+func NewMemberEvents(onLeave func(nodeName string)) *MemberEvents {
+	events := &MemberEvents{leaves: make(chan string, memberEventBuffer)}
+	go func() {
+		for nodeName := range events.leaves {
+			onLeave(nodeName)
+		}
+	}()
+	return events
+}
+
+// NotifyJoin does nothing, new nodes pick up their share of the keyspace on their own
+func (events *MemberEvents) NotifyJoin(node *memberlist.Node) {}
+
+// NotifyLeave queues the node for the leave handler, without blocking
+func (events *MemberEvents) NotifyLeave(node *memberlist.Node) {
+	select {
+	case events.leaves <- node.Name:
+	default:
+		logrus.Warnf("Too many nodes left at once, skipping the cleanup for %s", node.Name)
+	}
+}
+
+// NotifyUpdate does nothing
+func (events *MemberEvents) NotifyUpdate(node *memberlist.Node) {}
+
+// InitMemberList created a memberlist, and joins it to the network. events and versions may be nil
 // TODO clean this up, since we only really need the 1 port
-func InitMemberList(name string, port int, seedServers []string, seedPort int) (*memberlist.Memberlist, int, error) {
-	conf := memberlist.DefaultLANConfig()
+func InitMemberList(name string, port int, seedServers []string, seedPort int, profile string, events *MemberEvents, versions *ConfigVersions) (*memberlist.Memberlist, int, error) {
+	conf, err := MemberListConfig(profile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
 	conf.Name = name
 	conf.BindPort = port
+	if events != nil {
+		conf.Events = events
+	}
+	if versions != nil {
+		conf.Delegate = versions
+	}
 
 	list, err := memberlist.Create(conf)
 
 	if err != nil {
 		logrus.Fatal(err)
 	}
+	if versions != nil {
+		versions.attach(list)
+	}
 
 	myName := name + ":" + strconv.Itoa(seedPort)
 	// TODO Possibly examine # of nodes joined, if under a threshold... take action?
@@ -74,3 +146,57 @@ func prioritizeSeedServers(name string, seedServers []string) []string {
 	// instead of all of them trying the same node, or a random shuffle which could be the same node
 	return append(postSlice, preSlice...)
 }
+
+// srvLookup resolves a DNS SRV record, as net.LookupSRV does
+type srvLookup func(service string, proto string, name string) (string, []*net.SRV, error)
+
+// SeedServers returns the host:port of every seed server to join
+func (cfg *Config) SeedServers() []string {
+	return seedServers(cfg.Core, net.LookupSRV)
+}
+
+func seedServers(core Core, lookup srvLookup) []string {
+	if core.SeedSRV == "" {
+		return core.SeedServers
+	}
+	// The record is looked up by its full name, ie _memberlist._tcp.dynamiq.example.com
+	_, records, err := lookup("", "", core.SeedSRV)
+	if err != nil || len(records) == 0 {
+		logrus.Warnf("Unable to resolve seedsrv %s, falling back to seedserver: %v", core.SeedSRV, err)
+		return core.SeedServers
+	}
+	seeds := make([]string, 0, len(records))
+	for _, record := range records {
+		seeds = append(seeds, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+	}
+	return seeds
+}
+
+// ScheduleSeedRejoin joins the seeds seedsrv names every seedresolveinterval
+func ScheduleSeedRejoin(cfg *Config, list *memberlist.Memberlist) {
+	if cfg.Core.SeedSRV == "" || cfg.Core.SeedResolveInterval <= 0 {
+		return
+	}
+	myName := cfg.Core.Name + ":" + strconv.Itoa(cfg.Core.SeedPort)
+	go func() {
+		for range time.Tick(cfg.Core.SeedResolveInterval * time.Millisecond) {
+			if _, err := rejoinSeeds(cfg.Core, myName, net.LookupSRV, list.Join); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}()
+}
+
+// rejoinSeeds joins every seed server other than this node, returning how many were joined
+func rejoinSeeds(core Core, myName string, lookup srvLookup, join func(seeds []string) (int, error)) (int, error) {
+	others := make([]string, 0)
+	for _, seed := range seedServers(core, lookup) {
+		if seed != myName {
+			others = append(others, seed)
+		}
+	}
+	if len(others) == 0 {
+		return 0, nil
+	}
+	return join(others)
+}
@@ -0,0 +1,161 @@
+package app_test
+
+import (
+	"errors"
+	"net"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/hashicorp/memberlist"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Members", func() {
+
+	Context("MemberListConfig", func() {
+		It("should default to the LAN profile", func() {
+			defaultConf, err := app.MemberListConfig("")
+			Expect(err).ToNot(HaveOccurred())
+			lanConf, _ := app.MemberListConfig(app.ClusterProfileLAN)
+			Expect(defaultConf.ProbeInterval).To(Equal(lanConf.ProbeInterval))
+		})
+
+		It("should use the slower WAN timings for the WAN profile", func() {
+			lanConf, _ := app.MemberListConfig(app.ClusterProfileLAN)
+			wanConf, err := app.MemberListConfig(app.ClusterProfileWAN)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(wanConf.ProbeInterval).To(BeNumerically(">", lanConf.ProbeInterval))
+		})
+
+		It("should use the faster local timings for the local profile", func() {
+			lanConf, _ := app.MemberListConfig(app.ClusterProfileLAN)
+			localConf, err := app.MemberListConfig(app.ClusterProfileLocal)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(localConf.ProbeTimeout).To(BeNumerically("<", lanConf.ProbeTimeout))
+		})
+
+		It("should reject unknown profiles", func() {
+			_, err := app.MemberListConfig("moon")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context("MemberEvents", func() {
+		It("should hand nodes that leave to the handler", func() {
+			left := make(chan string, 1)
+			events := app.NewMemberEvents(func(nodeName string) {
+				left <- nodeName
+			})
+			events.NotifyLeave(&memberlist.Node{Name: "gone"})
+			Eventually(left).Should(Receive(Equal("gone")))
+		})
+
+		It("should not block gossip while the handler is slow", func() {
+			release := make(chan struct{})
+			events := app.NewMemberEvents(func(nodeName string) {
+				<-release
+			})
+			defer close(release)
+
+			done := make(chan struct{})
+			go func() {
+				for i := 0; i < 1000; i++ {
+					events.NotifyLeave(&memberlist.Node{Name: "gone"})
+				}
+				close(done)
+			}()
+			Eventually(done).Should(BeClosed())
+		})
+
+		It("should resync the partitions of every queue when reclaiming a node", func() {
+			parts := app.InitPartitions(cfg, testQueueName)
+			parts.Resize(cfg, testQueueName, 0)
+			reclaiming := &app.Queues{QueueMap: map[string]*app.Queue{
+				testQueueName: {Name: testQueueName, Parts: parts},
+			}}
+			reclaiming.ReclaimNode(cfg, "gone")
+			minPartitions, _ := cfg.GetMinPartitions(testQueueName)
+			Expect(parts.PartitionCount()).To(Equal(minPartitions))
+		})
+	})
+
+	Context("ConfigVersions", func() {
+		It("should sync the other nodes once when one bumps its config version", func() {
+			synced := make(chan struct{}, 10)
+			first := app.NewConfigVersions(func() {})
+			second := app.NewConfigVersions(func() { synced <- struct{}{} })
+			// The second node isn't up yet, so the first joins nothing
+			firstList, _, _ := app.InitMemberList("versions-first", 17101, []string{"127.0.0.1:17102"}, 17101, app.ClusterProfileLocal, nil, first)
+			defer firstList.Shutdown()
+			secondList, joined, err := app.InitMemberList("versions-second", 17102, []string{"127.0.0.1:17101"}, 17101, app.ClusterProfileLocal, nil, second)
+			Expect(err).ToNot(HaveOccurred())
+			defer secondList.Shutdown()
+			Expect(joined).To(Equal(1))
+
+			Consistently(synced, "200ms").ShouldNot(Receive())
+			first.Bump()
+			Eventually(synced, "5s").Should(Receive())
+			// The version is gossiped more than once, but only synced on the first time it's heard
+			Consistently(synced, "1s").ShouldNot(Receive())
+		})
+	})
+
+	Context("seed servers", func() {
+		var core app.Core
+		srv := func(service string, proto string, name string) (string, []*net.SRV, error) {
+			Expect(name).To(Equal("_memberlist._tcp.dynamiq.example.com"))
+			return "", []*net.SRV{{Target: "seed1.example.com.", Port: 7000}, {Target: "seed2.example.com.", Port: 7001}}, nil
+		}
+
+		BeforeEach(func() {
+			core = app.Core{SeedSRV: "_memberlist._tcp.dynamiq.example.com", SeedServers: []string{"static:7000"}}
+		})
+
+		It("should use the static list without a seedsrv", func() {
+			core.SeedSRV = ""
+			Expect(app.SeedServersWith(core, srv)).To(Equal([]string{"static:7000"}))
+		})
+
+		It("should resolve the seedsrv to its targets", func() {
+			Expect(app.SeedServersWith(core, srv)).To(Equal([]string{"seed1.example.com:7000", "seed2.example.com:7001"}))
+		})
+
+		It("should fall back to the static list if the seedsrv can't be resolved", func() {
+			failing := func(service string, proto string, name string) (string, []*net.SRV, error) {
+				return "", nil, errors.New("no such host")
+			}
+			Expect(app.SeedServersWith(core, failing)).To(Equal([]string{"static:7000"}))
+		})
+
+		It("should join the resolved seeds other than itself", func() {
+			var joined []string
+			count, err := app.RejoinSeedsWith(core, "seed2.example.com:7001", srv, func(seeds []string) (int, error) {
+				joined = seeds
+				return len(seeds), nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(1))
+			Expect(joined).To(Equal([]string{"seed1.example.com:7000"}))
+		})
+
+		It("should pass both resolved seeds to the join", func() {
+			var joined []string
+			app.RejoinSeedsWith(core, "elsewhere:7000", srv, func(seeds []string) (int, error) {
+				joined = seeds
+				return len(seeds), nil
+			})
+			Expect(joined).To(ConsistOf("seed1.example.com:7000", "seed2.example.com:7001"))
+		})
+
+		It("should not join when it is the only seed", func() {
+			core.SeedSRV = ""
+			joins := 0
+			count, err := app.RejoinSeedsWith(core, "static:7000", srv, func(seeds []string) (int, error) {
+				joins++
+				return 0, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(BeZero())
+			Expect(joins).To(BeZero())
+		})
+	})
+})
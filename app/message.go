@@ -0,0 +1,77 @@
+package app
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tpjg/goriakpbc"
+)
+
+// AttributeMetaPrefix prefixes the meta keys holding a received message's attributes
+const AttributeMetaPrefix = "attribute:"
+
+// TimestampMetaKey is the meta key holding when a received message was put
+const TimestampMetaKey = "timestamp"
+
+// ReceiveCountMetaKey is the meta key holding how many times a message has been received
+const ReceiveCountMetaKey = "receive_count"
+
+// Message is a message as handed out by a queue, independent of how it is stored
+type Message struct {
+	ID          string
+	Body        []byte
+	ContentType string
+	// Attributes are those the message's envelope was stored with, if it was stored in one
+	Attributes map[string]string
+	// ReceiveCount is how many times the message has been received, or 0 if that isn't known
+	ReceiveCount int
+	// Timestamp is when the message was put, if it was stored in an envelope or has just been put
+	Timestamp time.Time
+	// ContentEncoding is how the message's data is encoded in Riak, such as deflate, or identity if
+	// it isn't compressed. The Body is always decoded
+	ContentEncoding string
+	// Receipt is the handle for deleting the message, if it was received rather than looked up
+	Receipt string
+	// VisibleUntil is when the message is handed out again if it isn't deleted, if it was received
+	VisibleUntil time.Time
+}
+
+// newMessage maps a message fetched from Riak, already opened, to a Message
+func newMessage(object riak.RObject) Message {
+	message := Message{
+		ID:          object.Key,
+		Body:        object.Data,
+		ContentType: object.ContentType,
+		Attributes:  make(map[string]string),
+		Receipt:     object.Meta[ReceiptMetaKey],
+	}
+	for key, value := range object.Meta {
+		if strings.HasPrefix(key, AttributeMetaPrefix) {
+			message.Attributes[strings.TrimPrefix(key, AttributeMetaPrefix)] = value
+		}
+	}
+	// Messages stored before the encoding was recorded only have the compressed flag
+	message.ContentEncoding = object.Meta[ContentEncodingMetaKey]
+	if message.ContentEncoding == "" {
+		message.ContentEncoding = contentEncoding(object.Meta[CompressedMetaKey])
+	}
+	if count, err := strconv.Atoi(object.Meta[ReceiveCountMetaKey]); err == nil {
+		message.ReceiveCount = count
+	}
+	if timestamp, err := time.Parse(time.RFC3339Nano, object.Meta[TimestampMetaKey]); err == nil {
+		message.Timestamp = timestamp
+	}
+	if visibleUntil, err := time.Parse(time.RFC3339Nano, object.Meta[VisibleUntilMetaKey]); err == nil {
+		message.VisibleUntil = visibleUntil
+	}
+	return message
+}
+
+func newMessages(objects []riak.RObject) []Message {
+	messages := make([]Message, 0, len(objects))
+	for _, object := range objects {
+		messages = append(messages, newMessage(object))
+	}
+	return messages
+}
@@ -0,0 +1,55 @@
+package app_test
+
+import (
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/codec"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
+)
+
+var _ = Describe("Message", func() {
+
+	It("should map every field of a received message", func() {
+		json := codec.NewJSONCodec()
+		data, _ := json.Marshal(codec.Envelope{
+			Body:        []byte("body"),
+			Attributes:  map[string]string{"source": "web"},
+			Timestamp:   time.Now().Add(-time.Minute),
+			ContentType: "text/plain",
+		})
+		object := riak.RObject{Key: "12345", ContentType: json.ContentType(), Data: data, Meta: map[string]string{app.ReceiveCountMetaKey: "3"}}
+		app.OpenEnvelope(&object)
+		receivedAt := time.Now()
+		claimedUntil := receivedAt.Add(30 * time.Second)
+		part := app.InitPartitions(cfg, testQueueName)
+		part.Claim([]string{"12345"}, claimedUntil)
+		messages := []riak.RObject{object}
+		app.AttachReceipts(messages, part, "node1", receivedAt, 30)
+
+		message := app.NewMessage(messages[0])
+		Expect(message.ID).To(Equal("12345"))
+		Expect(message.Body).To(Equal([]byte("body")))
+		Expect(message.ContentType).To(Equal("text/plain"))
+		Expect(message.Attributes).To(Equal(map[string]string{"source": "web"}))
+		Expect(message.ReceiveCount).To(Equal(3))
+		Expect(message.Timestamp).To(BeTemporally("~", time.Now().Add(-time.Minute), time.Second))
+		Expect(message.Receipt).To(Equal(app.NewReceiptHandle("12345", receivedAt, claimedUntil, "node1")))
+		Expect(message.VisibleUntil).To(BeTemporally("~", receivedAt.Add(30*time.Second), time.Millisecond))
+	})
+
+	It("should leave what wasn't stored with a message empty", func() {
+		message := app.NewMessage(riak.RObject{Key: "12345", ContentType: "application/json", Data: []byte("body")})
+		Expect(message.ID).To(Equal("12345"))
+		Expect(message.Body).To(Equal([]byte("body")))
+		Expect(message.ContentType).To(Equal("application/json"))
+		Expect(message.Attributes).To(BeEmpty())
+		Expect(message.ReceiveCount).To(Equal(0))
+		Expect(message.ContentEncoding).To(Equal(app.ContentEncodingIdentity))
+		Expect(message.Timestamp.IsZero()).To(BeTrue())
+		Expect(message.Receipt).To(BeEmpty())
+		Expect(message.VisibleUntil.IsZero()).To(BeTrue())
+	})
+})
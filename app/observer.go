@@ -0,0 +1,20 @@
+package app
+
+// QueueObserver is handed the stats of every queue on each config sync
+type QueueObserver interface {
+	OnMetrics(stats QueueStats)
+}
+
+// AddObserver registers observer to be handed the stats of every queue from the next sync on
+func (queues *Queues) AddObserver(observer QueueObserver) {
+	queues.Lock()
+	defer queues.Unlock()
+	queues.observers = append(queues.observers, observer)
+}
+
+// getObservers returns the registered observers
+func (queues *Queues) getObservers() []QueueObserver {
+	queues.RLock()
+	defer queues.RUnlock()
+	return queues.observers
+}
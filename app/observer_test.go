@@ -0,0 +1,37 @@
+package app_test
+
+import (
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// recordingObserver keeps every QueueStats it is handed
+type recordingObserver struct {
+	seen []app.QueueStats
+}
+
+func (observer *recordingObserver) OnMetrics(stats app.QueueStats) {
+	observer.seen = append(observer.seen, stats)
+}
+
+var _ = Describe("QueueObserver", func() {
+	It("should be handed what the queue's receives saw on each sync", func() {
+		observed := &app.Queues{QueueMap: make(map[string]*app.Queue)}
+		observer := &recordingObserver{}
+		observed.AddObserver(observer)
+		queue := &app.Queue{Name: testQueueName, Parts: app.InitPartitions(cfg, testQueueName)}
+
+		queue.ObserveReceive(10, 4, 250)
+		queue.ObserveReceive(10, 1, 250)
+		observed.SampleAt(cfg, queue, time.Now())
+		Expect(observer.seen).To(Equal([]app.QueueStats{{Name: testQueueName, Received: 5, ApproxDepth: 250, FillRatio: 25}}))
+
+		// Each sync starts a new sample
+		observed.SampleAt(cfg, queue, time.Now())
+		Expect(observer.seen).To(HaveLen(2))
+		Expect(observer.seen[1]).To(Equal(app.QueueStats{Name: testQueueName, ApproxDepth: 250}))
+	})
+})
@@ -0,0 +1,178 @@
+package app
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// PartitionStrategyHeap serves the least recently used partition first. This is the default
+const PartitionStrategyHeap = "heap"
+
+// PartitionStrategyRandom serves a random partition out of the ones currently visible
+const PartitionStrategyRandom = "random"
+
+// PartitionStrategyRoundRobin serves the visible partitions in order of their IDs
+const PartitionStrategyRoundRobin = "roundrobin"
+
+// PartitionStrategyNodeHash orders the nodes by a hash of their names, serving the least recently used partition first
+const PartitionStrategyNodeHash = "nodehash"
+
+// PartitionStrategy decides which slice of the keyspace a node owns, and which partition is served next
+type PartitionStrategy interface {
+	// NodePosition returns the index of the local node's slice of the keyspace
+	NodePosition(localName string, nodeNames []string) int
+	// pop removes and returns the next partition to serve, or nil if none are visible. It holds
+	// the lock, so the heap isn't seen half empty while the partitions are walked
+	pop(part *Partitions, visibilityTimeout float64) *Partition
+}
+
+// NewPartitionStrategy returns the PartitionStrategy with the given name, or the heap strategy for ""
+func NewPartitionStrategy(name string) (PartitionStrategy, error) {
+	switch name {
+	case "", PartitionStrategyHeap:
+		return heapStrategy{}, nil
+	case PartitionStrategyRandom:
+		return randomStrategy{}, nil
+	case PartitionStrategyRoundRobin:
+		return roundRobinStrategy{}, nil
+	case PartitionStrategyNodeHash:
+		return nodeHashStrategy{}, nil
+	}
+	return nil, fmt.Errorf("Unknown partition strategy %s", name)
+}
+
+func (cfg *Config) partitionStrategy() PartitionStrategy {
+	// Configs built by hand, rather than through GetCoreConfig, won't have a strategy set
+	if cfg.PartitionStrategy == nil {
+		return heapStrategy{}
+	}
+	return cfg.PartitionStrategy
+}
+
+type heapStrategy struct{}
+
+func (s heapStrategy) NodePosition(localName string, nodeNames []string) int {
+	return sortedNodePosition(localName, nodeNames)
+}
+
+func (s heapStrategy) pop(part *Partitions, visibilityTimeout float64) *Partition {
+	// Held while popping, as InFlightCount and the others walk the heap by emptying it
+	part.Lock()
+	defer part.Unlock()
+	poppedPartition, _ := part.partitions.Pop()
+	if poppedPartition == nil {
+		return nil
+	}
+	partition := poppedPartition.(*Partition)
+	if time.Since(partition.LastUsed).Seconds() > visibilityTimeout {
+		partition.generation = part.generation
+		return partition
+	}
+	// The heap is ordered by LastUsed, so if this one isn't visible none of them are
+	part.partitions.Push(partition, partition.LastUsed.UnixNano())
+	return nil
+}
+
+type randomStrategy struct{}
+
+func (s randomStrategy) NodePosition(localName string, nodeNames []string) int {
+	return sortedNodePosition(localName, nodeNames)
+}
+
+func (s randomStrategy) pop(part *Partitions, visibilityTimeout float64) *Partition {
+	return part.popVisible(visibilityTimeout, func(visible []*Partition) *Partition {
+		return visible[rand.Intn(len(visible))]
+	})
+}
+
+type roundRobinStrategy struct{}
+
+func (s roundRobinStrategy) NodePosition(localName string, nodeNames []string) int {
+	return sortedNodePosition(localName, nodeNames)
+}
+
+func (s roundRobinStrategy) pop(part *Partitions, visibilityTimeout float64) *Partition {
+	return part.popVisible(visibilityTimeout, func(visible []*Partition) *Partition {
+		// Take the lowest ID after the last one we served, wrapping around to the lowest overall
+		var next, lowest *Partition
+		for _, partition := range visible {
+			if lowest == nil || partition.ID < lowest.ID {
+				lowest = partition
+			}
+			if partition.ID > part.lastServed && (next == nil || partition.ID < next.ID) {
+				next = partition
+			}
+		}
+		if next == nil {
+			next = lowest
+		}
+		part.lastServed = next.ID
+		return next
+	})
+}
+
+type nodeHashStrategy struct {
+	heapStrategy
+}
+
+func (s nodeHashStrategy) NodePosition(localName string, nodeNames []string) int {
+	sorted := make([]string, len(nodeNames))
+	copy(sorted, nodeNames)
+	sort.Slice(sorted, func(i, j int) bool {
+		left, right := hashNodeName(sorted[i]), hashNodeName(sorted[j])
+		if left == right {
+			return sorted[i] < sorted[j]
+		}
+		return left < right
+	})
+	for i, name := range sorted {
+		if name == localName {
+			return i
+		}
+	}
+	return 0
+}
+
+// popVisible pops the partition choose picks from those visible, pushing the rest back
+func (part *Partitions) popVisible(visibilityTimeout float64, choose func([]*Partition) *Partition) *Partition {
+	part.Lock()
+	defer part.Unlock()
+	all := make([]*Partition, 0, part.partitionCount)
+	visible := make([]*Partition, 0, part.partitionCount)
+	for part.partitions.Size() > 0 {
+		poppedPartition, _ := part.partitions.Pop()
+		partition := poppedPartition.(*Partition)
+		all = append(all, partition)
+		if time.Since(partition.LastUsed).Seconds() > visibilityTimeout {
+			visible = append(visible, partition)
+		}
+	}
+	var chosen *Partition
+	if len(visible) > 0 {
+		chosen = choose(visible)
+		chosen.generation = part.generation
+	}
+	for _, partition := range all {
+		if partition != chosen {
+			part.partitions.Push(partition, partition.LastUsed.UnixNano())
+		}
+	}
+	return chosen
+}
+
+func sortedNodePosition(localName string, nodeNames []string) int {
+	// sort our nodes so that we have a canonical ordering
+	sorted := make([]string, len(nodeNames))
+	copy(sorted, nodeNames)
+	sort.Strings(sorted)
+	return sort.SearchStrings(sorted, localName)
+}
+
+func hashNodeName(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return h.Sum32()
+}
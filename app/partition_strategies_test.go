@@ -0,0 +1,66 @@
+package app_test
+
+import (
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PartitionStrategy", func() {
+
+	Context("NewPartitionStrategy", func() {
+		It("should default to the heap strategy", func() {
+			strategy, err := app.NewPartitionStrategy("")
+			Expect(err).ToNot(HaveOccurred())
+			heap, _ := app.NewPartitionStrategy(app.PartitionStrategyHeap)
+			Expect(strategy).To(Equal(heap))
+		})
+
+		It("should reject unknown strategies", func() {
+			_, err := app.NewPartitionStrategy("fastest")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("nodehash", func() {
+		var strategy app.PartitionStrategy
+
+		BeforeEach(func() {
+			strategy, _ = app.NewPartitionStrategy(app.PartitionStrategyNodeHash)
+		})
+
+		It("should give two nodes disjoint positions", func() {
+			nodes := []string{"node-a", "node-b"}
+			positionA := strategy.NodePosition("node-a", nodes)
+			positionB := strategy.NodePosition("node-b", nodes)
+			Expect(positionA).ToNot(Equal(positionB))
+			Expect([]int{positionA, positionB}).To(ConsistOf(0, 1))
+		})
+
+		It("should be stable regardless of the member order", func() {
+			positionA := strategy.NodePosition("node-a", []string{"node-a", "node-b"})
+			Expect(strategy.NodePosition("node-a", []string{"node-b", "node-a"})).To(Equal(positionA))
+			Expect(strategy.NodePosition("node-a", []string{"node-a", "node-b"})).To(Equal(positionA))
+		})
+	})
+
+	Context("roundrobin", func() {
+		AfterEach(func() {
+			cfg.PartitionStrategy = nil
+		})
+
+		It("should serve the partitions in order of their IDs", func() {
+			cfg.PartitionStrategy, _ = app.NewPartitionStrategy(app.PartitionStrategyRoundRobin)
+			partitions := app.InitPartitions(cfg, testQueueName)
+			partitions.Resize(cfg, testQueueName, 3)
+
+			served := make([]int, 0, 3)
+			for i := 0; i < 3; i++ {
+				_, _, partition, err := partitions.GetPartition(cfg, testQueueName, memberList)
+				Expect(err).ToNot(HaveOccurred())
+				served = append(served, partition.ID)
+			}
+			Expect(served).To(Equal([]int{0, 1, 2}))
+		})
+	})
+})
@@ -4,7 +4,7 @@ import (
 	"errors"
 	"math"
 	"math/rand"
-	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -20,6 +20,14 @@ const NoPartitions string = "no available partitions"
 type Partitions struct {
 	partitions     *lane.PQueue
 	partitionCount int
+	// the last partition served, used by the roundrobin strategy
+	lastServed int
+	// the ids handed out by receives, keyed to when they are visible again
+	claims map[string]time.Time
+	// the number of times partitions were drained
+	generation int
+	// the generation each drained partition ID was last drained in
+	drained map[int]int
 	sync.RWMutex
 }
 
@@ -27,6 +35,10 @@ type Partitions struct {
 type Partition struct {
 	ID       int
 	LastUsed time.Time
+	// InFlight is the number of messages served from this partition when it was last used
+	InFlight int
+	// the generation of its Partitions when it was checked out
+	generation int
 }
 
 // InitPartitions creates a series of partitions based on the provided config and queue
@@ -34,6 +46,7 @@ func InitPartitions(cfg *Config, queueName string) *Partitions {
 	part := &Partitions{
 		partitions:     lane.NewPQueue(lane.MINPQ),
 		partitionCount: 0,
+		lastServed:     -1,
 	}
 	// We'll initially allocate the minimum amount
 	minPartitions, _ := cfg.GetMinPartitions(queueName)
@@ -48,15 +61,196 @@ func (part *Partitions) PartitionCount() int {
 	return part.partitionCount
 }
 
+// InFlightCount returns the number of messages served from partitions still within the visibility timeout
+func (part *Partitions) InFlightCount(visibilityTimeout float64) int {
+	part.Lock()
+	defer part.Unlock()
+	inFlight := 0
+	checked := make([]*Partition, 0, part.partitionCount)
+	for part.partitions.Size() > 0 {
+		poppedPartition, _ := part.partitions.Pop()
+		partition := poppedPartition.(*Partition)
+		if time.Since(partition.LastUsed).Seconds() <= visibilityTimeout {
+			inFlight += partition.InFlight
+		}
+		checked = append(checked, partition)
+	}
+	for _, partition := range checked {
+		part.partitions.Push(partition, partition.LastUsed.UnixNano())
+	}
+	return inFlight
+}
+
+// UnlockAll makes every locked partition visible again, returning the number of messages served from them
+func (part *Partitions) UnlockAll(visibilityTimeout float64) int {
+	part.Lock()
+	defer part.Unlock()
+	unlocked := 0
+	// The same backdating PushPartition gives a partition which served nothing
+	visibleAt := time.Now().Add(-(time.Duration(visibilityTimeout) * time.Second))
+	checked := make([]*Partition, 0, part.partitionCount)
+	for part.partitions.Size() > 0 {
+		poppedPartition, _ := part.partitions.Pop()
+		partition := poppedPartition.(*Partition)
+		if time.Since(partition.LastUsed).Seconds() <= visibilityTimeout {
+			unlocked += partition.InFlight
+			partition.LastUsed = visibleAt
+		}
+		partition.InFlight = 0
+		checked = append(checked, partition)
+	}
+	for _, partition := range checked {
+		part.partitions.Push(partition, partition.LastUsed.UnixNano())
+	}
+	part.claims = nil
+	return unlocked
+}
+
+// release makes the locked partition holding id visible again at visibleAt, returning whether there was one
+func (part *Partitions) release(nodeBottom int, nodeTop int, id int, visibilityTimeout float64, visibleAt time.Time) bool {
+	part.Lock()
+	defer part.Unlock()
+	released := false
+	checked := make([]*Partition, 0, part.partitionCount)
+	for part.partitions.Size() > 0 {
+		poppedPartition, _ := part.partitions.Pop()
+		partition := poppedPartition.(*Partition)
+		bottom, top := partitionRange(nodeBottom, nodeTop, partition.ID, part.partitionCount)
+		if !released && id >= bottom && id <= top && time.Since(partition.LastUsed).Seconds() <= visibilityTimeout {
+			// Backdate it, so it's locked until visibleAt
+			partition.LastUsed = visibleAt.Add(-time.Duration(visibilityTimeout * float64(time.Second)))
+			if !visibleAt.After(time.Now()) {
+				partition.InFlight = 0
+			}
+			part.reclaim(bottom, top, visibleAt)
+			released = true
+		}
+		checked = append(checked, partition)
+	}
+	for _, partition := range checked {
+		part.partitions.Push(partition, partition.LastUsed.UnixNano())
+	}
+	return released
+}
+
+// claim marks up to limit of the ids not already in flight as in flight until visibleAt
+func (part *Partitions) claim(ids []string, limit int, visibleAt time.Time) []string {
+	part.Lock()
+	defer part.Unlock()
+	now := time.Now()
+	if part.claims == nil {
+		part.claims = make(map[string]time.Time)
+	}
+	for id, until := range part.claims {
+		if !until.After(now) {
+			delete(part.claims, id)
+		}
+	}
+	claimed := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if len(claimed) >= limit {
+			break
+		}
+		if _, ok := part.claims[id]; ok {
+			continue
+		}
+		part.claims[id] = visibleAt
+		claimed = append(claimed, id)
+	}
+	return claimed
+}
+
+// unclaim drops the claims on ids read but not handed out, making their partition visible again once it has none
+func (part *Partitions) unclaim(nodeBottom int, nodeTop int, ids []string, visibilityTimeout float64) {
+	if len(ids) == 0 {
+		return
+	}
+	part.Lock()
+	defer part.Unlock()
+	dropped := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := part.claims[id]; !ok {
+			continue
+		}
+		delete(part.claims, id)
+		if value, err := strconv.Atoi(id); err == nil {
+			dropped = append(dropped, value)
+		}
+	}
+	now := time.Now()
+	lockedFor := time.Duration(visibilityTimeout * float64(time.Second))
+	checked := make([]*Partition, 0, part.partitionCount)
+	for part.partitions.Size() > 0 {
+		poppedPartition, _ := part.partitions.Pop()
+		partition := poppedPartition.(*Partition)
+		bottom, top := partitionRange(nodeBottom, nodeTop, partition.ID, part.partitionCount)
+		if now.Sub(partition.LastUsed) <= lockedFor {
+			held := false
+			for _, value := range dropped {
+				if value >= bottom && value <= top {
+					held = true
+					if partition.InFlight > 0 {
+						partition.InFlight--
+					}
+				}
+			}
+			if held && !part.claimedWithin(bottom, top, now) {
+				// The same backdating UnlockAll gives it
+				partition.LastUsed = now.Add(-lockedFor)
+				partition.InFlight = 0
+			}
+		}
+		checked = append(checked, partition)
+	}
+	for _, partition := range checked {
+		part.partitions.Push(partition, partition.LastUsed.UnixNano())
+	}
+}
+
+// claimedWithin returns whether any id from bottom to top is claimed past now, with the lock held
+func (part *Partitions) claimedWithin(bottom int, top int, now time.Time) bool {
+	for id, until := range part.claims {
+		value, err := strconv.Atoi(id)
+		if err == nil && value >= bottom && value <= top && until.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimedUntil returns when the claim on id is visible again, and whether there is one in flight
+func (part *Partitions) claimedUntil(id string) (time.Time, bool) {
+	part.RLock()
+	defer part.RUnlock()
+	until, ok := part.claims[id]
+	return until, ok && until.After(time.Now())
+}
+
+// reclaim makes the claimed ids from bottom to top visible again at visibleAt, with the lock held
+func (part *Partitions) reclaim(bottom int, top int, visibleAt time.Time) {
+	for id := range part.claims {
+		value, err := strconv.Atoi(id)
+		if err != nil || value < bottom || value > top {
+			continue
+		}
+		if visibleAt.After(time.Now()) {
+			part.claims[id] = visibleAt
+		} else {
+			delete(part.claims, id)
+		}
+	}
+}
+
 // GetNodePartitionRange returns the range of partitions active for this node
 func GetNodePartitionRange(cfg *Config, list *memberlist.Memberlist) (int, int) {
 	//get the node position and the node count
-	nodePosition, nodeCount := getNodePosition(list)
+	nodePosition, nodeCount := getNodePosition(cfg, list)
 
-	//calculate the range that our node is responsible for
-	step := math.MaxInt64 / nodeCount
-	nodeBottom := nodePosition * step
-	nodeTop := (nodePosition + 1) * step
+	//calculate the range of the key space that our node is responsible for
+	min, max := cfg.Core.keySpace()
+	step := int(max-min) / nodeCount
+	nodeBottom := int(min) + nodePosition*step
+	nodeTop := int(min) + (nodePosition+1)*step
 	return nodeBottom, nodeTop
 }
 
@@ -70,28 +264,67 @@ func (part *Partitions) GetPartition(cfg *Config, queueName string, list *member
 		logrus.Error(err)
 	}
 
-	// calculate my range for the given number
+	partitionBottom, partitionTop := partitionRange(nodeBottom, nodeTop, myPartition, totalPartitions)
+	return partitionBottom, partitionTop, partition, err
+}
+
+// PartitionRange is a partition popped off of a queue, along with the range of ids it covers
+type PartitionRange struct {
+	Bottom    int
+	Top       int
+	Partition *Partition
+}
+
+// GetFreePartitions pops every partition of the queue which isn't locked, falling back to GetPartition if none are
+func (part *Partitions) GetFreePartitions(cfg *Config, queueName string, list *memberlist.Memberlist) ([]PartitionRange, error) {
+	visTimeout, _ := cfg.GetVisibilityTimeout(queueName)
+	popped := make([]*Partition, 0)
+	for {
+		partition := cfg.partitionStrategy().pop(part, visTimeout)
+		if partition == nil {
+			break
+		}
+		popped = append(popped, partition)
+	}
+	if len(popped) == 0 {
+		bottom, top, partition, err := part.GetPartition(cfg, queueName, list)
+		if err != nil {
+			return nil, err
+		}
+		return []PartitionRange{{Bottom: bottom, Top: top, Partition: partition}}, nil
+	}
+
+	nodeBottom, nodeTop := GetNodePartitionRange(cfg, list)
+	part.RLock()
+	totalPartitions := part.partitionCount
+	part.RUnlock()
+	ranges := make([]PartitionRange, len(popped))
+	for i, partition := range popped {
+		bottom, top := partitionRange(nodeBottom, nodeTop, partition.ID, totalPartitions)
+		ranges[i] = PartitionRange{Bottom: bottom, Top: top, Partition: partition}
+	}
+	return ranges, nil
+}
+
+// partitionRange calculates the range of ids covered by the given partition of the node's range
+func partitionRange(nodeBottom int, nodeTop int, partitionID int, totalPartitions int) (int, int) {
 	nodeRange := nodeTop - nodeBottom
 	nodeStep := nodeRange / totalPartitions
-	partitionBottom := nodeStep*myPartition + nodeBottom
-	partitionTop := nodeStep*(myPartition+1) + nodeBottom
-	return partitionBottom, partitionTop, partition, err
+	return nodeStep*partitionID + nodeBottom, nodeStep*(partitionID+1) + nodeBottom
 }
 
 //helper method to get the node position
-func getNodePosition(list *memberlist.Memberlist) (int, int) {
+func getNodePosition(cfg *Config, list *memberlist.Memberlist) (int, int) {
 	// figure out which node we are
-	// grab and sort the node names
+	// grab the node names, the strategy decides on a canonical ordering
+	// node failure will cause more dupes
 	nodes := list.Members()
 	var nodeNames []string
 	for _, node := range nodes {
 		nodeNames = append(nodeNames, node.Name)
 	}
-	// sort our nodes so that we have a canonical ordering
-	// node failure will cause more dupes
-	sort.Strings(nodeNames)
 	// find our index position
-	nodePosition := sort.SearchStrings(nodeNames, list.LocalNode().Name)
+	nodePosition := cfg.partitionStrategy().NodePosition(list.LocalNode().Name, nodeNames)
 	nodeCount := len(nodeNames)
 	return nodePosition, nodeCount
 }
@@ -103,25 +336,18 @@ func (part *Partitions) getPartitionPosition(cfg *Config, queueName string) (int
 	myPartition := -1
 
 	var err error
-	poppedPartition, _ := part.partitions.Pop()
-	var workingPartition *Partition
-	if poppedPartition != nil {
-		workingPartition = poppedPartition.(*Partition)
-	} else {
-		// this seems a little scary
-		return myPartition, workingPartition, part.partitionCount, errors.New(NoPartitions)
-	}
 	visTimeout, _ := cfg.GetVisibilityTimeout(queueName)
-	if time.Since(workingPartition.LastUsed).Seconds() > visTimeout {
+	workingPartition := cfg.partitionStrategy().pop(part, visTimeout)
+	if workingPartition != nil {
 		myPartition = workingPartition.ID
 	} else {
-		part.partitions.Push(workingPartition, workingPartition.LastUsed.UnixNano())
 		part.Lock()
 		defer part.Unlock()
-		MinPartitions, _ := cfg.GetMinPartitions(queueName)
-		if part.partitionCount < MinPartitions {
+		maxPartitions, _ := cfg.GetMaxPartitions(queueName)
+		if part.partitionCount < maxPartitions {
 			workingPartition = new(Partition)
 			workingPartition.ID = part.partitionCount
+			workingPartition.generation = part.generation
 			myPartition = workingPartition.ID
 			part.partitionCount = part.partitionCount + 1
 		} else {
@@ -133,71 +359,103 @@ func (part *Partitions) getPartitionPosition(cfg *Config, queueName string) (int
 
 // PushPartition pushes a partition back onto the queue for the given queue
 func (part *Partitions) PushPartition(cfg *Config, queueName string, partition *Partition, lock bool) {
+	visTimeout, _ := cfg.GetVisibilityTimeout(queueName)
+	// Held across the push, so the partitions can't be drained between the check and the push
+	part.Lock()
+	defer part.Unlock()
+	// If it was drained while it was out, it no longer has a valid range, and a partition made since
+	// may have taken its ID
+	if partition.ID >= part.partitionCount || part.drained[partition.ID] > partition.generation {
+		return
+	}
 	if lock {
 		partition.LastUsed = time.Now()
 		part.partitions.Push(partition, partition.LastUsed.UnixNano())
 	} else {
-		visTimeout, _ := cfg.GetVisibilityTimeout(queueName)
 		unlockTime := int(visTimeout)
 		partition.LastUsed = time.Now().Add(-(time.Duration(unlockTime) * time.Second))
 		part.partitions.Push(partition, partition.LastUsed.UnixNano())
 	}
 }
 
+// Resize grows or shrinks the partitions to the given count
+func (part *Partitions) Resize(cfg *Config, queueName string, count int) {
+	part.Lock()
+	defer part.Unlock()
+	if count < part.partitionCount {
+		part.drainPartitions(count)
+	} else if count > part.partitionCount {
+		part.makePartitions(cfg, queueName, count-part.partitionCount)
+	}
+}
+
 func (part *Partitions) makePartitions(cfg *Config, queueName string, partitionsToMake int) {
 	var initialTime time.Time
-	MinPartitions, _ := cfg.GetMinPartitions(queueName)
 	offset := part.partitionCount
 	for partitionID := offset; partitionID < offset+partitionsToMake; partitionID++ {
-		if MinPartitions > partitionID {
-			partition := new(Partition)
-			partition.ID = partitionID
-			partition.LastUsed = initialTime
-			part.partitions.Push(partition, rand.Int63n(100000))
-			part.partitionCount = part.partitionCount + 1
+		partition := new(Partition)
+		partition.ID = partitionID
+		partition.LastUsed = initialTime
+		part.partitions.Push(partition, rand.Int63n(100000))
+		part.partitionCount = part.partitionCount + 1
+	}
+}
+
+// drainPartitions removes every partition with an ID at or above count
+func (part *Partitions) drainPartitions(count int) {
+	kept := make([]*Partition, 0, count)
+	for part.partitions.Size() > 0 {
+		poppedPartition, _ := part.partitions.Pop()
+		if partition := poppedPartition.(*Partition); partition.ID < count {
+			kept = append(kept, partition)
 		}
 	}
+	for _, partition := range kept {
+		part.partitions.Push(partition, partition.LastUsed.UnixNano())
+	}
+	// Any partitions currently checked out will be dropped by PushPartition if they no longer fit
+	part.generation++
+	if part.drained == nil {
+		part.drained = make(map[int]int)
+	}
+	for partitionID := count; partitionID < part.partitionCount; partitionID++ {
+		part.drained[partitionID] = part.generation
+	}
+	part.partitionCount = count
 }
-func (part *Partitions) syncPartitions(cfg *Config, queueName string) {
 
+func (part *Partitions) syncPartitions(cfg *Config, queueName string) {
 	part.Lock()
-	MinPartitions, _ := cfg.GetMinPartitions(queueName)
+	defer part.Unlock()
 	minPartitions, _ := cfg.GetMinPartitions(queueName)
+	maxPartitions, _ := cfg.GetMaxPartitions(queueName)
 	maxPartitionAge, _ := cfg.GetMaxPartitionAge(queueName)
 
-	var partsRemoved int
-	for partsRemoved = 0; MinPartitions < part.partitionCount; partsRemoved++ {
-		_, _ = part.partitions.Pop()
+	if part.partitionCount > maxPartitions {
+		part.drainPartitions(maxPartitions)
 	}
-	part.partitionCount = part.partitionCount - partsRemoved
 
 	if part.partitionCount < minPartitions {
 		part.makePartitions(cfg, queueName, minPartitions-part.partitionCount)
 	}
 
 	// Partition Aging logic
-	// pop a partition
-	var workingPartition *Partition
-	poppedPartition, _ := part.partitions.Pop()
-	if poppedPartition != nil {
-		workingPartition = poppedPartition.(*Partition)
-	} else {
-		// this seems a little scary. we do a similiar thing in getPartitionPosition
-		return
-	}
-	part.partitionCount = part.partitionCount - 1
-
-	// check if the partition is older than the max age ( but not a fresh partition )
-	// if true pop the next partition, continue until this condition
-	for time.Since(workingPartition.LastUsed).Seconds() > maxPartitionAge && part.partitionCount >= minPartitions {
-		poppedPartition, _ = part.partitions.Pop()
-		if poppedPartition != nil {
-			workingPartition = poppedPartition.(*Partition)
+	// count the partitions older than the max age ( but not fresh partitions, which have never been used )
+	// and drain that many, without going below the minimum
+	stalePartitions := 0
+	checked := make([]*Partition, 0, part.partitionCount)
+	for part.partitions.Size() > 0 {
+		poppedPartition, _ := part.partitions.Pop()
+		partition := poppedPartition.(*Partition)
+		if !partition.LastUsed.IsZero() && time.Since(partition.LastUsed).Seconds() > maxPartitionAge {
+			stalePartitions++
 		}
-		part.partitionCount = part.partitionCount - 1
+		checked = append(checked, partition)
+	}
+	for _, partition := range checked {
+		part.partitions.Push(partition, partition.LastUsed.UnixNano())
+	}
+	if stalePartitions > 0 && part.partitionCount > minPartitions {
+		part.drainPartitions(int(math.Max(float64(minPartitions), float64(part.partitionCount-stalePartitions))))
 	}
-	//when false push the last popped partition
-	part.partitions.Push(workingPartition, workingPartition.LastUsed.UnixNano())
-	part.partitionCount = part.partitionCount + 1
-	part.Unlock()
 }
@@ -1,9 +1,17 @@
 package app_test
 
 import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
 	"github.com/Tapjoy/dynamiq/app"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
 )
 
 var _ = Describe("Partition", func() {
@@ -13,7 +21,6 @@ var _ = Describe("Partition", func() {
 		err               error
 		partitionTopID    int
 		partitionBottomID int
-		partition         *app.Partition
 	)
 
 	BeforeEach(func() {
@@ -31,7 +38,7 @@ var _ = Describe("Partition", func() {
 	Context("GetPartition", func() {
 		BeforeEach(func() {
 			// Get the partition ids, and any errors
-			partitionBottomID, partitionTopID, partition, err = partitions.GetPartition(cfg, testQueueName, memberList)
+			partitionBottomID, partitionTopID, _, err = partitions.GetPartition(cfg, testQueueName, memberList)
 		})
 
 		It("should get a partitionTopId", func() {
@@ -46,4 +53,155 @@ var _ = Describe("Partition", func() {
 			Expect(err).ToNot(HaveOccurred())
 		})
 	})
+
+	Context("InFlightCount", func() {
+		It("should only count messages from partitions still within the visibility timeout", func() {
+			visTimeout, _ := cfg.GetVisibilityTimeout(testQueueName)
+			_, _, locked, _ := partitions.GetPartition(cfg, testQueueName, memberList)
+			locked.InFlight = 5
+			partitions.PushPartition(cfg, testQueueName, locked, true)
+			_, _, unlocked, _ := partitions.GetPartition(cfg, testQueueName, memberList)
+			unlocked.InFlight = 3
+			partitions.PushPartition(cfg, testQueueName, unlocked, false)
+
+			Expect(partitions.InFlightCount(visTimeout)).To(Equal(5))
+		})
+
+		It("should not make receives alongside it grow the partitions", func() {
+			count := partitions.PartitionCount()
+			got := make(chan *app.Partition, 1)
+			partitions.DrainedWith(func() {
+				go func() {
+					_, _, partition, _ := partitions.GetPartition(cfg, testQueueName, memberList)
+					got <- partition
+				}()
+				// The receive waits for the heap to be refilled, rather than find it empty
+				Consistently(got, 50*time.Millisecond).ShouldNot(Receive())
+			})
+			var partition *app.Partition
+			Eventually(got).Should(Receive(&partition))
+			Expect(partition).ToNot(BeNil())
+			Expect(partitions.PartitionCount()).To(Equal(count))
+		})
+	})
+
+	Context("starvation", func() {
+		It("should report no partitions available once every one is checked out, and warn if it lasts", func() {
+			queue := &app.Queue{Name: testQueueName, Parts: partitions, Config: queues.QueueMap[testQueueName].Config}
+			availableKey := testQueueName + "." + app.QueuePartitionsAvailableStatsSuffix
+			maxPartitions, _ := cfg.GetMaxPartitions(testQueueName)
+			var logged bytes.Buffer
+			logrus.SetOutput(&logged)
+			defer logrus.SetOutput(ioutil.Discard)
+
+			start := time.Now()
+			queue.CheckStarvationAt(cfg, start)
+			Expect(statsClient.Gauge(availableKey)).To(Equal(int64(maxPartitions)))
+
+			// A consumer which never pushes its partitions back
+			checkedOut := make([]*app.Partition, 0, maxPartitions)
+			for i := 0; i < maxPartitions; i++ {
+				_, _, partition, err := partitions.GetPartition(cfg, testQueueName, memberList)
+				Expect(err).ToNot(HaveOccurred())
+				checkedOut = append(checkedOut, partition)
+			}
+			_, _, _, err := partitions.GetPartition(cfg, testQueueName, memberList)
+			Expect(err).To(MatchError(app.NoPartitions))
+
+			queue.CheckStarvationAt(cfg, start)
+			Expect(statsClient.Gauge(availableKey)).To(BeZero())
+			Expect(logged.String()).To(BeEmpty())
+			queue.CheckStarvationAt(cfg, start.Add(app.DefaultPartitionStarvation))
+			Expect(logged.String()).To(ContainSubstring("Queue " + testQueueName + " has had no partitions available"))
+
+			// Handing one back ends the starvation
+			partitions.PushPartition(cfg, testQueueName, checkedOut[0], false)
+			logged.Reset()
+			queue.CheckStarvationAt(cfg, start.Add(2*app.DefaultPartitionStarvation))
+			Expect(statsClient.Gauge(availableKey)).To(Equal(int64(1)))
+			Expect(logged.String()).To(BeEmpty())
+		})
+	})
+
+	Context("Resize", func() {
+		It("should keep the full node range covered after growing and shrinking", func() {
+			partitions.Resize(cfg, testQueueName, 5)
+			Expect(partitions.PartitionCount()).To(Equal(5))
+			partitions.Resize(cfg, testQueueName, 2)
+			Expect(partitions.PartitionCount()).To(Equal(2))
+
+			// Check out every partition, and make sure their ranges line up end to end
+			// so that no message in the node range is left without a partition
+			bottoms := make([]int, 0, 2)
+			tops := make(map[int]int)
+			for i := 0; i < 2; i++ {
+				bottom, top, _, err := partitions.GetPartition(cfg, testQueueName, memberList)
+				Expect(err).ToNot(HaveOccurred())
+				bottoms = append(bottoms, bottom)
+				tops[bottom] = top
+			}
+			sort.Ints(bottoms)
+
+			nodeBottom, nodeTop := app.GetNodePartitionRange(cfg, memberList)
+			Expect(bottoms[0]).To(Equal(nodeBottom))
+			Expect(tops[bottoms[0]]).To(Equal(bottoms[1]))
+			Expect(tops[bottoms[1]]).To(BeNumerically("~", nodeTop, 2))
+		})
+
+		It("should drop a partition drained while it was out, even once its ID is in use again", func() {
+			partitions.Resize(cfg, testQueueName, 4)
+			out := make([]*app.Partition, 0, 4)
+			for i := 0; i < 4; i++ {
+				_, _, partition, err := partitions.GetPartition(cfg, testQueueName, memberList)
+				Expect(err).ToNot(HaveOccurred())
+				out = append(out, partition)
+			}
+			partitions.Resize(cfg, testQueueName, 2)
+			partitions.Resize(cfg, testQueueName, 4)
+			for _, partition := range out {
+				partitions.PushPartition(cfg, testQueueName, partition, false)
+			}
+
+			seen := make(map[int]bool)
+			for i := 0; i < 4; i++ {
+				_, _, partition, err := partitions.GetPartition(cfg, testQueueName, memberList)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(seen).ToNot(HaveKey(partition.ID))
+				seen[partition.ID] = true
+			}
+			Expect(seen).To(HaveLen(4))
+			_, _, partition, _ := partitions.GetPartition(cfg, testQueueName, memberList)
+			Expect(partition.ID).To(Equal(4))
+		})
+
+		It("should keep every message receivable after growing and then shrinking", func() {
+			queue := &app.Queue{Name: testQueueName, Config: queues.QueueMap[testQueueName].Config, Parts: partitions}
+			nodeBottom, nodeTop := app.GetNodePartitionRange(cfg, memberList)
+			bucket := &app.MemoryMessages{Objects: make(map[string]riak.RObject)}
+			for i := 0; i < 12; i++ {
+				id := strconv.Itoa(nodeBottom + (nodeTop-nodeBottom)/12*i + 1)
+				bucket.Objects[id] = riak.RObject{Key: id, Data: []byte(id)}
+			}
+
+			partitions.Resize(cfg, testQueueName, 6)
+			// One is still out when the partitions shrink
+			_, _, out, err := partitions.GetPartition(cfg, testQueueName, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			partitions.Resize(cfg, testQueueName, 2)
+			partitions.PushPartition(cfg, testQueueName, out, false)
+
+			received := make(map[string]int)
+			for i := 0; i < 10 && len(received) < len(bucket.Objects); i++ {
+				messages, err := queue.GetWith(cfg, memberList, 100, bucket)
+				Expect(err).ToNot(HaveOccurred())
+				for _, message := range messages {
+					received[message.ID]++
+				}
+			}
+			Expect(received).To(HaveLen(len(bucket.Objects)))
+			for id := range bucket.Objects {
+				Expect(received).To(HaveKeyWithValue(id, 1))
+			}
+		})
+	})
 })
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"errors"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/memberlist"
+	"github.com/tpjg/goriakpbc"
+)
+
+// ErrInvalidPartition represents the condition that occurs if a partition ID isn't held on this node
+var ErrInvalidPartition = errors.New("There is no partition with that id on this node")
+
+// PeekPartition returns up to batchsize of the messages in one of the queue's partitions, without receiving them
+func (queue *Queue) PeekPartition(cfg *Config, list *memberlist.Memberlist, partitionID int, batchsize int64) ([]Message, error) {
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+	defer release()
+	return queue.peekPartition(cfg, list, partitionID, batchsize, bucketQuery(cfg, bucket), riakMessages{bucket})
+}
+
+func (queue *Queue) peekPartition(cfg *Config, list *memberlist.Memberlist, partitionID int, batchsize int64, query func(bottom int, top int, limit uint32) ([]string, error), messages messageStore) ([]Message, error) {
+	batchsize, err := queue.ClampBatchSize(cfg, batchsize)
+	if err != nil {
+		return nil, err
+	}
+	total := queue.Parts.PartitionCount()
+	if partitionID < 0 || partitionID >= total {
+		return nil, ErrInvalidPartition
+	}
+	nodeBottom, nodeTop := GetNodePartitionRange(cfg, list)
+	bottom, top := partitionIDRange(nodeBottom, nodeTop, partitionID, total)
+	ids, err := query(bottom, top, uint32(batchsize))
+	if err != nil {
+		return nil, err
+	}
+	rObjects, _ := fetchAll(ids, func(id string) riak.RObject {
+		rObject, err := messages.get(id)
+		if err != nil || rObject == nil {
+			return riak.RObject{}
+		}
+		return *rObject
+	}, cfg.fetchTimeout())
+	byID := make(map[string]riak.RObject, len(rObjects))
+	for _, rObject := range rObjects {
+		if len(rObject.Data) == 0 || rObject.Conflict() || openMessage(cfg, &rObject) != nil {
+			continue
+		}
+		byID[rObject.Key] = rObject
+	}
+	// Fetches finish in any order, so put them back in the order of their ids
+	peeked := make([]riak.RObject, 0, len(byID))
+	for _, id := range ids {
+		if rObject, ok := byID[id]; ok {
+			peeked = append(peeked, rObject)
+		}
+	}
+	return newMessages(peeked), nil
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app/stats"
+	"github.com/tpjg/goriakpbc"
+)
+
+// RiakPoolSizeStatsKey is the gauge holding the number of backend connections in the pool
+const RiakPoolSizeStatsKey = "riak.pool.size"
+
+// RiakPoolInUseStatsKey is the gauge holding the number of backend connections currently in use
+const RiakPoolInUseStatsKey = "riak.pool.in_use"
+
+// RiakPoolWaitStatsKey is the gauge holding how long, in milliseconds, the latest acquire waited for a connection
+const RiakPoolWaitStatsKey = "riak.pool.wait_ms"
+
+// RiakPoolTimeoutsStatsKey is the counter of acquires which gave up waiting for a connection
+const RiakPoolTimeoutsStatsKey = "riak.pool.timeouts"
+
+// ErrPoolExhausted represents the condition that occurs if no Riak connection frees up within connacquiretimeout
+var ErrPoolExhausted = errors.New("Timed out waiting for a Riak connection")
+
+// PoolMeter tracks use of the Riak connection pool, holding a slot for each connection
+type PoolMeter struct {
+	slots chan struct{}
+	inUse int64
+}
+
+// NewPoolMeter returns a PoolMeter for a pool of the given size
+func NewPoolMeter(size int) *PoolMeter {
+	if size < 1 {
+		size = 1
+	}
+	return &PoolMeter{slots: make(chan struct{}, size)}
+}
+
+// Acquire takes a slot, waiting for one if need be, and returns the func releasing it
+func (p *PoolMeter) Acquire(client stats.Client) func() {
+	release, _ := p.AcquireWithin(client, 0)
+	return release
+}
+
+// AcquireWithin is Acquire, failing with ErrPoolExhausted once timeout passes
+func (p *PoolMeter) AcquireWithin(client stats.Client, timeout time.Duration) (func(), error) {
+	start := time.Now()
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case p.slots <- struct{}{}:
+		case <-timer.C:
+			client.SetGauge(RiakPoolWaitStatsKey, int64(time.Since(start)/time.Millisecond))
+			client.Incr(RiakPoolTimeoutsStatsKey, 1)
+			return func() {}, ErrPoolExhausted
+		}
+	} else {
+		p.slots <- struct{}{}
+	}
+	client.SetGauge(RiakPoolWaitStatsKey, int64(time.Since(start)/time.Millisecond))
+	p.record(client, atomic.AddInt64(&p.inUse, 1))
+
+	released := int32(0)
+	return func() {
+		// Releasing twice would free a slot someone else holds
+		if !atomic.CompareAndSwapInt32(&released, 0, 1) {
+			return
+		}
+		inUse := atomic.AddInt64(&p.inUse, -1)
+		<-p.slots
+		p.record(client, inUse)
+	}, nil
+}
+
+func (p *PoolMeter) record(client stats.Client, inUse int64) {
+	client.SetGauge(RiakPoolSizeStatsKey, int64(cap(p.slots)))
+	client.SetGauge(RiakPoolInUseStatsKey, inUse)
+}
+
+// RiakConnection returns the pool of riak connections, along with the func to call once done with it
+func (cfg *Config) RiakConnection() (*riak.Client, func(), error) {
+	if cfg.RiakPoolMeter == nil {
+		return cfg.RiakPool, func() {}, nil
+	}
+	release, err := cfg.RiakPoolMeter.AcquireWithin(cfg.StatsClient(), cfg.connAcquireTimeout())
+	if err != nil {
+		return nil, release, err
+	}
+	return cfg.RiakPool, release, nil
+}
+
+// connAcquireTimeout returns how long RiakConnection waits on an exhausted pool
+func (cfg *Config) connAcquireTimeout() time.Duration {
+	return cfg.Core.ConnAcquireTimeout * time.Millisecond
+}
@@ -0,0 +1,114 @@
+package app_test
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PoolMeter", func() {
+
+	var (
+		client   *stats.MemoryClient
+		meterCfg *app.Config
+	)
+
+	BeforeEach(func() {
+		client = stats.NewMemoryClient()
+		meterCfg = &app.Config{
+			Stats:         app.Stats{Client: client},
+			RiakPoolMeter: app.NewPoolMeter(2),
+		}
+	})
+
+	It("should report every connection in use once concurrent acquires fill the pool", func() {
+		var acquired sync.WaitGroup
+		releases := make(chan func(), 2)
+		for i := 0; i < 2; i++ {
+			acquired.Add(1)
+			go func() {
+				defer acquired.Done()
+				_, release, _ := meterCfg.RiakConnection()
+				releases <- release
+			}()
+		}
+		acquired.Wait()
+		Expect(client.Gauge(app.RiakPoolSizeStatsKey)).To(Equal(int64(2)))
+		Expect(client.Gauge(app.RiakPoolInUseStatsKey)).To(Equal(int64(2)))
+
+		// A third acquire has to wait for one of the connections to be released
+		third := make(chan func())
+		go func() {
+			_, release, _ := meterCfg.RiakConnection()
+			third <- release
+		}()
+		Consistently(third, 50*time.Millisecond).ShouldNot(Receive())
+		(<-releases)()
+		var release func()
+		Eventually(third).Should(Receive(&release))
+		Expect(client.Gauge(app.RiakPoolWaitStatsKey)).To(BeNumerically(">=", 50))
+
+		release()
+		(<-releases)()
+		Expect(client.Gauge(app.RiakPoolInUseStatsKey)).To(Equal(int64(0)))
+	})
+
+	It("should give up waiting for a connection after connacquiretimeout", func() {
+		meterCfg.RiakPoolMeter = app.NewPoolMeter(1)
+		meterCfg.Core.ConnAcquireTimeout = 20
+		_, held, err := meterCfg.RiakConnection()
+		Expect(err).ToNot(HaveOccurred())
+
+		start := time.Now()
+		_, release, err := meterCfg.RiakConnection()
+		Expect(err).To(Equal(app.ErrPoolExhausted))
+		Expect(time.Since(start)).To(BeNumerically(">=", 20*time.Millisecond))
+		Expect(client.Counter(app.RiakPoolTimeoutsStatsKey)).To(Equal(int64(1)))
+		// Releasing after a timeout frees nothing
+		release()
+		Expect(client.Gauge(app.RiakPoolInUseStatsKey)).To(Equal(int64(1)))
+
+		// Stores, deletes and queries all hold their connection throughout, so fail fast alike
+		_, _, err = meterCfg.RiakBucket("messages", testQueueName)
+		Expect(err).To(Equal(app.ErrPoolExhausted))
+		queue := &app.Queue{Name: testQueueName}
+		Expect(queue.Delete(meterCfg, "1")).To(Equal(app.ErrPoolExhausted))
+		_, err = queue.Purge(meterCfg)
+		Expect(err).To(Equal(app.ErrPoolExhausted))
+
+		held()
+		_, release, err = meterCfg.RiakConnection()
+		Expect(err).ToNot(HaveOccurred())
+		release()
+		Expect(client.Counter(app.RiakPoolTimeoutsStatsKey)).To(Equal(int64(4)))
+	})
+
+	It("should free the connection of a bucket which can't be had", func() {
+		breaker := app.NewBreaker(1, time.Minute, time.Minute)
+		breaker.Record(errors.New("connection refused"))
+		meterCfg.RiakBreaker = breaker
+		_, release, err := meterCfg.RiakBucket("messages", testQueueName)
+		Expect(err).To(Equal(app.ErrBreakerOpen))
+		Expect(client.Gauge(app.RiakPoolInUseStatsKey)).To(Equal(int64(0)))
+		release()
+		Expect(client.Gauge(app.RiakPoolInUseStatsKey)).To(Equal(int64(0)))
+	})
+
+	It("should only free a connection once, however often it is released", func() {
+		_, release, _ := meterCfg.RiakConnection()
+		release()
+		release()
+		Expect(client.Gauge(app.RiakPoolInUseStatsKey)).To(Equal(int64(0)))
+	})
+
+	It("should leave configs without a meter unmetered", func() {
+		_, release, _ := (&app.Config{Stats: app.Stats{Client: client}}).RiakConnection()
+		release()
+		Expect(client.Gauge(app.RiakPoolSizeStatsKey)).To(Equal(int64(0)))
+	})
+})
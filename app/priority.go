@@ -0,0 +1,160 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/memberlist"
+	"github.com/tpjg/goriakpbc"
+)
+
+// PriorityIndex is the 2i holding the priority, and id, of messages put with a priority above 0
+const PriorityIndex = "priority_bin"
+
+// MaxPriority is the highest priority a message can be put with
+const MaxPriority = 9
+
+// ErrInvalidPriority represents the condition that occurs if a message is put with a priority outside 0 to MaxPriority
+var ErrInvalidPriority = errors.New("Priorities must be between 0 and 9")
+
+// priorityTerm returns the PriorityIndex term for message id put with priority
+func priorityTerm(priority int, id string) string {
+	return fmt.Sprintf("%d:%s", priority, padMessageID(id, MessageIDDigits))
+}
+
+// checkPriority returns ErrInvalidPriority if priority is outside 0 to MaxPriority
+func checkPriority(priority int) error {
+	if priority < 0 || priority > MaxPriority {
+		return ErrInvalidPriority
+	}
+	return nil
+}
+
+// indexPriority adds the PriorityIndex term for the object's id, if it has a priority above 0
+func indexPriority(object *riak.RObject, priority int) {
+	if priority > 0 {
+		object.Indexes[PriorityIndex] = []string{priorityTerm(priority, object.Key)}
+	} else {
+		delete(object.Indexes, PriorityIndex)
+	}
+}
+
+// messagePriority returns the priority a message was put with, or 0 if it hasn't one
+func messagePriority(object riak.RObject) int {
+	terms := object.Indexes[PriorityIndex]
+	if len(terms) == 0 {
+		return 0
+	}
+	priority, err := strconv.Atoi(strings.SplitN(terms[0], ":", 2)[0])
+	if err != nil {
+		return 0
+	}
+	return priority
+}
+
+// PutWithPriority puts a Message onto the queue with a priority from 0 to MaxPriority
+func (queue *Queue) PutWithPriority(cfg *Config, message string, priority int) (string, error) {
+	stored, err := queue.putInGroup(cfg, message, putOptions{priority: priority})
+	if err != nil {
+		return "", err
+	}
+	return stored.ID, nil
+}
+
+// GetByPriority is Get, serving the messages of higher priorities first
+func (queue *Queue) GetByPriority(cfg *Config, list *memberlist.Memberlist, batchsize int64) ([]Message, error) {
+	ctx, span := queue.startSpan(cfg, context.Background(), "dynamiq.get_by_priority")
+	messages, err := queue.getByPriority(ctx, cfg, list, batchsize)
+	endReceiveSpan(span, batchsize, messages, err)
+	return messages, err
+}
+
+func (queue *Queue) getByPriority(ctx context.Context, cfg *Config, list *memberlist.Memberlist, batchsize int64) ([]Message, error) {
+	batchsize, ok, err := queue.receivable(cfg, batchsize)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []Message{}, nil
+	}
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+	defer release()
+	bands := func(priority int, bottom int, top int, limit uint32) ([]string, error) {
+		return pageIDs(limit, uint32(cfg.Core.IndexPageSize), func(pageLimit uint32, continuation string) ([]string, string, error) {
+			min := priorityTerm(priority, strconv.Itoa(bottom))
+			max := priorityTerm(priority, strconv.Itoa(top))
+			return bucket.IndexQueryRangePage(PriorityIndex, min, max, pageLimit, continuation)
+		})
+	}
+	receivedAt := time.Now()
+	messageIds, err := queue.reserve(cfg, list, batchsize, priorityQuery(bands, bucketQuery(cfg, bucket)))
+	// The fetches below take connections of their own
+	release()
+	if err != nil || len(messageIds) == 0 {
+		return []Message{}, err
+	}
+	messages := queue.receiveHeads(cfg, list, byPriority(queue.retrieveObjects(ctx, messageIds, cfg)), queue.groupHeads(cfg))
+	visTimeout, _ := cfg.GetVisibilityTimeout(queue.Name)
+	attachReceipts(messages, queue.Parts, list.LocalNode().Name, receivedAt, visTimeout)
+	return newMessages(messages), nil
+}
+
+// priorityQuery returns a query reading each priority band in turn, highest first, then the rest
+func priorityQuery(bands func(priority int, bottom int, top int, limit uint32) ([]string, error), rest func(bottom int, top int, limit uint32) ([]string, error)) func(bottom int, top int, limit uint32) ([]string, error) {
+	return func(bottom int, top int, limit uint32) ([]string, error) {
+		ids := make([]string, 0, limit)
+		seen := make(map[string]bool, limit)
+		add := func(found []string) {
+			for _, id := range found {
+				if !seen[id] && uint32(len(ids)) < limit {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+		for priority := MaxPriority; priority > 0 && uint32(len(ids)) < limit; priority-- {
+			found, err := bands(priority, bottom, top, limit-uint32(len(ids)))
+			add(found)
+			if err != nil {
+				return ids, err
+			}
+		}
+		if uint32(len(ids)) < limit {
+			// Those already taken may come back among them, so ask for the whole batch
+			found, err := rest(bottom, top, limit)
+			add(found)
+			if err != nil {
+				return ids, err
+			}
+		}
+		return ids, nil
+	}
+}
+
+// byPriority sorts fetched messages highest priority first
+func byPriority(objects []riak.RObject) []riak.RObject {
+	sort.SliceStable(objects, func(i, j int) bool {
+		return messagePriority(objects[i]) > messagePriority(objects[j])
+	})
+	return objects
+}
+
+// ReceiveByPriority is Receive, receiving with GetByPriority
+func (queue *Queue) ReceiveByPriority(cfg *Config, list *memberlist.Memberlist, maxMessages int64, waitTime time.Duration) ([]Message, error) {
+	if waitTime < 0 || waitTime > MaxReceiveWaitTime {
+		return nil, ErrInvalidWaitTime
+	}
+	return receive(func() ([]Message, error) {
+		return queue.GetByPriority(cfg, list, maxMessages)
+	}, waitTime, ReceivePollInterval)
+}
@@ -0,0 +1,101 @@
+package app_test
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
+)
+
+var _ = Describe("Priority", func() {
+
+	// priorities maps each stored message id to the priority it was put with
+	var priorities map[int]int
+
+	// inRange returns the stored ids from bottom to top lowest first, which match, as an index would
+	inRange := func(bottom int, top int, limit uint32, match func(priority int) bool) []string {
+		found := []int{}
+		for id, priority := range priorities {
+			if id >= bottom && id <= top && match(priority) {
+				found = append(found, id)
+			}
+		}
+		sort.Ints(found)
+		ids := []string{}
+		for _, id := range found {
+			if uint32(len(ids)) < limit {
+				ids = append(ids, strconv.Itoa(id))
+			}
+		}
+		return ids
+	}
+	bands := func(priority int, bottom int, top int, limit uint32) ([]string, error) {
+		return inRange(bottom, top, limit, func(p int) bool { return p == priority }), nil
+	}
+	rest := func(bottom int, top int, limit uint32) ([]string, error) {
+		return inRange(bottom, top, limit, func(int) bool { return true }), nil
+	}
+
+	BeforeEach(func() {
+		priorities = map[int]int{1: 0, 2: 5, 3: 0, 4: 9, 5: 5, 6: 0, 7: 9, 500: 9}
+	})
+
+	It("should only accept priorities from 0 to MaxPriority", func() {
+		queue := &app.Queue{Name: "prioritized"}
+		_, err := queue.PutWithPriority(cfg, "urgent", app.MaxPriority+1)
+		Expect(err).To(Equal(app.ErrInvalidPriority))
+		_, err = queue.PutWithPriority(cfg, "urgent", -1)
+		Expect(err).To(Equal(app.ErrInvalidPriority))
+	})
+
+	It("should read the highest band first, then the lower ones, then the rest", func() {
+		query := app.PriorityQueryWith(bands, rest)
+		ids, err := query(0, 100, 10)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{"4", "7", "2", "5", "1", "3", "6"}))
+	})
+
+	It("should only fall back to lower bands to fill the batch", func() {
+		query := app.PriorityQueryWith(bands, rest)
+		ids, err := query(0, 100, 3)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{"4", "7", "2"}))
+	})
+
+	It("should only scan the bands within the partition", func() {
+		query := app.PriorityQueryWith(bands, rest)
+		ids, err := query(0, 5, 2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ids).To(Equal([]string{"4", "2"}))
+	})
+
+	It("should order fetched messages highest priority first", func() {
+		object := func(id string, priority int) riak.RObject {
+			indexes := map[string][]string{}
+			if priority > 0 {
+				indexes[app.PriorityIndex] = []string{app.PriorityTerm(priority, id)}
+			}
+			return riak.RObject{Key: id, Indexes: indexes}
+		}
+		// In the order their fetches finished
+		fetched := []riak.RObject{object("1", 0), object("2", 5), object("4", 9), object("3", 0), object("5", 5)}
+		keys := []string{}
+		for _, o := range app.ByPriority(fetched) {
+			keys = append(keys, o.Key)
+		}
+		Expect(keys).To(Equal([]string{"4", "2", "5", "1", "3"}))
+	})
+
+	It("should move a message's priority term along with it when its id is taken", func() {
+		queue := &app.Queue{Name: "prioritized"}
+		object := &riak.RObject{Key: "1", Indexes: map[string][]string{app.PriorityIndex: {app.PriorityTerm(7, "1")}}}
+		bucket := &app.MemoryMessages{Objects: map[string]riak.RObject{"1": {Key: "1"}}}
+		id, err := queue.StoreUniqueWith(cfg, object, func() (string, error) { return "2", nil }, bucket)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(id).To(Equal("2"))
+		Expect(object.Indexes[app.PriorityIndex]).To(Equal([]string{app.PriorityTerm(7, "2")}))
+	})
+})
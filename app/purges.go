@@ -0,0 +1,147 @@
+package app
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/memberlist"
+	"github.com/tpjg/goriakpbc"
+	"github.com/tpjg/goriakpbc/pb"
+)
+
+// PendingPurgesName is the map holding when each deleted queue's messages are purged
+const PendingPurgesName = "pending_purges"
+
+// deleteGracePeriod returns how long a deleted queue's messages are kept, or 0 if they are never purged
+func (cfg *Config) deleteGracePeriod() time.Duration {
+	return cfg.Core.DeleteGracePeriod * time.Millisecond
+}
+
+// purgeStore reads and clears the queues whose messages are waiting to be purged
+type purgeStore interface {
+	queueExists(name string) (bool, error)
+	// pendingPurges returns when each deleted queue's messages are due to be purged
+	pendingPurges() (map[string]time.Time, error)
+	cancelPurge(name string) error
+	// purgeMessages deletes every message left in the queue, returning how many it deleted
+	purgeMessages(name string) (int, error)
+}
+
+// PurgeDeletedQueues purges the messages of every deleted queue whose deletegraceperiod has passed
+func (queues *Queues) PurgeDeletedQueues(cfg *Config, list *memberlist.Memberlist) {
+	if position, _ := getNodePosition(cfg, list); position != 0 {
+		return
+	}
+	queues.purgeDeletedQueues(riakPurgeStore{cfg: cfg}, time.Now())
+}
+
+func (queues *Queues) purgeDeletedQueues(store purgeStore, now time.Time) {
+	pending, err := store.pendingPurges()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	for name, purgeAt := range pending {
+		if now.Before(purgeAt) {
+			continue
+		}
+		exists, err := store.queueExists(name)
+		if err != nil {
+			logrus.Error(err)
+			continue
+		}
+		if !exists {
+			purged, err := store.purgeMessages(name)
+			if err != nil {
+				// Try the rest of them again on the next sweep
+				logrus.Error(err)
+				continue
+			}
+			logrus.Infof("Purged %d messages from deleted queue %s", purged, name)
+		}
+		if err = store.cancelPurge(name); err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+// riakPurgeStore keeps the pending purges in the queues config in Riak
+type riakPurgeStore struct {
+	cfg *Config
+}
+
+func (s riakPurgeStore) queueExists(name string) (bool, error) {
+	return s.cfg.isKnownQueue(name)
+}
+
+func (s riakPurgeStore) removeQueue(name string) error {
+	return s.cfg.destroyQueue(name)
+}
+
+func (s riakPurgeStore) schedulePurge(name string, purgeAt time.Time) error {
+	bucket, release, err := s.cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return err
+	}
+	defer release()
+	queuesConfig, err := bucket.FetchMap(QueueConfigName)
+	if err != nil && err != riak.NotFound {
+		return err
+	}
+	queuesConfig.AddMap(PendingPurgesName).AddRegister(name).Update([]byte(strconv.FormatInt(purgeAt.UnixNano(), 10)))
+	return s.cfg.ConfigMaps.storeConfigMap(QueueConfigName, queuesConfig)
+}
+
+func (s riakPurgeStore) pendingPurges() (map[string]time.Time, error) {
+	pending := make(map[string]time.Time)
+	bucket, release, err := s.cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	queuesConfig, err := bucket.FetchMap(QueueConfigName)
+	if err == riak.NotFound {
+		return pending, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	purges := queuesConfig.FetchMap(PendingPurgesName)
+	if purges == nil {
+		return pending, nil
+	}
+	for key, value := range purges.Values {
+		if key.Type != pb.MapField_REGISTER {
+			continue
+		}
+		purgeAt, err := strconv.ParseInt(registerValue(value), 10, 64)
+		if err != nil {
+			logrus.Errorf("Couldn't read when deleted queue %s is purged: %s", key.Key, err)
+			continue
+		}
+		pending[key.Key] = time.Unix(0, purgeAt)
+	}
+	return pending, nil
+}
+
+func (s riakPurgeStore) cancelPurge(name string) error {
+	bucket, release, err := s.cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return err
+	}
+	defer release()
+	queuesConfig, err := bucket.FetchMap(QueueConfigName)
+	if err == riak.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	queuesConfig.AddMap(PendingPurgesName).RemoveRegister(name)
+	return s.cfg.ConfigMaps.storeConfigMap(QueueConfigName, queuesConfig)
+}
+
+func (s riakPurgeStore) purgeMessages(name string) (int, error) {
+	return (&Queue{Name: name}).Purge(s.cfg)
+}
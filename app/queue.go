@@ -1,16 +1,22 @@
 package app
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/codec"
+	"github.com/Tapjoy/dynamiq/app/compressor"
 	"github.com/Tapjoy/dynamiq/app/stats"
+	"github.com/Tapjoy/dynamiq/app/tracing"
 	"github.com/hashicorp/memberlist"
 	"github.com/tpjg/goriakpbc"
 )
@@ -32,12 +38,157 @@ const QueueDepthStatsSuffix = "depth.count"
 // QueueDepthAprStatsSuffix is
 const QueueDepthAprStatsSuffix = "approximate_depth.count"
 
+// QueueDepthAvailableStatsSuffix is the approximate depth, minus the messages currently in flight
+const QueueDepthAvailableStatsSuffix = "available_depth.count"
+
 // QueueFillDeltaStatsSuffix
 const QueueFillDeltaStatsSuffix = "fill.count"
 
+// QueueFillPreciseStatsSuffix is the fill ratio of the last receive in hundredths of a percent
+const QueueFillPreciseStatsSuffix = "fill.precise"
+
+// FillRatioFloor rounds the fill ratio down to a whole percent
+const FillRatioFloor = "floor"
+
+// FillRatioRound rounds the fill ratio to the nearest whole percent
+const FillRatioRound = "round"
+
+// FillRatioCeil rounds the fill ratio up to a whole percent
+const FillRatioCeil = "ceil"
+
+// ErrInvalidBatchSize represents the condition that occurs if a receive asks for fewer than 1 message
+var ErrInvalidBatchSize = errors.New("Batchsizes must be non-negative integers greater than 0")
+
+// ErrQueueFull represents the condition that occurs if a put finds the queue at its max_depth
+var ErrQueueFull = errors.New("Queue is full")
+
+// ErrInvalidMaxDepth represents the condition that occurs if a queue is configured with a negative max_depth
+var ErrInvalidMaxDepth = errors.New("max_depth must be 0 or greater")
+
+// ErrQueueEmpty represents the condition that occurs if a receive finds no messages, with emptyqueueerror set
+var ErrQueueEmpty = errors.New("Queue is empty")
+
+// ErrQueueDisabled represents the condition that occurs if a disabled queue rejects a put
+var ErrQueueDisabled = errors.New("Queue is disabled")
+
+// QueueConfigChangedStatsSuffix is the stat counting syncs which found the queue's config had changed
+const QueueConfigChangedStatsSuffix = "config.changed"
+
+// QueueGetMissingStatsSuffix is the stat counting messages a receive asked Riak for, but didn't find
+const QueueGetMissingStatsSuffix = "get.missing"
+
+// QueueConflictsStatsSuffix is the stat counting conflicted messages found
+const QueueConflictsStatsSuffix = "conflicts.count"
+
+// QueueReadRepairSiblingsStatsSuffix is the stat counting siblings put onto the queue again by read repair
+const QueueReadRepairSiblingsStatsSuffix = "read_repair.siblings"
+
+// DefaultMissingWarnRatio is the share of a receive's messages which may be missing before a warning is logged
+const DefaultMissingWarnRatio = 0.5
+
+// reconcilePageSize is how many message ids each 2i query returns while reconciling the depth
+const reconcilePageSize = 1000
+
+// CompressedMetaKey is the meta key naming the algorithm a stored message was compressed with
+const CompressedMetaKey = "compressed"
+
+// CompressionDictionaryMetaKey is the meta key holding the ID of the zstd dictionary a message was compressed with
+const CompressionDictionaryMetaKey = "compression_dictionary"
+
+// ContentEncodingMetaKey is the meta key naming the HTTP Content-Encoding of a stored message's data
+const ContentEncodingMetaKey = "content_encoding"
+
+// ContentEncodingIdentity is the content encoding of a message stored without compression
+const ContentEncodingIdentity = "identity"
+
+// contentEncoding returns the HTTP content encoding of data compressed with algorithm
+func contentEncoding(algorithm string) string {
+	switch algorithm {
+	case "":
+		return ContentEncodingIdentity
+	case "zlib", "true":
+		return "deflate"
+	case "lzw":
+		return "compress"
+	}
+	return algorithm
+}
+
+// ErrMessageNotFound represents the condition that occurs if no message exists with a given id
+var ErrMessageNotFound = errors.New("Message not found")
+
+// ErrIDCollision represents the condition that occurs if every id a put drew was already taken
+var ErrIDCollision = errors.New("Could not find an unused message id")
+
+// DefaultMaxPutRetries is how many more ids a put draws after a collision, if maxputretries isn't set
+const DefaultMaxPutRetries = 2
+
+// QueuePutCollisionsStatsSuffix is the stat counting the ids puts drew which were already taken
+const QueuePutCollisionsStatsSuffix = "put.collisions"
+
 // MaxIDSize is
 var MaxIDSize = *big.NewInt(math.MaxInt64)
 
+// MessageIDDigits is the most digits a message id can have, as ids are below MaxIDSize
+const MessageIDDigits = 19
+
+// keySpace returns the range of message ids, from keyspacemin up to but not including keyspacemax
+func (core Core) keySpace() (int64, int64) {
+	if core.KeySpaceMax == 0 {
+		return core.KeySpaceMin, MaxIDSize.Int64()
+	}
+	return core.KeySpaceMin, core.KeySpaceMax
+}
+
+// newMessageID returns a random message id within the key space, zero-padded to the configured width
+func (cfg *Config) newMessageID() string {
+	min, max := cfg.Core.keySpace()
+	randy, _ := rand.Int(rand.Reader, big.NewInt(max-min))
+	randy.Add(randy, big.NewInt(min))
+	return padMessageID(randy.String(), cfg.Core.MessageIDWidth)
+}
+
+// padMessageID zero-pads id to width digits
+func padMessageID(id string, width int) string {
+	if len(id) >= width {
+		return id
+	}
+	return strings.Repeat("0", width-len(id)) + id
+}
+
+// MessageIndexIDInt reads message ids from the id_int 2i every message is stored with
+const MessageIndexIDInt = "id_int"
+
+// MessageIndexKey reads message ids from Riak's own $key index, so messages needn't be stored with id_int
+const MessageIndexKey = "$key"
+
+// messageIndex returns the 2i message ids are read from
+func (cfg *Config) messageIndex() string {
+	if cfg.Core.MessageIndex == MessageIndexKey {
+		return MessageIndexKey
+	}
+	return MessageIndexIDInt
+}
+
+// idRange returns the terms of the message index covering the ids from bottom to top
+func (cfg *Config) idRange(bottom int64, top int64) (string, string) {
+	width := cfg.Core.MessageIDWidth
+	return padMessageID(strconv.FormatInt(bottom, 10), width), padMessageID(strconv.FormatInt(top, 10), width)
+}
+
+// queryIDs pages through the ids of the messages in bucket from bottom to top
+func (cfg *Config) queryIDs(bucket *riak.Bucket, bottom int64, top int64, limit uint32, continuation string) ([]string, string, error) {
+	min, max := cfg.idRange(bottom, top)
+	return bucket.IndexQueryRangePage(cfg.messageIndex(), min, max, limit, continuation)
+}
+
+// indexMessageID adds the message index term for id to object, if the message index needs one
+func (cfg *Config) indexMessageID(object *riak.RObject, id string) {
+	if cfg.messageIndex() == MessageIndexIDInt {
+		object.Indexes[MessageIndexIDInt] = []string{id}
+	}
+}
+
 // Queues represents
 type Queues struct {
 	// a container for all queues
@@ -49,6 +200,29 @@ type Queues struct {
 	// Channels / Timer for syncing the config
 	syncScheduler *time.Ticker
 	syncKiller    chan struct{}
+	syncStopped   chan struct{}
+	// Channels for stopping the expiry sweeps
+	expireKiller  chan struct{}
+	expireStopped chan struct{}
+	stopOnce      sync.Once
+	// syncLock keeps a sync requested through SyncNow from running alongside the scheduled one
+	syncLock sync.Mutex
+	// observers are handed every queue's stats on each sync
+	observers []QueueObserver
+	// createLock keeps GetOrCreate from creating the same queue twice at once
+	createLock sync.Mutex
+}
+
+// QueueStats is a point in time view of a queue's stats
+type QueueStats struct {
+	// Name is the queue the stats are for
+	Name        string `json:"-"`
+	Sent        int64  `json:"sent"`
+	Received    int64  `json:"received"`
+	Deleted     int64  `json:"deleted"`
+	ApproxDepth int64  `json:"approximate_depth"`
+	// FillRatio is the percentage of the last receive's batchsize that was filled
+	FillRatio int64 `json:"fill_ratio"`
 }
 
 // Queue represents
@@ -62,291 +236,1446 @@ type Queue struct {
 	Config *riak.RDtMap
 	// Mutex for protecting rw access to the Config object
 	sync.RWMutex
+	// Rate limiters, keyed by the setting holding their rate
+	limiters     map[string]*RateLimiter
+	limitersLock sync.Mutex
+	// What receives saw since the last sync, for scaling the partitions
+	autoscaler autoscaler
+	// How many GetBackoff receives in a row came up empty
+	backoff backoff
+	// The BatchWriters putting onto the queue which aren't closed yet, flushed by Flush
+	writers struct {
+		open map[*BatchWriter]struct{}
+		sync.Mutex
+	}
+	// Puts on this node draw from a fifo queue's sequence one at a time
+	sequence sync.Mutex
+	// When the queue last ran out of available partitions, or zero if it has some
+	starvation struct {
+		since time.Time
+		sync.Mutex
+	}
+}
+
+// recordFillRatio sets the percentage of the batch a receive filled
+func recordFillRatio(c stats.Client, queueName string, batchSize int64, messageCount int64, rounding string, precise bool) error {
+	key := fmt.Sprintf("%s.%s", queueName, QueueFillDeltaStatsSuffix)
+	// We need the division to use floats as go does not supporting int/int returning an int
+	// Multiply by 100 before dividing, so whole percentages come out exact and aren't rounded up
+	percent := float64(messageCount*100) / float64(batchSize)
+	var rate float64
+	switch rounding {
+	case FillRatioRound:
+		rate = math.Floor(percent + 0.5)
+	case FillRatioCeil:
+		rate = math.Ceil(percent)
+	default:
+		rate = math.Floor(percent)
+	}
+	var errs stats.Errors
+	errs.Add(c.SetGauge(key, int64(rate)))
+	if precise {
+		// Gauges are whole numbers, so keep two decimal places by counting hundredths of a percent
+		key = fmt.Sprintf("%s.%s", queueName, QueueFillPreciseStatsSuffix)
+		errs.Add(c.SetGauge(key, int64(math.Floor(float64(messageCount*10000)/float64(batchSize)+0.5))))
+	}
+	return errs.Err()
+}
+
+func incrementMessageCount(c stats.Client, queueName string, numberOfMessages int64) error {
+	var errs stats.Errors
+	// Increment # Sent
+	key := fmt.Sprintf("%s.%s", queueName, QueueSentStatsSuffix)
+	errs.Add(c.Incr(key, numberOfMessages))
+	// Increment Depth count
+	key = fmt.Sprintf("%s.%s", queueName, QueueDepthStatsSuffix)
+	errs.Add(c.IncrGauge(key, numberOfMessages))
+	return errs.Err()
+}
+
+func decrementMessageCount(c stats.Client, queueName string, numberOfMessages int64) error {
+	var errs stats.Errors
+	// Increment # Deleted
+	key := fmt.Sprintf("%s.%s", queueName, QueueDeletedStatsSuffix)
+	errs.Add(c.Incr(key, numberOfMessages))
+	// Decrement Depth count
+	key = fmt.Sprintf("%s.%s", queueName, QueueDepthStatsSuffix)
+	errs.Add(c.DecrGauge(key, numberOfMessages))
+	return errs.Err()
+}
+
+// recordMissing counts the messages a receive didn't find
+func recordMissing(c stats.Client, queueName string, requested int, missing int, warnRatio float64) error {
+	if missing == 0 {
+		return nil
+	}
+	if requested > 0 && float64(missing)/float64(requested) > warnRatio {
+		logrus.Warnf("%d of the %d messages requested from queue %s were missing", missing, requested, queueName)
+	}
+	key := fmt.Sprintf("%s.%s", queueName, QueueGetMissingStatsSuffix)
+	return c.Incr(key, int64(missing))
+}
+
+func incrementReceiveCount(c stats.Client, queueName string, numberOfMessages int64) error {
+	// Increment # Received
+	key := fmt.Sprintf("%s.%s", queueName, QueueReceivedStatsSuffix)
+	err := c.Incr(key, numberOfMessages)
+	return err
+}
+func (queue *Queue) setQueueDepthApr(cfg *Config, list *memberlist.Memberlist, ids []string) error {
+	c := queue.statsClient(cfg)
+	// set  depth
+	key := fmt.Sprintf("%s.%s", queue.Name, QueueDepthAprStatsSuffix)
+	// find the difference between the first messages id and the last messages id
+
+	var count int64
+	if len(ids) > 1 {
+		first, _ := strconv.ParseInt(ids[0], 10, 64)
+		last, _ := strconv.ParseInt(ids[len(ids)-1], 10, 64)
+		difference := last - first
+		// find the density of messages
+		density := float64(len(ids)) / float64(difference)
+		// find the total count of messages by multiplying the density by the key range
+		min, max := cfg.Core.keySpace()
+		count = int64(density * float64(max-min))
+	} else {
+		// for small queues where we only return 1 message or no messages guesstimate ( or should we return 0? )
+		multiplier := queue.Parts.PartitionCount() * len(list.Members())
+		count = int64(len(ids) * multiplier)
+	}
+
+	queue.autoscaler.observeDepth(count)
+	var errs stats.Errors
+	errs.Add(c.SetGauge(key, count))
+	// The estimate includes messages which are in flight, and can't be served until their
+	// partition's visibility timeout passes. Only this node's in flight messages are known here
+	visTimeout, _ := cfg.GetVisibilityTimeout(queue.Name)
+	inFlight := int64(queue.Parts.InFlightCount(visTimeout))
+	errs.Add(c.SetGauge(fmt.Sprintf("%s.%s", queue.Name, QueueInFlightStatsSuffix), inFlight))
+	available := count - inFlight
+	if available < 0 {
+		available = 0
+	}
+	key = fmt.Sprintf("%s.%s", queue.Name, QueueDepthAvailableStatsSuffix)
+	errs.Add(c.SetGauge(key, available))
+	return errs.Err()
+}
+
+// Stats returns the queue's stats, read back from the stats client
+func (queue *Queue) Stats(cfg *Config) (QueueStats, error) {
+	snapshot, err := stats.TakeSnapshot(queue.statsClient(cfg))
+	if err != nil {
+		return QueueStats{}, err
+	}
+	key := func(suffix string) string {
+		return fmt.Sprintf("%s.%s", queue.Name, suffix)
+	}
+	return QueueStats{
+		Name:        queue.Name,
+		Sent:        snapshot.Counters[key(QueueSentStatsSuffix)],
+		Received:    snapshot.Counters[key(QueueReceivedStatsSuffix)],
+		Deleted:     snapshot.Counters[key(QueueDeletedStatsSuffix)],
+		ApproxDepth: snapshot.Gauges[key(QueueDepthAprStatsSuffix)],
+		FillRatio:   snapshot.Gauges[key(QueueFillDeltaStatsSuffix)],
+	}, nil
+}
+
+// GetQueue returns the queue with the given name, or ErrQueueNotFound if this node doesn't know of it
+func (queues *Queues) GetQueue(name string) (*Queue, error) {
+	queues.RLock()
+	defer queues.RUnlock()
+	queue, ok := queues.QueueMap[name]
+	if !ok {
+		return nil, ErrQueueNotFound
+	}
+	return queue, nil
+}
+
+// queueList returns the queues this node knows of, so they can be worked on without holding the lock
+func (queues *Queues) queueList() []*Queue {
+	queues.RLock()
+	defer queues.RUnlock()
+	list := make([]*Queue, 0, len(queues.QueueMap))
+	for _, queue := range queues.QueueMap {
+		list = append(list, queue)
+	}
+	return list
+}
+
+// GetOrCreate returns the queue with the given name, creating it first if need be
+func (queues *Queues) GetOrCreate(cfg *Config, name string) (*Queue, error) {
+	queue, _, err := queues.getOrCreate(name, func() (*Queue, error) {
+		return cfg.initializeQueue(name)
+	})
+	return queue, err
+}
+
+// getOrCreate returns the queue with the given name, and whether it was created with create
+func (queues *Queues) getOrCreate(name string, create func() (*Queue, error)) (*Queue, bool, error) {
+	if queue, err := queues.GetQueue(name); err == nil {
+		return queue, false, nil
+	}
+	queues.createLock.Lock()
+	defer queues.createLock.Unlock()
+	// Another call may have created it while this one waited
+	if queue, err := queues.GetQueue(name); err == nil {
+		return queue, false, nil
+	}
+	queue, err := create()
+	if queue == nil {
+		return nil, false, err
+	}
+	queues.Lock()
+	queues.QueueMap[name] = queue
+	queues.Unlock()
+	return queue, true, err
+}
+
+// Exists checks is the given queue name is already created or not
+func (queues *Queues) Exists(cfg *Config, queueName string) bool {
+	// For now, lets go right to Riak for this
+	// Because of the config delay, we don't wanna check the memory values
+
+	bucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		logrus.Error(err)
+		return false
+	}
+	defer release()
+	m, _ := cfg.ConfigMaps.fetchConfigMap(bucket, QueueConfigName)
+	// The map may be cached, so look the set up without adding it
+	set := m.FetchSet(QueueSetName)
+	if set == nil {
+		return false
+	}
+
+	for _, value := range set.GetValue() {
+		logrus.Debugf("Looking for %s, found %s", queueName, string(value[:]))
+		if string(value[:]) == queueName {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteQueue deletes the given queue
+func (queues *Queues) DeleteQueue(name string, cfg *Config) (bool, error) {
+	return queues.deleteQueue(riakPurgeStore{cfg: cfg}, name, cfg.deleteGracePeriod(), time.Now())
+}
+
+// queueRemover drops a queue from the known queues, then destroys its config
+type queueRemover interface {
+	removeQueue(name string) error
+	// schedulePurge records that the queue's messages are to be purged at purgeAt
+	schedulePurge(name string, purgeAt time.Time) error
+}
+
+func (queues *Queues) deleteQueue(store queueRemover, name string, gracePeriod time.Duration, now time.Time) (bool, error) {
+	// Schedule the purge first, so a queue is never deleted without one. If the removal then
+	// fails, the queue still exists when the purge is due, which cancels it
+	if gracePeriod > 0 {
+		if err := store.schedulePurge(name, now.Add(gracePeriod)); err != nil {
+			logrus.Errorf("Couldn't schedule the messages of queue %s to be purged: %s", name, err)
+			return false, err
+		}
+	}
+	// Only a removal Riak confirmed counts. Reading the queue back afterwards can't tell a queue
+	// which is gone from one Riak failed to report on
+	err := store.removeQueue(name)
+	if err != nil {
+		logrus.Errorf("Couldn't confirm queue %s was deleted: %s", name, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// ResizeQueue sets the maximum number of partitions for the given queue
+func (queues *Queues) ResizeQueue(cfg *Config, name string, newMax int) error {
+	queue, err := queues.GetQueue(name)
+	if err != nil {
+		return fmt.Errorf("There is no queue named %s", name)
+	}
+	if newMax <= 0 {
+		return ErrInvalidPartitionCount
+	}
+	minPartitions, err := cfg.GetMinPartitions(name)
+	if err != nil {
+		return err
+	}
+	if newMax < minPartitions {
+		return ErrInvalidPartitionCount
+	}
+
+	err = cfg.SetMaxPartitions(name, newMax)
+	if err != nil {
+		return err
+	}
+	// Drain locally right away, other nodes will drain on their next config sync
+	if queue.Parts.PartitionCount() > newMax {
+		queue.Parts.Resize(cfg, name, newMax)
+	}
+	return nil
+}
+
+// ClampBatchSize returns requested cut down to the queue's max_batch_size
+func (queue *Queue) ClampBatchSize(cfg *Config, requested int64) (int64, error) {
+	if requested <= 0 {
+		return 0, ErrInvalidBatchSize
+	}
+	maxBatchSize, err := cfg.GetMaxBatchSize(queue.Name)
+	if err != nil {
+		return 0, err
+	}
+	if maxBatchSize > 0 && requested > maxBatchSize {
+		return maxBatchSize, nil
+	}
+	return requested, nil
+}
+
+// Get gets a message from the queue
+func (queue *Queue) Get(cfg *Config, list *memberlist.Memberlist, batchsize int64) ([]Message, error) {
+	ctx, span := queue.startSpan(cfg, context.Background(), "dynamiq.get")
+	messages, err := queue.get(ctx, cfg, list, batchsize)
+	endReceiveSpan(span, batchsize, messages, err)
+	return messages, err
+}
+
+func (queue *Queue) get(ctx context.Context, cfg *Config, list *memberlist.Memberlist, batchsize int64) ([]Message, error) {
+	batchsize, ok, err := queue.receivable(cfg, batchsize)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []Message{}, nil
+	}
+	//set the bucket
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+	defer release()
+	return queue.getFrom(cfg, list, batchsize, riakIndex{ctx: ctx, cfg: cfg, queue: queue, bucket: bucket, release: release})
+}
+
+// getFrom receives up to batchsize messages through index
+func (queue *Queue) getFrom(cfg *Config, list *memberlist.Memberlist, batchsize int64, index messageIndex) ([]Message, error) {
+	receivedAt := time.Now()
+	messageIds, err := queue.reserve(cfg, list, batchsize, index.query)
+	if err != nil {
+		return nil, err
+	}
+	if len(messageIds) == 0 {
+		if cfg.Core.EmptyQueueError {
+			return nil, ErrQueueEmpty
+		}
+		return nil, nil
+	}
+	messages := queue.receiveHeads(cfg, list, index.fetch(messageIds), index.groupHead)
+	visTimeout, _ := cfg.GetVisibilityTimeout(queue.Name)
+	attachReceipts(messages, queue.Parts, list.LocalNode().Name, receivedAt, visTimeout)
+	return newMessages(messages), nil
+}
+
+// Reserve claims up to batchsize messages, as Get does, without fetching them
+func (queue *Queue) Reserve(cfg *Config, list *memberlist.Memberlist, batchsize int64) ([]string, error) {
+	batchsize, ok, err := queue.receivable(cfg, batchsize)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []string{}, nil
+	}
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+	defer release()
+	return queue.reserve(cfg, list, batchsize, bucketQuery(cfg, bucket))
+}
+
+// FetchReserved fetches the messages with the given ids, as reserved by Reserve
+func (queue *Queue) FetchReserved(cfg *Config, ids []string) ([]Message, error) {
+	return newMessages(filterGroupHeads(queue.retrieveObjects(context.Background(), ids, cfg), queue.groupHeads(cfg))), nil
+}
+
+// receivable returns the clamped batchsize, and whether a receive may go ahead
+func (queue *Queue) receivable(cfg *Config, batchsize int64) (int64, bool, error) {
+	if enabled, err := cfg.GetQueueEnabled(queue.Name); err == nil && !enabled {
+		return 0, false, nil
+	}
+	batchsize, err := queue.ClampBatchSize(cfg, batchsize)
+	if err == nil {
+		err = queue.allow(cfg, MaxGetRate, 1)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return batchsize, true, nil
+}
+
+// reserve claims up to batchsize of the ids query finds within a partition
+func (queue *Queue) reserve(cfg *Config, list *memberlist.Memberlist, batchsize int64, query func(bottom int, top int, limit uint32) ([]string, error)) ([]string, error) {
+	// get the top and bottom partitions
+	partBottom, partTop, partition, err := queue.Parts.GetPartition(cfg, queue.Name, list)
+
+	if err != nil {
+		return nil, err
+	}
+	//get a list of batchsize message ids
+	found, err := query(partBottom, partTop, uint32(batchsize))
+	defer queue.setQueueDepthApr(cfg, list, found)
+
+	if err != nil {
+		logrus.Error(err)
+		if len(found) > 0 {
+			// Hand back what was read before the failed page, rather than claim it for no one
+			err = nil
+		}
+	}
+	messageIds := queue.Parts.claim(found, int(batchsize), queue.visibleAt(cfg))
+	// We need it as 64 for stats reporting
+	messageCount := int64(len(messageIds))
+
+	// return the partition to the parts heap, but only lock it when we have messages
+	partition.InFlight = int(messageCount)
+	if messageCount > 0 {
+		defer queue.Parts.PushPartition(cfg, queue.Name, partition, true)
+	} else {
+		defer queue.Parts.PushPartition(cfg, queue.Name, partition, false)
+	}
+	defer incrementReceiveCount(queue.statsClient(cfg), queue.Name, messageCount)
+	defer recordFillRatio(queue.statsClient(cfg), queue.Name, batchsize, messageCount, cfg.Core.FillRatioRounding, cfg.Core.FillRatioPrecise)
+	queue.autoscaler.observeReceive(batchsize, messageCount)
+	logrus.Debug("Message retrieved ", messageCount)
+	return messageIds, err
+}
+
+// visibleAt returns when messages received now are visible again
+func (queue *Queue) visibleAt(cfg *Config) time.Time {
+	visTimeout, _ := cfg.GetVisibilityTimeout(queue.Name)
+	return time.Now().Add(time.Duration(visTimeout * float64(time.Second)))
+}
+
+// messageIndex finds a queue's messages, so receives can be run against something other than Riak
+type messageIndex interface {
+	// query returns the ids of up to limit messages from bottom to top
+	query(bottom int, top int, limit uint32) ([]string, error)
+	// fetch returns the messages with the given ids
+	fetch(ids []string) []riak.RObject
+	// groupHead returns the id of the oldest message in the group
+	groupHead(group string) (string, error)
+}
+
+// riakIndex finds the messages in a queue's bucket, fetching them on connections of their own
+type riakIndex struct {
+	ctx     context.Context
+	cfg     *Config
+	queue   *Queue
+	bucket  *riak.Bucket
+	release func()
+}
+
+func (i riakIndex) query(bottom int, top int, limit uint32) ([]string, error) {
+	return bucketQuery(i.cfg, i.bucket)(bottom, top, limit)
+}
+
+func (i riakIndex) fetch(ids []string) []riak.RObject {
+	i.release()
+	return i.queue.retrieveObjects(i.ctx, ids, i.cfg)
+}
+
+func (i riakIndex) groupHead(group string) (string, error) {
+	return i.queue.groupHeads(i.cfg)(group)
+}
+
+// bucketQuery returns a function reading the ids of up to limit messages in bucket from bottom to top
+func bucketQuery(cfg *Config, bucket *riak.Bucket) func(bottom int, top int, limit uint32) ([]string, error) {
+	return func(bottom int, top int, limit uint32) ([]string, error) {
+		return pageIDs(limit, uint32(cfg.Core.IndexPageSize), func(pageLimit uint32, continuation string) ([]string, string, error) {
+			return cfg.queryIDs(bucket, int64(bottom), int64(top), pageLimit, continuation)
+		})
+	}
+}
+
+// pageIDs returns up to limit ids from page, at most pageSize at a time
+func pageIDs(limit uint32, pageSize uint32, page func(limit uint32, continuation string) ([]string, string, error)) ([]string, error) {
+	if pageSize == 0 || pageSize >= limit {
+		ids, _, err := page(limit, "")
+		return ids, err
+	}
+	ids := make([]string, 0, limit)
+	continuation := ""
+	for uint32(len(ids)) < limit {
+		pageLimit := limit - uint32(len(ids))
+		if pageLimit > pageSize {
+			pageLimit = pageSize
+		}
+		got, next, err := page(pageLimit, continuation)
+		ids = append(ids, got...)
+		if err != nil {
+			return ids, err
+		}
+		if next == "" {
+			break
+		}
+		continuation = next
+	}
+	return ids, nil
+}
+
+// GetParallel is Get, receiving from every free partition at once
+func (queue *Queue) GetParallel(cfg *Config, list *memberlist.Memberlist, batchsize int64) ([]Message, error) {
+	ctx, span := queue.startSpan(cfg, context.Background(), "dynamiq.get_parallel")
+	messages, err := queue.getParallel(ctx, cfg, list, batchsize)
+	endReceiveSpan(span, batchsize, messages, err)
+	return messages, err
+}
+
+func (queue *Queue) getParallel(ctx context.Context, cfg *Config, list *memberlist.Memberlist, batchsize int64) ([]Message, error) {
+	batchsize, ok, err := queue.receivable(cfg, batchsize)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return []Message{}, nil
+	}
+
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+	defer release()
+	messageIds, sample, err := queue.collectPartitions(cfg, list, batchsize, bucketQuery(cfg, bucket))
+	// The fetches below take connections of their own
+	release()
+	if err != nil {
+		return nil, err
+	}
+	defer queue.setQueueDepthApr(cfg, list, sample)
+
+	messageCount := int64(len(messageIds))
+	defer incrementReceiveCount(queue.statsClient(cfg), queue.Name, messageCount)
+	defer recordFillRatio(queue.statsClient(cfg), queue.Name, batchsize, messageCount, cfg.Core.FillRatioRounding, cfg.Core.FillRatioPrecise)
+	queue.autoscaler.observeReceive(batchsize, messageCount)
+	receivedAt := time.Now()
+	messages := queue.receiveHeads(cfg, list, queue.retrieveObjects(ctx, messageIds, cfg), queue.groupHeads(cfg))
+	visTimeout, _ := cfg.GetVisibilityTimeout(queue.Name)
+	attachReceipts(messages, queue.Parts, list.LocalNode().Name, receivedAt, visTimeout)
+	return newMessages(messages), nil
+}
+
+// collectPartitions claims ids from every free partition, returning them and the fullest partition's ids
+func (queue *Queue) collectPartitions(cfg *Config, list *memberlist.Memberlist, batchsize int64, query func(bottom int, top int, limit uint32) ([]string, error)) ([]string, []string, error) {
+	ranges, err := queue.Parts.GetFreePartitions(cfg, queue.Name, list)
+	if err != nil {
+		return nil, nil, err
+	}
+	results := make([][]string, len(ranges))
+	var wg sync.WaitGroup
+	for i, partitionRange := range ranges {
+		wg.Add(1)
+		go func(i int, partitionRange PartitionRange) {
+			defer wg.Done()
+			ids, err := query(partitionRange.Bottom, partitionRange.Top, uint32(batchsize))
+			if err != nil {
+				// Only this partition's share is lost, it gets pushed back unlocked below
+				logrus.Error(err)
+			}
+			results[i] = ids
+		}(i, partitionRange)
+	}
+	wg.Wait()
+
+	messageIds := make([]string, 0, batchsize)
+	var sample []string
+	visibleAt := queue.visibleAt(cfg)
+	for i, partitionRange := range ranges {
+		ids := results[i]
+		if len(ids) > len(sample) {
+			sample = ids
+		}
+		ids = queue.Parts.claim(ids, int(batchsize)-len(messageIds), visibleAt)
+		messageIds = append(messageIds, ids...)
+		partitionRange.Partition.InFlight = len(ids)
+		queue.Parts.PushPartition(cfg, queue.Name, partitionRange.Partition, len(ids) > 0)
+	}
+	return messageIds, sample, nil
+}
+
+// RequeueInFlight makes the messages this node has in flight receivable again right away
+func (queue *Queue) RequeueInFlight(cfg *Config) (int, error) {
+	visTimeout, err := cfg.GetVisibilityTimeout(queue.Name)
+	if err != nil {
+		return 0, err
+	}
+	requeued := queue.Parts.UnlockAll(visTimeout)
+	logrus.Infof("Requeued %d in flight messages on queue %s", requeued, queue.Name)
+	return requeued, nil
+}
+
+// Put puts a Message onto the queue, returning its id
+func (queue *Queue) Put(cfg *Config, message string) (string, error) {
+	return queue.PutInGroup(cfg, message, "")
+}
+
+// PutInGroup puts a Message onto the queue as part of a message group
+func (queue *Queue) PutInGroup(cfg *Config, message string, groupID string) (string, error) {
+	stored, err := queue.putInGroup(cfg, message, putOptions{groupID: groupID})
+	if err != nil {
+		return "", err
+	}
+	return stored.ID, nil
+}
+
+// PutReturning puts a Message onto the queue, returning all of it
+func (queue *Queue) PutReturning(cfg *Config, message string) (*Message, error) {
+	stored, err := queue.putInGroup(cfg, message, putOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// putOptions are the optional parts of a put
+type putOptions struct {
+	// groupID is the message group to put the message into, or "" for none
+	groupID string
+	// idempotencyKey stops the message being put again within the queue's idempotency_ttl, if set
+	idempotencyKey string
+	// ctx carries the trace the put is part of, if any
+	ctx context.Context
+	// prepared is the body to store, if it was already prepared for another queue with the same
+	// message_codec and compression settings
+	prepared *preparedBody
+	// priority is the band GetByPriority serves the message from, 0 for none
+	priority int
+}
+
+func (opts putOptions) context() context.Context {
+	if opts.ctx == nil {
+		return context.Background()
+	}
+	return opts.ctx
+}
+
+func (queue *Queue) putInGroup(cfg *Config, message string, opts putOptions) (Message, error) {
+	ctx, span := queue.startSpan(cfg, opts.context(), "dynamiq.put")
+	opts.ctx = ctx
+	stored, err := queue.putTraced(cfg, message, opts)
+	span.SetAttribute("dynamiq.message_id", stored.ID)
+	span.End(err)
+	return stored, err
+}
+
+func (queue *Queue) putTraced(cfg *Config, message string, opts putOptions) (Message, error) {
+	err := checkPriority(opts.priority)
+	if err == nil {
+		err = queue.acceptingPuts(cfg)
+	}
+	if err == nil {
+		err = queue.allow(cfg, MaxPutRate, 1)
+	}
+	if err != nil {
+		logrus.Error(err)
+		return Message{}, err
+	}
+	//Grab our bucket
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err == nil {
+		defer release()
+		var shouldCompress, _ = cfg.GetCompressedMessages(queue.Name)
+		var messageCodec codec.Codec
+		messageCodec, err = cfg.GetMessageCodec(queue.Name)
+		if err == nil {
+			store := func(opts putOptions) (Message, error) {
+				return queue.storeMessage(cfg, bucket, message, opts, messageCodec, shouldCompress)
+			}
+			var stored Message
+			isNew := true
+			ttl, _ := cfg.GetIdempotencyTTL(queue.Name)
+			if opts.idempotencyKey != "" && ttl > 0 {
+				now := time.Now()
+				// The keys are recorded on the put's own connection
+				var keys *riak.Bucket
+				keys, err = cfg.riakBucketOn(cfg.RiakPool, "messages", idempotencyBucketName(queue.Name))
+				if err != nil {
+					logrus.Error(err)
+					return Message{}, err
+				}
+				stored, isNew, err = putOnce(opts.idempotencyKey, now.Add(-time.Duration(ttl*float64(time.Second))), now, func(min string, max string) (string, error) {
+					id, err := idempotentID(keys, min, max)
+					if err != nil {
+						logrus.Error(err)
+						return "", ErrRiakUnavailable
+					}
+					return id, nil
+				}, func() (Message, error) {
+					return store(opts)
+				}, func(term string, id string) error {
+					return rememberIdempotent(keys, term, id, now)
+				})
+			} else {
+				stored, err = store(opts)
+			}
+			if err == nil {
+				if isNew {
+					defer incrementMessageCount(queue.statsClient(cfg), queue.Name, 1)
+				}
+				return stored, nil
+			}
+		}
+	}
+	//Actually want to handle this in some other way
+	logrus.Error(err)
+	return Message{}, err
+}
+
+// PutIfNotFull puts a Message onto the queue unless it holds max_depth messages
+func (queue *Queue) PutIfNotFull(cfg *Config, message string, exact bool) (string, error) {
+	return queue.putIfNotFull(cfg, message, putOptions{}, exact)
+}
+
+func (queue *Queue) putIfNotFull(cfg *Config, message string, opts putOptions, exact bool) (string, error) {
+	err := queue.checkNotFull(cfg, exact)
+	if err != nil {
+		return "", err
+	}
+	stored, err := queue.putInGroup(cfg, message, opts)
+	if err != nil {
+		return "", err
+	}
+	return stored.ID, nil
+}
+
+func (queue *Queue) checkNotFull(cfg *Config, exact bool) error {
+	maxDepth, err := cfg.GetMaxDepth(queue.Name)
+	if err != nil || maxDepth <= 0 {
+		return nil
+	}
+	var depth int64
+	if !exact {
+		snapshot, err := stats.TakeSnapshot(queue.statsClient(cfg))
+		if err == nil {
+			depth = snapshot.Gauges[fmt.Sprintf("%s.%s", queue.Name, QueueDepthAprStatsSuffix)]
+		} else {
+			exact = true
+		}
+	}
+	if exact {
+		bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+		if err != nil {
+			return err
+		}
+		defer release()
+		depth, err = countMessages(idPages(cfg, bucket), maxDepth)
+		if err != nil {
+			return err
+		}
+	}
+	if depth >= maxDepth {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// BatchPut puts multiple Messages onto the queue
+func (queue *Queue) BatchPut(cfg *Config, messages []string) ([]string, error) {
+	err := queue.acceptingPuts(cfg)
+	if err == nil {
+		err = queue.allow(cfg, MaxPutRate, len(messages))
+	}
+	if err != nil {
+		return nil, err
+	}
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+	defer release()
+	var shouldCompress, _ = cfg.GetCompressedMessages(queue.Name)
+	messageCodec, err := cfg.GetMessageCodec(queue.Name)
+	if err != nil {
+		return nil, err
+	}
+	uuids := make([]string, len(messages))
+	var stored int64
+	var lastErr error
+	for i, message := range messages {
+		put, err := queue.storeMessage(cfg, bucket, message, putOptions{}, messageCodec, shouldCompress)
+		if err != nil {
+			logrus.Error(err)
+			lastErr = err
+			continue
+		}
+		uuids[i] = put.ID
+		stored++
+	}
+	defer incrementMessageCount(queue.statsClient(cfg), queue.Name, stored)
+	return uuids, lastErr
+}
+
+// acceptingPuts returns ErrQueueDisabled if the queue is disabled, and set to reject puts while it is
+func (queue *Queue) acceptingPuts(cfg *Config) error {
+	if enabled, err := cfg.GetQueueEnabled(queue.Name); err != nil || enabled {
+		return nil
+	}
+	if reject, _ := cfg.GetRejectPutsWhenDisabled(queue.Name); reject {
+		return ErrQueueDisabled
+	}
+	return nil
+}
+
+func (queue *Queue) storeMessage(cfg *Config, bucket *riak.Bucket, message string, opts putOptions, messageCodec codec.Codec, shouldCompress bool) (Message, error) {
+	newID := queue.newIDs(cfg)
+	messageObj, stored, err := queue.newMessageObject(cfg, bucket, message, opts, newID, messageCodec, shouldCompress)
+	if err != nil {
+		return Message{}, err
+	}
+	stored.ID, err = queue.storeUnique(cfg, messageObj, newID, riakMessages{bucket})
+	if err != nil {
+		return Message{}, err
+	}
+	return stored, nil
+}
+
+// storeUnique stores object under an id which isn't taken yet, and returns the id
+func (queue *Queue) storeUnique(cfg *Config, object *riak.RObject, newID func() (string, error), messages messageStore) (string, error) {
+	for retries := 0; ; retries++ {
+		taken, err := messages.exists(object.Key)
+		if err != nil {
+			logrus.Error(err)
+			return "", ErrRiakUnavailable
+		}
+		if !taken {
+			break
+		}
+		if err := queue.statsClient(cfg).Incr(fmt.Sprintf("%s.%s", queue.Name, QueuePutCollisionsStatsSuffix), 1); err != nil {
+			logrus.Error(err)
+		}
+		if retries == cfg.maxPutRetries() {
+			return "", ErrIDCollision
+		}
+		logrus.Warnf("Message id %s is already taken, drawing another", object.Key)
+		object.Key, err = newID()
+		if err != nil {
+			logrus.Error(err)
+			return "", ErrRiakUnavailable
+		}
+		cfg.indexMessageID(object, object.Key)
+		indexPriority(object, messagePriority(*object))
+	}
+	err := messages.store(object)
+	if err != nil {
+		logrus.Error(err)
+		return "", ErrRiakUnavailable
+	}
+	return object.Key, nil
+}
+
+// newMessageObject prepares the Riak object storing message under an id drawn from newID
+func (queue *Queue) newMessageObject(cfg *Config, bucket *riak.Bucket, message string, opts putOptions, newID func() (string, error), messageCodec codec.Codec, shouldCompress bool) (*riak.RObject, Message, error) {
+	prepared := opts.prepared
+	if prepared == nil {
+		var err error
+		prepared, err = queue.prepareBody(cfg, opts.context(), message, messageCodec, shouldCompress)
+		if err != nil {
+			return nil, Message{}, err
+		}
+	}
+	body, contentType, algorithm := prepared.data, prepared.contentType, prepared.algorithm
+	stored := prepared.message
+	stored.Attributes = make(map[string]string, len(prepared.message.Attributes))
+	for key, value := range prepared.message.Attributes {
+		stored.Attributes[key] = value
+	}
+	putAt := stored.Timestamp
+
+	//Retrieve a UUID
+	uuid, err := newID()
+	if err != nil {
+		logrus.Error(err)
+		return nil, Message{}, ErrRiakUnavailable
+	}
+	stored.ID = uuid
+
+	messageObj := bucket.NewObject(uuid)
+	cfg.indexMessageID(messageObj, uuid)
+	indexPriority(messageObj, opts.priority)
+	if opts.groupID != "" {
+		messageObj.Indexes[GroupIndex] = []string{groupIndexTerm(opts.groupID, putAt)}
+	}
+	messageObj.Indexes[MessageCreatedIndex] = []string{createdTerm(putAt)}
+	if messageObj.Meta == nil {
+		messageObj.Meta = make(map[string]string)
+	}
+	if algorithm != "" {
+		messageObj.Meta[CompressedMetaKey] = algorithm
+	}
+	if prepared.dictionary != "" {
+		messageObj.Meta[CompressionDictionaryMetaKey] = prepared.dictionary
+	}
+	// The checksum covers the body as put, so it can be compared once the message is opened again
+	checksumAlgorithm, err := cfg.GetBodyChecksum(queue.Name)
+	if err != nil {
+		return nil, Message{}, err
+	}
+	checksum, _ := bodyChecksum(checksumAlgorithm, stored.Body)
+	if checksum != "" {
+		messageObj.Meta[ChecksumMetaKey] = checksum
+	}
+	// Record what was actually applied, which is nothing if compressing failed
+	stored.ContentEncoding = contentEncoding(algorithm)
+	messageObj.Meta[ContentEncodingMetaKey] = stored.ContentEncoding
+	messageObj.ContentType = contentType
+	messageObj.Data = body
+	return messageObj, stored, nil
+}
+
+// preparedBody is a message body as it is stored
+type preparedBody struct {
+	data        []byte
+	contentType string
+	algorithm   string
+	// dictionary is the ID of the dictionary the data was compressed with, if any
+	dictionary string
+	message    Message
+}
+
+// prepareBody wraps and compresses message as a put onto the queue would
+func (queue *Queue) prepareBody(cfg *Config, ctx context.Context, message string, messageCodec codec.Codec, shouldCompress bool) (*preparedBody, error) {
+	var body = []byte(message)
+	// THIS NEEDS TO BE CONFIGURABLE
+	contentType := "application/json"
+	putAt := time.Now()
+	stored := Message{Body: body, ContentType: contentType, Attributes: make(map[string]string), Timestamp: putAt}
+	if messageCodec != nil {
+		envelope := codec.Envelope{Body: body, Timestamp: putAt, ContentType: contentType}
+		// Carry the producer's trace on the message, so consumers can link their spans to it
+		cfg.tracer().Inject(ctx, stored.Attributes)
+		if len(stored.Attributes) > 0 {
+			envelope.Attributes = stored.Attributes
+		}
+		wrapped, err := messageCodec.Marshal(envelope)
+		if err != nil {
+			return nil, err
+		}
+		body = wrapped
+		contentType = messageCodec.ContentType()
+	}
+	algorithm, dictionary := "", ""
+	if shouldCompress == true {
+		var err error
+		body, algorithm, dictionary, err = compressBody(cfg, queue.Name, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &preparedBody{data: body, contentType: contentType, algorithm: algorithm, dictionary: dictionary, message: stored}, nil
+}
+
+// Delete deletes a Message from the queue
+func (queue *Queue) Delete(cfg *Config, id string) error {
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err == nil {
+		defer release()
+		err = queue.deleteWith(queue.statsClient(cfg), id, queue.messages(cfg, bucket))
+		if err == nil {
+			return nil
+		}
+	}
+
+	// if we got here we're borked
+	// TODO stats cleanup? Possibility that this gets us out of sync
+	logrus.Error(err)
+	if IsRiakUnavailable(err) || err == ErrPoolExhausted {
+		return err
+	}
+	return ErrRiakUnavailable
+}
+
+// BatchDelete deletes multiple messages at once, returning how many couldn't be deleted
+func (queue *Queue) BatchDelete(cfg *Config, ids []string) (int, error) {
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err != nil {
+		// if we got here we're borked
+		// TODO stats cleanup? Possibility that this gets us out of sync
+		logrus.Error(err)
+		return 0, err
+	}
+	defer release()
+	_, span := queue.startSpan(cfg, context.Background(), "dynamiq.batch_delete")
+	errors := queue.batchDeleteWith(queue.statsClient(cfg), ids, queue.messages(cfg, bucket))
+	span.SetAttribute("dynamiq.requested", len(ids))
+	span.SetAttribute("dynamiq.errors", errors)
+	span.End(nil)
+	return errors, nil
+}
+
+// deleteWith deletes the message with id from messages, taking it off the depth only if it was still stored
+func (queue *Queue) deleteWith(c stats.Client, id string, messages messageStore) error {
+	deleted, err := deleteMessage(id, messages)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		defer decrementMessageCount(c, queue.Name, 1)
+	}
+	return nil
+}
+
+func (queue *Queue) batchDeleteWith(c stats.Client, ids []string, messages messageStore) int {
+	errors, deleted := 0, 0
+	for _, id := range ids {
+		wasDeleted, err := deleteMessage(id, messages)
+		if err != nil {
+			logrus.Error(err)
+			errors++
+		} else if wasDeleted {
+			deleted++
+		}
+	}
+	// Don't count deletes that failed, or messages which were already gone
+	defer decrementMessageCount(c, queue.Name, int64(deleted))
+	return errors
+}
+
+// deleteMessage deletes the message with id if it is still stored, returning whether it was
+func deleteMessage(id string, messages messageStore) (bool, error) {
+	present, err := messages.exists(id)
+	if err != nil {
+		return false, err
+	}
+	if !present {
+		return false, nil
+	}
+	err = messages.remove(id)
+	if err == riak.NotFound {
+		// Deleted by someone else since we looked
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func recordFillRatio(c stats.Client, queueName string, batchSize int64, messageCount int64) error {
-	key := fmt.Sprintf("%s.%s", queueName, QueueFillDeltaStatsSuffix)
-	// We need the division to use floats as go does not supporting int/int returning an int
-	// Multiply by 100 to return a whole number, round down because we don't care about that much precision
-	rate := int64(math.Floor((float64(messageCount) / float64(batchSize)) * 100))
-	return c.SetGauge(key, rate)
+// messageStore keeps a queue's messages, so they can be read and written somewhere other than Riak
+type messageStore interface {
+	get(id string) (*riak.RObject, error)
+	exists(id string) (bool, error)
+	store(object *riak.RObject) error
+	remove(id string) error
 }
 
-func incrementMessageCount(c stats.Client, queueName string, numberOfMessages int64) error {
-	// Increment # Sent
-	key := fmt.Sprintf("%s.%s", queueName, QueueSentStatsSuffix)
-	err := c.Incr(key, numberOfMessages)
-	// Increment Depth count
-	key = fmt.Sprintf("%s.%s", queueName, QueueDepthStatsSuffix)
-	err = c.IncrGauge(key, numberOfMessages)
-	return err
+// riakMessages keeps the messages in a queue's bucket
+type riakMessages struct {
+	bucket *riak.Bucket
 }
 
-func decrementMessageCount(c stats.Client, queueName string, numberOfMessages int64) error {
-	// Increment # Deleted
-	key := fmt.Sprintf("%s.%s", queueName, QueueDeletedStatsSuffix)
-	err := c.Incr(key, numberOfMessages)
-	// Decrement Depth count
-	key = fmt.Sprintf("%s.%s", queueName, QueueDepthStatsSuffix)
-	err = c.DecrGauge(key, numberOfMessages)
-	return err
+func (m riakMessages) get(id string) (*riak.RObject, error) {
+	return m.bucket.Get(id)
 }
 
-func incrementReceiveCount(c stats.Client, queueName string, numberOfMessages int64) error {
-	// Increment # Received
-	key := fmt.Sprintf("%s.%s", queueName, QueueReceivedStatsSuffix)
-	err := c.Incr(key, numberOfMessages)
-	return err
+func (m riakMessages) exists(id string) (bool, error) {
+	return m.bucket.Exists(id)
 }
-func (queue *Queue) setQueueDepthApr(c stats.Client, list *memberlist.Memberlist, queueName string, ids []string) error {
-	// set  depth
-	key := fmt.Sprintf("%s.%s", queueName, QueueDepthAprStatsSuffix)
-	// find the difference between the first messages id and the last messages id
 
-	if len(ids) > 1 {
-		first, _ := strconv.ParseInt(ids[0], 10, 64)
-		last, _ := strconv.ParseInt(ids[len(ids)-1], 10, 64)
-		difference := last - first
-		// find the density of messages
-		density := float64(len(ids)) / float64(difference)
-		// find the total count of messages by multiplying the density by the key range
-		count := density * math.MaxInt64
-		return c.SetGauge(key, int64(count))
+func (m riakMessages) store(object *riak.RObject) error {
+	return object.Store()
+}
 
-	}
-	// for small queues where we only return 1 message or no messages guesstimate ( or should we return 0? )
-	multiplier := queue.Parts.PartitionCount() * len(list.Members())
-	return c.SetGauge(key, int64(len(ids)*multiplier))
+func (m riakMessages) remove(id string) error {
+	return m.bucket.Delete(id)
 }
 
-// Exists checks is the given queue name is already created or not
-func (queues *Queues) Exists(cfg *Config, queueName string) bool {
-	// For now, lets go right to Riak for this
-	// Because of the config delay, we don't wanna check the memory values
-	client := cfg.RiakConnection()
+// startSpan starts a span for an operation on the queue, as a child of the span in ctx if any
+func (queue *Queue) startSpan(cfg *Config, ctx context.Context, name string) (context.Context, tracing.Span) {
+	ctx, span := cfg.tracer().Start(ctx, name)
+	span.SetAttribute("dynamiq.queue", queue.Name)
+	return ctx, span
+}
 
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	m, _ := bucket.FetchMap(QueueConfigName)
-	set := m.AddSet(QueueSetName)
+func endReceiveSpan(span tracing.Span, batchsize int64, messages []Message, err error) {
+	span.SetAttribute("dynamiq.batch_size", batchsize)
+	span.SetAttribute("dynamiq.received", len(messages))
+	span.End(err)
+}
 
-	for _, value := range set.GetValue() {
-		logrus.Debug("Looking for %s, found %s", queueName, string(value[:]))
-		if string(value[:]) == queueName {
-			return true
+// ReconcileDepth sets the depth gauge to the number of messages stored for the queue
+func (queue *Queue) ReconcileDepth(cfg *Config) error {
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return reconcileDepth(queue.statsClient(cfg), queue.Name, idPages(cfg, bucket))
+}
+
+// Purge deletes every message stored for the queue
+func (queue *Queue) Purge(cfg *Config) (int, error) {
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return queue.purge(queue.statsClient(cfg), idPages(cfg, bucket), riakMessages{bucket})
+}
+
+func (queue *Queue) purge(c stats.Client, page func(continuation string) ([]string, string, error), messages messageStore) (int, error) {
+	purged, failed := 0, 0
+	var err error
+	continuation := ""
+	for {
+		var ids []string
+		ids, continuation, err = page(continuation)
+		if err != nil {
+			break
+		}
+		for _, id := range ids {
+			deleted, deleteErr := deleteMessage(id, messages)
+			if deleteErr != nil {
+				logrus.Error(deleteErr)
+				failed++
+			} else if deleted {
+				purged++
+			}
+		}
+		if continuation == "" {
+			break
 		}
 	}
-	return false
+	if purged > 0 {
+		statsErr := c.DecrGauge(fmt.Sprintf("%s.%s", queue.Name, QueueDepthStatsSuffix), int64(purged))
+		if statsErr != nil {
+			logrus.Error(statsErr)
+		}
+	}
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("Unable to purge %d messages from queue %s", failed, queue.Name)
+	}
+	return purged, err
 }
 
-// DeleteQueue deletes the given queue
-func (queues *Queues) DeleteQueue(name string, cfg *Config) bool {
-	client := cfg.RiakConnection()
+// idPages returns a function paging through the ids of every message stored in the queue's bucket
+func idPages(cfg *Config, bucket *riak.Bucket) func(continuation string) ([]string, string, error) {
+	return func(continuation string) ([]string, string, error) {
+		return cfg.queryIDs(bucket, 0, math.MaxInt64, reconcilePageSize, continuation)
+	}
+}
+
+func reconcileDepth(c stats.Client, queueName string, page func(continuation string) ([]string, string, error)) error {
+	count, err := countMessages(page, 0)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s.%s", queueName, QueueDepthStatsSuffix)
+	return c.SetGauge(key, count)
+}
 
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	config, _ := bucket.FetchMap(QueueConfigName)
-	config.FetchSet("queues").Remove([]byte(name))
-	config.Store()
+// countMessages counts the ids page returns, stopping once it passes a positive limit
+func countMessages(page func(continuation string) ([]string, string, error), limit int64) (int64, error) {
+	var count int64
+	continuation := ""
+	for {
+		ids, next, err := page(continuation)
+		if err != nil {
+			return count, err
+		}
+		count += int64(len(ids))
+		if next == "" || (limit > 0 && count > limit) {
+			return count, nil
+		}
+		continuation = next
+	}
+}
 
-	bucketConfig, _ := bucket.FetchMap(queueConfigRecordName(name))
-	bucketConfig.Destroy()
+// RetrieveMessages takes a list of message ids and pulls the actual data from Riak
+func (queue *Queue) RetrieveMessages(ids []string, cfg *Config) []Message {
+	return newMessages(queue.retrieveObjects(context.Background(), ids, cfg))
+}
+
+// retrieveObjects is RetrieveMessages, returning the opened objects
+func (queue *Queue) retrieveObjects(ctx context.Context, ids []string, cfg *Config) []riak.RObject {
+	_, span := queue.startSpan(cfg, ctx, "dynamiq.retrieve_messages")
+	defer span.End(nil)
+	span.SetAttribute("dynamiq.requested", len(ids))
+	start := time.Now()
+	rObjects, timedOut := fetchAll(ids, func(riakKey string) riak.RObject {
+		// Hold a connection for the fetch, so the pool meter shows if these are starving the pool
+		client, release, err := cfg.RiakConnection()
+		if err != nil {
+			// Left out like a missing message, it's served again once its partition is unlocked
+			logrus.Warn(err)
+			return riak.RObject{}
+		}
+		bucket, err := cfg.riakBucketOn(client, "messages", queue.Name)
+		if err != nil {
+			release()
+			logrus.Warn(err)
+			return riak.RObject{}
+		}
+		rObject, err := bucket.Get(riakKey)
+		release()
+		if err != nil || rObject == nil {
+			// This is likely an object not found error, which we get from dupes as partitions resize while
+			// messages are being deleted (happens on new queues, or under any condition triggering a resize)
+			// Thats why it's debug, not error - it's expected in certain conditions, based on how the underlying
+			// library works
+			logrus.Debug(err)
+			return riak.RObject{}
+		}
+		if openMessage(cfg, rObject) != nil {
+			// Leave out messages we can't read, rather than hand back garbage
+			rObject.Data = nil
+		}
+		return *rObject
+	}, cfg.fetchTimeout())
+	if timedOut > 0 {
+		// The messages are still stored, and are served again once their partition is unlocked
+		logrus.Warnf("Gave up on %d of %d messages from queue %s after fetchtimeout", timedOut, len(ids), queue.Name)
+	}
+	span.SetAttribute("dynamiq.timed_out", timedOut)
+	returnVals := make([]riak.RObject, 0)
+	missing := 0
 
-	//return true if queue doesn't exist anymore
-	return !queues.Exists(cfg, name)
+	for _, rObject := range rObjects {
+		//If the key isn't blank, we've got a meaningful object to deal with
+		if len(rObject.Data) > 0 {
+			returnVals = append(returnVals, rObject)
+		}
+		if rObject.Conflict() {
+			queue.repairConflict(cfg, &rObject)
+		} else if len(rObject.Data) == 0 {
+			missing++
+		}
+	}
+	queue.checkBodies(queue.statsClient(cfg), returnVals)
+	recordMissing(queue.statsClient(cfg), queue.Name, len(rObjects), missing, cfg.missingWarnRatio())
+	span.SetAttribute("dynamiq.missing", missing)
+	elapsed := time.Since(start)
+	logrus.Debugf("Get Multi attempted to lookup %d messages, actually returning %d messages", len(ids), len(returnVals))
+	logrus.Debugf("Get Multi Took %s\n", elapsed)
+	return returnVals
 }
 
-// Get gets a message from the queue
-func (queue *Queue) Get(cfg *Config, list *memberlist.Memberlist, batchsize int64) ([]riak.RObject, error) {
-	// grab a riak client
-	client := cfg.RiakConnection()
+// fetchAll runs fetch for every id at once, returning the objects fetched before timeout
+func fetchAll(ids []string, fetch func(id string) riak.RObject, timeout time.Duration) ([]riak.RObject, int) {
+	// Buffered, so fetches finishing after the timeout don't block forever
+	results := make(chan riak.RObject, len(ids))
+	for _, id := range ids {
+		go func(id string) {
+			results <- fetch(id)
+		}(id)
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	rObjects := make([]riak.RObject, 0, len(ids))
+	for len(rObjects) < len(ids) {
+		select {
+		case rObject := <-results:
+			rObjects = append(rObjects, rObject)
+		case <-expired:
+			return rObjects, len(ids) - len(rObjects)
+		}
+	}
+	return rObjects, 0
+}
 
-	//set the bucket
-	bucket, err := client.NewBucketType("messages", queue.Name)
+// GetByID fetches a single message directly by its id, without locking any partitions
+func (queue *Queue) GetByID(cfg *Config, id string) (*Message, error) {
+	bucket, release, err := cfg.RiakBucket("messages", queue.Name)
 	if err != nil {
 		logrus.Error(err)
 		return nil, err
 	}
+	rObject, err := bucket.Get(id)
+	// Repairing a conflict puts the siblings on connections of their own
+	release()
+	return queue.openByID(cfg, rObject, err)
+}
 
-	// get the top and bottom partitions
-	partBottom, partTop, partition, err := queue.Parts.GetPartition(cfg, queue.Name, list)
-
+// openByID opens the message GetByID read, given the error reading it
+func (queue *Queue) openByID(cfg *Config, rObject *riak.RObject, err error) (*Message, error) {
+	if err == riak.NotFound || (err == nil && rObject == nil) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		logrus.Error(err)
+		return nil, ErrRiakUnavailable
+	}
+	if rObject.Conflict() {
+		// The siblings are re-put under new ids, so nothing lives at this id anymore
+		queue.repairConflict(cfg, rObject)
+		return nil, ErrMessageNotFound
+	}
+	if len(rObject.Data) == 0 {
+		return nil, ErrMessageNotFound
+	}
+	err = openMessage(cfg, rObject)
 	if err != nil {
 		return nil, err
 	}
-	//get a list of batchsize message ids
-	messageIds, _, err := bucket.IndexQueryRangePage("id_int", strconv.Itoa(partBottom), strconv.Itoa(partTop), uint32(batchsize), "")
-	defer queue.setQueueDepthApr(cfg.Stats.Client, list, queue.Name, messageIds)
+	queue.checkBodies(queue.statsClient(cfg), []riak.RObject{*rObject})
+	message := newMessage(*rObject)
+	return &message, nil
+}
 
+// compressBody compresses a message body with the queue's compression_algorithm
+func compressBody(cfg *Config, queueName string, body []byte) ([]byte, string, string, error) {
+	c, algorithm, err := cfg.GetCompressor(queueName)
 	if err != nil {
 		logrus.Error(err)
+		return nil, "", "", err
 	}
-	// We need it as 64 for stats reporting
-	messageCount := int64(len(messageIds))
-
-	// return the partition to the parts heap, but only lock it when we have messages
-	if messageCount > 0 {
-		defer queue.Parts.PushPartition(cfg, queue.Name, partition, true)
-	} else {
-		defer queue.Parts.PushPartition(cfg, queue.Name, partition, false)
+	compressedBody, err := c.Compress(body)
+	if err != nil {
+		logrus.Error("Error compressing message body")
+		logrus.Error(err)
+		return body, "", "", nil
 	}
-	defer incrementReceiveCount(cfg.Stats.Client, queue.Name, messageCount)
-	defer recordFillRatio(cfg.Stats.Client, queue.Name, batchsize, messageCount)
-	logrus.Debug("Message retrieved ", messageCount)
-	return queue.RetrieveMessages(messageIds, cfg), err
+	return compressedBody, algorithm, compressorDictionary(c), nil
 }
 
-// Put puts a Message onto the queue
-func (queue *Queue) Put(cfg *Config, message string) string {
-	//Grab our bucket
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("messages", queue.Name)
-	if err == nil {
-		// Prepare the body and compress, if need be
-		var body = []byte(message)
-		var shouldCompress, _ = cfg.GetCompressedMessages(queue.Name)
-		if shouldCompress == true {
-			var compressedBody []byte
-			compressedBody, err = cfg.Compressor.Compress(body)
-			if err != nil {
-				logrus.Error("Error compressing message body")
-				logrus.Error(err)
-			} else {
-				body = compressedBody
-			}
-		}
-
-		//Retrieve a UUID
-		randy, _ := rand.Int(rand.Reader, &MaxIDSize)
-		uuid := randy.String()
-
-		messageObj := bucket.NewObject(uuid)
-		messageObj.Indexes["id_int"] = []string{uuid}
-		// THIS NEEDS TO BE CONFIGURABLE
-		messageObj.ContentType = "application/json"
-		messageObj.Data = body
-		messageObj.Store()
-
-		defer incrementMessageCount(cfg.Stats.Client, queue.Name, 1)
-		return uuid
+// compressorDictionary returns the ID of the dictionary c compresses with, if any
+func compressorDictionary(c compressor.Compressor) string {
+	if z, ok := c.(compressor.ZstdCompressor); ok && z.DictionaryID() != 0 {
+		return strconv.FormatUint(uint64(z.DictionaryID()), 10)
 	}
-	//Actually want to handle this in some other way
 	return ""
 }
 
-// Delete deletes a Message from the queue
-func (queue *Queue) Delete(cfg *Config, id string) bool {
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("messages", queue.Name)
-	if err == nil {
-		err = bucket.Delete(id)
+// openMessage turns the stored data of a message back into the body that was put
+func openMessage(cfg *Config, rObject *riak.RObject) error {
+	data, err := decompressBody(cfg, rObject.Meta, rObject.Data)
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	rObject.Data = data
+	openEnvelope(rObject)
+	return nil
+}
+
+func decompressBody(cfg *Config, meta map[string]string, data []byte) ([]byte, error) {
+	algorithm := meta[CompressedMetaKey]
+	switch algorithm {
+	case "":
+		return data, nil
+	case "true":
+		// Flagged before the algorithm was recorded
+		return cfg.Compressor.Decompress(data)
+	}
+	c, err := compressor.NewCompressor(algorithm)
+	if dictionary := meta[CompressionDictionaryMetaKey]; err == nil && dictionary != "" {
+		// Make sure the dictionary is loaded, so a missing one is reported as such
+		var dictID uint64
+		dictID, err = strconv.ParseUint(dictionary, 10, 32)
 		if err == nil {
-			defer decrementMessageCount(cfg.Stats.Client, queue.Name, 1)
-			return true
+			c, err = compressor.NewZstdCompressor(uint32(dictID))
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
+	return c.Decompress(data)
+}
 
-	// if we got here we're borked
-	// TODO stats cleanup? Possibility that this gets us out of sync
-	logrus.Error(err)
-	return false
+// openEnvelope replaces the data of a message stored in an envelope with its body
+func openEnvelope(rObject *riak.RObject) {
+	messageCodec, ok := codec.ForContentType(rObject.ContentType)
+	if !ok {
+		return
+	}
+	envelope, err := messageCodec.Unmarshal(rObject.Data)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	rObject.ContentType, rObject.Data = envelope.ContentType, envelope.Body
+	if rObject.Meta == nil {
+		rObject.Meta = make(map[string]string)
+	}
+	for key, value := range envelope.Attributes {
+		rObject.Meta[AttributeMetaPrefix+key] = value
+	}
+	if !envelope.Timestamp.IsZero() {
+		rObject.Meta[TimestampMetaKey] = envelope.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
 }
 
-// BatchDelete deletes multiple messages at once
-func (queue *Queue) BatchDelete(cfg *Config, ids []string) (int, error) {
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("messages", queue.Name)
-	errors := 0
-	if err == nil {
-		for _, id := range ids {
-			err = bucket.Delete(id)
-			if err != nil {
-				logrus.Error(err)
-				errors++
-			}
-		}
-		// Don't count deletes that failed
-		defer decrementMessageCount(cfg.Stats.Client, queue.Name, int64(len(ids)-errors))
-	} else {
-		// if we got here we're borked
-		// TODO stats cleanup? Possibility that this gets us out of sync
+func envelopeBody(contentType string, data []byte) (string, []byte) {
+	messageCodec, ok := codec.ForContentType(contentType)
+	if !ok {
+		return contentType, data
+	}
+	envelope, err := messageCodec.Unmarshal(data)
+	if err != nil {
 		logrus.Error(err)
+		return contentType, data
 	}
-	return errors, err
+	return envelope.ContentType, envelope.Body
 }
 
-// RetrieveMessages takes a list of message ids and pulls the actual data from Riak
-func (queue *Queue) RetrieveMessages(ids []string, cfg *Config) []riak.RObject {
-	var rObjectArrayChan = make(chan riak.RObject, len(ids))
-	var rKeys = make(chan string, len(ids))
+// repairConflict read repairs a conflicted message into independent messages
+func (queue *Queue) repairConflict(cfg *Config, rObject *riak.RObject) {
+	queue.repair(cfg, rObject, func(body string) (string, error) {
+		return queue.Put(cfg, body)
+	}, rObject.Destroy)
+}
 
-	start := time.Now()
-	// We might need to decompress the data
-	var decompressMessages, _ = cfg.GetCompressedMessages(queue.Name)
-	// foreach message id we have
-	for i := 0; i < len(ids); i++ {
-		// Kick off a go routine
-		go func() {
-			var riakKey string
-			client := cfg.RiakConnection()
-			bucket, _ := client.NewBucketType("messages", queue.Name)
-			// Pop a key off the rKeys channel
-			riakKey = <-rKeys
-			rObject, err := bucket.Get(riakKey)
-			if err != nil {
-				// This is likely an object not found error, which we get from dupes as partitions resize while
-				// messages are being deleted (happens on new queues, or under any condition triggering a resize)
-				// Thats why it's debug, not error - it's expected in certain conditions, based on how the underlying
-				// library works
-				logrus.Debug(err)
-				// If we didn't get an error, push the riak object into the objectarray channel
-			}
-			if decompressMessages == true {
-				var data, _ = cfg.Compressor.Decompress(rObject.Data)
-				rObject.Data = data
-			}
-			rObjectArrayChan <- *rObject
-		}()
-		// Push the id into the rKeys channel
-		rKeys <- ids[i]
+func (queue *Queue) repair(cfg *Config, rObject *riak.RObject, put func(body string) (string, error), destroy func() error) {
+	policy, err := cfg.GetConflictPolicy(queue.Name)
+	if err != nil {
+		// Splitting never loses a message, so fall back to it
+		logrus.Error(err)
+		policy = ConflictSplit
 	}
-	returnVals := make([]riak.RObject, 0)
-
-	// TODO find a better mechanism than 2 loops?
-	for i := 0; i < len(ids); i++ {
-		// While the above go-rountes are running, just start popping off the channel as available
-		var rObject = <-rObjectArrayChan
-		//If the key isn't blank, we've got a meaningful object to deal with
-		if len(rObject.Data) > 0 {
-			returnVals = append(returnVals, rObject)
+	siblings, _ := resolveSiblings(policy, rObject.Siblings)
+	if discarded := len(rObject.Siblings) - len(siblings); discarded > 0 {
+		logrus.Debugf("conflict_policy %s discarded %d siblings of message %s", policy, discarded, rObject.Key)
+	}
+	var reput int64
+	for _, sibling := range siblings {
+		// Put will compress the data again, so hand it the original body
+		data, err := decompressBody(cfg, sibling.Meta, sibling.Data)
+		if err != nil {
+			logrus.Error(err)
+			continue
 		}
-		// In the event of a key conflict ( due to multiple messages receiving the same id from Random )
-		// we need to Read Repair the object into multiple independent messages
-		// the following code reads any siblings, and re-puts them onto the queue
-		// then deletes the conflicted object
-		if rObject.Conflict() {
-			for _, sibling := range rObject.Siblings {
-				if len(sibling.Data) > 0 {
-					queue.Put(cfg, string(sibling.Data))
-				} else {
-					logrus.Debugf("sibling had no data")
-				}
-			}
-			// delete the object
-			err := rObject.Destroy()
-			if err != nil {
-				logrus.Error(err)
-			}
+		_, data = envelopeBody(sibling.ContentType, data)
+		if _, err = put(string(data)); err != nil {
+			logrus.Error(err)
+			continue
 		}
+		reput++
+	}
+	// A steady stream of these points at ids being generated carelessly
+	var errs stats.Errors
+	errs.Add(queue.statsClient(cfg).Incr(fmt.Sprintf("%s.%s", queue.Name, QueueConflictsStatsSuffix), 1))
+	if reput > 0 {
+		errs.Add(queue.statsClient(cfg).Incr(fmt.Sprintf("%s.%s", queue.Name, QueueReadRepairSiblingsStatsSuffix), reput))
+	}
+	if err := errs.Err(); err != nil {
+		logrus.Error(err)
+	}
+	// delete the object
+	err = destroy()
+	if err != nil {
+		logrus.Error(err)
 	}
-	elapsed := time.Since(start)
-	logrus.Debugf("Get Multi attempted to lookup %d messages, actually returning %d messages", len(ids), len(returnVals))
-	logrus.Debugf("Get Multi Took %s\n", elapsed)
-	return returnVals
 }
 
 func (queues *Queues) syncConfig(cfg *Config) {
 	logrus.Debug("syncing Queue config with Riak")
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("maps", ConfigurationBucket)
+	bucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
 	if err != nil {
 		// This is likely caused by a network blip against the riak node, or the node being down
 		// In lieu of hard-failing the service, which can recover once riak comes back, we'll simply
@@ -356,7 +1685,9 @@ func (queues *Queues) syncConfig(cfg *Config) {
 		return
 	}
 
-	queuesConfig, err := bucket.FetchMap(QueueConfigName)
+	queuesConfig, err := cfg.ConfigMaps.fetchConfigMap(bucket, QueueConfigName)
+	// Each queue syncs on a connection of its own
+	release()
 	if err != nil {
 		if err.Error() == "Object not found" {
 			// This means there are no queues yet
@@ -373,7 +1704,7 @@ func (queues *Queues) syncConfig(cfg *Config) {
 	queues.updateConfig(queuesConfig)
 
 	//iterate the map and add or remove topics that need to be destroyed
-	queueSet := queues.getConfig().AddSet(QueueSetName)
+	queueSet := queues.getConfig().FetchSet(QueueSetName)
 
 	if queueSet == nil {
 		//bail if there aren't any queues
@@ -387,41 +1718,67 @@ func (queues *Queues) syncConfig(cfg *Config) {
 		return
 	}
 
+	queueNames := make([]string, 0, len(queueSlice))
+	for _, queue := range queueSlice {
+		queueNames = append(queueNames, string(queue))
+	}
+	queues.syncQueues(cfg, queueNames, func(name string) {
+		initQueueFromRiak(cfg, name)
+	})
+
+	//sync all topics with riak
+	observers := queues.getObservers()
+	for _, queue := range queues.queueList() {
+		queue.syncConfig(cfg, observers)
+	}
+}
+
+// syncQueues initializes the named queues this node doesn't know of, and drops the rest
+func (queues *Queues) syncQueues(cfg *Config, names []string, initQueue func(name string)) {
 	//Is there a better way to do this?
 	//iterate over the queues in riak and add the missing ones
 	queuesToKeep := make(map[string]bool)
-	for _, queue := range queueSlice {
-		queueName := string(queue)
-		var present bool
-		_, present = queues.QueueMap[queueName]
-		if present != true {
-			initQueueFromRiak(cfg, queueName)
+	for _, queueName := range names {
+		if _, err := queues.GetQueue(queueName); err != nil {
+			initQueue(queueName)
 		}
 		queuesToKeep[queueName] = true
 	}
 
 	//iterate over the topics in topics.TopicMap and delete the ones no longer used
 	topics := cfg.Topics
-	for queue := range queues.QueueMap {
+	queues.RLock()
+	known := make([]string, 0, len(queues.QueueMap))
+	for name := range queues.QueueMap {
+		known = append(known, name)
+	}
+	queues.RUnlock()
+	for _, queue := range known {
 		var present bool
 		_, present = queuesToKeep[queue]
 		if present != true {
-			for topic := range topics.TopicMap {
-				topicQueueList := topics.TopicMap[topic].ListQueues()
+			for _, topic := range topics.topicList() {
+				topicQueueList := topic.ListQueues()
 				for _, topicQueue := range topicQueueList {
 					if topicQueue == string(queue) {
-						topics.TopicMap[topic].DeleteQueue(cfg, string(queue))
+						if err := topic.DeleteQueue(cfg, string(queue)); err != nil {
+							logrus.Error(err)
+						}
 					}
 				}
 			}
+			queues.Lock()
 			delete(queues.QueueMap, queue)
+			queues.Unlock()
 		}
 	}
+}
 
-	//sync all topics with riak
-	for _, queue := range queues.QueueMap {
-		queue.syncConfig(cfg)
-	}
+// SyncNow syncs the queue config with Riak straight away
+func (queues *Queues) SyncNow(cfg *Config) {
+	queues.syncLock.Lock()
+	defer queues.syncLock.Unlock()
+	queues.syncConfig(cfg)
 }
 
 func (queues *Queues) scheduleSync(cfg *Config) {
@@ -429,27 +1786,73 @@ func (queues *Queues) scheduleSync(cfg *Config) {
 	if queues.syncScheduler == nil {
 		queues.syncScheduler = time.NewTicker(cfg.Core.SyncConfigInterval * time.Millisecond)
 	}
+	queues.syncKiller = make(chan struct{})
+	queues.syncStopped = make(chan struct{})
 	// Go routine to listen to either the scheduler or the killer
 	go func(config *Config) {
+		defer close(queues.syncStopped)
 		for {
 			select {
 			// Check to see if we have a tick
 			case <-queues.syncScheduler.C:
-				queues.syncConfig(cfg)
+				queues.SyncNow(cfg)
 			// Check to see if we've been stopped
 			case <-queues.syncKiller:
 				queues.syncScheduler.Stop()
+				// Store what the queues' batch writers are still holding
+				for _, queue := range queues.queueList() {
+					if err := queue.Flush(cfg); err != nil {
+						logrus.Error(err)
+					}
+				}
+				// Send on anything the stats client is still holding before we go
+				err := stats.Flush(cfg.StatsClient())
+				if err != nil {
+					logrus.Error(err)
+				}
 				return
 			}
 		}
 	}(cfg)
 }
 
+// Stop ends the config sync, and any expiry sweeps, and waits for them to exit. It is safe to call more than once
+func (queues *Queues) Stop() {
+	queues.stopOnce.Do(func() {
+		if queues.expireKiller != nil {
+			close(queues.expireKiller)
+			<-queues.expireStopped
+		}
+		if queues.syncKiller == nil {
+			return
+		}
+		close(queues.syncKiller)
+		<-queues.syncStopped
+	})
+}
+
+// ReclaimNode resyncs the partitions when a node leaves the cluster
+func (queues *Queues) ReclaimNode(cfg *Config, nodeName string) {
+	logrus.Infof("Node %s left the cluster, reclaiming its share of the keyspace", nodeName)
+	// Syncing reads the queues' settings, which takes the lock again
+	for _, queue := range queues.queueList() {
+		if queue.Parts != nil {
+			queue.Parts.syncPartitions(cfg, queue.Name)
+		}
+	}
+}
+
 func initQueueFromRiak(cfg *Config, queueName string) {
-	client := cfg.RiakConnection()
 
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	config, _ := bucket.FetchMap(queueConfigRecordName(queueName))
+	bucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		// Left for the next sync to pick up
+		logrus.Error(err)
+		return
+	}
+	config, _ := cfg.ConfigMaps.fetchConfigMap(bucket, queueConfigRecordName(queueName))
+	// InitPartitions reads the settings of a queue not added yet from Riak, on a connection of its own
+	release()
 
 	queue := Queue{
 		Name:   queueName,
@@ -457,25 +1860,75 @@ func initQueueFromRiak(cfg *Config, queueName string) {
 		Config: config,
 	}
 
-	// This is adding a new member to the collection, it shouldn't need a lock?
-	// TODO Keep an eye on this for emergent issues
+	// Lock while adding, so snapshots taken alongside the sync see the queue either way
+	cfg.Queues.Lock()
 	cfg.Queues.QueueMap[queueName] = &queue
+	cfg.Queues.Unlock()
+
+	// Surface a bad algorithm now, rather than on the first put. The queue is still served, so
+	// receives keep working while the config is fixed
+	if _, _, err := cfg.GetCompressor(queueName); err != nil {
+		logrus.Error(err)
+	}
 }
 
-func (queue *Queue) syncConfig(cfg *Config) {
+func (queue *Queue) syncConfig(cfg *Config, observers []QueueObserver) {
 	//refresh the queue RDtMap
-	client := cfg.RiakConnection()
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-
-	rCfg, _ := bucket.FetchMap(queueConfigRecordName(queue.Name))
-	queue.updateConfig(rCfg)
+	bucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		// Keep serving the config we have until the next sync
+		logrus.Error(err)
+		return
+	}
+	rCfg, _ := cfg.ConfigMaps.fetchConfigMap(bucket, queueConfigRecordName(queue.Name))
+	// The rest of the sync can read or write the config, on connections of its own
+	release()
+	queue.updateConfig(queue.statsClient(cfg), rCfg)
 	queue.Parts.syncPartitions(cfg, queue.Name)
+	queue.checkStarvation(cfg, time.Now())
+	// Load the queue's dictionary before any messages compressed with it are received
+	if _, err := cfg.GetCompressionDictionary(queue.Name); err != nil {
+		logrus.Error(err)
+	}
+	queue.sample(cfg, observers, time.Now())
 }
 
-func (queue *Queue) updateConfig(rCfg *riak.RDtMap) {
+// updateConfig swaps in the queue's latest config, logging each setting which changed
+func (queue *Queue) updateConfig(c stats.Client, rCfg *riak.RDtMap) {
 	queue.Lock()
-	defer queue.Unlock()
+	old := queue.Config
 	queue.Config = rCfg
+	queue.Unlock()
+	changes := configChanges(old, rCfg)
+	if len(changes) == 0 {
+		return
+	}
+	for _, change := range changes {
+		logrus.Infof("Queue %s config changed: %s", queue.Name, change)
+	}
+	err := c.Incr(fmt.Sprintf("%s.%s", queue.Name, QueueConfigChangedStatsSuffix), 1)
+	if err != nil {
+		logrus.Error(err)
+	}
+}
+
+// statsClient returns the stats client the queue's stats go through
+func (queue *Queue) statsClient(cfg *Config) stats.Client {
+	return stats.NewPrefixedClient(cfg.StatsClient(), queue.tenant())
+}
+
+// tenant returns the queue's tenant from its cached config
+func (queue *Queue) tenant() string {
+	config := queue.getConfig()
+	if config == nil {
+		return ""
+	}
+	reg := config.FetchRegister(Tenant)
+	if reg == nil {
+		return ""
+	}
+	tenant, _ := registerValueToString(reg)
+	return tenant
 }
 
 func (queue *Queue) getConfig() *riak.RDtMap {
@@ -484,10 +1937,15 @@ func (queue *Queue) getConfig() *riak.RDtMap {
 	return queue.Config
 }
 
+// updateConfig swaps in the latest list of queues, logging any which were added or removed since the last one
 func (queues *Queues) updateConfig(rCfg *riak.RDtMap) {
 	queues.Lock()
-	defer queues.Unlock()
+	old := queues.Config
 	queues.Config = rCfg
+	queues.Unlock()
+	for _, change := range configChanges(old, rCfg) {
+		logrus.Infof("Queue list changed: %s", change)
+	}
 }
 
 func (queues *Queues) getConfig() *riak.RDtMap {
@@ -0,0 +1,1863 @@
+package app_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/codec"
+	"github.com/Tapjoy/dynamiq/app/compressor"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	"github.com/Tapjoy/dynamiq/app/tracing"
+	"github.com/klauspost/compress/zstd"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
+	"github.com/tpjg/goriakpbc/pb"
+)
+
+// flushingClient counts how often it was flushed
+type flushingClient struct {
+	*stats.MemoryClient
+	flushes int
+}
+
+func (c *flushingClient) Flush() error {
+	c.flushes++
+	return nil
+}
+
+var _ = Describe("Queue", func() {
+
+	Context("ClampBatchSize", func() {
+		It("should clamp a batchsize over the queue's max_batch_size", func() {
+			maxBatchSize, _ := cfg.GetMaxBatchSize(testQueueName)
+			Expect(queues.QueueMap[testQueueName].ClampBatchSize(cfg, maxBatchSize*10)).To(Equal(maxBatchSize))
+			Expect(queues.QueueMap[testQueueName].ClampBatchSize(cfg, 5)).To(Equal(int64(5)))
+		})
+
+		It("should reject a zero or negative batchsize", func() {
+			_, err := queues.QueueMap[testQueueName].ClampBatchSize(cfg, 0)
+			Expect(err).To(Equal(app.ErrInvalidBatchSize))
+			_, err = queues.QueueMap[testQueueName].ClampBatchSize(cfg, -5)
+			Expect(err).To(Equal(app.ErrInvalidBatchSize))
+		})
+	})
+
+	Context("storing under a unique id", func() {
+		var bucket *app.MemoryMessages
+		queue := &app.Queue{Name: "unique"}
+		stored := func() map[string]string {
+			bodies := make(map[string]string)
+			for id, object := range bucket.Objects {
+				bodies[id] = string(object.Data)
+			}
+			return bodies
+		}
+
+		BeforeEach(func() {
+			bucket = &app.MemoryMessages{Objects: map[string]riak.RObject{"1": {Key: "1", Data: []byte("first")}}}
+		})
+
+		It("should draw a fresh id when the id is already taken, so both messages survive", func() {
+			object := &riak.RObject{Key: "1", Data: []byte("second"), Indexes: map[string][]string{app.MessageIndexIDInt: {"1"}}}
+			id, err := queue.StoreUniqueWith(cfg, object, func() (string, error) { return "2", nil }, bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(Equal("2"))
+			Expect(stored()).To(Equal(map[string]string{"1": "first", "2": "second"}))
+			Expect(object.Indexes[app.MessageIndexIDInt]).To(Equal([]string{"2"}))
+		})
+
+		It("should give up once every id it drew was taken", func() {
+			object := &riak.RObject{Key: "1", Data: []byte("second"), Indexes: make(map[string][]string)}
+			_, err := queue.StoreUniqueWith(cfg, object, func() (string, error) { return "1", nil }, bucket)
+			Expect(err).To(Equal(app.ErrIDCollision))
+			Expect(stored()).To(Equal(map[string]string{"1": "first"}))
+		})
+
+		It("should draw up to maxputretries more ids, counting every collision", func() {
+			client := stats.NewMemoryClient()
+			retryCfg := &app.Config{Core: app.Core{MaxPutRetries: 4}, Stats: app.Stats{Client: client}}
+			draws := 0
+			object := &riak.RObject{Key: "1", Data: []byte("second"), Indexes: make(map[string][]string)}
+			_, err := queue.StoreUniqueWith(retryCfg, object, func() (string, error) {
+				draws++
+				return "1", nil
+			}, bucket)
+			Expect(err).To(Equal(app.ErrIDCollision))
+			Expect(draws).To(Equal(4))
+			Expect(client.Counter(queue.Name + "." + app.QueuePutCollisionsStatsSuffix)).To(Equal(int64(5)))
+			Expect(stored()).To(Equal(map[string]string{"1": "first"}))
+
+			// An id freed up within the limit is used
+			client.Reset()
+			draws = 0
+			object.Key = "1"
+			id, err := queue.StoreUniqueWith(retryCfg, object, func() (string, error) {
+				draws++
+				return strconv.Itoa(draws), nil
+			}, bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(Equal("2"))
+			Expect(client.Counter(queue.Name + "." + app.QueuePutCollisionsStatsSuffix)).To(Equal(int64(2)))
+		})
+	})
+
+	Context("read repair", func() {
+		It("should count the conflict, and each sibling put again", func() {
+			client := stats.NewMemoryClient()
+			repairConfig := &app.Config{Stats: app.Stats{Client: client}}
+			conflicted := &riak.RObject{Key: "12345", Siblings: []riak.Sibling{
+				{Data: []byte("first")},
+				{Data: []byte("second")},
+				{},
+				{Data: []byte("failing")},
+			}}
+			reput := make([]string, 0)
+			destroyed := false
+			queue := &app.Queue{Name: "conflicted"}
+			queue.RepairConflictWith(repairConfig, conflicted, func(body string) (string, error) {
+				if body == "failing" {
+					return "", app.ErrRiakUnavailable
+				}
+				reput = append(reput, body)
+				return "67890", nil
+			}, func() error {
+				destroyed = true
+				return nil
+			})
+			Expect(reput).To(Equal([]string{"first", "second"}))
+			Expect(destroyed).To(BeTrue())
+			Expect(client.Counter("conflicted." + app.QueueConflictsStatsSuffix)).To(Equal(int64(1)))
+			Expect(client.Counter("conflicted." + app.QueueReadRepairSiblingsStatsSuffix)).To(Equal(int64(2)))
+		})
+
+		Context("conflict_policy", func() {
+			sibling := func(body string, putAt int64) riak.Sibling {
+				return riak.Sibling{Data: []byte(body), Indexes: map[string][]string{app.MessageCreatedIndex: {strconv.FormatInt(putAt, 10)}}}
+			}
+			// repairWith read repairs the siblings under policy, returning the bodies put again
+			repairWith := func(policy string, siblings ...riak.Sibling) []string {
+				config := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+				config.Values[riak.MapKey{Key: app.ConflictPolicy, Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte(policy)}
+				queue := &app.Queue{Name: "conflicted", Config: config}
+				repairConfig := &app.Config{Queues: &app.Queues{QueueMap: map[string]*app.Queue{"conflicted": queue}}}
+				reput := make([]string, 0)
+				destroyed := false
+				queue.RepairConflictWith(repairConfig, &riak.RObject{Key: "12345", Siblings: siblings}, func(body string) (string, error) {
+					reput = append(reput, body)
+					return "67890", nil
+				}, func() error {
+					destroyed = true
+					return nil
+				})
+				Expect(destroyed).To(BeTrue())
+				return reput
+			}
+
+			It("should put every sibling again when splitting", func() {
+				Expect(repairWith(app.ConflictSplit, sibling("retry", 1), sibling("retry", 2))).To(Equal([]string{"retry", "retry"}))
+				Expect(repairWith(app.ConflictSplit, sibling("first", 1), sibling("second", 2))).To(Equal([]string{"first", "second"}))
+			})
+
+			It("should put only the first sibling with data again under first", func() {
+				Expect(repairWith(app.ConflictFirst, sibling("retry", 1), sibling("retry", 2))).To(Equal([]string{"retry"}))
+				Expect(repairWith(app.ConflictFirst, riak.Sibling{}, sibling("first", 2), sibling("second", 1))).To(Equal([]string{"first"}))
+			})
+
+			It("should put only the sibling put last again under last-write-wins", func() {
+				Expect(repairWith(app.ConflictLastWriteWins, sibling("retry", 1), sibling("retry", 2))).To(Equal([]string{"retry"}))
+				Expect(repairWith(app.ConflictLastWriteWins, sibling("newer", 5), sibling("older", 3))).To(Equal([]string{"newer"}))
+				// Siblings which predate the index lose to any which have it
+				Expect(repairWith(app.ConflictLastWriteWins, sibling("indexed", 3), riak.Sibling{Data: []byte("unindexed")})).To(Equal([]string{"indexed"}))
+			})
+
+			It("should fall back to splitting under an unknown policy", func() {
+				Expect(repairWith("newest", sibling("first", 1), sibling("second", 2))).To(Equal([]string{"first", "second"}))
+				Expect(cfg.SetConflictPolicy(testQueueName, "newest")).To(Equal(app.ErrInvalidConflictPolicy))
+			})
+		})
+	})
+
+	Context("fetching messages", func() {
+		It("should return the messages fetched in time, and give up on a slow fetch", func() {
+			release := make(chan struct{})
+			defer close(release)
+			fetch := func(id string) riak.RObject {
+				if id == "slow" {
+					<-release
+				}
+				return riak.RObject{Key: id, Data: []byte(id)}
+			}
+			start := time.Now()
+			rObjects, timedOut := app.FetchAllWith([]string{"first", "slow", "second"}, fetch, 50*time.Millisecond)
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(timedOut).To(Equal(1))
+			keys := make([]string, 0, len(rObjects))
+			for _, rObject := range rObjects {
+				keys = append(keys, rObject.Key)
+			}
+			Expect(keys).To(ConsistOf("first", "second"))
+		})
+
+		It("should wait on every fetch without a timeout", func() {
+			fetch := func(id string) riak.RObject {
+				time.Sleep(20 * time.Millisecond)
+				return riak.RObject{Key: id, Data: []byte(id)}
+			}
+			rObjects, timedOut := app.FetchAllWith([]string{"first", "second"}, fetch, 0)
+			Expect(timedOut).To(BeZero())
+			Expect(rObjects).To(HaveLen(2))
+		})
+	})
+
+	Context("Snapshot", func() {
+		It("should not change along with the queues it was taken from", func() {
+			visibilityKey := riak.MapKey{Key: app.VisibilityTimeout, Type: pb.MapField_REGISTER}
+			config := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+			config.Values[visibilityKey] = &riak.RDtRegister{Value: []byte("30")}
+			snapshotted := &app.Queues{QueueMap: map[string]*app.Queue{
+				"first": {Name: "first", Config: config},
+			}}
+
+			snapshot := snapshotted.Snapshot()
+			Expect(snapshot).To(HaveLen(1))
+			Expect(snapshot["first"].Settings[app.VisibilityTimeout]).To(Equal("30"))
+			// Settings the queue predates are shown with their defaults
+			Expect(snapshot["first"].Settings[app.MaxBatchSize]).To(Equal(app.DefaultSettings[app.MaxBatchSize]))
+
+			config.Values[visibilityKey].(*riak.RDtRegister).Value[0] = '9'
+			snapshotted.QueueMap["second"] = &app.Queue{Name: "second", Config: config}
+			Expect(snapshot).To(HaveLen(1))
+			Expect(snapshot["first"].Settings[app.VisibilityTimeout]).To(Equal("30"))
+			Expect(snapshotted.Snapshot()["first"].Settings[app.VisibilityTimeout]).To(Equal("90"))
+		})
+	})
+
+	Context("config changes", func() {
+		It("should log and count the settings which changed on a sync", func() {
+			configWith := func(visibilityTimeout string) *riak.RDtMap {
+				config := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+				config.Values[riak.MapKey{Key: app.VisibilityTimeout, Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte(visibilityTimeout)}
+				config.Values[riak.MapKey{Key: app.MaxBatchSize, Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte("100")}
+				return config
+			}
+			client := stats.NewMemoryClient()
+			queue := &app.Queue{Name: "audited"}
+			var logged bytes.Buffer
+			logrus.SetOutput(&logged)
+			defer logrus.SetOutput(ioutil.Discard)
+
+			// The first config read is not a change
+			queue.UpdateConfigWith(client, configWith("30"))
+			queue.UpdateConfigWith(client, configWith("30"))
+			Expect(logged.String()).To(BeEmpty())
+			Expect(client.Counter("audited." + app.QueueConfigChangedStatsSuffix)).To(BeZero())
+
+			queue.UpdateConfigWith(client, configWith("60"))
+			Expect(logged.String()).To(ContainSubstring("Queue audited config changed: visibility_timeout 30 -> 60"))
+			Expect(logged.String()).ToNot(ContainSubstring(app.MaxBatchSize))
+			Expect(client.Counter("audited." + app.QueueConfigChangedStatsSuffix)).To(Equal(int64(1)))
+		})
+	})
+
+	Context("when disabled", func() {
+		setRegister := func(name string, value string) {
+			key := riak.MapKey{Key: name, Type: pb.MapField_REGISTER}
+			queues.QueueMap[testQueueName].Config.Values[key] = &riak.RDtRegister{Value: []byte(value)}
+		}
+
+		BeforeEach(func() {
+			setRegister(app.Enabled, "false")
+		})
+
+		AfterEach(func() {
+			setRegister(app.Enabled, app.DefaultSettings[app.Enabled])
+			setRegister(app.RejectPutsWhenDisabled, app.DefaultSettings[app.RejectPutsWhenDisabled])
+		})
+
+		It("should return no messages on Get", func() {
+			messages, err := queues.QueueMap[testQueueName].Get(cfg, memberList, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(BeEmpty())
+		})
+
+		It("should reject puts only when configured to", func() {
+			setRegister(app.RejectPutsWhenDisabled, "true")
+			_, err := queues.QueueMap[testQueueName].BatchPut(cfg, []string{"message"})
+			Expect(err).To(Equal(app.ErrQueueDisabled))
+			uuid, err := queues.QueueMap[testQueueName].Put(cfg, "message")
+			Expect(err).To(Equal(app.ErrQueueDisabled))
+			Expect(uuid).To(BeEmpty())
+		})
+
+		It("should be readable as enabled again once re-enabled", func() {
+			Expect(cfg.GetQueueEnabled(testQueueName)).To(BeFalse())
+			setRegister(app.Enabled, "true")
+			Expect(cfg.GetQueueEnabled(testQueueName)).To(BeTrue())
+		})
+	})
+
+	Context("Stats", func() {
+		It("should match the underlying counters and gauges", func() {
+			statsClient.Reset()
+			statsClient.Incr(testQueueName+"."+app.QueueSentStatsSuffix, 10)
+			statsClient.Incr(testQueueName+"."+app.QueueReceivedStatsSuffix, 7)
+			statsClient.Incr(testQueueName+"."+app.QueueDeletedStatsSuffix, 4)
+			statsClient.SetGauge(testQueueName+"."+app.QueueDepthAprStatsSuffix, 6)
+			statsClient.SetGauge(testQueueName+"."+app.QueueFillDeltaStatsSuffix, 70)
+
+			queueStats, err := queues.QueueMap[testQueueName].Stats(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(queueStats).To(Equal(app.QueueStats{Name: testQueueName, Sent: 10, Received: 7, Deleted: 4, ApproxDepth: 6, FillRatio: 70}))
+		})
+
+		It("should namespace each queue's stats under its tenant", func() {
+			client := stats.NewMemoryClient()
+			tenantCfg := &app.Config{Stats: app.Stats{Client: client}}
+			queueFor := func(name string, tenant string) *app.Queue {
+				config := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+				config.Values[riak.MapKey{Key: app.Tenant, Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte(tenant)}
+				return &app.Queue{Name: name, Config: config}
+			}
+			acme, globex, shared := queueFor("orders", "acme"), queueFor("orders", "globex"), &app.Queue{Name: "orders"}
+
+			Expect(acme.StatsClient(tenantCfg).Incr("orders."+app.QueueSentStatsSuffix, 3)).To(Succeed())
+			Expect(globex.StatsClient(tenantCfg).Incr("orders."+app.QueueSentStatsSuffix, 5)).To(Succeed())
+			Expect(shared.StatsClient(tenantCfg).Incr("orders."+app.QueueSentStatsSuffix, 7)).To(Succeed())
+			Expect(client.Counter("acme.orders." + app.QueueSentStatsSuffix)).To(Equal(int64(3)))
+			Expect(client.Counter("globex.orders." + app.QueueSentStatsSuffix)).To(Equal(int64(5)))
+			Expect(client.Counter("orders." + app.QueueSentStatsSuffix)).To(Equal(int64(7)))
+
+			// Each reads back its own namespace only
+			acmeStats, err := acme.Stats(tenantCfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(acmeStats.Sent).To(Equal(int64(3)))
+			globexStats, err := globex.Stats(tenantCfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(globexStats.Sent).To(Equal(int64(5)))
+		})
+
+		It("should only allow tenants which add a single level to the keys", func() {
+			Expect(cfg.SetTenant(testQueueName, "acme.corp")).To(Equal(app.ErrInvalidTenant))
+			Expect(cfg.SetTenant(testQueueName, "acme corp")).To(Equal(app.ErrInvalidTenant))
+		})
+	})
+
+	Context("message envelopes", func() {
+		It("should store messages as is by default", func() {
+			Expect(cfg.GetMessageCodec(testQueueName)).To(BeNil())
+		})
+
+		It("should unwrap the body of an enveloped message", func() {
+			msgpack := codec.NewMsgpackCodec()
+			data, _ := msgpack.Marshal(codec.Envelope{Body: []byte("body"), ContentType: "application/json"})
+			rObject := &riak.RObject{Key: "1", ContentType: msgpack.ContentType(), Data: data}
+			app.OpenEnvelope(rObject)
+			Expect(rObject.Data).To(Equal([]byte("body")))
+			Expect(rObject.ContentType).To(Equal("application/json"))
+		})
+
+		It("should leave messages stored without an envelope alone", func() {
+			rObject := &riak.RObject{Key: "1", ContentType: "application/json", Data: []byte("body")}
+			app.OpenEnvelope(rObject)
+			Expect(rObject.Data).To(Equal([]byte("body")))
+		})
+	})
+
+	Context("compression", func() {
+		It("should read back a queue holding both compressed and uncompressed messages", func() {
+			compressingCfg := &app.Config{Compressor: compressor.NewZlibCompressor()}
+			compressed, _ := compressingCfg.Compressor.Compress([]byte("compressed body"))
+			messages := []*riak.RObject{
+				{Key: "1", Meta: map[string]string{app.CompressedMetaKey: "true"}, Data: compressed},
+				{Key: "2", Meta: map[string]string{}, Data: []byte("plain body")},
+				{Key: "3", Data: []byte("body from before the flag")},
+			}
+			for _, message := range messages {
+				Expect(app.OpenMessage(compressingCfg, message)).To(Succeed())
+			}
+			Expect(string(messages[0].Data)).To(Equal("compressed body"))
+			Expect(string(messages[1].Data)).To(Equal("plain body"))
+			Expect(string(messages[2].Data)).To(Equal("body from before the flag"))
+		})
+
+		It("should record the content encoding applied, and read it back with the message", func() {
+			queue := queues.QueueMap[testQueueName]
+			for shouldCompress, encoding := range map[bool]string{true: "deflate", false: app.ContentEncodingIdentity} {
+				object, stored, err := queue.NewMessageObjectWith(cfg, "body", nil, shouldCompress)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(object.Meta[app.ContentEncodingMetaKey]).To(Equal(encoding))
+				Expect(stored.ContentEncoding).To(Equal(encoding))
+
+				Expect(app.OpenMessage(cfg, object)).To(Succeed())
+				message := app.NewMessage(*object)
+				Expect(string(message.Body)).To(Equal("body"))
+				Expect(message.ContentEncoding).To(Equal(encoding))
+			}
+		})
+
+		It("should work out the content encoding of messages stored before it was recorded", func() {
+			Expect(app.NewMessage(riak.RObject{Key: "1", Meta: map[string]string{app.CompressedMetaKey: "true"}}).ContentEncoding).To(Equal("deflate"))
+			Expect(app.NewMessage(riak.RObject{Key: "2", Meta: map[string]string{app.CompressedMetaKey: "lzw"}}).ContentEncoding).To(Equal("compress"))
+		})
+
+		Context("with a body checksum", func() {
+			checksumKey := riak.MapKey{Key: app.BodyChecksum, Type: pb.MapField_REGISTER}
+
+			AfterEach(func() {
+				queues.QueueMap[testQueueName].Config.Values[checksumKey] = &riak.RDtRegister{Value: []byte(app.DefaultSettings[app.BodyChecksum])}
+			})
+
+			It("should match the body once the message is opened again", func() {
+				queue := queues.QueueMap[testQueueName]
+				for _, algorithm := range []string{app.ChecksumCRC32, app.ChecksumSHA256} {
+					queues.QueueMap[testQueueName].Config.Values[checksumKey] = &riak.RDtRegister{Value: []byte(algorithm)}
+					object, _, err := queue.NewMessageObjectWith(cfg, "checked body", codec.NewJSONCodec(), true)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(object.Meta[app.ChecksumMetaKey]).To(HavePrefix(algorithm + ":"))
+					Expect(app.OpenMessage(cfg, object)).To(Succeed())
+					Expect(queue.CheckBodies(stats.NewMemoryClient(), []riak.RObject{*object})).To(BeZero())
+				}
+			})
+
+			It("should detect a body which was corrupted in storage", func() {
+				queue := queues.QueueMap[testQueueName]
+				queues.QueueMap[testQueueName].Config.Values[checksumKey] = &riak.RDtRegister{Value: []byte(app.ChecksumCRC32)}
+				object, _, err := queue.NewMessageObjectWith(cfg, "checked body", nil, false)
+				Expect(err).ToNot(HaveOccurred())
+				object.Data[0] ^= 0xff
+				Expect(app.OpenMessage(cfg, object)).To(Succeed())
+
+				client := stats.NewMemoryClient()
+				Expect(queue.CheckBodies(client, []riak.RObject{*object})).To(Equal(1))
+				Expect(client.Counter(testQueueName + "." + app.QueueChecksumMismatchStatsSuffix)).To(Equal(int64(1)))
+			})
+
+			It("should store messages without a checksum by default", func() {
+				object, _, err := queues.QueueMap[testQueueName].NewMessageObjectWith(cfg, "body", nil, false)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(object.Meta).ToNot(HaveKey(app.ChecksumMetaKey))
+			})
+		})
+
+		Context("with a registered compressor", func() {
+			var identity *identityCompressor
+			algorithmKey := riak.MapKey{Key: app.CompressionAlgorithm, Type: pb.MapField_REGISTER}
+
+			BeforeEach(func() {
+				identity = &identityCompressor{}
+				compressor.RegisterCompressor("identity", func() compressor.Compressor { return identity })
+				queues.QueueMap[testQueueName].Config.Values[algorithmKey] = &riak.RDtRegister{Value: []byte("identity")}
+			})
+
+			AfterEach(func() {
+				queues.QueueMap[testQueueName].Config.Values[algorithmKey] = &riak.RDtRegister{Value: []byte(app.DefaultSettings[app.CompressionAlgorithm])}
+			})
+
+			It("should round-trip a message through the queue's algorithm", func() {
+				body, algorithm, err := app.CompressBody(cfg, testQueueName, []byte("custom body"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(algorithm).To(Equal("identity"))
+
+				message := &riak.RObject{Key: "1", Meta: map[string]string{app.CompressedMetaKey: algorithm}, Data: body}
+				Expect(app.OpenMessage(cfg, message)).To(Succeed())
+				Expect(string(message.Data)).To(Equal("custom body"))
+				Expect(identity.compressed).To(Equal(1))
+				Expect(identity.decompressed).To(Equal(1))
+			})
+
+			It("should report an algorithm which isn't registered as a config error", func() {
+				queues.QueueMap[testQueueName].Config.Values[algorithmKey] = &riak.RDtRegister{Value: []byte("no_such_algorithm")}
+				_, _, err := cfg.GetCompressor(testQueueName)
+				Expect(err).To(MatchError(ContainSubstring("invalid compression_algorithm")))
+				_, _, err = app.CompressBody(cfg, testQueueName, []byte("body"))
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("with a zstd dictionary", func() {
+			var path string
+			algorithmKey := riak.MapKey{Key: app.CompressionAlgorithm, Type: pb.MapField_REGISTER}
+			dictionaryKey := riak.MapKey{Key: app.CompressionDictionary, Type: pb.MapField_REGISTER}
+			order := func(i int) string {
+				return fmt.Sprintf(`{"order_id": %d, "status": "shipped", "customer": {"tier": "gold", "region": "us-east-1"}, "items": [{"sku": "SKU-%d", "quantity": 1}]}`, i, i%7)
+			}
+
+			BeforeEach(func() {
+				samples := make([][]byte, 0, 100)
+				for i := 0; i < 100; i++ {
+					samples = append(samples, []byte(order(i)))
+				}
+				dict, err := zstd.BuildDict(zstd.BuildDictOptions{ID: 4242, Contents: samples, History: bytes.Join(samples[:20], nil), Offsets: [3]int{1, 4, 8}})
+				Expect(err).ToNot(HaveOccurred())
+				file, err := ioutil.TempFile("", "dynamiq-dictionary")
+				Expect(err).ToNot(HaveOccurred())
+				_, err = file.Write(dict)
+				Expect(err).ToNot(HaveOccurred())
+				file.Close()
+				path = file.Name()
+				queues.QueueMap[testQueueName].Config.Values[algorithmKey] = &riak.RDtRegister{Value: []byte("zstd")}
+			})
+
+			AfterEach(func() {
+				queues.QueueMap[testQueueName].Config.Values[algorithmKey] = &riak.RDtRegister{Value: []byte(app.DefaultSettings[app.CompressionAlgorithm])}
+				queues.QueueMap[testQueueName].Config.Values[dictionaryKey] = &riak.RDtRegister{Value: []byte(app.DefaultSettings[app.CompressionDictionary])}
+				os.Remove(path)
+			})
+
+			It("should round-trip messages, compressing them smaller than without it", func() {
+				queue := queues.QueueMap[testQueueName]
+				message := order(1000)
+				plain, _, err := queue.NewMessageObjectWith(cfg, message, nil, true)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(plain.Meta).ToNot(HaveKey(app.CompressionDictionaryMetaKey))
+
+				queue.Config.Values[dictionaryKey] = &riak.RDtRegister{Value: []byte(path)}
+				object, _, err := queue.NewMessageObjectWith(cfg, message, nil, true)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(object.Meta[app.CompressedMetaKey]).To(Equal("zstd"))
+				Expect(object.Meta[app.CompressionDictionaryMetaKey]).To(Equal("4242"))
+				Expect(len(object.Data)).To(BeNumerically("<", len(plain.Data)))
+
+				for _, stored := range []*riak.RObject{plain, object} {
+					Expect(app.OpenMessage(cfg, stored)).To(Succeed())
+					Expect(string(stored.Data)).To(Equal(message))
+				}
+			})
+
+			It("should report a message compressed with a dictionary which isn't loaded", func() {
+				message := &riak.RObject{Key: "1", Meta: map[string]string{app.CompressedMetaKey: "zstd", app.CompressionDictionaryMetaKey: "9999"}, Data: []byte("data")}
+				Expect(app.OpenMessage(cfg, message)).To(MatchError(ContainSubstring("No zstd dictionary is registered with ID 9999")))
+			})
+
+			It("should reject a file which isn't a dictionary", func() {
+				Expect(ioutil.WriteFile(path, []byte("not a dictionary"), 0644)).To(Succeed())
+				Expect(cfg.SetCompressionDictionary(testQueueName, path)).To(MatchError(ContainSubstring("isn't a zstd dictionary")))
+			})
+		})
+	})
+
+	Context("fill ratio", func() {
+		fillKey := testQueueName + "." + app.QueueFillDeltaStatsSuffix
+		preciseKey := testQueueName + "." + app.QueueFillPreciseStatsSuffix
+
+		It("should round a third of a batch as configured", func() {
+			expected := map[string]int64{"": 33, app.FillRatioFloor: 33, app.FillRatioRound: 33, app.FillRatioCeil: 34}
+			for rounding, rate := range expected {
+				client := stats.NewMemoryClient()
+				Expect(app.RecordFillRatio(client, testQueueName, 3, 1, rounding, false)).To(Succeed())
+				Expect(client.Gauge(fillKey)).To(Equal(rate), "rounding %q", rounding)
+				Expect(client.Gauge(preciseKey)).To(Equal(int64(0)))
+			}
+			client := stats.NewMemoryClient()
+			Expect(app.RecordFillRatio(client, testQueueName, 3, 2, app.FillRatioRound, false)).To(Succeed())
+			Expect(client.Gauge(fillKey)).To(Equal(int64(67)))
+		})
+
+		It("should keep whole percentages exact", func() {
+			client := stats.NewMemoryClient()
+			Expect(app.RecordFillRatio(client, testQueueName, 10, 7, app.FillRatioCeil, false)).To(Succeed())
+			Expect(client.Gauge(fillKey)).To(Equal(int64(70)))
+		})
+
+		It("should tell a nearly empty receive apart from an empty one when precise", func() {
+			client := stats.NewMemoryClient()
+			Expect(app.RecordFillRatio(client, testQueueName, 3, 1, app.FillRatioFloor, true)).To(Succeed())
+			Expect(client.Gauge(preciseKey)).To(Equal(int64(3333)))
+			Expect(app.RecordFillRatio(client, testQueueName, 1000, 1, app.FillRatioFloor, true)).To(Succeed())
+			Expect(client.Gauge(fillKey)).To(Equal(int64(0)))
+			Expect(client.Gauge(preciseKey)).To(Equal(int64(10)))
+		})
+	})
+
+	Context("missing messages", func() {
+		It("should count the messages a receive didn't find", func() {
+			client := stats.NewMemoryClient()
+			missingKey := testQueueName + "." + app.QueueGetMissingStatsSuffix
+			Expect(app.RecordMissing(client, testQueueName, 10, 3, app.DefaultMissingWarnRatio)).To(Succeed())
+			Expect(client.Counter(missingKey)).To(Equal(int64(3)))
+			Expect(app.RecordMissing(client, testQueueName, 10, 0, app.DefaultMissingWarnRatio)).To(Succeed())
+			Expect(app.RecordMissing(client, testQueueName, 4, 4, app.DefaultMissingWarnRatio)).To(Succeed())
+			Expect(client.Counter(missingKey)).To(Equal(int64(7)))
+		})
+	})
+
+	Context("message ids", func() {
+		It("should sort padded ids as strings in the same order as numbers", func() {
+			numbers := []int64{5, 123456789, 42, math.MaxInt64, 0, 9000000000000000000, 77}
+			ids := make([]string, len(numbers))
+			for i, number := range numbers {
+				ids[i] = app.PadMessageID(strconv.FormatInt(number, 10), app.MessageIDDigits)
+				Expect(ids[i]).To(HaveLen(app.MessageIDDigits))
+			}
+			sort.Strings(ids)
+			sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+			for i, id := range ids {
+				// setQueueDepthApr parses ids back into numbers, which has to survive the padding
+				parsed, err := strconv.ParseInt(id, 10, 64)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(parsed).To(Equal(numbers[i]))
+			}
+		})
+
+		It("should leave ids alone when padding is off", func() {
+			Expect(app.PadMessageID("42", 0)).To(Equal("42"))
+		})
+	})
+
+	Context("index pages", func() {
+		stored := make([]string, 25)
+		for i := range stored {
+			stored[i] = strconv.Itoa(i)
+		}
+		var limits []uint32
+		// index serves the stored ids a page at a time, continuing from the offset it hands back
+		index := func(limit uint32, continuation string) ([]string, string, error) {
+			limits = append(limits, limit)
+			offset, _ := strconv.Atoi(continuation)
+			end := offset + int(limit)
+			if end >= len(stored) {
+				return stored[offset:], "", nil
+			}
+			return stored[offset:end], strconv.Itoa(end), nil
+		}
+
+		BeforeEach(func() {
+			limits = nil
+		})
+
+		It("should read a batch larger than a page across several pages", func() {
+			ids, err := app.PageIDsWith(22, 10, index)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ids).To(Equal(stored[:22]))
+			Expect(limits).To(Equal([]uint32{10, 10, 2}))
+		})
+
+		It("should stop once the index runs out", func() {
+			ids, err := app.PageIDsWith(100, 10, index)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ids).To(Equal(stored))
+			Expect(limits).To(HaveLen(3))
+		})
+
+		It("should read the whole batch at once without a page size", func() {
+			ids, err := app.PageIDsWith(22, 0, index)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ids).To(Equal(stored[:22]))
+			Expect(limits).To(Equal([]uint32{22}))
+		})
+	})
+
+	Context("message index", func() {
+		AfterEach(func() {
+			cfg.Core.MessageIndex = ""
+			cfg.Core.MessageIDWidth = 0
+		})
+
+		It("should query the same ids from $key as from id_int", func() {
+			cfg.Core.MessageIDWidth = app.MessageIDDigits
+			queue := queues.QueueMap[testQueueName]
+			var objects []*riak.RObject
+			for i := 0; i < 200; i++ {
+				object, _, err := queue.NewMessageObjectWith(cfg, "body", nil, false)
+				Expect(err).ToNot(HaveOccurred())
+				objects = append(objects, object)
+			}
+			// id_int is an integer index, compared as numbers, while $key compares keys as strings
+			query := func(index string, min string, max string) []string {
+				var ids []string
+				for _, object := range objects {
+					if index == app.MessageIndexKey {
+						if object.Key >= min && object.Key <= max {
+							ids = append(ids, object.Key)
+						}
+						continue
+					}
+					term, _ := strconv.ParseInt(object.Indexes[app.MessageIndexIDInt][0], 10, 64)
+					bottom, _ := strconv.ParseInt(min, 10, 64)
+					top, _ := strconv.ParseInt(max, 10, 64)
+					if term >= bottom && term <= top {
+						ids = append(ids, object.Key)
+					}
+				}
+				sort.Strings(ids)
+				return ids
+			}
+			partitions := [][2]int64{{0, 42}, {43, math.MaxInt64 / 4}, {math.MaxInt64/4 + 1, math.MaxInt64}}
+			total := 0
+			for _, partition := range partitions {
+				bottom, top := partition[0], partition[1]
+				cfg.Core.MessageIndex = app.MessageIndexIDInt
+				min, max := cfg.IDRange(bottom, top)
+				byIDInt := query(app.MessageIndexIDInt, min, max)
+				cfg.Core.MessageIndex = app.MessageIndexKey
+				min, max = cfg.IDRange(bottom, top)
+				byKey := query(app.MessageIndexKey, min, max)
+				Expect(byKey).To(Equal(byIDInt))
+				total += len(byKey)
+			}
+			Expect(total).To(Equal(len(objects)))
+		})
+
+		It("should only store id_int when reading from it", func() {
+			cfg.Core.MessageIDWidth = app.MessageIDDigits
+			object, _, err := queues.QueueMap[testQueueName].NewMessageObjectWith(cfg, "body", nil, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(object.Indexes[app.MessageIndexIDInt]).To(Equal([]string{object.Key}))
+			cfg.Core.MessageIndex = app.MessageIndexKey
+			object, _, err = queues.QueueMap[testQueueName].NewMessageObjectWith(cfg, "body", nil, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(object.Indexes).ToNot(HaveKey(app.MessageIndexIDInt))
+		})
+	})
+
+	Context("Delete", func() {
+		var bucket *app.MemoryMessages
+		var client *stats.MemoryClient
+		var queue *app.Queue
+		deletedKey := testQueueName + "." + app.QueueDeletedStatsSuffix
+
+		BeforeEach(func() {
+			bucket = &app.MemoryMessages{Objects: map[string]riak.RObject{"1": {Key: "1"}, "2": {Key: "2"}}}
+			client = stats.NewMemoryClient()
+			queue = queues.QueueMap[testQueueName]
+		})
+
+		It("should delete a stored message", func() {
+			Expect(queue.DeleteWith(client, "1", bucket)).To(Succeed())
+			Expect(bucket.Objects).ToNot(HaveKey("1"))
+			Expect(client.Counter(deletedKey)).To(Equal(int64(1)))
+		})
+
+		It("should treat a missing message as deleted, without counting it", func() {
+			Expect(queue.DeleteWith(client, "3", bucket)).To(Succeed())
+			Expect(client.Counter(deletedKey)).To(Equal(int64(0)))
+		})
+
+		It("should only count a message deleted twice once", func() {
+			Expect(queue.DeleteWith(client, "1", bucket)).To(Succeed())
+			Expect(queue.DeleteWith(client, "1", bucket)).To(Succeed())
+			Expect(client.Counter(deletedKey)).To(Equal(int64(1)))
+			Expect(client.Gauge(testQueueName + "." + app.QueueDepthStatsSuffix)).To(Equal(int64(-1)))
+			Expect(queue.BatchDeleteWith(client, []string{"1", "2", "2"}, bucket)).To(Equal(0))
+			Expect(client.Counter(deletedKey)).To(Equal(int64(2)))
+		})
+
+		It("should treat a message deleted since it was looked up as deleted", func() {
+			bucket.Raced = map[string]bool{"1": true}
+			Expect(queue.DeleteWith(client, "1", bucket)).To(Succeed())
+			Expect(client.Counter(deletedKey)).To(Equal(int64(0)))
+		})
+
+		It("should still report real errors", func() {
+			down := errors.New("riak is down")
+			bucket.Err = down
+			Expect(queue.DeleteWith(client, "1", bucket)).To(Equal(down))
+			Expect(queue.BatchDeleteWith(client, []string{"1", "2"}, bucket)).To(Equal(2))
+			Expect(client.Counter(deletedKey)).To(Equal(int64(0)))
+		})
+	})
+
+	Context("tracing", func() {
+		var tracer *tracing.MemoryTracer
+
+		BeforeEach(func() {
+			tracer = tracing.NewMemoryTracer()
+			cfg.Tracer = tracer
+		})
+
+		AfterEach(func() {
+			cfg.Tracer = nil
+			cfg.RiakBreaker = nil
+		})
+
+		It("should record a span for each put and get", func() {
+			cfg.RiakBreaker = app.NewBreaker(1, time.Hour, time.Hour)
+			cfg.RiakBreaker.Record(errors.New("riak is down"))
+			queue := queues.QueueMap[testQueueName]
+			_, err := queue.Put(cfg, "message")
+			Expect(err).To(Equal(app.ErrBreakerOpen))
+			_, err = queue.Get(cfg, memberList, 10)
+			Expect(err).To(Equal(app.ErrBreakerOpen))
+
+			spans := tracer.Spans()
+			Expect(spans).To(HaveLen(2))
+			Expect(spans[0].Name).To(Equal("dynamiq.put"))
+			Expect(spans[0].Attributes).To(HaveKeyWithValue("dynamiq.queue", testQueueName))
+			Expect(spans[0].Err).To(Equal(app.ErrBreakerOpen))
+			Expect(spans[1].Name).To(Equal("dynamiq.get"))
+			Expect(spans[1].Attributes).To(HaveKeyWithValue("dynamiq.batch_size", int64(10)))
+		})
+
+		It("should carry the producer's trace in the message's attributes", func() {
+			ctx, producer := tracer.Start(context.Background(), "producer")
+			msgpack := codec.NewMsgpackCodec()
+			object, stored, err := queues.QueueMap[testQueueName].NewTracedMessageObjectWith(ctx, cfg, "body", msgpack)
+			Expect(err).ToNot(HaveOccurred())
+			producer.End(nil)
+			envelope, err := msgpack.Unmarshal(object.Data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(envelope.Attributes).To(HaveKey(tracing.TraceParentKey))
+			Expect(stored.Attributes).To(Equal(envelope.Attributes))
+
+			_, consumer := tracer.Start(tracer.Extract(context.Background(), envelope.Attributes), "consumer")
+			consumer.End(nil)
+			spans := tracer.Spans()
+			Expect(spans[1].TraceID).To(Equal(spans[0].TraceID))
+			Expect(spans[1].ParentID).To(Equal(spans[0].SpanID))
+		})
+
+		It("should leave messages alone while tracing is off", func() {
+			cfg.Tracer = nil
+			object, _, err := queues.QueueMap[testQueueName].NewTracedMessageObjectWith(context.Background(), cfg, "body", codec.NewJSONCodec())
+			Expect(err).ToNot(HaveOccurred())
+			envelope, err := codec.NewJSONCodec().Unmarshal(object.Data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(envelope.Attributes).To(BeEmpty())
+		})
+	})
+
+	Context("Inspect", func() {
+		var queue *app.Queue
+
+		BeforeEach(func() {
+			queue = &app.Queue{Name: testQueueName, Config: queues.QueueMap[testQueueName].Config}
+			queue.Parts = app.InitPartitions(cfg, testQueueName)
+			queue.Parts.Resize(cfg, testQueueName, 5)
+		})
+
+		It("should count every message in exactly one partition", func() {
+			ids := []int{0, 1, 42, math.MaxInt64 / 5, math.MaxInt64 / 3, math.MaxInt64 / 2, math.MaxInt64 - 5}
+			for i := 0; i < 100; i++ {
+				ids = append(ids, rand.Intn(math.MaxInt64-5))
+			}
+			infos, err := queue.InspectWith(cfg, memberList, func(bottom int, top int) (int64, error) {
+				var count int64
+				for _, id := range ids {
+					if id >= bottom && id <= top {
+						count++
+					}
+				}
+				return count, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(infos).To(HaveLen(5))
+			var total int64
+			for i, info := range infos {
+				Expect(info.ID).To(Equal(i))
+				Expect(info.Owner).To(Equal(memberList.LocalNode().Name))
+				total += info.Count
+			}
+			Expect(total).To(Equal(int64(len(ids))))
+		})
+
+		It("should report the partitions which are leased", func() {
+			_, _, checkedOut, err := queue.Parts.GetPartition(cfg, testQueueName, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			_, _, locked, err := queue.Parts.GetPartition(cfg, testQueueName, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			queue.Parts.PushPartition(cfg, testQueueName, locked, true)
+			infos, err := queue.InspectWith(cfg, memberList, func(bottom int, top int) (int64, error) { return 0, nil })
+			Expect(err).ToNot(HaveOccurred())
+			for _, info := range infos {
+				switch info.ID {
+				case checkedOut.ID:
+					Expect(info.Leased).To(BeTrue())
+					Expect(info.LeasedUntil.IsZero()).To(BeTrue())
+				case locked.ID:
+					Expect(info.Leased).To(BeTrue())
+					Expect(info.LeasedUntil).To(BeTemporally(">", time.Now()))
+				default:
+					Expect(info.Leased).To(BeFalse())
+				}
+			}
+		})
+	})
+
+	Context("PeekPartition", func() {
+		var queue *app.Queue
+		var stored []int
+		var bucket *app.MemoryMessages
+
+		BeforeEach(func() {
+			queue = &app.Queue{Name: testQueueName, Config: queues.QueueMap[testQueueName].Config}
+			queue.Parts = app.InitPartitions(cfg, testQueueName)
+			queue.Parts.Resize(cfg, testQueueName, 5)
+			step := math.MaxInt64 / 10
+			stored = []int{}
+			bucket = &app.MemoryMessages{Objects: make(map[string]riak.RObject)}
+			for i := 0; i < 10; i++ {
+				stored = append(stored, i*step+1, i*step+2)
+			}
+			for _, id := range stored {
+				key := strconv.Itoa(id)
+				bucket.Objects[key] = riak.RObject{Key: key, Data: []byte("body " + key)}
+			}
+		})
+
+		It("should return only the messages within the partition's range", func() {
+			infos, err := queue.InspectWith(cfg, memberList, func(bottom int, top int) (int64, error) { return 0, nil })
+			Expect(err).ToNot(HaveOccurred())
+			statsClient.Reset()
+			for _, info := range infos {
+				within := 0
+				for _, id := range stored {
+					if id >= info.Bottom && id < info.Top {
+						within++
+					}
+				}
+				messages, err := queue.PeekPartitionWith(cfg, memberList, info.ID, 100, bucket)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(messages).To(HaveLen(within))
+				for _, message := range messages {
+					id, _ := strconv.Atoi(message.ID)
+					Expect(id).To(BeNumerically(">=", info.Bottom))
+					Expect(id).To(BeNumerically("<", info.Top))
+					Expect(message.Body).To(Equal([]byte("body " + message.ID)))
+				}
+			}
+			Expect(statsClient.Snapshot().Counters).To(BeEmpty())
+			Expect(statsClient.Snapshot().Gauges).To(BeEmpty())
+		})
+
+		It("should leave the partition and its messages as they were", func() {
+			first, err := queue.PeekPartitionWith(cfg, memberList, 0, 2, bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(first).To(HaveLen(2))
+			again, err := queue.PeekPartitionWith(cfg, memberList, 0, 2, bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(again).To(Equal(first))
+			Expect(queue.Parts.InFlightCount(30)).To(BeZero())
+		})
+
+		It("should reject partitions the node doesn't have", func() {
+			_, err := queue.PeekPartitionWith(cfg, memberList, 5, 10, bucket)
+			Expect(err).To(Equal(app.ErrInvalidPartition))
+			_, err = queue.PeekPartitionWith(cfg, memberList, -1, 10, bucket)
+			Expect(err).To(Equal(app.ErrInvalidPartition))
+			_, err = queue.PeekPartitionWith(cfg, memberList, 0, 0, bucket)
+			Expect(err).To(Equal(app.ErrInvalidBatchSize))
+		})
+	})
+
+	Context("Get", func() {
+		var queue *app.Queue
+		var bucket *app.MemoryMessages
+
+		BeforeEach(func() {
+			queue = &app.Queue{Name: testQueueName, Config: queues.QueueMap[testQueueName].Config}
+			queue.Parts = app.InitPartitions(cfg, testQueueName)
+			bucket = &app.MemoryMessages{}
+		})
+
+		AfterEach(func() {
+			cfg.Core.EmptyQueueError = false
+		})
+
+		It("should return no messages and no error for an empty queue", func() {
+			messages, err := queue.GetWith(cfg, memberList, 10, bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(BeEmpty())
+		})
+
+		It("should return ErrQueueEmpty for an empty queue with emptyqueueerror set", func() {
+			cfg.Core.EmptyQueueError = true
+			messages, err := queue.GetWith(cfg, memberList, 10, bucket)
+			Expect(err).To(Equal(app.ErrQueueEmpty))
+			Expect(messages).To(BeEmpty())
+		})
+
+		It("should return the error of a query which failed", func() {
+			failure := errors.New("index unavailable")
+			bucket.Err = failure
+			for _, emptyQueueError := range []bool{false, true} {
+				cfg.Core.EmptyQueueError = emptyQueueError
+				messages, err := queue.GetWith(cfg, memberList, 10, bucket)
+				Expect(err).To(Equal(failure))
+				Expect(messages).To(BeEmpty())
+			}
+		})
+
+		It("should return the messages it found without an error", func() {
+			cfg.Core.EmptyQueueError = true
+			// One partition, so the message is in whichever is received from
+			queue.Parts.Resize(cfg, testQueueName, 1)
+			bucket.Objects = map[string]riak.RObject{"1": {Key: "1", Data: []byte("body")}}
+			messages, err := queue.GetWith(cfg, memberList, 10, bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].Receipt).ToNot(BeEmpty())
+		})
+
+		It("should receive the next message of a group as soon as its head is deleted", func() {
+			queue.Parts.Resize(cfg, testQueueName, 2)
+			// The group's two messages fall in different partitions
+			head, next := "1", strconv.Itoa(math.MaxInt64/2+1)
+			bucket.Objects = make(map[string]riak.RObject)
+			for i, id := range []string{head, next} {
+				putAt := time.Now().Add(time.Duration(i) * time.Second)
+				bucket.Objects[id] = riak.RObject{Key: id, Data: []byte("body"), Indexes: map[string][]string{app.GroupIndex: {app.GroupIndexTerm("order", putAt)}}}
+			}
+			receive := func() []string {
+				var received []string
+				// Read both partitions, whichever order they come in
+				for i := 0; i < 2; i++ {
+					messages, _ := queue.GetWith(cfg, memberList, 10, bucket)
+					for _, message := range messages {
+						received = append(received, message.ID)
+					}
+				}
+				return received
+			}
+
+			Expect(receive()).To(Equal([]string{head}))
+			visTimeout, _ := cfg.GetVisibilityTimeout(testQueueName)
+			Expect(queue.Parts.InFlightCount(visTimeout)).To(Equal(1))
+
+			delete(bucket.Objects, head)
+			Expect(receive()).To(Equal([]string{next}))
+		})
+	})
+
+	Context("Reserve", func() {
+		var queue *app.Queue
+		var stored []int
+		var bucket *app.MemoryMessages
+		// query reads the stored ids within a range lowest first, as the message index would
+		query := func(bottom int, top int, limit uint32) ([]string, error) {
+			ids := []string{}
+			for _, id := range stored {
+				if id >= bottom && id <= top && uint32(len(ids)) < limit {
+					ids = append(ids, strconv.Itoa(id))
+				}
+			}
+			return ids, nil
+		}
+
+		BeforeEach(func() {
+			queue = &app.Queue{Name: testQueueName, Config: queues.QueueMap[testQueueName].Config}
+			queue.Parts = app.InitPartitions(cfg, testQueueName)
+			queue.Parts.Resize(cfg, testQueueName, 4)
+			stored = nil
+			for i := 0; i < 4; i++ {
+				// Two messages in each partition's range
+				stored = append(stored, i*(math.MaxInt64/4)+1, i*(math.MaxInt64/4)+2)
+			}
+			bucket = &app.MemoryMessages{Objects: make(map[string]riak.RObject)}
+			for _, id := range stored {
+				bucket.Objects[strconv.Itoa(id)] = riak.RObject{Key: strconv.Itoa(id)}
+			}
+		})
+
+		It("should hide reserved ids from other receives until they are visible again", func() {
+			reserved, err := queue.ReserveWith(cfg, memberList, 10, bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(HaveLen(2))
+
+			// Get reserves its ids the same way, so a concurrent receive gets another partition
+			seen := make(map[string]bool)
+			for i := 0; i < 3; i++ {
+				others, err := queue.ReserveWith(cfg, memberList, 10, bucket)
+				Expect(err).ToNot(HaveOccurred())
+				for _, id := range others {
+					Expect(reserved).ToNot(ContainElement(id))
+					seen[id] = true
+				}
+			}
+			Expect(seen).To(HaveLen(6))
+
+			// Reserving doesn't touch the messages, so they can be fetched, or received, later
+			visTimeout, _ := cfg.GetVisibilityTimeout(testQueueName)
+			Expect(queue.Parts.UnlockAll(visTimeout)).To(Equal(8))
+			var again []string
+			for i := 0; i < 4; i++ {
+				ids, err := queue.ReserveWith(cfg, memberList, 10, bucket)
+				Expect(err).ToNot(HaveOccurred())
+				again = append(again, ids...)
+			}
+			Expect(again).To(ContainElement(reserved[0]))
+			Expect(again).To(ContainElement(reserved[1]))
+		})
+
+		It("should hand back the ids read before a page failed", func() {
+			failure := errors.New("riak is down")
+			// Every range has a page of two ids, after which the index stops answering
+			bucket.Query = func(bottom int, top int, limit uint32) ([]string, error) {
+				return app.PageIDsWith(limit, 2, func(pageLimit uint32, continuation string) ([]string, string, error) {
+					if continuation == "" {
+						ids, _ := query(bottom, top, pageLimit)
+						return ids, "next", nil
+					}
+					return nil, "", failure
+				})
+			}
+			reserved, err := queue.ReserveWith(cfg, memberList, 10, bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(HaveLen(2))
+			visTimeout, _ := cfg.GetVisibilityTimeout(testQueueName)
+			Expect(queue.Parts.InFlightCount(visTimeout)).To(Equal(2))
+		})
+
+		It("should leave the partition unlocked when no page could be read", func() {
+			failure := errors.New("riak is down")
+			bucket.Err = failure
+			_, err := queue.ReserveWith(cfg, memberList, 10, bucket)
+			Expect(err).To(Equal(failure))
+			visTimeout, _ := cfg.GetVisibilityTimeout(testQueueName)
+			Expect(queue.Parts.InFlightCount(visTimeout)).To(BeZero())
+		})
+
+		It("should reserve nothing while the queue is disabled", func() {
+			key := riak.MapKey{Key: app.Enabled, Type: pb.MapField_REGISTER}
+			queue.Config.Values[key] = &riak.RDtRegister{Value: []byte("false")}
+			defer func() {
+				queue.Config.Values[key] = &riak.RDtRegister{Value: []byte(app.DefaultSettings[app.Enabled])}
+			}()
+			reserved, err := queue.ReserveWith(cfg, memberList, 10, bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reserved).To(BeEmpty())
+		})
+
+		It("should hand each message to one consumer when the ranges they read overlap", func() {
+			// Every receive reads every stored id, as receives on nodes which disagree about the ranges would
+			bucket.Query = func(bottom int, top int, limit uint32) ([]string, error) {
+				return query(0, math.MaxInt64, limit)
+			}
+			visTimeout, _ := cfg.GetVisibilityTimeout(testQueueName)
+			for round := 0; round < 10; round++ {
+				var lock sync.Mutex
+				var wg sync.WaitGroup
+				received := make(map[string]int)
+				for consumer := 0; consumer < 8; consumer++ {
+					wg.Add(1)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+						ids, err := queue.ReserveWith(cfg, memberList, 3, bucket)
+						Expect(err).ToNot(HaveOccurred())
+						lock.Lock()
+						defer lock.Unlock()
+						for _, id := range ids {
+							received[id]++
+						}
+					}()
+				}
+				wg.Wait()
+				for id, count := range received {
+					Expect(count).To(Equal(1), "message %s was received %d times", id, count)
+				}
+				queue.Parts.UnlockAll(visTimeout)
+			}
+		})
+	})
+
+	Context("SyncNow", func() {
+		AfterEach(func() {
+			delete(queues.QueueMap, "synced_queue")
+		})
+
+		It("should serve a queue as soon as it is synced", func() {
+			Expect(queues.QueueMap).ToNot(HaveKey("synced_queue"))
+			queues.SyncNowWith(cfg, []string{testQueueName, "synced_queue"})
+			Expect(queues.QueueMap).To(HaveKey("synced_queue"))
+			Expect(queues.QueueMap).To(HaveKey(testQueueName))
+		})
+
+		It("should run one sync at a time", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					queues.SyncNowWith(cfg, []string{testQueueName, "synced_queue"})
+				}()
+			}
+			wg.Wait()
+			Expect(queues.QueueMap).To(HaveLen(2))
+		})
+
+		It("should let settings be read while it adds and drops queues", func() {
+			// Dropping a queue unsubscribes it from the topics, so the sync needs some to look through
+			dropping := &app.Config{Core: core, Queues: queues, Topics: &app.Topics{TopicMap: make(map[string]*app.Topic)}}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 50; i++ {
+					queues.SyncNowWith(dropping, []string{testQueueName, "synced_queue"})
+					queues.SyncNowWith(dropping, []string{testQueueName})
+				}
+			}()
+			for i := 0; i < 50; i++ {
+				timeout, err := cfg.GetVisibilityTimeout(testQueueName)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(timeout).To(BeNumerically("==", 30))
+			}
+			<-done
+			Expect(queues.QueueMap).To(HaveLen(1))
+		})
+	})
+
+	Context("GetOrCreate", func() {
+		var created *app.Queues
+
+		BeforeEach(func() {
+			created = &app.Queues{QueueMap: map[string]*app.Queue{testQueueName: {Name: testQueueName}}}
+		})
+
+		It("should return a queue it already knows without creating it", func() {
+			queue, wasCreated, err := created.GetOrCreateWith(testQueueName, func() (*app.Queue, error) {
+				Fail("created a queue which already exists")
+				return nil, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(wasCreated).To(BeFalse())
+			Expect(queue).To(BeIdenticalTo(created.QueueMap[testQueueName]))
+		})
+
+		It("should create a queue once, however many ask for it at the same time", func() {
+			var creates int32
+			results := make([]*app.Queue, 20)
+			var wg sync.WaitGroup
+			for i := range results {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					defer GinkgoRecover()
+					queue, _, err := created.GetOrCreateWith("fresh", func() (*app.Queue, error) {
+						atomic.AddInt32(&creates, 1)
+						time.Sleep(10 * time.Millisecond)
+						return &app.Queue{Name: "fresh"}, nil
+					})
+					Expect(err).ToNot(HaveOccurred())
+					results[i] = queue
+				}(i)
+			}
+			wg.Wait()
+			Expect(atomic.LoadInt32(&creates)).To(Equal(int32(1)))
+			for _, queue := range results {
+				Expect(queue).To(BeIdenticalTo(created.QueueMap["fresh"]))
+			}
+		})
+
+		It("should leave the queue out when creating it fails", func() {
+			_, wasCreated, err := created.GetOrCreateWith("fresh", func() (*app.Queue, error) {
+				return nil, app.ErrRiakUnavailable
+			})
+			Expect(err).To(Equal(app.ErrRiakUnavailable))
+			Expect(wasCreated).To(BeFalse())
+			Expect(created.QueueMap).ToNot(HaveKey("fresh"))
+		})
+	})
+
+	Context("key space", func() {
+		AfterEach(func() {
+			cfg.Core.KeySpaceMax = 0
+			statsClient.Reset()
+		})
+
+		It("should scale the depth estimate to a reduced key space", func() {
+			// 10 messages spread over a tenth of the key space
+			ids := []string{"0", "11111", "22222", "33333", "44444", "55555", "66666", "77777", "88888", "100000"}
+			queue := &app.Queue{Name: testQueueName, Parts: app.InitPartitions(cfg, testQueueName)}
+			cfg.Core.KeySpaceMax = 1000000
+			Expect(queue.SetQueueDepthAprWith(cfg, memberList, ids)).To(Succeed())
+			Expect(statsClient.Gauge(testQueueName + "." + app.QueueDepthAprStatsSuffix)).To(BeNumerically("~", 100, 1))
+
+			nodeBottom, nodeTop := app.GetNodePartitionRange(cfg, memberList)
+			Expect(nodeBottom).To(BeNumerically(">=", 0))
+			Expect(nodeTop).To(BeNumerically("<=", 1000000))
+		})
+	})
+
+	Context("fifo", func() {
+		AfterEach(func() {
+			cfg.Core.KeySpaceMin = 0
+			cfg.Core.KeySpaceMax = 0
+			cfg.Core.MessageIDWidth = 0
+		})
+
+		It("should number messages put at once in the order they drew from the sequence", func() {
+			// Padded, so ids sort as strings as id_int sorts them as numbers
+			cfg.Core.MessageIDWidth = app.MessageIDDigits
+			queue := &app.Queue{Name: "ordered"}
+			// Not safe to call concurrently, so this also checks the draws are made one at a time
+			var sequence int64
+			var drawn []int64
+			newID := queue.SequenceIDsWith(cfg, func() (int64, error) {
+				sequence++
+				drawn = append(drawn, sequence)
+				return sequence, nil
+			})
+			var (
+				ids  []string
+				lock sync.Mutex
+				wg   sync.WaitGroup
+			)
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					id, err := newID()
+					Expect(err).ToNot(HaveOccurred())
+					lock.Lock()
+					defer lock.Unlock()
+					ids = append(ids, id)
+				}()
+			}
+			wg.Wait()
+
+			// A range scan of the message index returns ids in the order they sort in
+			sort.Strings(ids)
+			expected := make([]string, len(drawn))
+			for i, seq := range drawn {
+				expected[i] = app.PadMessageID(strconv.FormatInt(seq, 10), cfg.Core.MessageIDWidth)
+			}
+			Expect(ids).To(Equal(expected))
+		})
+
+		It("should count up from the bottom of the key space, and stop at the top", func() {
+			cfg.Core.KeySpaceMin = 5
+			cfg.Core.KeySpaceMax = 10
+			queue := &app.Queue{Name: "ordered"}
+			var sequence int64 = 3
+			newID := queue.SequenceIDsWith(cfg, func() (int64, error) {
+				sequence++
+				return sequence, nil
+			})
+			id, err := newID()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(Equal(app.PadMessageID("9", cfg.Core.MessageIDWidth)))
+			_, err = newID()
+			Expect(err).To(Equal(app.ErrSequenceExhausted))
+		})
+
+		It("should receive messages put at once in the order they were put", func() {
+			cfg.Core.MessageIDWidth = app.MessageIDDigits
+			queue := &app.Queue{Name: testQueueName, Config: queues.QueueMap[testQueueName].Config, Parts: app.InitPartitions(cfg, testQueueName)}
+			var sequence int64
+			newID := queue.SequenceIDsWith(cfg, func() (int64, error) {
+				sequence++
+				return sequence, nil
+			})
+			var (
+				// Each message's body is the order it was put in
+				bucket = &app.MemoryMessages{Objects: make(map[string]riak.RObject)}
+				lock   sync.Mutex
+				wg     sync.WaitGroup
+			)
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					lock.Lock()
+					defer lock.Unlock()
+					id, err := newID()
+					Expect(err).ToNot(HaveOccurred())
+					bucket.Objects[id] = riak.RObject{Key: id, Data: []byte(strconv.Itoa(len(bucket.Objects) + 1))}
+				}()
+			}
+			wg.Wait()
+
+			var received []string
+			// Only the first partition holds any of them
+			for i := 0; i < queue.Parts.PartitionCount() && len(received) == 0; i++ {
+				messages, err := queue.GetWith(cfg, memberList, 20, bucket)
+				Expect(err).ToNot(HaveOccurred())
+				for _, message := range messages {
+					received = append(received, string(message.Body))
+				}
+			}
+			expected := make([]string, 0, len(bucket.Objects))
+			for i := 1; i <= len(bucket.Objects); i++ {
+				expected = append(expected, strconv.Itoa(i))
+			}
+			Expect(received).To(Equal(expected))
+		})
+
+		It("should hand two nodes drawing from the same counter at once different numbers", func() {
+			// stored is the counter as Riak holds it, which both nodes increment
+			var stored int64
+			fetch := func() (int64, error) {
+				return stored, nil
+			}
+			var other int64
+			// The other node draws once this one has read the counter, but before its increment lands
+			first, err := app.DrawSequenceWith(func() error {
+				var err error
+				other, err = app.DrawSequenceWith(func() error {
+					stored++
+					return nil
+				}, fetch)
+				Expect(err).ToNot(HaveOccurred())
+				stored++
+				return nil
+			}, fetch)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(other).To(Equal(int64(1)))
+			Expect(first).To(Equal(int64(2)))
+		})
+
+		It("should not read the counter back when the increment fails", func() {
+			failure := errors.New("riak is down")
+			_, err := app.DrawSequenceWith(func() error {
+				return failure
+			}, func() (int64, error) {
+				Fail("read back a counter which wasn't incremented")
+				return 0, nil
+			})
+			Expect(err).To(Equal(failure))
+		})
+	})
+
+	Context("PutIfNotFull", func() {
+		setRegister := func(name string, value string) {
+			key := riak.MapKey{Key: name, Type: pb.MapField_REGISTER}
+			queues.QueueMap[testQueueName].Config.Values[key] = &riak.RDtRegister{Value: []byte(value)}
+		}
+		depthKey := testQueueName + "." + app.QueueDepthAprStatsSuffix
+
+		BeforeEach(func() {
+			// Puts that get past the depth check fail fast, instead of reaching Riak
+			cfg.RiakBreaker = app.NewBreaker(1, time.Hour, time.Hour)
+			cfg.RiakBreaker.Record(errors.New("riak is down"))
+			setRegister(app.MaxDepth, "10")
+		})
+
+		AfterEach(func() {
+			cfg.RiakBreaker = nil
+			setRegister(app.MaxDepth, app.DefaultSettings[app.MaxDepth])
+			statsClient.Reset()
+		})
+
+		It("should go on to store the message while under max_depth", func() {
+			statsClient.SetGauge(depthKey, 5)
+			_, err := queues.QueueMap[testQueueName].PutIfNotFull(cfg, "message", false)
+			Expect(err).To(Equal(app.ErrBreakerOpen))
+		})
+
+		It("should reject the message once at max_depth", func() {
+			statsClient.SetGauge(depthKey, 10)
+			uuid, err := queues.QueueMap[testQueueName].PutIfNotFull(cfg, "message", false)
+			Expect(err).To(Equal(app.ErrQueueFull))
+			Expect(uuid).To(BeEmpty())
+		})
+
+		It("should count the messages of a tenant's queue when its stats can't be read back", func() {
+			register := func(value string) *riak.RDtRegister {
+				return &riak.RDtRegister{Value: []byte(value)}
+			}
+			// A put which got past the depth check would be turned away as disabled
+			tenantQueue := &app.Queue{Name: "tenant_queue", Config: &riak.RDtMap{Values: map[riak.MapKey]interface{}{
+				{Key: app.MaxDepth, Type: pb.MapField_REGISTER}:               register("10"),
+				{Key: app.Tenant, Type: pb.MapField_REGISTER}:                 register("acme"),
+				{Key: app.Enabled, Type: pb.MapField_REGISTER}:                register("false"),
+				{Key: app.RejectPutsWhenDisabled, Type: pb.MapField_REGISTER}: register("true"),
+			}}}
+			statsdCfg := &app.Config{
+				Core:        core,
+				Queues:      &app.Queues{QueueMap: map[string]*app.Queue{"tenant_queue": tenantQueue}},
+				Stats:       app.Stats{Client: stats.NewNOOPClient()},
+				RiakBreaker: cfg.RiakBreaker,
+			}
+			_, err := tenantQueue.PutIfNotFull(statsdCfg, "message", false)
+			Expect(err).To(Equal(app.ErrBreakerOpen))
+			_, err = tenantQueue.Stats(statsdCfg)
+			Expect(err).To(Equal(stats.ErrSnapshotUnsupported))
+		})
+
+		It("should stop counting an exact depth once past the limit", func() {
+			pages := 0
+			count, err := app.CountMessagesWith(func(continuation string) ([]string, string, error) {
+				pages++
+				return []string{"1", "2", "3", "4"}, "more", nil
+			}, 10)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(int64(12)))
+			Expect(pages).To(Equal(3))
+		})
+	})
+
+	Context("GetParallel", func() {
+		var queue *app.Queue
+
+		BeforeEach(func() {
+			queue = &app.Queue{Name: testQueueName, Parts: app.InitPartitions(cfg, testQueueName)}
+			queue.Parts.Resize(cfg, testQueueName, 4)
+		})
+
+		// queryRanges serves two ids at the bottom of every partition's range, noting the ranges asked for
+		queryRanges := func(bottoms map[int]bool) *app.MemoryMessages {
+			var lock sync.Mutex
+			return &app.MemoryMessages{Query: func(bottom int, top int, limit uint32) ([]string, error) {
+				lock.Lock()
+				bottoms[bottom] = true
+				lock.Unlock()
+				return []string{strconv.Itoa(bottom + 1), strconv.Itoa(bottom + 2)}, nil
+			}}
+		}
+
+		It("should return messages from every partition in one call", func() {
+			bottoms := make(map[int]bool)
+			ids, err := queue.CollectPartitionsWith(cfg, memberList, 100, queryRanges(bottoms))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bottoms).To(HaveLen(4))
+			Expect(ids).To(HaveLen(8))
+			for bottom := range bottoms {
+				Expect(ids).To(ContainElement(strconv.Itoa(bottom + 1)))
+			}
+		})
+
+		It("should cap the ids at the batch size, leaving partitions which gave none unlocked", func() {
+			ids, err := queue.CollectPartitionsWith(cfg, memberList, 3, queryRanges(make(map[int]bool)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ids).To(HaveLen(3))
+
+			// Two partitions had their ids taken, so only the other two are free for the next call
+			bottoms := make(map[int]bool)
+			_, err = queue.CollectPartitionsWith(cfg, memberList, 100, queryRanges(bottoms))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bottoms).To(HaveLen(2))
+		})
+	})
+
+	Context("RequeueInFlight", func() {
+		It("should make messages which were served receivable again right away", func() {
+			queue := &app.Queue{Name: testQueueName, Parts: app.InitPartitions(cfg, testQueueName)}
+			_, _, served, err := queue.Parts.GetPartition(cfg, testQueueName, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			served.InFlight = 5
+			queue.Parts.PushPartition(cfg, testQueueName, served, true)
+
+			requeued, err := queue.RequeueInFlight(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requeued).To(Equal(5))
+
+			// A receive gets the same partition back, rather than making a new one past the locked one
+			_, _, next, err := queue.Parts.GetPartition(cfg, testQueueName, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(next.ID).To(Equal(served.ID))
+			Expect(queue.Parts.PartitionCount()).To(Equal(1))
+			queue.Parts.PushPartition(cfg, testQueueName, next, false)
+
+			requeued, err = queue.RequeueInFlight(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requeued).To(Equal(0))
+		})
+	})
+
+	Context("ResetInflightStats", func() {
+		inFlightKey := testQueueName + "." + app.QueueInFlightStatsSuffix
+		availableKey := testQueueName + "." + app.QueueDepthAvailableStatsSuffix
+
+		It("should set the in flight gauges from the ids still in flight", func() {
+			queue := &app.Queue{Name: testQueueName, Parts: app.InitPartitions(cfg, testQueueName)}
+			queue.ObserveReceive(0, 0, 100)
+			_, _, served, err := queue.Parts.GetPartition(cfg, testQueueName, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			served.InFlight = 5
+			queue.Parts.PushPartition(cfg, testQueueName, served, true)
+			queue.Parts.Claim([]string{"1", "2", "3"}, time.Now().Add(time.Minute))
+			queue.Parts.Claim([]string{"4", "5"}, time.Now().Add(-time.Second))
+			statsClient.SetGauge(inFlightKey, 40)
+			statsClient.SetGauge(availableKey, 60)
+
+			inFlight, err := queue.ResetInflightStats(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inFlight).To(Equal(3))
+			Expect(statsClient.Gauge(inFlightKey)).To(Equal(int64(3)))
+			Expect(statsClient.Gauge(availableKey)).To(Equal(int64(97)))
+
+			// The ids still in flight stay that way, so a receive doesn't get the partition back yet
+			_, _, next, err := queue.Parts.GetPartition(cfg, testQueueName, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(next.ID).ToNot(Equal(served.ID))
+			queue.Parts.PushPartition(cfg, testQueueName, next, false)
+		})
+
+		It("should unlock partitions left locked with nothing in flight", func() {
+			queue := &app.Queue{Name: testQueueName, Parts: app.InitPartitions(cfg, testQueueName)}
+			_, _, served, err := queue.Parts.GetPartition(cfg, testQueueName, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			served.InFlight = 5
+			queue.Parts.PushPartition(cfg, testQueueName, served, true)
+			statsClient.SetGauge(inFlightKey, 5)
+
+			inFlight, err := queue.ResetInflightStats(cfg)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inFlight).To(BeZero())
+			Expect(statsClient.Gauge(inFlightKey)).To(BeZero())
+			Expect(queue.Parts.InFlightCount(30)).To(BeZero())
+
+			_, _, next, err := queue.Parts.GetPartition(cfg, testQueueName, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(next.ID).To(Equal(served.ID))
+			queue.Parts.PushPartition(cfg, testQueueName, next, false)
+		})
+	})
+
+	Context("GetByID", func() {
+		It("should return the message stored at an id", func() {
+			queue := queues.QueueMap[testQueueName]
+			object, stored, err := queue.NewMessageObjectWith(cfg, "body", nil, true)
+			Expect(err).ToNot(HaveOccurred())
+
+			bucket := &app.MemoryMessages{Objects: map[string]riak.RObject{stored.ID: *object}}
+			message, err := queue.GetByIDWith(cfg, stored.ID, bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(message.ID).To(Equal(stored.ID))
+			Expect(message.Body).To(Equal([]byte("body")))
+		})
+
+		It("should return ErrMessageNotFound for an id nothing is stored at", func() {
+			queue := queues.QueueMap[testQueueName]
+			bucket := &app.MemoryMessages{}
+			message, err := queue.GetByIDWith(cfg, "1", bucket)
+			Expect(err).To(Equal(app.ErrMessageNotFound))
+			Expect(message).To(BeNil())
+
+			// Nor is a message with no body
+			bucket.Objects = map[string]riak.RObject{"1": {Key: "1"}}
+			message, err = queue.GetByIDWith(cfg, "1", bucket)
+			Expect(err).To(Equal(app.ErrMessageNotFound))
+			Expect(message).To(BeNil())
+		})
+	})
+
+	Context("PutReturning", func() {
+		It("should return the message GetByID reads back", func() {
+			queue := queues.QueueMap[testQueueName]
+			for _, messageCodec := range []codec.Codec{nil, codec.NewMsgpackCodec()} {
+				object, stored, err := queue.NewMessageObjectWith(cfg, "body", messageCodec, true)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stored.ID).To(Equal(object.Key))
+				Expect(stored.Body).To(Equal([]byte("body")))
+				Expect(stored.ContentType).To(Equal("application/json"))
+				Expect(stored.Timestamp).To(BeTemporally("~", time.Now(), time.Second))
+
+				Expect(app.OpenMessage(cfg, object)).To(Succeed())
+				read := app.NewMessage(*object)
+				Expect(read.ID).To(Equal(stored.ID))
+				Expect(read.Body).To(Equal(stored.Body))
+				Expect(read.ContentType).To(Equal(stored.ContentType))
+				if messageCodec != nil {
+					Expect(read.Timestamp).To(BeTemporally("==", stored.Timestamp))
+				}
+			}
+		})
+	})
+
+	Context("without a stats client", func() {
+		It("should put, receive and delete messages", func() {
+			unconfigured := *cfg
+			unconfigured.Stats.Client = nil
+			queue := &app.Queue{Name: testQueueName, Config: queues.QueueMap[testQueueName].Config, Parts: app.InitPartitions(cfg, testQueueName)}
+			bucket := &app.MemoryMessages{Objects: map[string]riak.RObject{"1": {Key: "1", Data: []byte("taken")}}}
+
+			// Taking an id which is in use is counted
+			object, _, err := queue.NewMessageObjectWith(&unconfigured, "body", nil, false)
+			Expect(err).ToNot(HaveOccurred())
+			object.Key = "1"
+			id, err := queue.StoreUniqueWith(&unconfigured, object, func() (string, error) { return "2", nil }, bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(Equal("2"))
+
+			// Leave the new message alone on one partition, so it's in whichever is received from
+			delete(bucket.Objects, "1")
+			queue.Parts.Resize(&unconfigured, testQueueName, 1)
+			messages, err := queue.GetWith(&unconfigured, memberList, 10, bucket)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].Body).To(Equal([]byte("body")))
+
+			Expect(queue.DeleteWith(unconfigured.StatsClient(), id, bucket)).To(Succeed())
+			Expect(bucket.Objects).ToNot(HaveKey(id))
+		})
+	})
+
+	Context("errors", func() {
+		AfterEach(func() {
+			cfg.RiakBreaker = nil
+			cfg.RiakPool = nil
+		})
+
+		It("should fail fast with ErrBreakerOpen while the breaker is open", func() {
+			cfg.RiakBreaker = app.NewBreaker(1, time.Hour, time.Hour)
+			cfg.RiakBreaker.Record(errors.New("riak is down"))
+			queue := queues.QueueMap[testQueueName]
+
+			_, err := queue.Put(cfg, "message")
+			Expect(err).To(Equal(app.ErrBreakerOpen))
+			stored, err := queue.PutReturning(cfg, "message")
+			Expect(err).To(Equal(app.ErrBreakerOpen))
+			Expect(stored).To(BeNil())
+			Expect(queue.Delete(cfg, "1")).To(Equal(app.ErrBreakerOpen))
+			_, err = queue.GetByID(cfg, "1")
+			Expect(err).To(Equal(app.ErrBreakerOpen))
+			Expect(app.IsRiakUnavailable(err)).To(BeTrue())
+		})
+
+		It("should return ErrRiakUnavailable when Riak can't be reached", func() {
+			cfg.RiakPool = riak.NewClientPool("127.0.0.1:1", 1)
+			queue := queues.QueueMap[testQueueName]
+
+			_, err := queue.Put(cfg, "message")
+			Expect(err).To(Equal(app.ErrRiakUnavailable))
+			Expect(queue.Delete(cfg, "1")).To(Equal(app.ErrRiakUnavailable))
+			_, err = queue.GetByID(cfg, "1")
+			Expect(err).To(Equal(app.ErrRiakUnavailable))
+		})
+
+		It("should return ErrQueueNotFound for a queue this node doesn't know of", func() {
+			queue, err := queues.GetQueue("no_such_queue")
+			Expect(err).To(Equal(app.ErrQueueNotFound))
+			Expect(queue).To(BeNil())
+
+			queue, err = queues.GetQueue(testQueueName)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(queue.Name).To(Equal(testQueueName))
+		})
+	})
+
+	Context("ReconcileDepth", func() {
+		It("should overwrite a drifted depth gauge with the real count", func() {
+			depthKey := testQueueName + "." + app.QueueDepthStatsSuffix
+			statsClient.SetGauge(depthKey, 42)
+
+			// Serve 5 ids over 3 pages of the index
+			pages := map[string][]string{"": {"1", "2"}, "a": {"3", "4"}, "b": {"5"}}
+			next := map[string]string{"": "a", "a": "b", "b": ""}
+			err := app.ReconcileDepthWith(statsClient, testQueueName, func(continuation string) ([]string, string, error) {
+				return pages[continuation], next[continuation], nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(statsClient.Gauge(depthKey)).To(Equal(int64(5)))
+		})
+	})
+})
+
+var _ = Describe("Queues", func() {
+
+	Context("DeleteQueue", func() {
+		AfterEach(func() {
+			cfg.RiakBreaker = nil
+		})
+
+		It("should report a clean delete once the queue is gone", func() {
+			store := &app.MemoryPurgeStore{Queues: map[string]bool{"doomed": true, "kept": true}}
+			deleted, err := queues.DeleteQueueWith(store, "doomed", 0, time.Now())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleted).To(BeTrue())
+			Expect(store.Queues).ToNot(HaveKey("doomed"))
+			Expect(store.Queues).To(HaveKey("kept"))
+			Expect(store.Purges).To(BeEmpty())
+		})
+
+		Context("with a grace period", func() {
+			var (
+				store     *app.MemoryPurgeStore
+				deletedAt time.Time
+			)
+
+			BeforeEach(func() {
+				store = &app.MemoryPurgeStore{
+					Queues:   map[string]bool{"doomed": true},
+					Messages: map[string]map[string]string{"doomed": {"1": "one", "2": "two"}},
+				}
+				deletedAt = time.Now()
+				deleted, err := queues.DeleteQueueWith(store, "doomed", time.Hour, deletedAt)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(deleted).To(BeTrue())
+			})
+
+			It("should keep the messages until the grace period has passed", func() {
+				queues.PurgeDeletedQueuesWith(store, deletedAt.Add(30*time.Minute))
+				Expect(store.Messages["doomed"]).To(HaveLen(2))
+				Expect(store.Purges).To(HaveKey("doomed"))
+
+				queues.PurgeDeletedQueuesWith(store, deletedAt.Add(time.Hour))
+				Expect(store.Messages).ToNot(HaveKey("doomed"))
+				Expect(store.Purges).To(BeEmpty())
+			})
+
+			It("should keep the messages of a queue created again within the grace period", func() {
+				store.Queues["doomed"] = true
+				queues.PurgeDeletedQueuesWith(store, deletedAt.Add(2*time.Hour))
+				Expect(store.Messages["doomed"]).To(HaveLen(2))
+				Expect(store.Purges).To(BeEmpty())
+			})
+		})
+
+		It("should not report success when Riak fails during the delete", func() {
+			cfg.RiakBreaker = app.NewBreaker(1, time.Hour, time.Hour)
+			cfg.RiakBreaker.Record(errors.New("riak is down"))
+			deleted, err := queues.DeleteQueue("doomed", cfg)
+			Expect(err).To(Equal(app.ErrBreakerOpen))
+			Expect(deleted).To(BeFalse())
+		})
+	})
+
+	Context("Stop", func() {
+		var (
+			client     *flushingClient
+			syncConfig *app.Config
+		)
+
+		BeforeEach(func() {
+			client = &flushingClient{MemoryClient: stats.NewMemoryClient()}
+			// Use a long interval, so the sync never actually reaches out to Riak
+			syncConfig = &app.Config{
+				Core:  app.Core{SyncConfigInterval: 60000},
+				Stats: app.Stats{Client: client},
+			}
+		})
+
+		It("should terminate the sync goroutine and flush stats", func() {
+			syncQueues := &app.Queues{QueueMap: make(map[string]*app.Queue)}
+			syncQueues.ScheduleSync(syncConfig)
+
+			stopped := make(chan struct{})
+			go func() {
+				syncQueues.Stop()
+				close(stopped)
+			}()
+			Eventually(stopped).Should(BeClosed())
+			Expect(client.flushes).To(Equal(1))
+		})
+
+		It("should be safe to call more than once, or without a running sync", func() {
+			syncQueues := &app.Queues{QueueMap: make(map[string]*app.Queue)}
+			syncQueues.Stop()
+			syncQueues.Stop()
+			Expect(client.flushes).To(Equal(0))
+		})
+	})
+})
+
+// identityCompressor stores bodies as is, counting how often it was used
+type identityCompressor struct {
+	compressed   int
+	decompressed int
+}
+
+func (c *identityCompressor) Compress(value []byte) ([]byte, error) {
+	c.compressed++
+	return value, nil
+}
+
+func (c *identityCompressor) Decompress(value []byte) ([]byte, error) {
+	c.decompressed++
+	return value, nil
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrThrottled represents the condition that occurs if a queue is used faster than its max_put_rate or max_get_rate
+var ErrThrottled = errors.New("Rate limit exceeded, slow down")
+
+// ErrInvalidRate represents the condition that occurs if a queue is configured with a negative rate limit
+var ErrInvalidRate = errors.New("Rate limits must be 0 or greater")
+
+// RateLimiter is a token bucket refilled at rate per second
+type RateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sync.Mutex
+}
+
+// NewRateLimiter returns a full RateLimiter allowing rate calls per second
+func NewRateLimiter(rate float64) *RateLimiter {
+	return newRateLimiter(rate, time.Now)
+}
+
+func newRateLimiter(rate float64, now func() time.Time) *RateLimiter {
+	return &RateLimiter{rate: rate, tokens: burstSize(rate), last: now(), now: now}
+}
+
+// SetRate changes the rate, keeping the tokens already earned up to the new burst size
+func (l *RateLimiter) SetRate(rate float64) {
+	l.Lock()
+	defer l.Unlock()
+	if rate == l.rate {
+		return
+	}
+	l.refill()
+	l.rate = rate
+	l.tokens = math.Min(l.tokens, burstSize(rate))
+}
+
+// Allow takes n tokens, returning false if there aren't enough
+func (l *RateLimiter) Allow(n float64) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	l.refill()
+	if l.tokens < math.Min(n, burstSize(l.rate)) {
+		return false
+	}
+	l.tokens -= n
+	return true
+}
+
+func (l *RateLimiter) refill() {
+	now := l.now()
+	l.tokens = math.Min(burstSize(l.rate), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+func burstSize(rate float64) float64 {
+	return math.Max(rate, 1)
+}
+
+// allow checks the queue's limiter for MaxPutRate or MaxGetRate
+func (queue *Queue) allow(cfg *Config, setting string, n int) error {
+	val, _ := cfg.getQueueSetting(setting, queue.Name)
+	rate, err := strconv.ParseFloat(val, 64)
+	if err != nil || rate <= 0 {
+		return nil
+	}
+	queue.limitersLock.Lock()
+	if queue.limiters == nil {
+		queue.limiters = make(map[string]*RateLimiter)
+	}
+	limiter, ok := queue.limiters[setting]
+	if !ok {
+		limiter = NewRateLimiter(rate)
+		queue.limiters[setting] = limiter
+	}
+	queue.limitersLock.Unlock()
+
+	limiter.SetRate(rate)
+	if !limiter.Allow(float64(n)) {
+		return ErrThrottled
+	}
+	return nil
+}
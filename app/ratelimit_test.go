@@ -0,0 +1,88 @@
+package app_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
+	"github.com/tpjg/goriakpbc/pb"
+)
+
+var _ = Describe("RateLimiter", func() {
+	var now time.Time
+	var limiter *app.RateLimiter
+
+	BeforeEach(func() {
+		now = time.Now()
+		limiter = app.NewRateLimiterWith(2, func() time.Time { return now })
+	})
+
+	It("should throttle calls over the rate", func() {
+		Expect(limiter.Allow(1)).To(BeTrue())
+		Expect(limiter.Allow(1)).To(BeTrue())
+		Expect(limiter.Allow(1)).To(BeFalse())
+	})
+
+	It("should restore capacity after waiting", func() {
+		Expect(limiter.Allow(2)).To(BeTrue())
+		Expect(limiter.Allow(1)).To(BeFalse())
+		now = now.Add(500 * time.Millisecond)
+		Expect(limiter.Allow(1)).To(BeTrue())
+		Expect(limiter.Allow(1)).To(BeFalse())
+	})
+
+	It("should let a call larger than the burst through once full, then pay it back", func() {
+		Expect(limiter.Allow(4)).To(BeTrue())
+		now = now.Add(time.Second)
+		Expect(limiter.Allow(1)).To(BeFalse())
+		now = now.Add(500 * time.Millisecond)
+		Expect(limiter.Allow(1)).To(BeTrue())
+	})
+
+	It("should never throttle with a rate of 0", func() {
+		limiter.SetRate(0)
+		for i := 0; i < 100; i++ {
+			Expect(limiter.Allow(1)).To(BeTrue())
+		}
+	})
+})
+
+var _ = Describe("Queue rate limits", func() {
+	var queue *app.Queue
+
+	setRegister := func(name string, value string) {
+		key := riak.MapKey{Key: name, Type: pb.MapField_REGISTER}
+		queues.QueueMap[testQueueName].Config.Values[key] = &riak.RDtRegister{Value: []byte(value)}
+	}
+
+	BeforeEach(func() {
+		// A fresh queue gets fresh limiters, while its settings still come from the suite queue
+		queue = &app.Queue{Name: testQueueName}
+		// Let the puts that get past the limiter fail fast instead of reaching Riak
+		cfg.RiakBreaker = app.NewBreaker(1, time.Hour, time.Hour)
+		cfg.RiakBreaker.Record(errors.New("riak is down"))
+		setRegister(app.MaxPutRate, "1")
+	})
+
+	AfterEach(func() {
+		cfg.RiakBreaker = nil
+		setRegister(app.MaxPutRate, app.DefaultSettings[app.MaxPutRate])
+	})
+
+	It("should return ErrThrottled once the queue's max_put_rate is exceeded", func() {
+		_, err := queue.BatchPut(cfg, []string{"message"})
+		Expect(err).To(Equal(app.ErrBreakerOpen))
+		_, err = queue.BatchPut(cfg, []string{"message"})
+		Expect(err).To(Equal(app.ErrThrottled))
+	})
+
+	It("should pick up a changed rate from the queue config", func() {
+		queue.BatchPut(cfg, []string{"message"})
+		setRegister(app.MaxPutRate, app.DefaultSettings[app.MaxPutRate])
+		_, err := queue.BatchPut(cfg, []string{"message"})
+		Expect(err).To(Equal(app.ErrBreakerOpen))
+	})
+})
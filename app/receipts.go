@@ -0,0 +1,168 @@
+package app
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/tpjg/goriakpbc"
+)
+
+// ReceiptMetaKey is the key in a received message's meta holding its receipt handle
+const ReceiptMetaKey = "receipt"
+
+// VisibleUntilMetaKey is the meta key holding when a received message is visible again
+const VisibleUntilMetaKey = "visible_until"
+
+var (
+	// ErrInvalidReceipt represents the condition that occurs if a receipt handle could not be decoded
+	ErrInvalidReceipt = errors.New("Receipt handle is invalid")
+	// ErrReceiptExpired represents the condition that occurs if a receipt handle outlived the
+	// visibility timeout of its queue, meaning the message may have been delivered again since
+	ErrReceiptExpired = errors.New("Receipt handle has expired")
+	// ErrReceiptSuperseded represents the condition that occurs if the delivery a receipt handle was
+	// issued for is over, as the message was handed back, or received again, since
+	ErrReceiptSuperseded = errors.New("Receipt handle is for an earlier delivery")
+	// ErrInvalidRequeueDelay represents the condition that occurs if a message is nacked with a
+	// negative requeue delay
+	ErrInvalidRequeueDelay = errors.New("Requeue delay must be 0 or greater")
+)
+
+// NewReceiptHandle returns the handle for a delivery of the message with id, claimed through node
+func NewReceiptHandle(id string, receivedAt time.Time, claimedUntil time.Time, node string) string {
+	raw := id + ":" + strconv.FormatInt(receivedAt.UnixNano(), 10) + ":" + strconv.FormatInt(claimedUntil.UnixNano(), 10) + ":" + node
+	return base64.URLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseReceiptHandle returns the message id, receive time and claim encoded into a receipt handle
+func ParseReceiptHandle(receipt string) (string, time.Time, time.Time, error) {
+	raw, err := base64.URLEncoding.DecodeString(receipt)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, ErrInvalidReceipt
+	}
+	// Node names may hold colons of their own, and handles issued before they were named hold none
+	parts := strings.SplitN(string(raw), ":", 4)
+	if len(parts) < 3 || parts[0] == "" {
+		return "", time.Time{}, time.Time{}, ErrInvalidReceipt
+	}
+	receivedNanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, ErrInvalidReceipt
+	}
+	claimedNanos, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, ErrInvalidReceipt
+	}
+	return parts[0], time.Unix(0, receivedNanos), time.Unix(0, claimedNanos), nil
+}
+
+// ReceiptNode returns the name of the node which issued a receipt handle, if it names one
+func ReceiptNode(receipt string) string {
+	raw, err := base64.URLEncoding.DecodeString(receipt)
+	if err != nil {
+		return ""
+	}
+	parts := strings.SplitN(string(raw), ":", 4)
+	if len(parts) < 4 {
+		return ""
+	}
+	return parts[3]
+}
+
+// receiptIssuer returns the HTTP address of the node which issued a receipt handle, or "" if it is local
+func receiptIssuer(members []*memberlist.Node, local string, httpPort int, receipt string) (string, error) {
+	node := ReceiptNode(receipt)
+	if node == "" || node == local {
+		return "", nil
+	}
+	for _, member := range members {
+		if member.Name == node {
+			return net.JoinHostPort(member.Addr.String(), strconv.Itoa(httpPort)), nil
+		}
+	}
+	return "", ErrReceiptSuperseded
+}
+
+// forwardReceipt hands a request made with a receipt handle on to the node which issued it
+func forwardReceipt(w http.ResponseWriter, req *http.Request, issuer string) {
+	httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: issuer}).ServeHTTP(w, req)
+}
+
+// DeleteByReceipt deletes the message a receipt handle was issued for
+func (queue *Queue) DeleteByReceipt(cfg *Config, receipt string) error {
+	id, err := queue.receiptID(cfg, receipt)
+	if err != nil {
+		return err
+	}
+	return queue.Delete(cfg, id)
+}
+
+// Ack acknowledges the message a receipt handle was issued for, deleting it, as DeleteByReceipt does
+func (queue *Queue) Ack(cfg *Config, receipt string) error {
+	return queue.DeleteByReceipt(cfg, receipt)
+}
+
+// Nack hands the message a receipt handle was issued for back to the queue after requeueDelay
+func (queue *Queue) Nack(cfg *Config, list *memberlist.Memberlist, receipt string, requeueDelay time.Duration) (bool, error) {
+	if requeueDelay < 0 {
+		return false, ErrInvalidRequeueDelay
+	}
+	id, err := queue.receiptID(cfg, receipt)
+	if err == ErrReceiptExpired || err == ErrReceiptSuperseded {
+		// It's visible again already, or was never in flight here
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	value, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return false, ErrInvalidReceipt
+	}
+	visTimeout, _ := cfg.GetVisibilityTimeout(queue.Name)
+	nodeBottom, nodeTop := GetNodePartitionRange(cfg, list)
+	return queue.Parts.release(nodeBottom, nodeTop, int(value), visTimeout, time.Now().Add(requeueDelay)), nil
+}
+
+// receiptID returns the id of the message a receipt handle's live delivery was issued for
+func (queue *Queue) receiptID(cfg *Config, receipt string) (string, error) {
+	id, receivedAt, claimedUntil, err := ParseReceiptHandle(receipt)
+	if err != nil {
+		return "", err
+	}
+	visTimeout, err := cfg.GetVisibilityTimeout(queue.Name)
+	if err != nil {
+		return "", err
+	}
+	if time.Since(receivedAt).Seconds() >= visTimeout {
+		return "", ErrReceiptExpired
+	}
+	if queue.Parts == nil {
+		return "", ErrReceiptSuperseded
+	}
+	if until, ok := queue.Parts.claimedUntil(id); !ok || !until.Equal(claimedUntil) {
+		return "", ErrReceiptSuperseded
+	}
+	return id, nil
+}
+
+// attachReceipts adds a receipt handle and a visibility deadline to the meta of each received message
+func attachReceipts(messages []riak.RObject, part *Partitions, node string, receivedAt time.Time, visibilityTimeout float64) {
+	visibleUntil := receivedAt.Add(time.Duration(visibilityTimeout * float64(time.Second))).UTC().Format(time.RFC3339Nano)
+	for i := range messages {
+		if messages[i].Meta == nil {
+			messages[i].Meta = make(map[string]string)
+		}
+		// A message without a claim gets a handle which no claim matches
+		claimedUntil, _ := part.claimedUntil(messages[i].Key)
+		messages[i].Meta[ReceiptMetaKey] = NewReceiptHandle(messages[i].Key, receivedAt, claimedUntil, node)
+		messages[i].Meta[VisibleUntilMetaKey] = visibleUntil
+	}
+}
@@ -0,0 +1,229 @@
+package app_test
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/hashicorp/memberlist"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
+)
+
+var _ = Describe("Receipts", func() {
+
+	Context("attached to received messages", func() {
+		It("should include a deadline of the receive time plus the visibility timeout", func() {
+			visTimeout, _ := cfg.GetVisibilityTimeout(testQueueName)
+			receivedAt := time.Now()
+			claimedUntil := receivedAt.Add(time.Duration(visTimeout) * time.Second)
+			part := app.InitPartitions(cfg, testQueueName)
+			part.Claim([]string{"12345"}, claimedUntil)
+			messages := []riak.RObject{{Key: "12345"}}
+			app.AttachReceipts(messages, part, "node1", receivedAt, visTimeout)
+
+			Expect(messages[0].Meta[app.ReceiptMetaKey]).To(Equal(app.NewReceiptHandle("12345", receivedAt, claimedUntil, "node1")))
+			visibleUntil, err := time.Parse(time.RFC3339Nano, messages[0].Meta[app.VisibleUntilMetaKey])
+			Expect(err).ToNot(HaveOccurred())
+			expected := receivedAt.Add(time.Duration(visTimeout) * time.Second)
+			Expect(visibleUntil).To(BeTemporally("~", expected, time.Millisecond))
+		})
+	})
+
+	Context("ParseReceiptHandle", func() {
+		It("should return the id, receive time and claim the handle was made from", func() {
+			receivedAt := time.Now()
+			claimedUntil := receivedAt.Add(time.Minute)
+			id, parsedAt, parsedUntil, err := app.ParseReceiptHandle(app.NewReceiptHandle("12345", receivedAt, claimedUntil, "node1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(Equal("12345"))
+			Expect(parsedAt.UnixNano()).To(Equal(receivedAt.UnixNano()))
+			Expect(parsedUntil.UnixNano()).To(Equal(claimedUntil.UnixNano()))
+		})
+
+		It("should reject handles it didn't make", func() {
+			_, _, _, err := app.ParseReceiptHandle("not a receipt")
+			Expect(err).To(Equal(app.ErrInvalidReceipt))
+			_, _, _, err = app.ParseReceiptHandle(base64.URLEncoding.EncodeToString([]byte("12345")))
+			Expect(err).To(Equal(app.ErrInvalidReceipt))
+			// Handles from before deliveries were tied to their claim
+			_, _, _, err = app.ParseReceiptHandle(base64.URLEncoding.EncodeToString([]byte("12345:1")))
+			Expect(err).To(Equal(app.ErrInvalidReceipt))
+		})
+	})
+
+	Context("ReceiptNode", func() {
+		It("should return the node the handle was issued by", func() {
+			Expect(app.ReceiptNode(app.NewReceiptHandle("12345", time.Now(), time.Now(), "node1"))).To(Equal("node1"))
+			Expect(app.ReceiptNode(app.NewReceiptHandle("12345", time.Now(), time.Now(), "node1:7000"))).To(Equal("node1:7000"))
+		})
+
+		It("should return nothing for handles issued before they named their node", func() {
+			receipt := base64.URLEncoding.EncodeToString([]byte("12345:1:2"))
+			Expect(app.ReceiptNode(receipt)).To(BeEmpty())
+			id, _, _, err := app.ParseReceiptHandle(receipt)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(Equal("12345"))
+		})
+	})
+
+	Context("ReceiptIssuer", func() {
+		members := []*memberlist.Node{
+			{Name: "node1", Addr: net.ParseIP("10.0.0.1")},
+			{Name: "node2", Addr: net.ParseIP("10.0.0.2")},
+		}
+
+		It("should check a handle issued by this node here", func() {
+			issuer, err := app.ReceiptIssuer(members, "node1", 8081, app.NewReceiptHandle("12345", time.Now(), time.Now(), "node1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(issuer).To(BeEmpty())
+		})
+
+		It("should send a handle issued by another node to it", func() {
+			issuer, err := app.ReceiptIssuer(members, "node1", 8081, app.NewReceiptHandle("12345", time.Now(), time.Now(), "node2"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(issuer).To(Equal("10.0.0.2:8081"))
+		})
+
+		It("should reject a handle issued by a node which has left", func() {
+			_, err := app.ReceiptIssuer(members, "node1", 8081, app.NewReceiptHandle("12345", time.Now(), time.Now(), "node3"))
+			Expect(err).To(Equal(app.ErrReceiptSuperseded))
+		})
+	})
+
+	Context("ForwardReceipt", func() {
+		It("should answer with the response of the node which issued the handle", func() {
+			issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				Expect(req.Method).To(Equal("DELETE"))
+				Expect(req.URL.Path).To(Equal("/v1/queues/test_queue/receipts/abc"))
+				w.WriteHeader(422)
+				w.Write([]byte(`{"error":"Receipt handle is for an earlier delivery"}`))
+			}))
+			defer issuer.Close()
+
+			recorder := httptest.NewRecorder()
+			app.ForwardReceipt(recorder, httptest.NewRequest("DELETE", "/v1/queues/test_queue/receipts/abc", nil), strings.TrimPrefix(issuer.URL, "http://"))
+			Expect(recorder.Code).To(Equal(422))
+			Expect(recorder.Body.String()).To(ContainSubstring("earlier delivery"))
+		})
+	})
+
+	Context("DeleteByReceipt", func() {
+		It("should reject a receipt older than the visibility timeout", func() {
+			visTimeout, _ := cfg.GetVisibilityTimeout(testQueueName)
+			receivedAt := time.Now().Add(-time.Duration(visTimeout+1) * time.Second)
+			receipt := app.NewReceiptHandle("12345", receivedAt, receivedAt, "node1")
+			Expect(queues.QueueMap[testQueueName].DeleteByReceipt(cfg, receipt)).To(Equal(app.ErrReceiptExpired))
+		})
+
+		It("should reject an invalid receipt", func() {
+			Expect(queues.QueueMap[testQueueName].DeleteByReceipt(cfg, "not a receipt")).To(Equal(app.ErrInvalidReceipt))
+		})
+	})
+
+	Context("Ack", func() {
+		var (
+			queue        *app.Queue
+			bucket       *app.MemoryMessages
+			claimedUntil time.Time
+			visTimeout   float64
+		)
+
+		ack := func(receipt string) error {
+			return queue.AckWith(cfg, receipt, bucket)
+		}
+
+		BeforeEach(func() {
+			queue = &app.Queue{Name: testQueueName, Parts: app.InitPartitions(cfg, testQueueName)}
+			bucket = &app.MemoryMessages{Objects: map[string]riak.RObject{"12345": {Key: "12345"}}}
+			visTimeout, _ = cfg.GetVisibilityTimeout(testQueueName)
+			claimedUntil = time.Now().Add(time.Duration(visTimeout) * time.Second)
+			queue.Parts.Claim([]string{"12345"}, claimedUntil)
+		})
+
+		It("should delete the message the receipt was issued for", func() {
+			Expect(ack(app.NewReceiptHandle("12345", time.Now(), claimedUntil, "node1"))).To(Succeed())
+			Expect(bucket.Objects).To(BeEmpty())
+		})
+
+		It("should reject a receipt made up for the message", func() {
+			Expect(ack(app.NewReceiptHandle("12345", time.Now(), claimedUntil.Add(-time.Nanosecond), "node1"))).To(Equal(app.ErrReceiptSuperseded))
+			Expect(bucket.Objects).To(HaveKey("12345"))
+		})
+
+		It("should reject the receipt of an earlier delivery", func() {
+			earlier := app.NewReceiptHandle("12345", time.Now(), claimedUntil, "node1")
+			// Handed back, then received again
+			queue.Parts.UnlockAll(visTimeout)
+			queue.Parts.Claim([]string{"12345"}, claimedUntil.Add(time.Second))
+			Expect(ack(earlier)).To(Equal(app.ErrReceiptSuperseded))
+			Expect(bucket.Objects).To(HaveKey("12345"))
+		})
+
+		It("should reject a receipt this node holds no claim for", func() {
+			Expect(ack(app.NewReceiptHandle("67890", time.Now(), claimedUntil, "node1"))).To(Equal(app.ErrReceiptSuperseded))
+		})
+	})
+
+	Context("Nack", func() {
+		var queue *app.Queue
+		var receipt string
+		var visTimeout float64
+
+		BeforeEach(func() {
+			queue = &app.Queue{Name: testQueueName, Parts: app.InitPartitions(cfg, testQueueName)}
+			bottom, _, served, err := queue.Parts.GetPartition(cfg, testQueueName, memberList)
+			Expect(err).ToNot(HaveOccurred())
+			served.InFlight = 1
+			queue.Parts.PushPartition(cfg, testQueueName, served, true)
+			visTimeout, _ = cfg.GetVisibilityTimeout(testQueueName)
+			claimedUntil := time.Now().Add(time.Duration(visTimeout) * time.Second)
+			queue.Parts.Claim([]string{strconv.Itoa(bottom + 1)}, claimedUntil)
+			receipt = app.NewReceiptHandle(strconv.Itoa(bottom+1), time.Now(), claimedUntil, "node1")
+		})
+
+		It("should make the message receivable again right away", func() {
+			requeued, err := queue.Nack(cfg, memberList, receipt, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requeued).To(BeTrue())
+			Expect(queue.Parts.InFlightCount(visTimeout)).To(BeZero())
+		})
+
+		It("should keep the message in flight until the delay passes", func() {
+			requeued, err := queue.Nack(cfg, memberList, receipt, time.Duration(visTimeout/2)*time.Second)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requeued).To(BeTrue())
+			// It's now locked as though received half a visibility timeout ago
+			Expect(queue.Parts.InFlightCount(visTimeout)).To(Equal(1))
+			Expect(queue.Parts.InFlightCount(visTimeout/2 - 1)).To(BeZero())
+		})
+
+		It("should do nothing for a message which is no longer in flight", func() {
+			receivedAt := time.Now().Add(-time.Duration(visTimeout+1) * time.Second)
+			expired := app.NewReceiptHandle("1", receivedAt, receivedAt, "node1")
+			requeued, err := queue.Nack(cfg, memberList, expired, 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requeued).To(BeFalse())
+			Expect(queue.Parts.InFlightCount(visTimeout)).To(Equal(1))
+		})
+
+		It("should do nothing for the receipt of another delivery", func() {
+			id, receivedAt, claimedUntil, _ := app.ParseReceiptHandle(receipt)
+			requeued, err := queue.Nack(cfg, memberList, app.NewReceiptHandle(id, receivedAt, claimedUntil.Add(time.Second), "node1"), 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requeued).To(BeFalse())
+			Expect(queue.Parts.InFlightCount(visTimeout)).To(Equal(1))
+		})
+
+		It("should reject a negative delay", func() {
+			_, err := queue.Nack(cfg, memberList, receipt, -time.Second)
+			Expect(err).To(Equal(app.ErrInvalidRequeueDelay))
+		})
+	})
+})
@@ -0,0 +1,112 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// ReceivePollInterval is how often Receive tries the queue again while waiting for messages
+const ReceivePollInterval = 100 * time.Millisecond
+
+// MaxReceiveWaitTime is the longest a single Receive may wait for messages
+const MaxReceiveWaitTime = 20 * time.Second
+
+// ErrInvalidWaitTime represents the condition that occurs if a receive's wait time is out of range
+var ErrInvalidWaitTime = errors.New("Wait time must be between 0 and 20 seconds")
+
+// Receive gets up to maxMessages messages from the queue, waiting up to waitTime for any
+func (queue *Queue) Receive(cfg *Config, list *memberlist.Memberlist, maxMessages int64, waitTime time.Duration) ([]Message, error) {
+	if waitTime < 0 || waitTime > MaxReceiveWaitTime {
+		return nil, ErrInvalidWaitTime
+	}
+	return receive(func() ([]Message, error) {
+		return queue.Get(cfg, list, maxMessages)
+	}, waitTime, ReceivePollInterval)
+}
+
+func receive(fetch func() ([]Message, error), waitTime time.Duration, interval time.Duration) ([]Message, error) {
+	deadline := time.Now().Add(waitTime)
+	for {
+		messages, err := fetch()
+		// Every partition being locked, or the queue being throttled, just means nothing to hand out yet
+		if err != nil && err.Error() != NoPartitions && err != ErrThrottled && err != ErrQueueEmpty {
+			return nil, err
+		}
+		if len(messages) > 0 {
+			return messages, nil
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			// Hand back why the last receive came up empty, as Get would
+			return []Message{}, err
+		}
+		if remaining < interval {
+			interval = remaining
+		}
+		time.Sleep(interval)
+	}
+}
+
+// QueueErrors holds the error each queue failed with, in an operation across several queues, keyed by queue name
+type QueueErrors map[string]error
+
+func (e QueueErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, fmt.Sprintf("%s: %s", name, e[name]))
+	}
+	return strings.Join(messages, "; ")
+}
+
+// GetMulti gets up to batchsize messages from each of the named queues, keyed by queue name
+func (queues *Queues) GetMulti(cfg *Config, list *memberlist.Memberlist, names []string, batchsize int64) (map[string][]Message, error) {
+	return queues.getMulti(names, func(queue *Queue) ([]Message, error) {
+		return queue.Get(cfg, list, batchsize)
+	})
+}
+
+func (queues *Queues) getMulti(names []string, get func(queue *Queue) ([]Message, error)) (map[string][]Message, error) {
+	received := make(map[string][]Message, len(names))
+	errs := make(QueueErrors)
+	found := make(map[string]*Queue, len(names))
+	for _, name := range names {
+		queue, err := queues.GetQueue(name)
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		found[name] = queue
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for name, queue := range found {
+		wg.Add(1)
+		go func(name string, queue *Queue) {
+			defer wg.Done()
+			messages, err := get(queue)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs[name] = err
+				return
+			}
+			received[name] = messages
+		}(name, queue)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return received, errs
+	}
+	return received, nil
+}
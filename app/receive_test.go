@@ -0,0 +1,136 @@
+package app_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Receive", func() {
+
+	var (
+		calls    int
+		messages = []app.Message{{ID: "1", Body: []byte("one")}, {ID: "2", Body: []byte("two")}}
+	)
+
+	// fetchAfter comes up empty until its nth call, then returns the messages
+	fetchAfter := func(n int) func() ([]app.Message, error) {
+		return func() ([]app.Message, error) {
+			calls++
+			if calls < n {
+				return nil, errors.New(app.NoPartitions)
+			}
+			return messages, nil
+		}
+	}
+
+	BeforeEach(func() {
+		calls = 0
+	})
+
+	It("should return right away when messages are already available", func() {
+		start := time.Now()
+		received, err := app.ReceiveWith(fetchAfter(1), time.Second, 10*time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(messages))
+		Expect(calls).To(Equal(1))
+		Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+	})
+
+	It("should return as soon as messages arrive part way through the wait", func() {
+		start := time.Now()
+		received, err := app.ReceiveWith(fetchAfter(4), time.Second, 10*time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(messages))
+		Expect(calls).To(Equal(4))
+		Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+	})
+
+	It("should return an empty list once the wait is up", func() {
+		start := time.Now()
+		received, err := app.ReceiveWith(func() ([]app.Message, error) {
+			calls++
+			return []app.Message{}, nil
+		}, 50*time.Millisecond, 10*time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).ToNot(BeNil())
+		Expect(received).To(BeEmpty())
+		Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+		Expect(calls).To(BeNumerically(">", 1))
+	})
+
+	It("should hand back why the last receive came up empty once the wait is up", func() {
+		received, err := app.ReceiveWith(func() ([]app.Message, error) {
+			calls++
+			return nil, app.ErrThrottled
+		}, 0, 10*time.Millisecond)
+		Expect(err).To(Equal(app.ErrThrottled))
+		Expect(received).To(BeEmpty())
+		Expect(calls).To(Equal(1))
+	})
+
+	It("should keep waiting on a queue which is empty with emptyqueueerror set", func() {
+		received, err := app.ReceiveWith(func() ([]app.Message, error) {
+			calls++
+			if calls < 3 {
+				return nil, app.ErrQueueEmpty
+			}
+			return messages, nil
+		}, time.Second, 10*time.Millisecond)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(messages))
+		Expect(calls).To(Equal(3))
+	})
+
+	It("should give up on the first error which isn't just an empty queue", func() {
+		riakError := errors.New("riak is down")
+		_, err := app.ReceiveWith(func() ([]app.Message, error) {
+			calls++
+			return nil, riakError
+		}, time.Second, 10*time.Millisecond)
+		Expect(err).To(Equal(riakError))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("should refuse to wait longer than the maximum", func() {
+		_, err := queues.QueueMap[testQueueName].Receive(cfg, memberList, 10, app.MaxReceiveWaitTime+time.Second)
+		Expect(err).To(Equal(app.ErrInvalidWaitTime))
+	})
+
+	Context("GetMulti", func() {
+		It("should key the messages received from each queue by its name", func() {
+			multi := &app.Queues{QueueMap: map[string]*app.Queue{
+				"first":   {Name: "first"},
+				"second":  {Name: "second"},
+				"failing": {Name: "failing"},
+			}}
+			received, err := multi.GetMultiWith([]string{"first", "second", "failing", "missing"}, func(queue *app.Queue) ([]app.Message, error) {
+				if queue.Name == "failing" {
+					return nil, app.ErrRiakUnavailable
+				}
+				return []app.Message{{ID: queue.Name + "-1", Body: []byte(queue.Name)}}, nil
+			})
+			Expect(received).To(HaveLen(2))
+			Expect(received["first"]).To(Equal([]app.Message{{ID: "first-1", Body: []byte("first")}}))
+			Expect(received["second"]).To(Equal([]app.Message{{ID: "second-1", Body: []byte("second")}}))
+
+			errs, ok := err.(app.QueueErrors)
+			Expect(ok).To(BeTrue())
+			Expect(errs).To(HaveLen(2))
+			Expect(errs["failing"]).To(Equal(app.ErrRiakUnavailable))
+			Expect(errs["missing"]).To(Equal(app.ErrQueueNotFound))
+		})
+
+		It("should not fail when every queue is received from", func() {
+			multi := &app.Queues{QueueMap: map[string]*app.Queue{"first": {Name: "first"}}}
+			received, err := multi.GetMultiWith([]string{"first"}, func(queue *app.Queue) ([]app.Message, error) {
+				return []app.Message{}, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(received).To(HaveKeyWithValue("first", BeEmpty()))
+		})
+	})
+})
@@ -0,0 +1,341 @@
+package app
+
+import (
+	"errors"
+	"math"
+	"regexp"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/tpjg/goriakpbc"
+)
+
+// RenamedFrom is the register a renamed queue's config keeps its previous name in
+const RenamedFrom = "renamed_from"
+
+var (
+	// ErrQueueNotFound represents the condition that occurs if an operation names a queue that doesn't exist
+	ErrQueueNotFound = errors.New("Queue does not exist")
+	// ErrQueueExists represents the condition that occurs if a queue is renamed to the name of another queue
+	ErrQueueExists = errors.New("Queue already exists")
+	// ErrInvalidQueueName represents the condition that occurs if a queue name is empty, or can't be
+	// used in a URL path
+	ErrInvalidQueueName = errors.New("Queue names must be non-empty, without slashes or whitespace")
+	// ErrReservedQueueName represents the condition that occurs if a queue is named after one of the
+	// keys dynamiq keeps its own config under
+	ErrReservedQueueName = errors.New("Queue name is reserved")
+)
+
+var validQueueName = regexp.MustCompile(`^[^/\s]+$`)
+
+// reservedQueueNames are the keys in the config bucket which aren't a queue's own record
+var reservedQueueNames = map[string]bool{QueueConfigName: true, TopicsConfigName: true}
+
+// checkQueueName returns an error if name can't be given to a queue
+func checkQueueName(name string) error {
+	if !validQueueName.MatchString(name) {
+		return ErrInvalidQueueName
+	}
+	if reservedQueueNames[name] {
+		return ErrReservedQueueName
+	}
+	return nil
+}
+
+// renameStore holds everything RenameQueue reads and writes, so it can be run against something other than Riak
+type renameStore interface {
+	queueExists(name string) (bool, error)
+	renamedFrom(name string) (string, error)
+	// copyConfig writes the old queue's settings to the new queue's config, returning it
+	copyConfig(oldName string, newName string) (*riak.RDtMap, error)
+	addQueue(name string) error
+	// removeQueue drops the queue from the known queues, then destroys its config
+	removeQueue(name string) error
+	topicNames() ([]string, error)
+	// repointTopic swaps oldName for newName in the topic's subscriptions, if it is subscribed
+	repointTopic(topicName string, oldName string, newName string) error
+	// messageIDs returns a page of the ids of the messages in the queue, from continuation on, and
+	// the continuation of the next page, or "" if this is the last
+	messageIDs(queueName string, continuation string) ([]string, string, error)
+	// moveMessage stores the message in the new queue, then deletes it from the old one
+	moveMessage(oldName string, newName string, id string) error
+}
+
+// RenameQueue renames a queue, moving its config, subscriptions and messages over
+func (queues *Queues) RenameQueue(cfg *Config, oldName string, newName string) error {
+	return queues.renameQueue(cfg, riakRenameStore{cfg: cfg}, oldName, newName)
+}
+
+func (queues *Queues) renameQueue(cfg *Config, store renameStore, oldName string, newName string) error {
+	if err := checkQueueName(newName); err != nil {
+		return err
+	}
+	if newName == oldName {
+		return ErrInvalidQueueName
+	}
+	oldExists, err := store.queueExists(oldName)
+	if err != nil {
+		return err
+	}
+	newExists, err := store.queueExists(newName)
+	if err != nil {
+		return err
+	}
+	resuming := false
+	if newExists {
+		from, err := store.renamedFrom(newName)
+		if err != nil {
+			return err
+		}
+		if from != oldName {
+			return ErrQueueExists
+		}
+		resuming = true
+	}
+	if !oldExists {
+		if !resuming {
+			return ErrQueueNotFound
+		}
+		// The rename got as far as dropping the old queue, but may not have destroyed its config
+		queues.removeFromMap(oldName)
+		return store.removeQueue(oldName)
+	}
+
+	config, err := store.copyConfig(oldName, newName)
+	if err != nil {
+		return err
+	}
+	err = store.addQueue(newName)
+	if err != nil {
+		return err
+	}
+
+	topicNames, err := store.topicNames()
+	if err != nil {
+		return err
+	}
+	for _, topicName := range topicNames {
+		err = store.repointTopic(topicName, oldName, newName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Serve the new name from this node right away, rather than waiting on the next config sync
+	newQueue := &Queue{Name: newName, Config: config}
+	if oldQueue, err := queues.GetQueue(oldName); err == nil {
+		newQueue.Parts = oldQueue.Parts
+	} else {
+		// Read before locking, as InitPartitions reads the queue's settings through the lock
+		newQueue.Parts = InitPartitions(cfg, newName)
+	}
+	queues.Lock()
+	queues.QueueMap[newName] = newQueue
+	delete(queues.QueueMap, oldName)
+	queues.Unlock()
+
+	// Follow the continuation rather than taking the first page until it's empty, as the index can
+	// still list messages which are gone, and those are never moved out of it
+	continuation := ""
+	for {
+		ids, next, err := store.messageIDs(oldName, continuation)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			err = store.moveMessage(oldName, newName, id)
+			if err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			break
+		}
+		continuation = next
+	}
+	logrus.Infof("Renamed queue %s to %s", oldName, newName)
+	return store.removeQueue(oldName)
+}
+
+func (queues *Queues) removeFromMap(name string) {
+	queues.Lock()
+	delete(queues.QueueMap, name)
+	queues.Unlock()
+}
+
+type riakRenameStore struct {
+	cfg *Config
+}
+
+func (s riakRenameStore) queueExists(name string) (bool, error) {
+	return s.cfg.isKnownQueue(name)
+}
+
+func (s riakRenameStore) renamedFrom(name string) (string, error) {
+	bucket, release, err := s.cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	config, err := bucket.FetchMap(queueConfigRecordName(name))
+	if err == riak.NotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	reg := config.FetchRegister(RenamedFrom)
+	if reg == nil {
+		return "", nil
+	}
+	return registerValueToString(reg)
+}
+
+func (s riakRenameStore) copyConfig(oldName string, newName string) (*riak.RDtMap, error) {
+	bucket, release, err := s.cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	oldConfig, err := bucket.FetchMap(queueConfigRecordName(oldName))
+	if err != nil {
+		return nil, err
+	}
+	newConfig, err := bucket.FetchMap(queueConfigRecordName(newName))
+	if err != nil && err != riak.NotFound {
+		return nil, err
+	}
+	for _, setting := range Settings {
+		value := []byte(DefaultSettings[setting])
+		if reg := oldConfig.FetchRegister(setting); reg != nil {
+			value = reg.GetValue()
+		}
+		newConfig.AddRegister(setting).Update(value)
+	}
+	newConfig.AddRegister(RenamedFrom).Update([]byte(oldName))
+	err = s.cfg.ConfigMaps.storeConfigMap(queueConfigRecordName(newName), newConfig)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.FetchMap(queueConfigRecordName(newName))
+}
+
+func (s riakRenameStore) addQueue(name string) error {
+	return s.cfg.addToKnownQueues(name)
+}
+
+func (s riakRenameStore) removeQueue(name string) error {
+	return s.cfg.destroyQueue(name)
+}
+
+func (s riakRenameStore) topicNames() ([]string, error) {
+	bucket, release, err := s.cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	topicsConfig, err := bucket.FetchMap(TopicsConfigName)
+	if err == riak.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, 10)
+	if topicSet := topicsConfig.FetchSet("topics"); topicSet != nil {
+		for _, name := range topicSet.GetValue() {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func (s riakRenameStore) repointTopic(topicName string, oldName string, newName string) error {
+	bucket, release, err := s.cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return err
+	}
+	defer release()
+	topicConfig, err := bucket.FetchMap(topicConfigRecordName(topicName))
+	if err == riak.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	queueSet := topicConfig.FetchSet("queues")
+	if queueSet == nil {
+		return nil
+	}
+	for _, queueName := range queueSet.GetValue() {
+		if string(queueName) == oldName {
+			queueSet.Add([]byte(newName))
+			queueSet.Remove([]byte(oldName))
+			return s.cfg.ConfigMaps.storeConfigMap(topicConfigRecordName(topicName), topicConfig)
+		}
+	}
+	return nil
+}
+
+func (s riakRenameStore) messageIDs(queueName string, continuation string) ([]string, string, error) {
+	bucket, release, err := s.cfg.RiakBucket("messages", queueName)
+	if err != nil {
+		return nil, "", err
+	}
+	defer release()
+	return s.cfg.queryIDs(bucket, 0, math.MaxInt64, reconcilePageSize, continuation)
+}
+
+func (s riakRenameStore) moveMessage(oldName string, newName string, id string) error {
+	source, release, err := s.cfg.RiakBucket("messages", oldName)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// The move is one operation, so both buckets share the connection
+	destination, err := s.cfg.riakBucketOn(s.cfg.RiakPool, "messages", newName)
+	if err != nil {
+		return err
+	}
+	rObject, err := source.Get(id)
+	if err == riak.NotFound {
+		// Already moved by an earlier attempt
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rObject.Conflict() {
+		// Give each sibling its own id, as repairConflict would
+		for _, sibling := range rObject.Siblings {
+			if len(sibling.Data) == 0 {
+				continue
+			}
+			uuid := s.cfg.newMessageID()
+			moved := destination.NewObject(uuid)
+			moved.ContentType = sibling.ContentType
+			moved.Data = sibling.Data
+			moved.Meta = sibling.Meta
+			moved.Indexes = sibling.Indexes
+			if moved.Indexes == nil {
+				moved.Indexes = make(map[string][]string)
+			}
+			s.cfg.indexMessageID(moved, uuid)
+			err = moved.Store()
+			if err != nil {
+				return err
+			}
+		}
+		return rObject.Destroy()
+	}
+	// Keeping the id means a move which is retried overwrites its earlier copy, instead of duplicating it
+	moved := destination.NewObject(id)
+	moved.ContentType = rObject.ContentType
+	moved.Data = rObject.Data
+	moved.Meta = rObject.Meta
+	moved.Indexes = rObject.Indexes
+	err = moved.Store()
+	if err != nil {
+		return err
+	}
+	return source.Delete(id)
+}
@@ -0,0 +1,77 @@
+package app_test
+
+import (
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RenameQueue", func() {
+	var renameQueues *app.Queues
+	var store *app.MemoryRenameStore
+
+	BeforeEach(func() {
+		renameQueues = &app.Queues{QueueMap: map[string]*app.Queue{
+			"old": {Name: "old"},
+		}}
+		store = &app.MemoryRenameStore{
+			Queues: map[string]map[string]string{
+				"old":   {app.VisibilityTimeout: "5"},
+				"other": {},
+			},
+			Topics: map[string][]string{
+				"subscribed":   {"other", "old"},
+				"unsubscribed": {"other"},
+			},
+			Messages: map[string]map[string]string{
+				"old": {"1": "one", "2": "two", "3": "three"},
+			},
+		}
+	})
+
+	It("should move the config, subscriptions and messages to the new name", func() {
+		Expect(renameQueues.RenameQueueWith(&app.Config{}, store, "old", "new")).To(Succeed())
+
+		Expect(store.Queues).ToNot(HaveKey("old"))
+		Expect(store.Queues["new"][app.VisibilityTimeout]).To(Equal("5"))
+		Expect(store.Topics["subscribed"]).To(ConsistOf("other", "new"))
+		Expect(store.Topics["unsubscribed"]).To(ConsistOf("other"))
+		Expect(store.Messages["old"]).To(BeEmpty())
+		Expect(store.Messages["new"]).To(Equal(map[string]string{"1": "one", "2": "two", "3": "three"}))
+		Expect(renameQueues.QueueMap).To(HaveKey("new"))
+		Expect(renameQueues.QueueMap).ToNot(HaveKey("old"))
+	})
+
+	It("should finish an interrupted rename when run again", func() {
+		store.FailMovesAfter = 1
+		Expect(renameQueues.RenameQueueWith(&app.Config{}, store, "old", "new")).ToNot(Succeed())
+		Expect(store.Queues).To(HaveKey("old"))
+		Expect(store.Messages["old"]).To(HaveLen(2))
+
+		store.FailMovesAfter = 0
+		Expect(renameQueues.RenameQueueWith(&app.Config{}, store, "old", "new")).To(Succeed())
+		Expect(store.Queues).ToNot(HaveKey("old"))
+		Expect(store.Messages["new"]).To(HaveLen(3))
+		Expect(renameQueues.RenameQueueWith(&app.Config{}, store, "old", "new")).To(Succeed())
+	})
+
+	It("should finish once every page was read, even if the index still lists messages which are gone", func() {
+		store.Tombstones = map[string][]string{"old": {"0", "4"}}
+		Expect(renameQueues.RenameQueueWith(&app.Config{}, store, "old", "new")).To(Succeed())
+		Expect(store.Queues).ToNot(HaveKey("old"))
+		Expect(store.Messages["new"]).To(Equal(map[string]string{"1": "one", "2": "two", "3": "three"}))
+	})
+
+	It("should refuse to rename onto an existing queue", func() {
+		Expect(renameQueues.RenameQueueWith(&app.Config{}, store, "old", "other")).To(Equal(app.ErrQueueExists))
+		Expect(store.Messages["old"]).To(HaveLen(3))
+	})
+
+	It("should validate the names", func() {
+		Expect(renameQueues.RenameQueueWith(&app.Config{}, store, "old", "")).To(Equal(app.ErrInvalidQueueName))
+		Expect(renameQueues.RenameQueueWith(&app.Config{}, store, "old", "a/b")).To(Equal(app.ErrInvalidQueueName))
+		Expect(renameQueues.RenameQueueWith(&app.Config{}, store, "old", app.TopicsConfigName)).To(Equal(app.ErrReservedQueueName))
+		Expect(renameQueues.RenameQueueWith(&app.Config{}, store, "old", app.QueueConfigName)).To(Equal(app.ErrReservedQueueName))
+		Expect(renameQueues.RenameQueueWith(&app.Config{}, store, "missing", "new")).To(Equal(app.ErrQueueNotFound))
+	})
+})
@@ -0,0 +1,235 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/tpjg/goriakpbc"
+)
+
+// ErrInvalidDeleteRetention represents the condition that occurs if a queue is configured with a negative delete_retention
+var ErrInvalidDeleteRetention = errors.New("delete_retention must be 0 or greater")
+
+// ErrRetentionDisabled represents the condition that occurs if a queue without a delete_retention is replayed
+var ErrRetentionDisabled = errors.New("The queue has no delete_retention, so keeps no deleted messages to replay")
+
+// ArchivedIndex is the 2i holding the time, in nanoseconds, an archived message was deleted at
+const ArchivedIndex = "deleted_int"
+
+// QueueReplayedStatsSuffix is the counter of deleted messages put onto the queue again by Replay
+const QueueReplayedStatsSuffix = "replayed.count"
+
+// archiveBucketName returns the name of the bucket the messages deleted from a queue are kept in
+func archiveBucketName(queueName string) string {
+	return queueName + "/deleted"
+}
+
+// messageArchive keeps the messages deleted from a queue, so Replay can be run against something other than Riak
+type messageArchive interface {
+	// archive keeps a copy of the stored message with id, as deleted at deletedAt
+	archive(id string, deletedAt time.Time) error
+	// archived returns the ids of the messages deleted from from up to until
+	archived(from time.Time, until time.Time) ([]string, error)
+	// body returns the body of the archived message with id, ready to be put again
+	body(id string) (string, error)
+	drop(id string) error
+}
+
+// archivingMessages archives each message before removing it from the messageStore
+type archivingMessages struct {
+	messageStore
+	archive messageArchive
+	now     func() time.Time
+}
+
+func (m archivingMessages) remove(id string) error {
+	if err := m.archive.archive(id, m.now()); err != nil {
+		return err
+	}
+	return m.messageStore.remove(id)
+}
+
+// messages returns the queue's messages in bucket, archived on delete if it has a delete_retention
+func (queue *Queue) messages(cfg *Config, bucket *riak.Bucket) messageStore {
+	retention, err := cfg.GetDeleteRetention(queue.Name)
+	if err != nil || retention <= 0 {
+		return riakMessages{bucket}
+	}
+	return archivingMessages{riakMessages{bucket}, queue.riakArchive(cfg, bucket), time.Now}
+}
+
+// Replay puts every message deleted from the queue since since onto it again, returning how many it put
+func (queue *Queue) Replay(cfg *Config, since time.Time) (int, error) {
+	retention, err := cfg.GetDeleteRetention(queue.Name)
+	if err != nil {
+		return 0, err
+	}
+	// Each put takes a connection of its own, so the archive only holds one while it's read
+	replayed, err := replay(queue.riakArchive(cfg, nil), since, time.Now(), retention, func(body string) error {
+		_, err := queue.Put(cfg, body)
+		return err
+	})
+	if replayed > 0 {
+		// Puts count towards sent.count and the depth as usual, this only tells replays apart
+		if err := queue.statsClient(cfg).Incr(fmt.Sprintf("%s.%s", queue.Name, QueueReplayedStatsSuffix), int64(replayed)); err != nil {
+			logrus.Error(err)
+		}
+		logrus.Infof("Replayed %d deleted messages onto queue %s", replayed, queue.Name)
+	}
+	return replayed, err
+}
+
+// replay puts the messages archived since since with put, dropping each from the archive once it's put
+func replay(archive messageArchive, since time.Time, now time.Time, retention float64, put func(body string) error) (int, error) {
+	if retention <= 0 {
+		return 0, ErrRetentionDisabled
+	}
+	if err := pruneArchive(archive, now, retention); err != nil {
+		return 0, err
+	}
+	if oldest := retainedSince(now, retention); since.Before(oldest) {
+		since = oldest
+	}
+	ids, err := archive.archived(since, now)
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for _, id := range ids {
+		body, err := archive.body(id)
+		if err == riak.NotFound {
+			// Replayed by someone else since we looked
+			continue
+		}
+		if err == nil {
+			err = put(body)
+		}
+		if err != nil {
+			return replayed, err
+		}
+		replayed++
+		if err := archive.drop(id); err != nil {
+			logrus.Error(err)
+		}
+	}
+	return replayed, nil
+}
+
+// retainedSince returns the earliest a message can have been deleted and still be archived
+func retainedSince(now time.Time, retention float64) time.Time {
+	return now.Add(-time.Duration(retention * float64(time.Second)))
+}
+
+// pruneArchive drops the archived messages deleted longer than retention seconds ago
+func pruneArchive(archive messageArchive, now time.Time, retention float64) error {
+	expired, err := archive.archived(time.Unix(0, 0), retainedSince(now, retention))
+	if err != nil {
+		return err
+	}
+	for _, id := range expired {
+		if err := archive.drop(id); err != nil && err != riak.NotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneArchive drops the messages deleted from the queue which have outlived its delete_retention
+func (queue *Queue) PruneArchive(cfg *Config) error {
+	retention, err := cfg.GetDeleteRetention(queue.Name)
+	if err != nil || retention <= 0 {
+		return err
+	}
+	return pruneArchive(queue.riakArchive(cfg, nil), time.Now(), retention)
+}
+
+// riakArchive archives the messages deleted from the queue's messages bucket into its archive bucket
+type riakArchive struct {
+	cfg       *Config
+	queueName string
+	// messages is the bucket deleted from, which is only needed to archive
+	messages *riak.Bucket
+}
+
+func (queue *Queue) riakArchive(cfg *Config, messages *riak.Bucket) riakArchive {
+	return riakArchive{cfg: cfg, queueName: queue.Name, messages: messages}
+}
+
+// deleted returns the archive bucket, holding a connection until the func returned is called
+func (a riakArchive) deleted() (*riak.Bucket, func(), error) {
+	return a.cfg.RiakBucket("messages", archiveBucketName(a.queueName))
+}
+
+func (a riakArchive) archive(id string, deletedAt time.Time) error {
+	deleted, err := a.cfg.riakBucketOn(a.cfg.RiakPool, "messages", archiveBucketName(a.queueName))
+	if err != nil {
+		return err
+	}
+	rObject, err := a.messages.Get(id)
+	if err == riak.NotFound || (err == nil && (rObject == nil || len(rObject.Data) == 0)) {
+		// Nothing left to keep
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	archived := deleted.NewObject(id)
+	archived.ContentType = rObject.ContentType
+	archived.Data = rObject.Data
+	archived.Meta = rObject.Meta
+	archived.Indexes = map[string][]string{ArchivedIndex: {strconv.FormatInt(deletedAt.UnixNano(), 10)}}
+	return archived.Store()
+}
+
+func (a riakArchive) archived(from time.Time, until time.Time) ([]string, error) {
+	deleted, release, err := a.deleted()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	min, max := strconv.FormatInt(from.UnixNano(), 10), strconv.FormatInt(until.UnixNano(), 10)
+	ids := []string{}
+	continuation := ""
+	for {
+		page, next, err := deleted.IndexQueryRangePage(ArchivedIndex, min, max, reconcilePageSize, continuation)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, page...)
+		if next == "" {
+			return ids, nil
+		}
+		continuation = next
+	}
+}
+
+func (a riakArchive) body(id string) (string, error) {
+	deleted, release, err := a.deleted()
+	if err != nil {
+		return "", err
+	}
+	rObject, err := deleted.Get(id)
+	release()
+	if err != nil {
+		return "", err
+	}
+	if rObject == nil {
+		return "", riak.NotFound
+	}
+	if err := openMessage(a.cfg, rObject); err != nil {
+		return "", err
+	}
+	return string(rObject.Data), nil
+}
+
+func (a riakArchive) drop(id string) error {
+	deleted, release, err := a.deleted()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return deleted.Delete(id)
+}
@@ -0,0 +1,112 @@
+package app_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
+)
+
+var _ = Describe("Replay", func() {
+	var (
+		archive  *app.MemoryArchive
+		queue    *app.Queue
+		client   *stats.MemoryClient
+		now      time.Time
+		replayed []string
+	)
+	// put records each replayed body, as the queue would store it again
+	put := func(body string) error {
+		replayed = append(replayed, body)
+		return nil
+	}
+
+	BeforeEach(func() {
+		archive = &app.MemoryArchive{MemoryMessages: app.MemoryMessages{Objects: map[string]riak.RObject{
+			"1": {Key: "1", Data: []byte("one")},
+			"2": {Key: "2", Data: []byte("two")},
+			"3": {Key: "3", Data: []byte("three")},
+		}}}
+		queue = &app.Queue{Name: "replayed"}
+		client = stats.NewMemoryClient()
+		now = time.Now()
+		replayed = nil
+	})
+
+	It("should archive messages as they are deleted", func() {
+		Expect(queue.DeleteArchivingWith(client, archive, "1", now)).To(Succeed())
+		Expect(archive.Objects).ToNot(HaveKey("1"))
+		Expect(archive.Archived).To(HaveKeyWithValue("1", app.ArchivedMessage{Body: "one", DeletedAt: now}))
+		Expect(client.Counter("replayed." + app.QueueDeletedStatsSuffix)).To(Equal(int64(1)))
+
+		// Deleting it again finds nothing, and leaves the archived copy alone
+		Expect(queue.DeleteArchivingWith(client, archive, "1", now.Add(time.Minute))).To(Succeed())
+		Expect(archive.Archived["1"].DeletedAt).To(Equal(now))
+	})
+
+	It("should replay a message deleted within the retention window", func() {
+		Expect(queue.DeleteArchivingWith(client, archive, "1", now.Add(-30*time.Second))).To(Succeed())
+		Expect(queue.DeleteArchivingWith(client, archive, "2", now.Add(-10*time.Second))).To(Succeed())
+
+		count, err := app.ReplayWith(archive, time.Time{}, now, 60, put)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(2))
+		Expect(replayed).To(Equal([]string{"one", "two"}))
+		Expect(archive.Archived).To(BeEmpty())
+
+		// Each message is only replayed once
+		count, err = app.ReplayWith(archive, time.Time{}, now, 60, put)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(BeZero())
+	})
+
+	It("should only replay messages deleted after since", func() {
+		Expect(queue.DeleteArchivingWith(client, archive, "1", now.Add(-30*time.Second))).To(Succeed())
+		Expect(queue.DeleteArchivingWith(client, archive, "2", now.Add(-10*time.Second))).To(Succeed())
+
+		count, err := app.ReplayWith(archive, now.Add(-20*time.Second), now, 60, put)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(1))
+		Expect(replayed).To(Equal([]string{"two"}))
+		Expect(archive.Archived).To(HaveKey("1"))
+	})
+
+	It("should not replay a message deleted outside the retention window", func() {
+		Expect(queue.DeleteArchivingWith(client, archive, "1", now.Add(-2*time.Minute))).To(Succeed())
+		Expect(queue.DeleteArchivingWith(client, archive, "2", now.Add(-10*time.Second))).To(Succeed())
+
+		count, err := app.ReplayWith(archive, time.Time{}, now, 60, put)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(count).To(Equal(1))
+		Expect(replayed).To(Equal([]string{"two"}))
+		Expect(archive.Archived).To(BeEmpty())
+	})
+
+	It("should drop messages which outlived the retention when pruned", func() {
+		Expect(queue.DeleteArchivingWith(client, archive, "1", now.Add(-2*time.Minute))).To(Succeed())
+		Expect(queue.DeleteArchivingWith(client, archive, "2", now.Add(-10*time.Second))).To(Succeed())
+
+		Expect(app.PruneArchiveWith(archive, now, 60)).To(Succeed())
+		Expect(archive.Archived).ToNot(HaveKey("1"))
+		Expect(archive.Archived).To(HaveKey("2"))
+	})
+
+	It("should keep a message which couldn't be put archived", func() {
+		Expect(queue.DeleteArchivingWith(client, archive, "1", now.Add(-10*time.Second))).To(Succeed())
+		failure := errors.New("riak is down")
+
+		count, err := app.ReplayWith(archive, time.Time{}, now, 60, func(body string) error { return failure })
+		Expect(err).To(Equal(failure))
+		Expect(count).To(BeZero())
+		Expect(archive.Archived).To(HaveKey("1"))
+	})
+
+	It("should refuse to replay a queue without a delete_retention", func() {
+		_, err := app.ReplayWith(archive, time.Time{}, now, 0, put)
+		Expect(err).To(Equal(app.ErrRetentionDisabled))
+	})
+})
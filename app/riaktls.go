@@ -0,0 +1,125 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ErrRiakTLSKeyPair represents the condition that occurs if only one of riaktlscert and riaktlskey is set
+var ErrRiakTLSKeyPair = errors.New("riaktlscert and riaktlskey must be set together")
+
+// riakDialer opens an encrypted connection to a Riak node. It's dialRiakTLS, unless a spec swaps it out
+type riakDialer func(network string, addr string, config *tls.Config) (net.Conn, error)
+
+// dialRiakTLS is tls.Dial, returning a plain net.Conn
+func dialRiakTLS(network string, addr string, config *tls.Config) (net.Conn, error) {
+	return tls.Dial(network, addr, config)
+}
+
+// riakTLSConfig builds the TLS config for talking to Riak, or returns nil if riaktls is off
+func riakTLSConfig(core Core) (*tls.Config, error) {
+	if !core.RiakTLS {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: core.RiakTLSServerName}
+	if core.RiakTLSCACert != "" {
+		pem, err := ioutil.ReadFile(core.RiakTLSCACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates could be read from riaktlscacert " + core.RiakTLSCACert)
+		}
+	}
+	if (core.RiakTLSCert == "") != (core.RiakTLSKey == "") {
+		return nil, ErrRiakTLSKeyPair
+	}
+	if core.RiakTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(core.RiakTLSCert, core.RiakTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// riakPoolAddress returns the address the Riak connection pool should connect to for host
+func riakPoolAddress(core Core, host string, dial riakDialer) (string, error) {
+	config, err := riakTLSConfig(core)
+	if err != nil || config == nil {
+		return host, err
+	}
+	tunnel, err := newRiakTLSTunnel(host, config, dial)
+	if err != nil {
+		return "", err
+	}
+	logrus.Infof("Connecting to Riak at %s over TLS, through %s", host, tunnel.Addr())
+	return tunnel.Addr(), nil
+}
+
+// riakTLSTunnel forwards plaintext connections on a loopback port over TLS to a Riak node
+type riakTLSTunnel struct {
+	listener net.Listener
+	remote   string
+	config   *tls.Config
+	dial     riakDialer
+}
+
+func newRiakTLSTunnel(remote string, config *tls.Config, dial riakDialer) (*riakTLSTunnel, error) {
+	// Only listen on loopback, so the plaintext side never leaves the box
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	tunnel := &riakTLSTunnel{listener: listener, remote: remote, config: config, dial: dial}
+	go tunnel.serve()
+	return tunnel, nil
+}
+
+// Addr returns the local address to point the connection pool at
+func (t *riakTLSTunnel) Addr() string {
+	return t.listener.Addr().String()
+}
+
+// Close stops accepting new connections. Ones already forwarding are left to finish
+func (t *riakTLSTunnel) Close() error {
+	return t.listener.Close()
+}
+
+func (t *riakTLSTunnel) serve() {
+	for {
+		local, err := t.listener.Accept()
+		if err != nil {
+			// The listener was closed
+			return
+		}
+		go t.forward(local)
+	}
+}
+
+func (t *riakTLSTunnel) forward(local net.Conn) {
+	defer local.Close()
+	remote, err := t.dial("tcp", t.remote, t.config)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer remote.Close()
+	done := make(chan struct{}, 2)
+	copyConn := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go copyConn(remote, local)
+	go copyConn(local, remote)
+	// Either side hanging up ends the connection, and the deferred closes unblock the other copy
+	<-done
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// DefaultRingReplicas is how many points each node gets on a HashRing
+const DefaultRingReplicas = 100
+
+// HashRing is a consistent hash ring of node names
+type HashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+// NewHashRing returns a HashRing holding replicas points for each of the given nodes
+func NewHashRing(nodeNames []string, replicas int) *HashRing {
+	if replicas <= 0 {
+		replicas = DefaultRingReplicas
+	}
+	ring := &HashRing{
+		points: make([]uint32, 0, len(nodeNames)*replicas),
+		owners: make(map[uint32]string, len(nodeNames)*replicas),
+	}
+	for _, name := range nodeNames {
+		for i := 0; i < replicas; i++ {
+			point := hashRingKey(name + "#" + strconv.Itoa(i))
+			if owner, ok := ring.owners[point]; ok {
+				// On the rare collision, keep the lowest name so every node builds the same ring
+				if owner < name {
+					continue
+				}
+			} else {
+				ring.points = append(ring.points, point)
+			}
+			ring.owners[point] = name
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// Owner returns the name of the node the key belongs to, or "" if the ring is empty
+func (ring *HashRing) Owner(key string) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+	hash := hashRingKey(key)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.owners[ring.points[i]]
+}
+
+// OwnerNode returns the name of the live node the given partition belongs to
+func (part *Partitions) OwnerNode(partitionID int, list *memberlist.Memberlist) string {
+	members := list.Members()
+	names := make([]string, 0, len(members))
+	for _, member := range members {
+		names = append(names, member.Name)
+	}
+	return NewHashRing(names, DefaultRingReplicas).Owner(strconv.Itoa(partitionID))
+}
+
+func hashRingKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
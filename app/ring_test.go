@@ -0,0 +1,49 @@
+package app_test
+
+import (
+	"strconv"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HashRing", func() {
+
+	It("should map each key to the same node every time", func() {
+		ring := app.NewHashRing([]string{"node0", "node1", "node2"}, app.DefaultRingReplicas)
+		rebuilt := app.NewHashRing([]string{"node2", "node0", "node1"}, app.DefaultRingReplicas)
+		for id := 0; id < 100; id++ {
+			Expect(ring.Owner(strconv.Itoa(id))).To(Equal(rebuilt.Owner(strconv.Itoa(id))))
+		}
+	})
+
+	It("should only reassign a small fraction of partitions when a node joins", func() {
+		nodes := []string{"node0", "node1", "node2", "node3", "node4"}
+		before := app.NewHashRing(nodes, app.DefaultRingReplicas)
+		after := app.NewHashRing(append(nodes, "node5"), app.DefaultRingReplicas)
+
+		moved := 0
+		partitions := 1000
+		for id := 0; id < partitions; id++ {
+			owner := after.Owner(strconv.Itoa(id))
+			if owner != before.Owner(strconv.Itoa(id)) {
+				// Anything that moved should have moved to the new node
+				Expect(owner).To(Equal("node5"))
+				moved++
+			}
+		}
+		// Ideally 1/6 of them move, allow some slack for an uneven ring
+		Expect(moved).To(BeNumerically(">", 0))
+		Expect(moved).To(BeNumerically("<", partitions/4))
+	})
+
+	It("should assign partitions to live members of the memberlist", func() {
+		partitions := app.InitPartitions(cfg, testQueueName)
+		Expect(partitions.OwnerNode(3, memberList)).To(Equal(memberList.LocalNode().Name))
+	})
+
+	It("should return no owner for an empty ring", func() {
+		Expect(app.NewHashRing(nil, app.DefaultRingReplicas).Owner("1")).To(BeEmpty())
+	})
+})
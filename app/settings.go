@@ -0,0 +1,163 @@
+package app
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/Tapjoy/dynamiq/app/codec"
+	"github.com/Tapjoy/dynamiq/app/compressor"
+)
+
+// ErrUnknownSetting represents the condition that occurs if a setting is named which SetSetting can't change
+var ErrUnknownSetting = errors.New("There is no queue setting with that name which can be changed")
+
+// ErrInvalidSettingValue represents the condition that occurs if a setting's value can't be parsed as the type it holds
+var ErrInvalidSettingValue = errors.New("The value is of the wrong type for the setting")
+
+// settingChecks validates a value for each setting SetSetting can change
+var settingChecks = map[string]func(value string) (string, error){
+	VisibilityTimeout:      floatSetting(nil),
+	MinPartitions:          intSetting(1, ErrInvalidPartitionCount),
+	MaxPartitions:          intSetting(1, ErrInvalidPartitionCount),
+	MaxPartitionAge:        floatSetting(nil),
+	CompressedMessages:     boolSetting,
+	MaxBatchSize:           intSetting(1, ErrInvalidBatchSize),
+	Enabled:                boolSetting,
+	RejectPutsWhenDisabled: boolSetting,
+	MessageCodec: func(value string) (string, error) {
+		if value != "none" {
+			if _, err := codec.NewCodec(value); err != nil {
+				return "", err
+			}
+		}
+		return value, nil
+	},
+	MaxPutRate: floatSetting(ErrInvalidRate),
+	MaxGetRate: floatSetting(ErrInvalidRate),
+	MaxDepth:   intSetting(0, ErrInvalidMaxDepth),
+	CompressionAlgorithm: func(value string) (string, error) {
+		if _, err := compressor.NewCompressor(value); err != nil {
+			return "", err
+		}
+		return value, nil
+	},
+	IdempotencyTTL: floatSetting(ErrInvalidIdempotencyTTL),
+	MessageTTL:     floatSetting(ErrInvalidMessageTTL),
+	BodyChecksum: func(value string) (string, error) {
+		if _, err := bodyChecksum(value, nil); err != nil {
+			return "", err
+		}
+		return value, nil
+	},
+	CompressionDictionary: func(value string) (string, error) {
+		if value != "" {
+			if _, err := compressor.LoadZstdDictionary(value); err != nil {
+				return "", err
+			}
+		}
+		return value, nil
+	},
+	Tenant: func(value string) (string, error) {
+		if value != "" && !validTenant.MatchString(value) {
+			return "", ErrInvalidTenant
+		}
+		return value, nil
+	},
+	ConflictPolicy: func(value string) (string, error) {
+		if _, err := resolveSiblings(value, nil); err != nil {
+			return "", err
+		}
+		return value, nil
+	},
+	Fifo:            boolSetting,
+	DeleteRetention: floatSetting(ErrInvalidDeleteRetention),
+}
+
+// floatSetting checks a value is a number, and if negative is set, that it is 0 or greater
+func floatSetting(negative error) func(value string) (string, error) {
+	return func(value string) (string, error) {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", ErrInvalidSettingValue
+		}
+		if negative != nil && parsed < 0 {
+			return "", negative
+		}
+		return strconv.FormatFloat(parsed, 'f', -1, 64), nil
+	}
+}
+
+// intSetting checks a value is a whole number of at least min, returning tooSmall if it's less
+func intSetting(min int64, tooSmall error) func(value string) (string, error) {
+	return func(value string) (string, error) {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", ErrInvalidSettingValue
+		}
+		if parsed < min {
+			return "", tooSmall
+		}
+		return strconv.FormatInt(parsed, 10), nil
+	}
+}
+
+func boolSetting(value string) (string, error) {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return "", ErrInvalidSettingValue
+	}
+	return strconv.FormatBool(parsed), nil
+}
+
+// checkSetting returns the value as it would be stored for the setting, or the reason it can't be
+func checkSetting(name string, value string) (string, error) {
+	check, ok := settingChecks[name]
+	if !ok {
+		return "", ErrUnknownSetting
+	}
+	return check(value)
+}
+
+// GetSetting returns the value of one of the queue's settings, and whether it is a setting at all
+func (queue *Queue) GetSetting(name string) (string, bool) {
+	defaultValue, ok := DefaultSettings[name]
+	if !ok {
+		return "", false
+	}
+	if config := queue.getConfig(); config != nil {
+		if reg := config.FetchRegister(name); reg != nil {
+			if value, err := registerValueToString(reg); err == nil {
+				return value, true
+			}
+		}
+	}
+	return defaultValue, true
+}
+
+// SetSetting validates and writes a value for one of the queue's settings
+func (queue *Queue) SetSetting(cfg *Config, name string, value string) error {
+	return queue.setSetting(name, value, func(name string, value string) error {
+		if name == MaxPartitions && cfg.Queues != nil {
+			// The check already parsed it
+			maxPartitions, _ := strconv.Atoi(value)
+			return cfg.Queues.ResizeQueue(cfg, queue.Name, maxPartitions)
+		}
+		return cfg.setQueueSetting(name, queue.Name, value)
+	}, func() {
+		if cfg.Queues != nil {
+			cfg.Queues.SyncNow(cfg)
+		}
+	})
+}
+
+func (queue *Queue) setSetting(name string, value string, store func(name string, value string) error, sync func()) error {
+	value, err := checkSetting(name, value)
+	if err != nil {
+		return err
+	}
+	if err = store(name, value); err != nil {
+		return err
+	}
+	sync()
+	return nil
+}
@@ -0,0 +1,69 @@
+package app_test
+
+import (
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
+)
+
+var _ = Describe("Settings", func() {
+
+	var (
+		queue  *app.Queue
+		stored map[string]string
+		synced int
+	)
+
+	// store writes to the queue's config map as though it were synced from Riak, which sync counts
+	store := func(name string, value string) error {
+		stored[name] = value
+		return nil
+	}
+	sync := func() {
+		for name, value := range stored {
+			queue.Config.AddRegister(name).Value = []byte(value)
+		}
+		synced++
+	}
+
+	BeforeEach(func() {
+		queue = &app.Queue{Name: "configured", Config: &riak.RDtMap{}}
+		stored = make(map[string]string)
+		synced = 0
+	})
+
+	It("should read back a visibility_timeout once it is set", func() {
+		value, ok := queue.GetSetting(app.VisibilityTimeout)
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal(app.DefaultSettings[app.VisibilityTimeout]))
+
+		Expect(queue.SetSettingWith(app.VisibilityTimeout, "2.5", store, sync)).To(Succeed())
+		Expect(synced).To(Equal(1))
+		value, ok = queue.GetSetting(app.VisibilityTimeout)
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal("2.5"))
+	})
+
+	It("should store values as the typed setters do", func() {
+		Expect(queue.SetSettingWith(app.Enabled, "0", store, sync)).To(Succeed())
+		Expect(queue.SetSettingWith(app.MaxDepth, "0100", store, sync)).To(Succeed())
+		Expect(stored).To(Equal(map[string]string{app.Enabled: "false", app.MaxDepth: "100"}))
+	})
+
+	It("should reject invalid values without writing anything", func() {
+		Expect(queue.SetSettingWith(app.VisibilityTimeout, "soon", store, sync)).To(Equal(app.ErrInvalidSettingValue))
+		Expect(queue.SetSettingWith(app.MaxBatchSize, "0", store, sync)).To(Equal(app.ErrInvalidBatchSize))
+		Expect(queue.SetSettingWith(app.MessageTTL, "-1", store, sync)).To(Equal(app.ErrInvalidMessageTTL))
+		Expect(queue.SetSettingWith(app.ConflictPolicy, "newest", store, sync)).To(Equal(app.ErrInvalidConflictPolicy))
+		Expect(stored).To(BeEmpty())
+		Expect(synced).To(BeZero())
+	})
+
+	It("should not know of settings which don't exist, or can't be changed", func() {
+		_, ok := queue.GetSetting("colour")
+		Expect(ok).To(BeFalse())
+		Expect(queue.SetSettingWith("colour", "blue", store, sync)).To(Equal(app.ErrUnknownSetting))
+		Expect(queue.SetSettingWith(app.PartitionCount, "3", store, sync)).To(Equal(app.ErrUnknownSetting))
+	})
+})
@@ -0,0 +1,38 @@
+package app
+
+// QueueConfigView is a copy of a queue's settings, as this node knew them at one point in time
+type QueueConfigView struct {
+	Name string `json:"name"`
+	// Settings holds each queue setting, with the default standing in for any the queue predates
+	Settings   map[string]string `json:"settings"`
+	Partitions int               `json:"partitions"`
+}
+
+// Snapshot returns a copy of the settings of every queue this node knows of
+func (queues *Queues) Snapshot() map[string]QueueConfigView {
+	queues.RLock()
+	defer queues.RUnlock()
+	views := make(map[string]QueueConfigView, len(queues.QueueMap))
+	for name, queue := range queues.QueueMap {
+		views[name] = queue.configView()
+	}
+	return views
+}
+
+func (queue *Queue) configView() QueueConfigView {
+	view := QueueConfigView{Name: queue.Name, Settings: make(map[string]string, len(Settings))}
+	config := queue.getConfig()
+	for _, setting := range Settings {
+		value := DefaultSettings[setting]
+		if config != nil {
+			if register := config.FetchRegister(setting); register != nil {
+				value = string(register.Value)
+			}
+		}
+		view.Settings[setting] = value
+	}
+	if queue.Parts != nil {
+		view.Partitions = queue.Parts.PartitionCount()
+	}
+	return view
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// QueuePartitionsAvailableStatsSuffix is the gauge of partitions a receive on this node could use
+const QueuePartitionsAvailableStatsSuffix = "partitions.available"
+
+// DefaultPartitionStarvation is how long a queue may have no partition available before a warning
+const DefaultPartitionStarvation = time.Minute
+
+// partitionStarvation returns how long a queue may have no partition available before a warning is logged
+func (cfg *Config) partitionStarvation() time.Duration {
+	if cfg.Core.PartitionStarvation > 0 {
+		return cfg.Core.PartitionStarvation * time.Millisecond
+	}
+	return DefaultPartitionStarvation
+}
+
+// availableCount returns how many partitions are visible, plus how many could still be made
+func (part *Partitions) availableCount(visibilityTimeout float64, maxPartitions int) int {
+	part.Lock()
+	defer part.Unlock()
+	available := 0
+	checked := make([]*Partition, 0, part.partitionCount)
+	for part.partitions.Size() > 0 {
+		poppedPartition, _ := part.partitions.Pop()
+		partition := poppedPartition.(*Partition)
+		if time.Since(partition.LastUsed).Seconds() > visibilityTimeout {
+			available++
+		}
+		checked = append(checked, partition)
+	}
+	for _, partition := range checked {
+		part.partitions.Push(partition, partition.LastUsed.UnixNano())
+	}
+	if maxPartitions > part.partitionCount {
+		available += maxPartitions - part.partitionCount
+	}
+	return available
+}
+
+// checkStarvation warns if the queue has had no partition available for partitionstarvation
+func (queue *Queue) checkStarvation(cfg *Config, now time.Time) {
+	visTimeout, _ := cfg.GetVisibilityTimeout(queue.Name)
+	maxPartitions, _ := cfg.GetMaxPartitions(queue.Name)
+	available := queue.Parts.availableCount(visTimeout, maxPartitions)
+	key := fmt.Sprintf("%s.%s", queue.Name, QueuePartitionsAvailableStatsSuffix)
+	if err := queue.statsClient(cfg).SetGauge(key, int64(available)); err != nil {
+		logrus.Error(err)
+	}
+	queue.starvation.Lock()
+	defer queue.starvation.Unlock()
+	if available > 0 {
+		queue.starvation.since = time.Time{}
+		return
+	}
+	if queue.starvation.since.IsZero() {
+		queue.starvation.since = now
+	}
+	if starved := now.Sub(queue.starvation.since); starved >= cfg.partitionStarvation() {
+		logrus.Warnf("Queue %s has had no partitions available for %s, with %d of them on this node", queue.Name, starved, queue.Parts.PartitionCount())
+	}
+}
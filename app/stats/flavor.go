@@ -0,0 +1,125 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FlavorGraphite keeps stats as dotted keys, making sure the names inside them can't add levels to the hierarchy
+const FlavorGraphite = "graphite"
+
+// FlavorDatadog sends stats under their suffix alone, with the queue or topic they are for as a tag
+const FlavorDatadog = "datadog"
+
+// TaggedClient is implemented by clients which can send tags along with their stats
+type TaggedClient interface {
+	Client
+	// WithTags returns a Client which sends each stat with the given name:value tags attached
+	WithTags(tags ...string) Client
+}
+
+// FlavoredClient rewrites the keys of stats into the style a backend expects
+type FlavoredClient struct {
+	client Client
+	flavor string
+	// suffixes are sorted longest first, so a suffix ending in another one is matched whole
+	suffixes []string
+	tags     map[string]string
+	// tenant is sent as a tag of its own with every tagged stat, if set
+	tenant string
+}
+
+// NewFlavoredClient wraps client so its stats are sent in the given flavor, graphite or datadog
+func NewFlavoredClient(client Client, flavor string, suffixTags map[string]string) (Client, error) {
+	switch flavor {
+	case "":
+		return client, nil
+	case FlavorGraphite, FlavorDatadog:
+	default:
+		return nil, fmt.Errorf("Unknown stats flavor %s", flavor)
+	}
+	f := &FlavoredClient{client: client, flavor: flavor, tags: suffixTags}
+	for suffix := range suffixTags {
+		f.suffixes = append(f.suffixes, suffix)
+	}
+	sort.Slice(f.suffixes, func(i, j int) bool { return len(f.suffixes[i]) > len(f.suffixes[j]) })
+	return f, nil
+}
+
+// Rewrite returns the key id is sent under, and the tags sent along with it
+func (f *FlavoredClient) Rewrite(id string) (string, []string) {
+	for _, suffix := range f.suffixes {
+		name := strings.TrimSuffix(id, "."+suffix)
+		if name == id || name == "" {
+			continue
+		}
+		if f.flavor == FlavorDatadog {
+			return suffix, []string{f.tags[suffix] + ":" + name}
+		}
+		// A dot in a queue name would otherwise read as another level of the hierarchy
+		return strings.Replace(name, ".", "_", -1) + "." + suffix, nil
+	}
+	return id, nil
+}
+
+// withTenant returns a copy of f which sends its stats for the given tenant
+func (f *FlavoredClient) withTenant(tenant string) *FlavoredClient {
+	namespaced := *f
+	namespaced.tenant = tenant
+	return &namespaced
+}
+
+// target returns the client to send a stat to, along with its key
+func (f *FlavoredClient) target(id string) (Client, string) {
+	key, tags := f.Rewrite(id)
+	if len(tags) > 0 {
+		if tagged, ok := f.client.(TaggedClient); ok {
+			if f.tenant != "" {
+				tags = append(tags, "tenant:"+f.tenant)
+			}
+			return tagged.WithTags(tags...), key
+		}
+		key = id
+	}
+	// Without a tag to carry it, the tenant goes back into the key
+	if f.tenant != "" {
+		key = f.tenant + "." + key
+	}
+	return f.client, key
+}
+
+// Incr increases the value of a given counter
+func (f *FlavoredClient) Incr(id string, value int64) error {
+	client, key := f.target(id)
+	return client.Incr(key, value)
+}
+
+// Decr decreases the value of a given counter
+func (f *FlavoredClient) Decr(id string, value int64) error {
+	client, key := f.target(id)
+	return client.Decr(key, value)
+}
+
+// IncrGauge increases the value of a given gauge
+func (f *FlavoredClient) IncrGauge(id string, value int64) error {
+	client, key := f.target(id)
+	return client.IncrGauge(key, value)
+}
+
+// DecrGauge decreases the value of a given gauge
+func (f *FlavoredClient) DecrGauge(id string, value int64) error {
+	client, key := f.target(id)
+	return client.DecrGauge(key, value)
+}
+
+// SetGauge sets the level of the given gauge
+func (f *FlavoredClient) SetGauge(id string, value int64) error {
+	client, key := f.target(id)
+	return client.SetGauge(key, value)
+}
+
+// Flush flushes the wrapped client, if it buffers stats
+func (f *FlavoredClient) Flush() error {
+	return Flush(f.client)
+}
@@ -0,0 +1,80 @@
+package stats_test
+
+import (
+	"github.com/Tapjoy/dynamiq/app/stats"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// untaggedClient only has the plain Client methods, so it can't be handed tags
+type untaggedClient struct {
+	stats.Client
+}
+
+var _ = Describe("FlavoredClient", func() {
+
+	var (
+		client     *stats.MemoryClient
+		suffixTags = map[string]string{"depth.count": "queue", "approximate_depth.count": "queue", "broadcast.count": "topic"}
+	)
+
+	flavored := func(flavor string, inner stats.Client) stats.Client {
+		c, err := stats.NewFlavoredClient(inner, flavor, suffixTags)
+		Expect(err).ToNot(HaveOccurred())
+		return c
+	}
+
+	BeforeEach(func() {
+		client = stats.NewMemoryClient()
+	})
+
+	Context("graphite", func() {
+		It("should keep dotted keys, flattening dots inside the name", func() {
+			c := flavored(stats.FlavorGraphite, client)
+			c.SetGauge("orders.eu.depth.count", 4)
+			c.Incr("signups.broadcast.count", 1)
+			Expect(client.Gauge("orders_eu.depth.count")).To(Equal(int64(4)))
+			Expect(client.Counter("signups.broadcast.count")).To(Equal(int64(1)))
+		})
+	})
+
+	Context("datadog", func() {
+		It("should split the name out into a tag", func() {
+			c := flavored(stats.FlavorDatadog, client)
+			c.SetGauge("orders.eu.approximate_depth.count", 7)
+			c.IncrGauge("orders.depth.count", 2)
+			c.Incr("signups.broadcast.count", 3)
+			Expect(client.Gauge(stats.TaggedKey("approximate_depth.count", "queue:orders.eu"))).To(Equal(int64(7)))
+			Expect(client.Gauge(stats.TaggedKey("depth.count", "queue:orders"))).To(Equal(int64(2)))
+			Expect(client.Counter(stats.TaggedKey("broadcast.count", "topic:signups"))).To(Equal(int64(3)))
+		})
+
+		It("should send a tenant as a tag of its own", func() {
+			c := stats.NewPrefixedClient(flavored(stats.FlavorDatadog, client), "acme")
+			c.SetGauge("orders.eu.approximate_depth.count", 7)
+			c.Incr("riak.pool.size", 1)
+			Expect(client.Gauge(stats.TaggedKey("approximate_depth.count", "queue:orders.eu", "tenant:acme"))).To(Equal(int64(7)))
+			Expect(client.Counter("acme.riak.pool.size")).To(Equal(int64(1)))
+		})
+
+		It("should keep the original key for clients which can't send tags", func() {
+			c := flavored(stats.FlavorDatadog, untaggedClient{client})
+			c.Incr("signups.broadcast.count", 1)
+			Expect(client.Counter("signups.broadcast.count")).To(Equal(int64(1)))
+		})
+	})
+
+	It("should pass keys without a known suffix through untouched", func() {
+		for _, flavor := range []string{stats.FlavorGraphite, stats.FlavorDatadog} {
+			c := flavored(flavor, client)
+			c.SetGauge("riak.pool.size", 16)
+		}
+		Expect(client.Gauge("riak.pool.size")).To(Equal(int64(16)))
+	})
+
+	It("should reject an unknown flavor, and leave clients alone without one", func() {
+		_, err := stats.NewFlavoredClient(client, "influx", suffixTags)
+		Expect(err).To(MatchError("Unknown stats flavor influx"))
+		Expect(stats.NewFlavoredClient(client, "", suffixTags)).To(BeIdenticalTo(client))
+	})
+})
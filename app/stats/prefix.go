@@ -0,0 +1,76 @@
+package stats
+
+import "strings"
+
+// PrefixedClient sends every stat under a prefix of its own
+type PrefixedClient struct {
+	client Client
+	prefix string
+}
+
+// NewPrefixedClient wraps client so each key is sent as prefix.key
+func NewPrefixedClient(client Client, prefix string) Client {
+	if prefix == "" {
+		return client
+	}
+	if flavored, ok := client.(*FlavoredClient); ok && flavored.flavor == FlavorDatadog {
+		return flavored.withTenant(prefix)
+	}
+	prefixed := PrefixedClient{client: client, prefix: prefix + "."}
+	if _, ok := client.(Snapshotter); ok {
+		return snapshotPrefixedClient{prefixed}
+	}
+	return prefixed
+}
+
+// snapshotPrefixedClient is a PrefixedClient over a client which can take snapshots
+type snapshotPrefixedClient struct {
+	PrefixedClient
+}
+
+// Incr increases the value of a given counter
+func (p PrefixedClient) Incr(id string, value int64) error {
+	return p.client.Incr(p.prefix+id, value)
+}
+
+// Decr decreases the value of a given counter
+func (p PrefixedClient) Decr(id string, value int64) error {
+	return p.client.Decr(p.prefix+id, value)
+}
+
+// IncrGauge increases the value of a given gauge
+func (p PrefixedClient) IncrGauge(id string, value int64) error {
+	return p.client.IncrGauge(p.prefix+id, value)
+}
+
+// DecrGauge decreases the value of a given gauge
+func (p PrefixedClient) DecrGauge(id string, value int64) error {
+	return p.client.DecrGauge(p.prefix+id, value)
+}
+
+// SetGauge sets the level of the given gauge
+func (p PrefixedClient) SetGauge(id string, value int64) error {
+	return p.client.SetGauge(p.prefix+id, value)
+}
+
+// Flush flushes the wrapped client, if it buffers stats
+func (p PrefixedClient) Flush() error {
+	return Flush(p.client)
+}
+
+// Snapshot returns the stats within the namespace, with the prefix taken back off their keys
+func (p snapshotPrefixedClient) Snapshot() Snapshot {
+	snapshot := Snapshot{Counters: make(map[string]int64), Gauges: make(map[string]int64)}
+	all := p.client.(Snapshotter).Snapshot()
+	for id, value := range all.Counters {
+		if strings.HasPrefix(id, p.prefix) {
+			snapshot.Counters[strings.TrimPrefix(id, p.prefix)] = value
+		}
+	}
+	for id, value := range all.Gauges {
+		if strings.HasPrefix(id, p.prefix) {
+			snapshot.Gauges[strings.TrimPrefix(id, p.prefix)] = value
+		}
+	}
+	return snapshot
+}
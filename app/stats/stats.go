@@ -1,6 +1,11 @@
 package stats
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/quipo/statsd"
@@ -16,12 +21,75 @@ type Client interface {
 	SetGauge(id string, value int64) error
 }
 
+// Flusher is implemented by clients which buffer stats before sending them on
+type Flusher interface {
+	Flush() error
+}
+
+// Flush sends on anything c has buffered, if it buffers stats at all
+func Flush(c Client) error {
+	if f, ok := c.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// ErrSnapshotUnsupported represents the condition that occurs if a client can't read back its stats
+var ErrSnapshotUnsupported = errors.New("The stats client can't read back its stats")
+
+// Snapshot is a point in time copy of the counters and gauges held by a client
+type Snapshot struct {
+	Counters map[string]int64
+	Gauges   map[string]int64
+}
+
+// Snapshotter is implemented by clients which can read back the stats written to them
+type Snapshotter interface {
+	Snapshot() Snapshot
+}
+
+// TakeSnapshot returns a Snapshot of c, or ErrSnapshotUnsupported if it can't take one
+func TakeSnapshot(c Client) (Snapshot, error) {
+	if s, ok := c.(Snapshotter); ok {
+		return s.Snapshot(), nil
+	}
+	return Snapshot{}, ErrSnapshotUnsupported
+}
+
+// Errors collects the errors from a series of stats calls
+type Errors []error
+
+// Add records err, ignoring nil values
+func (e *Errors) Add(err error) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// Err returns nil if no errors were recorded, otherwise the collected errors as one error
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e Errors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
 // StatsdClient will report stats to a StatsD compatible service
 type StatsdClient struct {
 	prefix   string
 	address  string
 	client   *statsd.StatsdClient
 	interval time.Duration
+	// tagConn carries stats sent with tags, which the statsd client has no way to write
+	tagConn net.Conn
 }
 
 // NewStatsdClient will create a new StatsdClient to be used for reporting metrics
@@ -33,9 +101,50 @@ func NewStatsdClient(address string, prefix string, interval time.Duration) Stat
 	}
 	client.client = statsd.NewStatsdClient(address, prefix)
 	client.client.CreateSocket()
+	// Dialing UDP doesn't reach out to the address, so this only fails on a bad address
+	client.tagConn, _ = net.Dial("udp", address)
 	return client
 }
 
+// WithTags returns a client which sends stats with the given tags, in the DogStatsD format
+func (c StatsdClient) WithTags(tags ...string) Client {
+	return taggedStatsdClient{conn: c.tagConn, prefix: c.prefix, tags: strings.Join(tags, ",")}
+}
+
+type taggedStatsdClient struct {
+	conn   net.Conn
+	prefix string
+	tags   string
+}
+
+func (c taggedStatsdClient) send(id string, value string, statType string) error {
+	if c.conn == nil {
+		return errors.New("The statsd address couldn't be dialed, dropping " + id)
+	}
+	_, err := fmt.Fprintf(c.conn, "%s%s:%s|%s|#%s", c.prefix, id, value, statType, c.tags)
+	return err
+}
+
+func (c taggedStatsdClient) Incr(id string, value int64) error {
+	return c.send(id, fmt.Sprintf("%d", value), "c")
+}
+
+func (c taggedStatsdClient) Decr(id string, value int64) error {
+	return c.send(id, fmt.Sprintf("%d", -value), "c")
+}
+
+func (c taggedStatsdClient) IncrGauge(id string, value int64) error {
+	return c.send(id, fmt.Sprintf("+%d", value), "g")
+}
+
+func (c taggedStatsdClient) DecrGauge(id string, value int64) error {
+	return c.send(id, fmt.Sprintf("-%d", value), "g")
+}
+
+func (c taggedStatsdClient) SetGauge(id string, value int64) error {
+	return c.send(id, fmt.Sprintf("%d", value), "g")
+}
+
 // Incr increases the value of a given counter
 func (c StatsdClient) Incr(id string, value int64) error {
 	return c.client.Incr(id, value)
@@ -94,3 +203,132 @@ func (c NOOPClient) DecrGauge(id string, value int64) error {
 func (c NOOPClient) SetGauge(id string, value int64) error {
 	return nil
 }
+
+// MemoryClient keeps all stats in memory, for use in tests and single node setups
+type MemoryClient struct {
+	counters map[string]int64
+	gauges   map[string]int64
+	sync.RWMutex
+}
+
+// NewMemoryClient returns a new, empty MemoryClient
+func NewMemoryClient() *MemoryClient {
+	return &MemoryClient{
+		counters: make(map[string]int64),
+		gauges:   make(map[string]int64),
+	}
+}
+
+// Incr increases the value of a given counter
+func (c *MemoryClient) Incr(id string, value int64) error {
+	c.Lock()
+	defer c.Unlock()
+	c.counters[id] += value
+	return nil
+}
+
+// Decr decreases the value of a given counter
+func (c *MemoryClient) Decr(id string, value int64) error {
+	c.Lock()
+	defer c.Unlock()
+	c.counters[id] -= value
+	return nil
+}
+
+// IncrGauge increases the value of a given gauge
+func (c *MemoryClient) IncrGauge(id string, value int64) error {
+	c.Lock()
+	defer c.Unlock()
+	c.gauges[id] += value
+	return nil
+}
+
+// DecrGauge decreases the value of a given gauge
+func (c *MemoryClient) DecrGauge(id string, value int64) error {
+	c.Lock()
+	defer c.Unlock()
+	c.gauges[id] -= value
+	return nil
+}
+
+// SetGauge sets the level of the given gauge
+func (c *MemoryClient) SetGauge(id string, value int64) error {
+	c.Lock()
+	defer c.Unlock()
+	c.gauges[id] = value
+	return nil
+}
+
+// TaggedKey is the key a MemoryClient keeps a stat sent with tags under
+func TaggedKey(id string, tags ...string) string {
+	return id + "|#" + strings.Join(tags, ",")
+}
+
+// WithTags returns a client which keeps stats in c, under their TaggedKey
+func (c *MemoryClient) WithTags(tags ...string) Client {
+	return taggedMemoryClient{client: c, tags: tags}
+}
+
+type taggedMemoryClient struct {
+	client *MemoryClient
+	tags   []string
+}
+
+func (t taggedMemoryClient) Incr(id string, value int64) error {
+	return t.client.Incr(TaggedKey(id, t.tags...), value)
+}
+
+func (t taggedMemoryClient) Decr(id string, value int64) error {
+	return t.client.Decr(TaggedKey(id, t.tags...), value)
+}
+
+func (t taggedMemoryClient) IncrGauge(id string, value int64) error {
+	return t.client.IncrGauge(TaggedKey(id, t.tags...), value)
+}
+
+func (t taggedMemoryClient) DecrGauge(id string, value int64) error {
+	return t.client.DecrGauge(TaggedKey(id, t.tags...), value)
+}
+
+func (t taggedMemoryClient) SetGauge(id string, value int64) error {
+	return t.client.SetGauge(TaggedKey(id, t.tags...), value)
+}
+
+// Counter returns the current value of the given counter, or 0 if it was never set
+func (c *MemoryClient) Counter(id string) int64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.counters[id]
+}
+
+// Gauge returns the current level of the given gauge, or 0 if it was never set
+func (c *MemoryClient) Gauge(id string) int64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.gauges[id]
+}
+
+// Reset clears all counters and gauges
+func (c *MemoryClient) Reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.counters = make(map[string]int64)
+	c.gauges = make(map[string]int64)
+}
+
+// Snapshot returns a copy of every counter and gauge
+func (c *MemoryClient) Snapshot() Snapshot {
+	c.RLock()
+	defer c.RUnlock()
+	snapshot := Snapshot{
+		Counters: make(map[string]int64, len(c.counters)),
+		Gauges:   make(map[string]int64, len(c.gauges)),
+	}
+	for id, value := range c.counters {
+		snapshot.Counters[id] = value
+	}
+	for id, value := range c.gauges {
+		snapshot.Gauges[id] = value
+	}
+	return snapshot
+}
@@ -0,0 +1,136 @@
+package stats_test
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/Tapjoy/dynamiq/app/stats"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MemoryClient", func() {
+
+	var client *stats.MemoryClient
+
+	BeforeEach(func() {
+		client = stats.NewMemoryClient()
+	})
+
+	Context("Counters", func() {
+		It("should start at 0", func() {
+			Expect(client.Counter("test.count")).To(Equal(int64(0)))
+		})
+
+		It("should increment and decrement", func() {
+			client.Incr("test.count", 5)
+			client.Decr("test.count", 2)
+			Expect(client.Counter("test.count")).To(Equal(int64(3)))
+		})
+	})
+
+	Context("Snapshot", func() {
+		It("should copy every counter and gauge", func() {
+			client.Incr("test.count", 2)
+			client.SetGauge("test.gauge", 9)
+			snapshot, err := stats.TakeSnapshot(client)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(snapshot.Counters).To(Equal(map[string]int64{"test.count": 2}))
+			Expect(snapshot.Gauges).To(Equal(map[string]int64{"test.gauge": 9}))
+
+			// Later writes don't leak into an earlier snapshot
+			client.Incr("test.count", 1)
+			Expect(snapshot.Counters["test.count"]).To(Equal(int64(2)))
+		})
+
+		It("should be unsupported by clients which don't keep their stats", func() {
+			_, err := stats.TakeSnapshot(stats.NewNOOPClient())
+			Expect(err).To(Equal(stats.ErrSnapshotUnsupported))
+		})
+	})
+
+	Context("Gauges", func() {
+		It("should apply deltas", func() {
+			client.IncrGauge("test.gauge", 10)
+			client.DecrGauge("test.gauge", 4)
+			Expect(client.Gauge("test.gauge")).To(Equal(int64(6)))
+		})
+
+		It("should overwrite the level on SetGauge", func() {
+			client.IncrGauge("test.gauge", 10)
+			client.SetGauge("test.gauge", 3)
+			Expect(client.Gauge("test.gauge")).To(Equal(int64(3)))
+		})
+
+		It("should keep gauges and counters separate", func() {
+			client.Incr("test.key", 1)
+			client.SetGauge("test.key", 7)
+			Expect(client.Counter("test.key")).To(Equal(int64(1)))
+			Expect(client.Gauge("test.key")).To(Equal(int64(7)))
+		})
+	})
+
+	Context("Concurrency", func() {
+		It("should not lose updates from concurrent writers", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						client.Incr("test.count", 1)
+						client.IncrGauge("test.gauge", 1)
+					}
+				}()
+			}
+			wg.Wait()
+			Expect(client.Counter("test.count")).To(Equal(int64(5000)))
+			Expect(client.Gauge("test.gauge")).To(Equal(int64(5000)))
+		})
+	})
+})
+
+var _ = Describe("Errors", func() {
+
+	It("should be nil when nothing failed", func() {
+		var errs stats.Errors
+		errs.Add(nil)
+		Expect(errs.Err()).To(BeNil())
+	})
+
+	It("should keep every error that was added", func() {
+		var errs stats.Errors
+		errs.Add(errors.New("first"))
+		errs.Add(nil)
+		errs.Add(errors.New("second"))
+		Expect(errs.Err()).To(MatchError("first; second"))
+	})
+})
+
+var _ = Describe("PrefixedClient", func() {
+	It("should send every stat under the prefix, and read back only its own", func() {
+		client := stats.NewMemoryClient()
+		prefixed := stats.NewPrefixedClient(client, "acme")
+		prefixed.Incr("orders.sent.count", 2)
+		prefixed.SetGauge("orders.depth.count", 4)
+		client.Incr("orders.sent.count", 9)
+		Expect(client.Counter("acme.orders.sent.count")).To(Equal(int64(2)))
+		Expect(client.Gauge("acme.orders.depth.count")).To(Equal(int64(4)))
+
+		snapshot, err := stats.TakeSnapshot(prefixed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(snapshot.Counters).To(Equal(map[string]int64{"orders.sent.count": 2}))
+		Expect(snapshot.Gauges).To(Equal(map[string]int64{"orders.depth.count": 4}))
+	})
+
+	It("should not take snapshots of a client which can't", func() {
+		prefixed := stats.NewPrefixedClient(stats.NewNOOPClient(), "acme")
+		_, err := stats.TakeSnapshot(prefixed)
+		Expect(err).To(Equal(stats.ErrSnapshotUnsupported))
+	})
+
+	It("should leave the client unwrapped without a prefix", func() {
+		client := stats.NewMemoryClient()
+		Expect(stats.NewPrefixedClient(client, "")).To(BeIdenticalTo(client))
+	})
+})
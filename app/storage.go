@@ -0,0 +1,135 @@
+package app
+
+import (
+	"github.com/tpjg/goriakpbc"
+)
+
+// StorageBucket names a bucket, along with the bucket type it's under
+type StorageBucket struct {
+	Type string
+	Name string
+}
+
+// MessagesBucket returns the bucket the named queue's messages are stored in
+func MessagesBucket(queueName string) StorageBucket {
+	return StorageBucket{Type: "messages", Name: queueName}
+}
+
+// ConfigBucket is the bucket holding the config maps of the queues and topics
+var ConfigBucket = StorageBucket{Type: "maps", Name: ConfigurationBucket}
+
+// StoredObject is an object as kept in a bucket, independent of the client it was read with
+type StoredObject struct {
+	ContentType string
+	Data        []byte
+	Meta        map[string]string
+	// Indexes maps each 2i of the object to its terms
+	Indexes map[string][]string
+}
+
+// Storage is what the queue logic needs of a Riak client
+type Storage interface {
+	Store(bucket StorageBucket, key string, object StoredObject) error
+	Fetch(bucket StorageBucket, key string) (StoredObject, error)
+	Delete(bucket StorageBucket, key string) error
+	// IndexRange returns a page of up to limit keys whose index terms fall from min to max, and the
+	// continuation of the next page, or "" if this is the last
+	IndexRange(bucket StorageBucket, index string, min string, max string, limit uint32, continuation string) ([]string, string, error)
+	FetchMap(bucket StorageBucket, key string) (map[string]string, error)
+	// StoreMap sets the given registers of the map, leaving the rest of it as it is
+	StoreMap(bucket StorageBucket, key string, registers map[string]string) error
+}
+
+// NewRiakStorage returns Storage going through the config's goriakpbc pool
+func NewRiakStorage(cfg *Config) Storage {
+	return riakStorage{cfg: cfg}
+}
+
+type riakStorage struct {
+	cfg *Config
+}
+
+func (s riakStorage) Store(bucket StorageBucket, key string, object StoredObject) error {
+	b, release, err := s.cfg.RiakBucket(bucket.Type, bucket.Name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	rObject := b.NewObject(key)
+	rObject.ContentType = object.ContentType
+	rObject.Data = object.Data
+	rObject.Meta = object.Meta
+	rObject.Indexes = object.Indexes
+	return rObject.Store()
+}
+
+func (s riakStorage) Fetch(bucket StorageBucket, key string) (StoredObject, error) {
+	b, release, err := s.cfg.RiakBucket(bucket.Type, bucket.Name)
+	if err != nil {
+		return StoredObject{}, err
+	}
+	defer release()
+	rObject, err := b.Get(key)
+	if err == nil && (rObject == nil || len(rObject.Data) == 0) {
+		err = riak.NotFound
+	}
+	if err != nil {
+		return StoredObject{}, err
+	}
+	return StoredObject{ContentType: rObject.ContentType, Data: rObject.Data, Meta: rObject.Meta, Indexes: rObject.Indexes}, nil
+}
+
+func (s riakStorage) Delete(bucket StorageBucket, key string) error {
+	b, release, err := s.cfg.RiakBucket(bucket.Type, bucket.Name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return b.Delete(key)
+}
+
+func (s riakStorage) IndexRange(bucket StorageBucket, index string, min string, max string, limit uint32, continuation string) ([]string, string, error) {
+	b, release, err := s.cfg.RiakBucket(bucket.Type, bucket.Name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer release()
+	return b.IndexQueryRangePage(index, min, max, limit, continuation)
+}
+
+func (s riakStorage) FetchMap(bucket StorageBucket, key string) (map[string]string, error) {
+	b, release, err := s.cfg.RiakBucket(bucket.Type, bucket.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	m, err := b.FetchMap(key)
+	if err != nil {
+		return nil, err
+	}
+	registers := make(map[string]string)
+	for mapKey, value := range m.Values {
+		if register, ok := value.(*riak.RDtRegister); ok {
+			registers[mapKey.Key] = string(register.GetValue())
+		}
+	}
+	return registers, nil
+}
+
+func (s riakStorage) StoreMap(bucket StorageBucket, key string, registers map[string]string) error {
+	b, release, err := s.cfg.RiakBucket(bucket.Type, bucket.Name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// A map which doesn't exist yet comes back empty, ready to be stored
+	m, err := b.FetchMap(key)
+	if err != nil && err != riak.NotFound {
+		return err
+	}
+	for name, value := range registers {
+		m.AddRegister(name).Update([]byte(value))
+	}
+	// Dropping any cached copy, as every other config write does
+	return s.cfg.ConfigMaps.storeConfigMap(key, m)
+}
@@ -0,0 +1,99 @@
+package app_test
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
+)
+
+var _ = Describe("Storage", func() {
+
+	// behaves runs the same queue operations against the Storage newStorage returns
+	behaves := func(newStorage func() app.Storage) {
+		var (
+			storage app.Storage
+			bucket  = app.MessagesBucket(testQueueName)
+			// base keeps the keys and terms of each run apart, as Riak keeps them between runs
+			base int64
+		)
+
+		BeforeEach(func() {
+			storage = newStorage()
+			base = time.Now().UnixNano()
+		})
+
+		key := func(i int64) string {
+			return strconv.FormatInt(base+i, 10)
+		}
+
+		It("should fetch a stored message until it is deleted", func() {
+			message := app.StoredObject{ContentType: "text/plain", Data: []byte("hello"), Meta: map[string]string{"group": "a"}}
+			Expect(storage.Store(bucket, key(0), message)).To(Succeed())
+
+			fetched, err := storage.Fetch(bucket, key(0))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fetched.Data).To(Equal([]byte("hello")))
+			Expect(fetched.Meta).To(HaveKeyWithValue("group", "a"))
+
+			Expect(storage.Delete(bucket, key(0))).To(Succeed())
+			_, err = storage.Fetch(bucket, key(0))
+			Expect(err).To(Equal(riak.NotFound))
+		})
+
+		It("should page through the messages put within a range", func() {
+			for i := int64(0); i < 3; i++ {
+				message := app.StoredObject{Data: []byte("body"), Indexes: map[string][]string{app.MessageCreatedIndex: {key(i)}}}
+				Expect(storage.Store(bucket, key(i), message)).To(Succeed())
+				defer storage.Delete(bucket, key(i))
+			}
+
+			first, continuation, err := storage.IndexRange(bucket, app.MessageCreatedIndex, key(0), key(2), 2, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(first).To(HaveLen(2))
+			Expect(continuation).ToNot(BeEmpty())
+			rest, continuation, err := storage.IndexRange(bucket, app.MessageCreatedIndex, key(0), key(2), 2, continuation)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(continuation).To(BeEmpty())
+			Expect(append(first, rest...)).To(ConsistOf(key(0), key(1), key(2)))
+		})
+
+		It("should keep the registers of a map, leaving the others be", func() {
+			name := "storage_spec_" + key(0)
+			_, err := storage.FetchMap(app.ConfigBucket, name)
+			Expect(err).To(Equal(riak.NotFound))
+
+			Expect(storage.StoreMap(app.ConfigBucket, name, map[string]string{app.VisibilityTimeout: "30", app.MaxDepth: "0"})).To(Succeed())
+			Expect(storage.StoreMap(app.ConfigBucket, name, map[string]string{app.MaxDepth: "100"})).To(Succeed())
+			registers, err := storage.FetchMap(app.ConfigBucket, name)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(registers).To(Equal(map[string]string{app.VisibilityTimeout: "30", app.MaxDepth: "100"}))
+		})
+	}
+
+	Context("in memory", func() {
+		behaves(func() app.Storage {
+			return app.NewMemoryStorage()
+		})
+	})
+
+	Context("on Riak through goriakpbc", func() {
+		var riakCfg *app.Config
+
+		BeforeEach(func() {
+			client := riak.NewClientPool(core.RiakNodes+":8087", 1)
+			if err := client.Ping(); err != nil {
+				Skip("No Riak node to run against at " + core.RiakNodes)
+			}
+			riakCfg = &app.Config{Core: core, RiakPool: client, Stats: app.Stats{Client: stats.NewMemoryClient()}}
+		})
+
+		behaves(func() app.Storage {
+			return app.NewRiakStorage(riakCfg)
+		})
+	})
+})
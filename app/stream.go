@@ -0,0 +1,77 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// StreamMinBackoff is how long a stream waits before receiving again, after coming up empty
+const StreamMinBackoff = 100 * time.Millisecond
+
+// StreamMaxBackoff is the longest a stream waits between receives, no matter how long it stays empty
+const StreamMaxBackoff = 5 * time.Second
+
+// streamMessages writes newline delimited JSON messages to w as fetch returns them
+func streamMessages(w http.ResponseWriter, req *http.Request, fetch func() ([]Message, error)) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	backoff := StreamMinBackoff
+	for {
+		messages, err := fetch()
+		// Throttled receives come back empty, so the backoff below slows the stream to the queue's rate
+		if err != nil && err.Error() != NoPartitions && err != ErrThrottled && err != ErrQueueEmpty {
+			logrus.Error(err)
+		}
+		for _, message := range messages {
+			err = encoder.Encode(formatMessage(message))
+			if err != nil {
+				// The client went away mid-write
+				return
+			}
+		}
+
+		wait := time.Duration(0)
+		if len(messages) > 0 {
+			flusher.Flush()
+			backoff = StreamMinBackoff
+		} else {
+			wait = backoff
+			backoff = backoff * 2
+			if backoff > StreamMaxBackoff {
+				backoff = StreamMaxBackoff
+			}
+		}
+		select {
+		case <-req.Context().Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// formatMessage converts a received message into its representation in API responses
+func formatMessage(message Message) map[string]interface{} {
+	formatted := make(map[string]interface{})
+	formatted["id"] = message.ID
+	formatted["body"] = string(message.Body[:])
+	formatted["receipt"] = message.Receipt
+	if len(message.Attributes) > 0 {
+		formatted["attributes"] = message.Attributes
+	}
+	formatted["visible_until"] = ""
+	if !message.VisibleUntil.IsZero() {
+		formatted["visible_until"] = message.VisibleUntil.Format(time.RFC3339Nano)
+	}
+	return formatted
+}
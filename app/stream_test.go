@@ -0,0 +1,55 @@
+package app_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	"github.com/Tapjoy/dynamiq/app"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stream", func() {
+
+	It("should stream messages until the client disconnects", func() {
+		var lock sync.Mutex
+		fetched := 0
+		// Every other receive comes up empty, to exercise the backoff
+		fetch := func() ([]app.Message, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			fetched++
+			if fetched%2 == 0 {
+				return nil, nil
+			}
+			return []app.Message{{ID: strconv.Itoa(fetched), Body: []byte("body")}}, nil
+		}
+
+		stopped := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			app.StreamMessagesWith(w, req, fetch)
+			close(stopped)
+		}))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(200))
+
+		reader := bufio.NewReader(resp.Body)
+		for i := 0; i < 3; i++ {
+			line, err := reader.ReadBytes('\n')
+			Expect(err).ToNot(HaveOccurred())
+			message := make(map[string]interface{})
+			Expect(json.Unmarshal(line, &message)).To(Succeed())
+			Expect(message["body"]).To(Equal("body"))
+		}
+
+		resp.Body.Close()
+		Eventually(stopped, "2s").Should(BeClosed())
+	})
+})
@@ -1,21 +1,56 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/Tapjoy/dynamiq/app/stats"
 	"github.com/tpjg/goriakpbc"
 )
 
+// Define statistics keys suffixes
+
+// TopicBroadcastStatsSuffix is the counter of messages broadcast by a topic
+const TopicBroadcastStatsSuffix = "broadcast.count"
+
+// TopicBroadcastQueueWritesStatsSuffix is the counter of queue writes made while fanning out broadcasts
+const TopicBroadcastQueueWritesStatsSuffix = "broadcast.queue_writes"
+
+// TopicBroadcastFailuresStatsSuffix is the counter of queue writes that failed while fanning out broadcasts
+const TopicBroadcastFailuresStatsSuffix = "broadcast.failures"
+
+// TopicBroadcastSkippedStatsSuffix is the counter of full queues skipped while fanning out broadcasts
+const TopicBroadcastSkippedStatsSuffix = "broadcast.skipped"
+
+// TopicCompressOnce is the topic setting for compressing a broadcast body once
+const TopicCompressOnce = "compress_once"
+
+// TopicSkipFullQueues is the topic setting for skipping subscribed queues at their max_depth
+const TopicSkipFullQueues = "skip_full_queues"
+
+// SentinelTopic is the placeholder kept in the list of topics, as Riak can't store an empty set
+const SentinelTopic = "default_topic"
+
+// ErrNoDefaultTopic represents the condition that occurs if no defaulttopic is configured
+var ErrNoDefaultTopic = errors.New("No defaulttopic is configured")
+
+// ErrTopicNotFound represents the condition that occurs if an operation names a topic that doesn't exist
+var ErrTopicNotFound = errors.New("Topic does not exist")
+
 // Topic represents a topic
 type Topic struct {
 	// store a CRDT in riak for the topic configuration including subscribers
-	Name     string
-	Config   *riak.RDtMap
-	riakPool *riak.Client
-	queues   *Queues
+	Name       string
+	Config     *riak.RDtMap
+	riakPool   *riak.Client
+	configMaps *ConfigMapCache
+	queues     *Queues
 	// Mutex for protecting rw access to the Config object
 	sync.RWMutex
 }
@@ -25,24 +60,31 @@ type Topics struct {
 	// global topic configuration, should contain list of all active topics
 	Config *riak.RDtMap
 	// topic map
-	TopicMap map[string]*Topic
-	riakPool *riak.Client
-	queues   *Queues
+	TopicMap   map[string]*Topic
+	riakPool   *riak.Client
+	configMaps *ConfigMapCache
+	queues     *Queues
+	// defaultTopic is the topic messages published without naming one are broadcast to, or "" for none
+	defaultTopic string
 	// Channels / Timer for syncing the config
 	syncScheduler *time.Ticker
 	syncKiller    chan struct{}
-	// Mutex for protecting rw access to the Config object
+	syncStopped   chan struct{}
+	stopOnce      sync.Once
+	// syncLock keeps a sync requested through SyncNow from running alongside the scheduled one
+	syncLock sync.Mutex
+	// Mutex for protecting rw access to the Config object and TopicMap
 	sync.RWMutex
 }
 
 // InitTopics initializes the set of known topics in the system
 func InitTopics(cfg *Config, queues *Queues) *Topics {
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("maps", "config")
+	bucket, release, err := cfg.RiakBucket("maps", "config")
 	if err != nil {
 		logrus.Error(err)
 	}
-	config, err := bucket.FetchMap("topicsConfig")
+	defer release()
+	config, err := bucket.FetchMap(TopicsConfigName)
 	if err != nil {
 		logrus.Error(err)
 	}
@@ -50,24 +92,96 @@ func InitTopics(cfg *Config, queues *Queues) *Topics {
 		topicSet := config.AddSet("topics")
 		// TODO Investigate if this is still the case
 		//there's a bug in the protobufs client/cant have an empty set
-		topicSet.Add([]byte("default_topic"))
-		err = config.Store()
+		topicSet.Add([]byte(SentinelTopic))
+		err = cfg.ConfigMaps.storeConfigMap(TopicsConfigName, config)
 	}
 	if err != nil {
 		logrus.Error(err)
 	}
 	topics := Topics{
-		Config:   config,
-		riakPool: cfg.RiakPool,
-		queues:   queues,
-		TopicMap: make(map[string]*Topic),
+		Config:       config,
+		riakPool:     cfg.RiakPool,
+		configMaps:   cfg.ConfigMaps,
+		queues:       queues,
+		defaultTopic: cfg.Core.DefaultTopic,
+		TopicMap:     make(map[string]*Topic),
 	}
-	go topics.scheduleSync(cfg)
+	topics.scheduleSync(cfg)
 	return &topics
 }
 
+// GetTopic returns the topic with the given name, or ErrTopicNotFound if this node doesn't know of it
+func (topics *Topics) GetTopic(name string) (*Topic, error) {
+	topics.RLock()
+	defer topics.RUnlock()
+	topic, ok := topics.TopicMap[name]
+	if !ok {
+		return nil, ErrTopicNotFound
+	}
+	return topic, nil
+}
+
+// TopicNames returns the names of every topic this node knows of
+func (topics *Topics) TopicNames() []string {
+	topics.RLock()
+	defer topics.RUnlock()
+	names := make([]string, 0, len(topics.TopicMap))
+	for name := range topics.TopicMap {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Publish broadcasts message to the configured defaulttopic
+func (topics *Topics) Publish(cfg *Config, message string) (map[string]BroadcastResult, error) {
+	topic, err := topics.getDefaultTopic()
+	if err != nil {
+		return nil, err
+	}
+	return topic.Broadcast(cfg, message), nil
+}
+
+// getDefaultTopic returns the configured defaulttopic, initializing it if this node doesn't know of it
+func (topics *Topics) getDefaultTopic() (*Topic, error) {
+	if topics.defaultTopic == "" {
+		return nil, ErrNoDefaultTopic
+	}
+	return topics.getOrInitTopic(topics.defaultTopic), nil
+}
+
+// isSentinel returns whether name is the placeholder SentinelTopic, rather than a real topic
+func (topics *Topics) isSentinel(name string) bool {
+	return name == SentinelTopic && topics.defaultTopic != SentinelTopic
+}
+
+// topicList returns the topics this node knows of, so they can be worked on without holding the lock
+func (topics *Topics) topicList() []*Topic {
+	topics.RLock()
+	defer topics.RUnlock()
+	list := make([]*Topic, 0, len(topics.TopicMap))
+	for _, topic := range topics.TopicMap {
+		list = append(list, topic)
+	}
+	return list
+}
+
+// getOrInitTopic returns the topic with the given name, initializing it if this node doesn't know of it
+func (topics *Topics) getOrInitTopic(name string) *Topic {
+	topic, err := topics.GetTopic(name)
+	if err != nil {
+		topic = topics.InitTopic(name)
+	}
+	return topic
+}
+
+func (topics *Topics) addTopic(topic *Topic) {
+	topics.Lock()
+	defer topics.Unlock()
+	topics.TopicMap[topic.Name] = topic
+}
+
 // InitTopic initializes an individual topic given a known name
-func (topics *Topics) InitTopic(name string) {
+func (topics *Topics) InitTopic(name string) *Topic {
 	// TODO refactor the behavior of this method into 2 methods, as described below
 	// Currently, this is used for 2 related but different purposes:
 	// 1. Create new topics
@@ -82,76 +196,315 @@ func (topics *Topics) InitTopic(name string) {
 	topic.Config = config
 	topic.Name = name
 	topic.riakPool = topics.riakPool
+	topic.configMaps = topics.configMaps
 	topic.queues = topics.queues
-	topics.TopicMap[name] = topic
+	topics.addTopic(topic)
 
 	// Save the topic level configuration object
 	// Currently, we do not have any options here, marked for future use
-	topic.Config.Store()
+	topics.configMaps.storeConfigMap(topicConfigRecordName(name), topic.Config)
 
 	// Add the queue to the riak store
-	topics.Config.FetchSet("topics").Add([]byte(name))
-	topics.Config.Store()
+	topicsConfig := topics.getConfig()
+	topicsConfig.FetchSet("topics").Add([]byte(name))
+	topics.configMaps.storeConfigMap(TopicsConfigName, topicsConfig)
+	return topic
 }
 
-// Broadcast will send the message to all listening queues and return the acked writes
-func (topic *Topic) Broadcast(cfg *Config, message string) map[string]string {
-	queueWrites := make(map[string]string)
+// BroadcastResult is the outcome of writing a broadcast to one subscribed queue
+type BroadcastResult struct {
+	// UUID is the id the message was stored under, or "" if it wasn't stored
+	UUID string
+	Err  error
+	// Duration is how long the write to the queue took
+	Duration time.Duration
+	// Skipped is whether the queue was skipped for holding its max_depth of messages, in which case
+	// Err is ErrQueueFull
+	Skipped bool
+}
+
+// Broadcast will send the message to all listening queues and return the result of each write
+func (topic *Topic) Broadcast(cfg *Config, message string) map[string]BroadcastResult {
+	if !topic.CompressOnce() {
+		return topic.broadcast(cfg, func(queue *Queue) (string, error) {
+			return queue.Put(cfg, message)
+		})
+	}
+	return topic.broadcastPrepared(cfg, prepareBroadcast(cfg, message), func(queue *Queue, opts putOptions) (string, error) {
+		stored, err := queue.putInGroup(cfg, message, opts)
+		return stored.ID, err
+	})
+}
+
+// prepareBroadcast returns a function preparing message as a put onto a compressed queue would
+func prepareBroadcast(cfg *Config, message string) func(queue *Queue) (*preparedBody, error) {
+	return func(queue *Queue) (*preparedBody, error) {
+		messageCodec, err := cfg.GetMessageCodec(queue.Name)
+		if err != nil {
+			return nil, err
+		}
+		return queue.prepareBody(cfg, context.Background(), message, messageCodec, true)
+	}
+}
+
+// broadcastPrepared is broadcast for topics with compress_once set
+func (topic *Topic) broadcastPrepared(cfg *Config, prepare func(queue *Queue) (*preparedBody, error), put func(queue *Queue, opts putOptions) (string, error)) map[string]BroadcastResult {
+	prepared := make(map[string]*preparedBody)
+	return topic.broadcast(cfg, func(queue *Queue) (string, error) {
+		key, ok := compressionSettings(cfg, queue.Name)
+		if !ok {
+			return put(queue, putOptions{})
+		}
+		body, present := prepared[key]
+		if !present {
+			var err error
+			body, err = prepare(queue)
+			if err != nil {
+				logrus.Error(err)
+				return put(queue, putOptions{})
+			}
+			prepared[key] = body
+		}
+		return put(queue, putOptions{prepared: body})
+	})
+}
+
+// compressionSettings returns a key shared by queues storing a body the same way
+func compressionSettings(cfg *Config, queueName string) (string, bool) {
+	shouldCompress, err := cfg.GetCompressedMessages(queueName)
+	if err != nil || !shouldCompress {
+		return "", false
+	}
+	messageCodec, err := cfg.GetMessageCodec(queueName)
+	if err != nil {
+		return "", false
+	}
+	c, algorithm, err := cfg.GetCompressor(queueName)
+	if err != nil {
+		return "", false
+	}
+	contentType := ""
+	if messageCodec != nil {
+		contentType = messageCodec.ContentType()
+	}
+	return contentType + "/" + algorithm + "/" + compressorDictionary(c), true
+}
+
+// CompressOnce returns whether broadcasts to the topic compress the body once
+func (topic *Topic) CompressOnce() bool {
+	register := topic.getConfig().FetchRegister(TopicCompressOnce)
+	value, err := registerValueToString(register)
+	return err == nil && value == "true"
+}
+
+// SetCompressOnce stores whether broadcasts to the topic compress the body once
+func (topic *Topic) SetCompressOnce(cfg *Config, compressOnce bool) error {
+	return topic.setBoolSetting(cfg, TopicCompressOnce, compressOnce)
+}
+
+// SkipFullQueues returns whether broadcasts to the topic skip subscribed queues which are full
+func (topic *Topic) SkipFullQueues() bool {
+	register := topic.getConfig().FetchRegister(TopicSkipFullQueues)
+	value, err := registerValueToString(register)
+	return err == nil && value == "true"
+}
+
+// SetSkipFullQueues stores whether broadcasts to the topic skip subscribed queues which are full
+func (topic *Topic) SetSkipFullQueues(cfg *Config, skipFullQueues bool) error {
+	return topic.setBoolSetting(cfg, TopicSkipFullQueues, skipFullQueues)
+}
+
+func (topic *Topic) setBoolSetting(cfg *Config, setting string, value bool) error {
+	bucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return err
+	}
+	defer release()
+	recordName := topicConfigRecordName(topic.Name)
+	config, err := bucket.FetchMap(recordName)
+	if err != nil {
+		return err
+	}
+	config.AddRegister(setting).NewValue = []byte(strconv.FormatBool(value))
+	err = cfg.ConfigMaps.storeConfigMap(recordName, config)
+	if err != nil {
+		return err
+	}
+	topic.updateConfig(config)
+	return nil
+}
+
+// broadcast writes to each subscribed queue with put
+func (topic *Topic) broadcast(cfg *Config, put func(queue *Queue) (string, error)) map[string]BroadcastResult {
+	queueWrites := make(map[string]BroadcastResult)
+	var writes, failures, skipped int64
+	skipFull := topic.SkipFullQueues()
 	// If we haven't mapped any queues to this topic yet, this will be nil
 	topicQueues := topic.getConfig().FetchSet("queues")
 	if topicQueues != nil {
 		for _, queue := range topicQueues.GetValue() {
 			//check if we've initialized this queue yet
-			var present bool
-			_, present = topic.queues.QueueMap[string(queue)]
-			if present == true {
-				uuid := topic.queues.QueueMap[string(queue)].Put(cfg, message)
-				queueWrites[string(queue)] = uuid
-			} else {
+			subscriber, err := topic.queues.GetQueue(string(queue))
+			if err != nil {
 				// Return something indicating no queue?
 				// SNS -> SQS would simply blindly accept the write and NOOP
+				continue
+			}
+			if skipFull && subscriber.checkNotFull(cfg, false) == ErrQueueFull {
+				queueWrites[string(queue)] = BroadcastResult{Err: ErrQueueFull, Skipped: true}
+				skipped++
+				continue
 			}
+			start := time.Now()
+			uuid, err := put(subscriber)
+			queueWrites[string(queue)] = BroadcastResult{UUID: uuid, Err: err, Duration: time.Since(start)}
+			if err != nil {
+				failures++
+			} else {
+				writes++
+			}
+		}
+	}
+	defer recordBroadcast(cfg.StatsClient(), topic.Name, 1, writes, failures)
+	if skipped > 0 {
+		if err := cfg.StatsClient().Incr(fmt.Sprintf("%s.%s", topic.Name, TopicBroadcastSkippedStatsSuffix), skipped); err != nil {
+			logrus.Error(err)
 		}
 	}
 	return queueWrites
 }
 
-// AddQueue adds a new queue as a subscriber to the topic
-func (topic *Topic) AddQueue(cfg *Config, name string) {
-	client := cfg.RiakConnection()
-
-	bucket, err := client.NewBucketType("maps", ConfigurationBucket)
-	recordName := topicConfigRecordName(topic.Name)
-	topic.Config, err = bucket.FetchMap(recordName)
+// BroadcastBatch sends multiple messages to every queue subscribed to the topic
+func (topic *Topic) BroadcastBatch(cfg *Config, messages []string) (map[string][]string, error) {
+	queueWrites := make(map[string][]string)
+	var writes, failures int64
+	var failedQueues []string
+	// If we haven't mapped any queues to this topic yet, this will be nil
+	topicQueues := topic.getConfig().FetchSet("queues")
+	if topicQueues != nil {
+		for _, queue := range topicQueues.GetValue() {
+			subscriber, present := topic.queues.QueueMap[string(queue)]
+			if present != true {
+				// SNS -> SQS would simply blindly accept the write and NOOP
+				continue
+			}
+			uuids, err := subscriber.BatchPut(cfg, messages)
+			if uuids == nil {
+				// Nothing stored at all, still report a slot per message
+				uuids = make([]string, len(messages))
+			}
+			queueWrites[string(queue)] = uuids
+			for _, uuid := range uuids {
+				if uuid == "" {
+					failures++
+				} else {
+					writes++
+				}
+			}
+			if err != nil {
+				failedQueues = append(failedQueues, string(queue))
+			}
+		}
+	}
+	defer recordBroadcast(cfg.StatsClient(), topic.Name, int64(len(messages)), writes, failures)
+	if len(failedQueues) > 0 {
+		return queueWrites, fmt.Errorf("Unable to write every message to queues %s", strings.Join(failedQueues, ", "))
+	}
+	return queueWrites, nil
+}
 
-	queueSet := topic.Config.AddSet("queues")
-	queueSet.Add([]byte(name))
-	topic.Config.Store()
-	topic.Config, err = bucket.FetchMap(recordName)
-	if err != nil {
-		logrus.Error(err)
+func recordBroadcast(c stats.Client, topicName string, broadcasts int64, writes int64, failures int64) error {
+	var errs stats.Errors
+	// Increment # Broadcast
+	key := fmt.Sprintf("%s.%s", topicName, TopicBroadcastStatsSuffix)
+	errs.Add(c.Incr(key, broadcasts))
+	// Increment # of queues written to
+	key = fmt.Sprintf("%s.%s", topicName, TopicBroadcastQueueWritesStatsSuffix)
+	errs.Add(c.Incr(key, writes))
+	if failures > 0 {
+		// Increment # of queues we failed to write to
+		key = fmt.Sprintf("%s.%s", topicName, TopicBroadcastFailuresStatsSuffix)
+		errs.Add(c.Incr(key, failures))
 	}
+	return errs.Err()
 }
 
-// DeleteQueue will remove a queue from the list of topic subscribers
-func (topic *Topic) DeleteQueue(cfg *Config, name string) {
-	client := cfg.RiakConnection()
-	recordName := topicConfigRecordName(topic.Name)
-	bucket, _ := client.NewBucketType("maps", ConfigurationBucket)
-	topic.Config, _ = bucket.FetchMap(recordName)
+// PurgeQueues purges every queue subscribed to the topic, returning how many messages each lost
+func (topic *Topic) PurgeQueues(cfg *Config) (map[string]int, error) {
+	return topic.purgeQueues(func(queue *Queue) (int, error) {
+		return queue.Purge(cfg)
+	})
+}
 
-	topic.Config.FetchSet("queues").Remove([]byte(name))
-	topic.Config.Store()
-	topic.Config, _ = bucket.FetchMap(recordName)
+func (topic *Topic) purgeQueues(purge func(queue *Queue) (int, error)) (map[string]int, error) {
+	purged := make(map[string]int)
+	errs := make(QueueErrors)
+	for _, name := range topic.ListQueues() {
+		queue, err := topic.queues.GetQueue(name)
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		count, err := purge(queue)
+		if err != nil {
+			errs[name] = err
+		}
+		if err == nil || count > 0 {
+			purged[name] = count
+		}
+	}
+	if len(errs) > 0 {
+		return purged, errs
+	}
+	return purged, nil
+}
 
+// AddQueue adds a new queue as a subscriber to the topic
+func (topic *Topic) AddQueue(cfg *Config, name string) error {
+	return topic.changeSubscriptions(cfg, func(config *riak.RDtMap) {
+		config.AddSet("queues").Add([]byte(name))
+	})
+}
+
+// DeleteQueue will remove a queue from the list of topic subscribers
+func (topic *Topic) DeleteQueue(cfg *Config, name string) error {
 	//TODO Need de-nitialize queue analog to initialize
+	return topic.changeSubscriptions(cfg, func(config *riak.RDtMap) {
+		if queueSet := config.FetchSet("queues"); queueSet != nil {
+			queueSet.Remove([]byte(name))
+		}
+	})
+}
 
+// changeSubscriptions applies change to the topic's stored config, then reads it back
+func (topic *Topic) changeSubscriptions(cfg *Config, change func(config *riak.RDtMap)) error {
+	bucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
+	if err != nil {
+		return err
+	}
+	defer release()
+	recordName := topicConfigRecordName(topic.Name)
+	config, err := bucket.FetchMap(recordName)
+	if err != nil {
+		return err
+	}
+	change(config)
+	err = cfg.ConfigMaps.storeConfigMap(recordName, config)
+	if err != nil {
+		return err
+	}
+	config, err = bucket.FetchMap(recordName)
+	if err != nil {
+		return err
+	}
+	topic.updateConfig(config)
+	return nil
 }
 
 // ListQueues will return a list of all known queues for a topic
 func (topic *Topic) ListQueues() []string {
 	list := make([]string, 0, 10)
-	queueList := topic.Config.FetchSet("queues")
+	queueList := topic.getConfig().FetchSet("queues")
 	if queueList != nil {
 		for _, queueName := range queueList.GetValue() {
 			list = append(list, string(queueName))
@@ -160,25 +513,70 @@ func (topic *Topic) ListQueues() []string {
 	return list
 }
 
+// SubscriberInfo describes one queue subscribed to a topic
+type SubscriberInfo struct {
+	Name string `json:"name"`
+	// Exists is false if the queue was deleted while the topic was still subscribed to it
+	Exists bool `json:"exists"`
+	// ApproxDepth is nil if the depth couldn't be read
+	ApproxDepth *int64 `json:"approximate_depth"`
+}
+
+// ListSubscribers returns every queue subscribed to the topic
+func (topic *Topic) ListSubscribers(cfg *Config) ([]SubscriberInfo, error) {
+	var snapshotErr error
+	subscribers := make([]SubscriberInfo, 0, 10)
+	for _, name := range topic.ListQueues() {
+		subscriber := SubscriberInfo{Name: name}
+		topic.queues.RLock()
+		queue, exists := topic.queues.QueueMap[name]
+		topic.queues.RUnlock()
+		subscriber.Exists = exists
+		if exists {
+			// Each queue's depth is read from its own tenant's namespace
+			snapshot, err := stats.TakeSnapshot(queue.statsClient(cfg))
+			if err == nil {
+				depth := snapshot.Gauges[fmt.Sprintf("%s.%s", name, QueueDepthAprStatsSuffix)]
+				subscriber.ApproxDepth = &depth
+			} else {
+				snapshotErr = err
+			}
+		}
+		subscribers = append(subscribers, subscriber)
+	}
+	return subscribers, snapshotErr
+}
+
 // DeleteTopic will delete the topic from the collection of all topics, which
 // removes any queues it's subscription list
 func (topics *Topics) DeleteTopic(cfg *Config, name string) bool {
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("maps", "config")
-	topicsConfig, err := bucket.FetchMap("topicsConfig")
+	// A topic this node doesn't know of has nothing to delete
+	if _, err := topics.GetTopic(name); err != nil {
+		return false
+	}
+	bucket, release, err := cfg.RiakBucket("maps", "config")
 	if err != nil {
 		logrus.Error(err)
+		return false
 	}
-	topicsConfig.FetchSet("topics").Remove([]byte(name))
-	err = topicsConfig.Store()
+	defer release()
+	topicsConfig, err := bucket.FetchMap(TopicsConfigName)
 	if err != nil {
 		logrus.Error(err)
+		return false
 	}
+	topicsConfig.FetchSet("topics").Remove([]byte(name))
+	err = cfg.ConfigMaps.storeConfigMap(TopicsConfigName, topicsConfig)
+	// The topic's own config is deleted on a connection of its own
+	release()
 	// Lock while we modify the topic name hash
 	topics.Lock()
-	topics.TopicMap[name].Delete(cfg)
+	topic, ok := topics.TopicMap[name]
 	delete(topics.TopicMap, name)
 	topics.Unlock()
+	if ok {
+		topic.Delete(cfg)
+	}
 
 	if err != nil {
 		logrus.Error(err)
@@ -190,15 +588,19 @@ func (topics *Topics) DeleteTopic(cfg *Config, name string) bool {
 // Delete will delete the given topic, which removes any queues from its subscription
 // list
 func (topic *Topic) Delete(cfg *Config) {
-	client := cfg.RiakConnection()
 
-	bucket, _ := client.NewBucketType("maps", "config")
+	bucket, release, err := cfg.RiakBucket("maps", "config")
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	defer release()
 	recordName := topicConfigRecordName(topic.Name)
 	topicConfig, err := bucket.FetchMap(recordName)
 	if err != nil {
 		logrus.Error(err)
 	}
-	topicConfig.Destroy()
+	cfg.ConfigMaps.destroyConfigMap(recordName, topicConfig)
 }
 
 func (topics *Topics) scheduleSync(cfg *Config) {
@@ -206,29 +608,54 @@ func (topics *Topics) scheduleSync(cfg *Config) {
 	if topics.syncScheduler == nil {
 		topics.syncScheduler = time.NewTicker(cfg.Core.SyncConfigInterval * time.Millisecond)
 	}
+	topics.syncKiller = make(chan struct{})
+	topics.syncStopped = make(chan struct{})
 	// Go routine to listen to either the scheduler or the killer
 	go func(config *Config) {
+		defer close(topics.syncStopped)
 		for {
 			select {
 			// Check to see if we have a tick
 			case <-topics.syncScheduler.C:
-				topics.syncConfig(cfg)
+				topics.SyncNow(cfg)
 			// Check to see if we've been stopped
 			case <-topics.syncKiller:
 				topics.syncScheduler.Stop()
+				// Send on anything the stats client is still holding before we go
+				err := stats.Flush(cfg.StatsClient())
+				if err != nil {
+					logrus.Error(err)
+				}
 				return
 			}
 		}
 	}(cfg)
 }
 
+// Stop ends the config sync, and waits for it to exit. It is safe to call more than once
+func (topics *Topics) Stop() {
+	topics.stopOnce.Do(func() {
+		if topics.syncKiller == nil {
+			return
+		}
+		close(topics.syncKiller)
+		<-topics.syncStopped
+	})
+}
+
+// SyncNow syncs the topic config with Riak straight away
+func (topics *Topics) SyncNow(cfg *Config) {
+	topics.syncLock.Lock()
+	defer topics.syncLock.Unlock()
+	topics.syncConfig(cfg)
+}
+
 //helpers
 //TODO move error handling for empty config in riak to initializer
 func (topics *Topics) syncConfig(cfg *Config) {
 	logrus.Debug("syncing Topic config with Riak")
 	//refresh the topic RDtMap
-	client := cfg.RiakConnection()
-	bucket, err := client.NewBucketType("maps", ConfigurationBucket)
+	bucket, release, err := cfg.RiakBucket("maps", ConfigurationBucket)
 	if err != nil {
 		// This is likely caused by a network blip against the riak node, or the node being down
 		// In lieu of hard-failing the service, which can recover once riak comes back, we'll simply
@@ -237,10 +664,11 @@ func (topics *Topics) syncConfig(cfg *Config) {
 		logrus.Error(err)
 		return
 	}
+	defer release()
 	//fetch the map ignore error for event that map doesn't exist
 	//TODO make these keys configurable?
 	//Question is this thread safe...?
-	topicsConfig, err := bucket.FetchMap("topicsConfig")
+	topicsConfig, err := cfg.ConfigMaps.fetchConfigMap(bucket, TopicsConfigName)
 	if err != nil {
 		if err.Error() == "Object not found" {
 			// This means there are no topics yet
@@ -257,26 +685,41 @@ func (topics *Topics) syncConfig(cfg *Config) {
 	topics.updateConfig(topicsConfig)
 
 	//iterate the map and add or remove topics that need to be destroyed
-	topicSlice := topics.Config.FetchSet("topics").GetValue()
+	topicSlice := topics.getConfig().FetchSet("topics").GetValue()
 	if topicSlice == nil {
 		//bail if there aren't any topics
 		return
 	}
-	//Is there a better way to do this?
+	topicNames := make([]string, 0, len(topicSlice))
+	for _, topic := range topicSlice {
+		topicNames = append(topicNames, string(topic))
+	}
+	topics.syncTopics(topicNames, func(name string) {
+		topics.InitTopic(name)
+	})
 
+	//sync all topics with riak
+	for _, topic := range topics.topicList() {
+		topic.syncConfig()
+	}
+}
+
+// syncTopics initializes the named topics this node doesn't know of, and drops those no longer named
+func (topics *Topics) syncTopics(names []string, initTopic func(name string)) {
 	//iterate over the topics in riak and add the missing ones
 	topicsToKeep := make(map[string]bool)
-	for _, topic := range topicSlice {
-		topicName := string(topic)
-		var present bool
-		_, present = topics.TopicMap[topicName]
-		if present != true {
-			topics.InitTopic(topicName)
+	for _, topicName := range names {
+		if topics.isSentinel(topicName) {
+			continue
+		}
+		if _, err := topics.GetTopic(topicName); err != nil {
+			initTopic(topicName)
 		}
 		topicsToKeep[topicName] = true
-
 	}
 	//iterate over the topics in topics.TopicMap and delete the ones no longer used
+	topics.Lock()
+	defer topics.Unlock()
 	for topic := range topics.TopicMap {
 		var present bool
 		_, present = topicsToKeep[topic]
@@ -284,11 +727,6 @@ func (topics *Topics) syncConfig(cfg *Config) {
 			delete(topics.TopicMap, topic)
 		}
 	}
-
-	//sync all topics with riak
-	for _, topic := range topics.TopicMap {
-		topic.syncConfig()
-	}
 }
 
 func (topic *Topic) syncConfig() {
@@ -299,10 +737,8 @@ func (topic *Topic) syncConfig() {
 		logrus.Error(err)
 	}
 	recordName := topicConfigRecordName(topic.Name)
-	rCfg, err := bucket.FetchMap(recordName)
-	// We need to remove the notion of the default topic, as we no longer need it
-	// For older installations that still have this topic, lets prevent it from being noisy
-	if err != nil && topic.Name != "default_topic" {
+	rCfg, err := topic.configMaps.fetchConfigMap(bucket, recordName)
+	if err != nil {
 		logrus.Error(err)
 	}
 	topic.updateConfig(rCfg)
@@ -0,0 +1,406 @@
+package app_test
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tapjoy/dynamiq/app"
+	"github.com/Tapjoy/dynamiq/app/compressor"
+	"github.com/Tapjoy/dynamiq/app/stats"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tpjg/goriakpbc"
+	"github.com/tpjg/goriakpbc/pb"
+)
+
+var _ = Describe("Topic", func() {
+
+	Context("BroadcastBatch", func() {
+		It("should report a slot per message for every subscribed queue", func() {
+			// Trip the breaker, so the writes fail fast instead of reaching out to Riak
+			breaker := app.NewBreaker(1, time.Hour, time.Hour)
+			breaker.Record(errors.New("riak is down"))
+			client := stats.NewMemoryClient()
+			broadcastConfig := &app.Config{Stats: app.Stats{Client: client}, RiakBreaker: breaker}
+
+			subscribers := &app.Queues{QueueMap: map[string]*app.Queue{
+				"first":  {Name: "first", Config: &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}},
+				"second": {Name: "second", Config: &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}},
+			}}
+			broadcastConfig.Queues = subscribers
+			topicConfig := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+			topicConfig.Values[riak.MapKey{Key: "queues", Type: pb.MapField_SET}] = &riak.RDtSet{Value: [][]byte{[]byte("first"), []byte("second")}}
+			topic := app.NewTopicWith("test_topic", topicConfig, subscribers)
+
+			messages := []string{"one", "two", "three", "four", "five"}
+			queueWrites, err := topic.BroadcastBatch(broadcastConfig, messages)
+			Expect(err).To(HaveOccurred())
+			Expect(queueWrites).To(HaveLen(2))
+			Expect(queueWrites["first"]).To(HaveLen(5))
+			Expect(queueWrites["second"]).To(HaveLen(5))
+			Expect(client.Counter("test_topic." + app.TopicBroadcastStatsSuffix)).To(Equal(int64(5)))
+			Expect(client.Counter("test_topic." + app.TopicBroadcastFailuresStatsSuffix)).To(Equal(int64(10)))
+		})
+	})
+
+	Context("Broadcast", func() {
+		It("should report the outcome of the write to each subscribed queue", func() {
+			client := stats.NewMemoryClient()
+			broadcastConfig := &app.Config{Stats: app.Stats{Client: client}}
+			subscribers := &app.Queues{QueueMap: map[string]*app.Queue{
+				"working": {Name: "working"},
+				"failing": {Name: "failing"},
+			}}
+			topicConfig := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+			topicConfig.Values[riak.MapKey{Key: "queues", Type: pb.MapField_SET}] = &riak.RDtSet{Value: [][]byte{[]byte("working"), []byte("failing"), []byte("deleted")}}
+			topic := app.NewTopicWith("test_topic", topicConfig, subscribers)
+
+			results := topic.BroadcastWith(broadcastConfig, func(queue *app.Queue) (string, error) {
+				if queue.Name == "failing" {
+					return "", app.ErrRiakUnavailable
+				}
+				time.Sleep(10 * time.Millisecond)
+				return "12345", nil
+			})
+			Expect(results).To(HaveLen(2))
+			Expect(results["working"].UUID).To(Equal("12345"))
+			Expect(results["working"].Err).ToNot(HaveOccurred())
+			Expect(results["working"].Duration).To(BeNumerically(">=", 10*time.Millisecond))
+			Expect(results["failing"].UUID).To(BeEmpty())
+			Expect(results["failing"].Err).To(Equal(app.ErrRiakUnavailable))
+			Expect(client.Counter("test_topic." + app.TopicBroadcastQueueWritesStatsSuffix)).To(Equal(int64(1)))
+			Expect(client.Counter("test_topic." + app.TopicBroadcastFailuresStatsSuffix)).To(Equal(int64(1)))
+		})
+
+		It("should count a write to each of the queues a broadcast fans out to", func() {
+			client := stats.NewMemoryClient()
+			broadcastConfig := &app.Config{Stats: app.Stats{Client: client}}
+			subscribers := &app.Queues{QueueMap: map[string]*app.Queue{
+				"first":  {Name: "first"},
+				"second": {Name: "second"},
+				"third":  {Name: "third"},
+			}}
+			topicConfig := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+			topicConfig.Values[riak.MapKey{Key: "queues", Type: pb.MapField_SET}] = &riak.RDtSet{Value: [][]byte{[]byte("first"), []byte("second"), []byte("third")}}
+			topic := app.NewTopicWith("test_topic", topicConfig, subscribers)
+
+			results := topic.BroadcastWith(broadcastConfig, func(queue *app.Queue) (string, error) {
+				return "12345", nil
+			})
+			Expect(results).To(HaveLen(3))
+			Expect(client.Counter("test_topic." + app.TopicBroadcastStatsSuffix)).To(Equal(int64(1)))
+			Expect(client.Counter("test_topic." + app.TopicBroadcastQueueWritesStatsSuffix)).To(Equal(int64(3)))
+			Expect(client.Counter("test_topic." + app.TopicBroadcastFailuresStatsSuffix)).To(BeZero())
+		})
+	})
+
+	Context("Broadcast with skip_full_queues", func() {
+		It("should skip the subscribed queues over their max_depth and deliver to the others", func() {
+			client := stats.NewMemoryClient()
+			client.SetGauge("full."+app.QueueDepthAprStatsSuffix, 12)
+			client.SetGauge("roomy."+app.QueueDepthAprStatsSuffix, 3)
+			queueConfig := func() *riak.RDtMap {
+				config := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+				config.Values[riak.MapKey{Key: app.MaxDepth, Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte("10")}
+				return config
+			}
+			subscribers := &app.Queues{QueueMap: map[string]*app.Queue{
+				"full":      {Name: "full", Config: queueConfig()},
+				"roomy":     {Name: "roomy", Config: queueConfig()},
+				"unlimited": {Name: "unlimited", Config: &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}},
+			}}
+			broadcastConfig := &app.Config{Stats: app.Stats{Client: client}, Queues: subscribers}
+			topicConfig := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+			topicConfig.Values[riak.MapKey{Key: "queues", Type: pb.MapField_SET}] = &riak.RDtSet{Value: [][]byte{[]byte("full"), []byte("roomy"), []byte("unlimited")}}
+			topicConfig.Values[riak.MapKey{Key: app.TopicSkipFullQueues, Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte("true")}
+			topic := app.NewTopicWith("test_topic", topicConfig, subscribers)
+			Expect(topic.SkipFullQueues()).To(BeTrue())
+
+			written := make([]string, 0)
+			results := topic.BroadcastWith(broadcastConfig, func(queue *app.Queue) (string, error) {
+				written = append(written, queue.Name)
+				return "12345", nil
+			})
+			Expect(written).To(ConsistOf("roomy", "unlimited"))
+			Expect(results).To(HaveLen(3))
+			Expect(results["full"].Skipped).To(BeTrue())
+			Expect(results["full"].Err).To(Equal(app.ErrQueueFull))
+			Expect(results["full"].UUID).To(BeEmpty())
+			Expect(results["roomy"].Skipped).To(BeFalse())
+			Expect(results["roomy"].UUID).To(Equal("12345"))
+			Expect(client.Counter("test_topic." + app.TopicBroadcastSkippedStatsSuffix)).To(Equal(int64(1)))
+			Expect(client.Counter("test_topic." + app.TopicBroadcastFailuresStatsSuffix)).To(BeZero())
+		})
+
+		It("should write to full queues when it isn't set", func() {
+			client := stats.NewMemoryClient()
+			client.SetGauge("full."+app.QueueDepthAprStatsSuffix, 12)
+			config := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+			config.Values[riak.MapKey{Key: app.MaxDepth, Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte("10")}
+			subscribers := &app.Queues{QueueMap: map[string]*app.Queue{"full": {Name: "full", Config: config}}}
+			broadcastConfig := &app.Config{Stats: app.Stats{Client: client}, Queues: subscribers}
+			topicConfig := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+			topicConfig.Values[riak.MapKey{Key: "queues", Type: pb.MapField_SET}] = &riak.RDtSet{Value: [][]byte{[]byte("full")}}
+			topic := app.NewTopicWith("test_topic", topicConfig, subscribers)
+
+			results := topic.BroadcastWith(broadcastConfig, func(queue *app.Queue) (string, error) {
+				return "12345", nil
+			})
+			Expect(results["full"].Skipped).To(BeFalse())
+			Expect(results["full"].UUID).To(Equal("12345"))
+		})
+	})
+
+	Context("Broadcast with compress_once", func() {
+		It("should compress the body once for the queues storing it the same way", func() {
+			queueConfig := func(compressed string) *riak.RDtMap {
+				config := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+				config.Values[riak.MapKey{Key: app.CompressedMessages, Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte(compressed)}
+				return config
+			}
+			subscribers := &app.Queues{QueueMap: map[string]*app.Queue{
+				"first":  {Name: "first", Config: queueConfig("true")},
+				"second": {Name: "second", Config: queueConfig("true")},
+				"plain":  {Name: "plain", Config: queueConfig("false")},
+			}}
+			broadcastConfig := &app.Config{Stats: app.Stats{Client: stats.NewMemoryClient()}, Queues: subscribers}
+			topicConfig := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+			topicConfig.Values[riak.MapKey{Key: "queues", Type: pb.MapField_SET}] = &riak.RDtSet{Value: [][]byte{[]byte("first"), []byte("second"), []byte("plain")}}
+			topicConfig.Values[riak.MapKey{Key: app.TopicCompressOnce, Type: pb.MapField_REGISTER}] = &riak.RDtRegister{Value: []byte("true")}
+			topic := app.NewTopicWith("test_topic", topicConfig, subscribers)
+			Expect(topic.CompressOnce()).To(BeTrue())
+
+			message := strings.Repeat("a large message body ", 1000)
+			bodies := make(map[string][]byte)
+			results, prepares := topic.BroadcastPreparedWith(broadcastConfig, message, func(queue *app.Queue, body []byte) (string, error) {
+				bodies[queue.Name] = body
+				return queue.Name, nil
+			})
+			Expect(results).To(HaveLen(3))
+			Expect(prepares).To(Equal(1))
+			Expect(bodies["plain"]).To(BeNil())
+			Expect(len(bodies["first"])).To(BeNumerically("<", len(message)))
+			// Both queues are handed the very same compressed bytes
+			Expect(&bodies["second"][0]).To(BeIdenticalTo(&bodies["first"][0]))
+			decompressed, err := compressor.NewZlibCompressor().Decompress(bodies["first"])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(decompressed)).To(Equal(message))
+		})
+	})
+
+	Context("PurgeQueues", func() {
+		It("should purge every subscribed queue, reporting those which failed without stopping", func() {
+			// stored holds the messages in each queue
+			stored := map[string]*app.MemoryMessages{
+				"first":  {Objects: map[string]riak.RObject{"1": {Key: "1"}, "2": {Key: "2"}}},
+				"second": {Objects: map[string]riak.RObject{"3": {Key: "3"}}},
+			}
+			client := stats.NewMemoryClient()
+			client.SetGauge("first."+app.QueueDepthStatsSuffix, 2)
+			subscribers := &app.Queues{QueueMap: map[string]*app.Queue{
+				"first":   {Name: "first"},
+				"second":  {Name: "second"},
+				"failing": {Name: "failing"},
+			}}
+			topicConfig := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+			topicConfig.Values[riak.MapKey{Key: "queues", Type: pb.MapField_SET}] = &riak.RDtSet{Value: [][]byte{[]byte("first"), []byte("failing"), []byte("second"), []byte("deleted")}}
+			topic := app.NewTopicWith("test_topic", topicConfig, subscribers)
+
+			purged, err := topic.PurgeQueuesWith(func(queue *app.Queue) (int, error) {
+				if queue.Name == "failing" {
+					return 0, app.ErrRiakUnavailable
+				}
+				bucket := stored[queue.Name]
+				return queue.PurgeWith(client, func(continuation string) ([]string, string, error) {
+					ids := make([]string, 0, len(bucket.Objects))
+					for id := range bucket.Objects {
+						ids = append(ids, id)
+					}
+					return ids, "", nil
+				}, bucket)
+			})
+			Expect(purged).To(Equal(map[string]int{"first": 2, "second": 1}))
+			Expect(stored["first"].Objects).To(BeEmpty())
+			Expect(stored["second"].Objects).To(BeEmpty())
+			Expect(client.Gauge("first." + app.QueueDepthStatsSuffix)).To(BeZero())
+
+			errs, ok := err.(app.QueueErrors)
+			Expect(ok).To(BeTrue())
+			Expect(errs).To(HaveLen(2))
+			Expect(errs["failing"]).To(Equal(app.ErrRiakUnavailable))
+			Expect(errs["deleted"]).To(Equal(app.ErrQueueNotFound))
+		})
+	})
+
+	Context("ListSubscribers", func() {
+		It("should mark subscriptions to deleted queues without failing the others", func() {
+			client := stats.NewMemoryClient()
+			client.SetGauge("live."+app.QueueDepthAprStatsSuffix, 12)
+			subscribersConfig := &app.Config{Stats: app.Stats{Client: client}}
+
+			subscribers := &app.Queues{QueueMap: map[string]*app.Queue{
+				"live": {Name: "live"},
+			}}
+			topicConfig := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+			topicConfig.Values[riak.MapKey{Key: "queues", Type: pb.MapField_SET}] = &riak.RDtSet{Value: [][]byte{[]byte("live"), []byte("deleted")}}
+			topic := app.NewTopicWith("test_topic", topicConfig, subscribers)
+
+			infos, err := topic.ListSubscribers(subscribersConfig)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(infos).To(HaveLen(2))
+			byName := make(map[string]app.SubscriberInfo)
+			for _, info := range infos {
+				byName[info.Name] = info
+			}
+			Expect(byName["live"].Exists).To(BeTrue())
+			Expect(*byName["live"].ApproxDepth).To(Equal(int64(12)))
+			Expect(byName["deleted"].Exists).To(BeFalse())
+			Expect(byName["deleted"].ApproxDepth).To(BeNil())
+		})
+	})
+})
+
+var _ = Describe("Topics", func() {
+
+	Context("TopicMap", func() {
+		It("should be safe to broadcast while the topics are synced", func() {
+			client := stats.NewMemoryClient()
+			broadcastConfig := &app.Config{Stats: app.Stats{Client: client}}
+			syncTopics := &app.Topics{TopicMap: make(map[string]*app.Topic)}
+			syncTopics.SyncTopicsWith([]string{"kept"})
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					// Add the other topic, then drop it again
+					if i%2 == 0 {
+						syncTopics.SyncTopicsWith([]string{"kept", "churned"})
+					} else {
+						syncTopics.SyncTopicsWith([]string{"kept"})
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					for _, name := range syncTopics.TopicNames() {
+						if topic, err := syncTopics.GetTopic(name); err == nil {
+							topic.Broadcast(broadcastConfig, "message")
+						}
+					}
+				}
+			}()
+			wg.Wait()
+
+			Expect(syncTopics.TopicNames()).To(Equal([]string{"kept"}))
+			Expect(client.Counter("kept." + app.TopicBroadcastStatsSuffix)).To(BeNumerically(">=", 200))
+			_, err := syncTopics.GetTopic("churned")
+			Expect(err).To(Equal(app.ErrTopicNotFound))
+		})
+	})
+
+	Context("DeleteTopic", func() {
+		It("should return false for a topic this node doesn't know, without touching Riak", func() {
+			deleteTopics := &app.Topics{TopicMap: make(map[string]*app.Topic)}
+			deleteTopics.SyncTopicsWith([]string{"kept"})
+			Expect(deleteTopics.DeleteTopic(&app.Config{}, "missing")).To(BeFalse())
+			Expect(deleteTopics.TopicNames()).To(Equal([]string{"kept"}))
+		})
+	})
+
+	Context("defaulttopic", func() {
+		subscribed := func(names ...string) *riak.RDtMap {
+			config := &riak.RDtMap{Values: make(map[riak.MapKey]interface{})}
+			set := &riak.RDtSet{}
+			for _, name := range names {
+				set.Value = append(set.Value, []byte(name))
+			}
+			config.Values[riak.MapKey{Key: "queues", Type: pb.MapField_SET}] = set
+			return config
+		}
+
+		It("should broadcast messages published without a topic to the subscribers of the defaulttopic", func() {
+			subscribers := &app.Queues{QueueMap: map[string]*app.Queue{
+				"first":  {Name: "first"},
+				"second": {Name: "second"},
+				"other":  {Name: "other"},
+			}}
+			publishConfig := &app.Config{Stats: app.Stats{Client: stats.NewMemoryClient()}, Queues: subscribers}
+			publishTopics := app.NewTopicsWith(subscribers, "events")
+			publishTopics.TopicMap["events"] = app.NewTopicWith("events", subscribed("first", "second"), subscribers)
+			publishTopics.TopicMap["elsewhere"] = app.NewTopicWith("elsewhere", subscribed("other"), subscribers)
+
+			written := make([]string, 0)
+			results, err := publishTopics.PublishWith(publishConfig, func(queue *app.Queue) (string, error) {
+				written = append(written, queue.Name)
+				return "12345", nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(written).To(ConsistOf("first", "second"))
+			Expect(results).To(HaveLen(2))
+		})
+
+		It("should refuse to publish without a defaulttopic", func() {
+			publishTopics := app.NewTopicsWith(&app.Queues{QueueMap: make(map[string]*app.Queue)}, "")
+			_, err := publishTopics.Publish(cfg, "message")
+			Expect(err).To(Equal(app.ErrNoDefaultTopic))
+		})
+
+		It("should only treat the sentinel as a topic when it is the defaulttopic", func() {
+			syncTopics := app.NewTopicsWith(&app.Queues{QueueMap: make(map[string]*app.Queue)}, "")
+			syncTopics.SyncTopicsWith([]string{app.SentinelTopic, "kept"})
+			Expect(syncTopics.TopicNames()).To(Equal([]string{"kept"}))
+
+			syncTopics = app.NewTopicsWith(&app.Queues{QueueMap: make(map[string]*app.Queue)}, app.SentinelTopic)
+			syncTopics.SyncTopicsWith([]string{app.SentinelTopic, "kept"})
+			Expect(syncTopics.TopicNames()).To(ConsistOf(app.SentinelTopic, "kept"))
+		})
+	})
+
+	Context("Stop", func() {
+		It("should terminate the sync goroutine and flush stats", func() {
+			client := &flushingClient{MemoryClient: stats.NewMemoryClient()}
+			// Use a long interval, so the sync never actually reaches out to Riak
+			syncConfig := &app.Config{
+				Core:  app.Core{SyncConfigInterval: 60000},
+				Stats: app.Stats{Client: client},
+			}
+			syncTopics := &app.Topics{TopicMap: make(map[string]*app.Topic)}
+			syncTopics.ScheduleSync(syncConfig)
+
+			stopped := make(chan struct{})
+			go func() {
+				syncTopics.Stop()
+				close(stopped)
+			}()
+			Eventually(stopped).Should(BeClosed())
+			Expect(client.flushes).To(Equal(1))
+		})
+
+		It("should terminate the loop within one interval while it is ticking", func() {
+			// Trip the breaker, so each sync fails fast instead of reaching out to Riak
+			breaker := app.NewBreaker(1, time.Hour, time.Hour)
+			breaker.Record(errors.New("riak is down"))
+			syncConfig := &app.Config{
+				Core:        app.Core{SyncConfigInterval: 20},
+				Stats:       app.Stats{Client: stats.NewNOOPClient()},
+				RiakBreaker: breaker,
+			}
+			syncTopics := &app.Topics{TopicMap: make(map[string]*app.Topic)}
+			syncTopics.ScheduleSync(syncConfig)
+			// Let a few syncs run first
+			time.Sleep(60 * time.Millisecond)
+
+			stopped := make(chan struct{})
+			go func() {
+				syncTopics.Stop()
+				close(stopped)
+			}()
+			Eventually(stopped, 20*time.Millisecond, time.Millisecond).Should(BeClosed())
+		})
+	})
+})
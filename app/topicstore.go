@@ -0,0 +1,77 @@
+package app
+
+import (
+	"errors"
+)
+
+var (
+	// ErrTopicExists represents the condition that occurs if a topic is created under a name
+	// already in use
+	ErrTopicExists = errors.New("Topic already exists")
+	// ErrInvalidTopicName represents the condition that occurs if a topic name is empty, or can't be
+	// used in a url
+	ErrInvalidTopicName = errors.New("Topic names must be non-empty, without slashes or whitespace")
+)
+
+// topicStore holds the topics the topic API manages, so it can be run against something other than Riak
+type topicStore interface {
+	topicExists(name string) bool
+	queueExists(name string) bool
+	createTopic(name string) error
+	deleteTopic(name string) error
+	// subscriptions returns the queues subscribed to the topic
+	subscriptions(topicName string) []string
+	subscribe(topicName string, queueName string) error
+	unsubscribe(topicName string, queueName string) error
+}
+
+// riakTopicStore is the topicStore of a running node, keeping topics in Riak
+type riakTopicStore struct {
+	cfg *Config
+}
+
+func (s riakTopicStore) topicExists(name string) bool {
+	_, err := s.cfg.Topics.GetTopic(name)
+	return err == nil
+}
+
+func (s riakTopicStore) queueExists(name string) bool {
+	_, err := s.cfg.Queues.GetQueue(name)
+	return err == nil
+}
+
+func (s riakTopicStore) createTopic(name string) error {
+	s.cfg.Topics.InitTopic(name)
+	return nil
+}
+
+func (s riakTopicStore) deleteTopic(name string) error {
+	if !s.cfg.Topics.DeleteTopic(s.cfg, name) {
+		return ErrRiakUnavailable
+	}
+	return nil
+}
+
+func (s riakTopicStore) subscriptions(topicName string) []string {
+	topic, err := s.cfg.Topics.GetTopic(topicName)
+	if err != nil {
+		return nil
+	}
+	return topic.ListQueues()
+}
+
+func (s riakTopicStore) subscribe(topicName string, queueName string) error {
+	topic, err := s.cfg.Topics.GetTopic(topicName)
+	if err != nil {
+		return err
+	}
+	return topic.AddQueue(s.cfg, queueName)
+}
+
+func (s riakTopicStore) unsubscribe(topicName string, queueName string) error {
+	topic, err := s.cfg.Topics.GetTopic(topicName)
+	if err != nil {
+		return err
+	}
+	return topic.DeleteQueue(s.cfg, queueName)
+}
@@ -0,0 +1,71 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName is the name dynamiq's spans are reported under
+const InstrumentationName = "github.com/Tapjoy/dynamiq"
+
+// OTelTracer starts OpenTelemetry spans, and carries their context with the given propagator
+type OTelTracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewOTelTracer returns a Tracer reporting spans to provider
+func NewOTelTracer(provider trace.TracerProvider, propagator propagation.TextMapPropagator) OTelTracer {
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	return OTelTracer{tracer: provider.Tracer(InstrumentationName), propagator: propagator}
+}
+
+// Start starts a span, as a child of the span in ctx if there is one
+func (t OTelTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, otelSpan{span: span}
+}
+
+// Inject writes the trace context of the span in ctx into carrier
+func (t OTelTracer) Inject(ctx context.Context, carrier map[string]string) {
+	t.propagator.Inject(ctx, propagation.MapCarrier(carrier))
+}
+
+// Extract returns ctx carrying the trace context written into carrier, if there is one
+func (t OTelTracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return t.propagator.Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttribute(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case int64:
+		s.span.SetAttributes(attribute.Int64(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+func (s otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
@@ -0,0 +1,161 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// TraceParentKey is the key, in a carrier, of the W3C trace context a span is linked to
+const TraceParentKey = "traceparent"
+
+// Tracer represents the interface for starting spans around queue operations
+type Tracer interface {
+	// Start starts a span with the given name, as a child of the span in ctx if there is one
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Inject writes the trace context of the span in ctx into carrier, so spans in another
+	// process can be linked to it
+	Inject(ctx context.Context, carrier map[string]string)
+	// Extract returns ctx carrying the trace context written into carrier, if there is one
+	Extract(ctx context.Context, carrier map[string]string) context.Context
+}
+
+// Span represents a single traced operation
+type Span interface {
+	SetAttribute(key string, value interface{})
+	// End ends the span, recording err against it if it isn't nil
+	End(err error)
+}
+
+// NOOPTracer is a Tracer which starts no spans, and carries no trace context
+type NOOPTracer struct {
+}
+
+// NewNOOPTracer returns a new NOOPTracer
+func NewNOOPTracer() NOOPTracer {
+	return NOOPTracer{}
+}
+
+// Start returns ctx, and a span which does nothing
+func (t NOOPTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+// Inject does nothing
+func (t NOOPTracer) Inject(ctx context.Context, carrier map[string]string) {
+}
+
+// Extract returns ctx
+func (t NOOPTracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return ctx
+}
+
+type noopSpan struct {
+}
+
+func (s noopSpan) SetAttribute(key string, value interface{}) {
+}
+
+func (s noopSpan) End(err error) {
+}
+
+// RecordedSpan is a span a MemoryTracer saw end
+type RecordedSpan struct {
+	Name     string
+	TraceID  string
+	SpanID   string
+	ParentID string
+	// Attributes are those the span was given before it ended
+	Attributes map[string]interface{}
+	Err        error
+}
+
+// MemoryTracer keeps every ended span in memory, for use in tests
+type MemoryTracer struct {
+	spans []RecordedSpan
+	sync.Mutex
+}
+
+// NewMemoryTracer returns a new MemoryTracer, without any spans
+func NewMemoryTracer() *MemoryTracer {
+	return &MemoryTracer{}
+}
+
+type spanContext struct {
+	traceID string
+	spanID  string
+}
+
+type spanContextKey struct{}
+
+// Start starts a span, in the trace of the span in ctx if there is one, or in a new trace
+func (t *MemoryTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &memorySpan{tracer: t, record: RecordedSpan{Name: name, SpanID: randomID(8), Attributes: make(map[string]interface{})}}
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		span.record.TraceID, span.record.ParentID = parent.traceID, parent.spanID
+	} else {
+		span.record.TraceID = randomID(16)
+	}
+	return context.WithValue(ctx, spanContextKey{}, spanContext{traceID: span.record.TraceID, spanID: span.record.SpanID}), span
+}
+
+// Inject writes the trace context of the span in ctx into carrier under TraceParentKey
+func (t *MemoryTracer) Inject(ctx context.Context, carrier map[string]string) {
+	if current, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		carrier[TraceParentKey] = fmt.Sprintf("00-%s-%s-01", current.traceID, current.spanID)
+	}
+}
+
+// Extract returns ctx carrying the trace context under TraceParentKey in carrier, if it is valid
+func (t *MemoryTracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	parts := strings.Split(carrier[TraceParentKey], "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+	return context.WithValue(ctx, spanContextKey{}, spanContext{traceID: parts[1], spanID: parts[2]})
+}
+
+// Spans returns a copy of the spans which ended, in the order they did
+func (t *MemoryTracer) Spans() []RecordedSpan {
+	t.Lock()
+	defer t.Unlock()
+	return append([]RecordedSpan(nil), t.spans...)
+}
+
+// Reset forgets every span which ended
+func (t *MemoryTracer) Reset() {
+	t.Lock()
+	defer t.Unlock()
+	t.spans = nil
+}
+
+type memorySpan struct {
+	tracer *MemoryTracer
+	record RecordedSpan
+	sync.Mutex
+}
+
+func (s *memorySpan) SetAttribute(key string, value interface{}) {
+	s.Lock()
+	defer s.Unlock()
+	s.record.Attributes[key] = value
+}
+
+func (s *memorySpan) End(err error) {
+	s.Lock()
+	s.record.Err = err
+	record := s.record
+	s.Unlock()
+	s.tracer.Lock()
+	defer s.tracer.Unlock()
+	s.tracer.spans = append(s.tracer.spans, record)
+}
+
+func randomID(bytes int) string {
+	id := make([]byte, bytes)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
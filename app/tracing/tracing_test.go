@@ -0,0 +1,75 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Tapjoy/dynamiq/app/tracing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var _ = Describe("Tracing", func() {
+	Context("OTelTracer", func() {
+		var exporter *tracetest.InMemoryExporter
+		var tracer tracing.OTelTracer
+
+		BeforeEach(func() {
+			exporter = tracetest.NewInMemoryExporter()
+			tracer = tracing.NewOTelTracer(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)), nil)
+		})
+
+		It("should export ended spans with their attributes and errors", func() {
+			_, span := tracer.Start(context.Background(), "dynamiq.put")
+			span.SetAttribute("dynamiq.queue", "orders")
+			span.SetAttribute("dynamiq.batch_size", int64(10))
+			span.End(errors.New("riak is down"))
+
+			spans := exporter.GetSpans()
+			Expect(spans).To(HaveLen(1))
+			Expect(spans[0].Name).To(Equal("dynamiq.put"))
+			Expect(spans[0].Attributes).To(HaveLen(2))
+			Expect(spans[0].Status.Description).To(Equal("riak is down"))
+		})
+
+		It("should link a consumer's span to the producer's through a carrier", func() {
+			ctx, producer := tracer.Start(context.Background(), "producer")
+			carrier := make(map[string]string)
+			tracer.Inject(ctx, carrier)
+			producer.End(nil)
+			Expect(carrier).To(HaveKey(tracing.TraceParentKey))
+
+			_, consumer := tracer.Start(tracer.Extract(context.Background(), carrier), "consumer")
+			consumer.End(nil)
+			spans := exporter.GetSpans()
+			Expect(spans[1].SpanContext.TraceID()).To(Equal(spans[0].SpanContext.TraceID()))
+			Expect(spans[1].Parent.SpanID()).To(Equal(spans[0].SpanContext.SpanID()))
+		})
+	})
+
+	Context("MemoryTracer", func() {
+		It("should read back the trace context an OTelTracer writes", func() {
+			exporter := tracetest.NewInMemoryExporter()
+			producer := tracing.NewOTelTracer(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)), nil)
+			ctx, span := producer.Start(context.Background(), "producer")
+			carrier := make(map[string]string)
+			producer.Inject(ctx, carrier)
+			span.End(nil)
+
+			consumer := tracing.NewMemoryTracer()
+			_, child := consumer.Start(consumer.Extract(context.Background(), carrier), "consumer")
+			child.End(nil)
+			Expect(consumer.Spans()[0].TraceID).To(Equal(exporter.GetSpans()[0].SpanContext.TraceID().String()))
+		})
+
+		It("should do nothing with a carrier without a trace", func() {
+			tracer := tracing.NewMemoryTracer()
+			ctx := tracer.Extract(context.Background(), map[string]string{tracing.TraceParentKey: "garbage"})
+			_, span := tracer.Start(ctx, "consumer")
+			span.End(nil)
+			Expect(tracer.Spans()[0].ParentID).To(BeEmpty())
+		})
+	})
+})
@@ -2,6 +2,9 @@ package main
 
 import (
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/Tapjoy/dynamiq/app"
@@ -25,10 +28,34 @@ func main() {
 	if err != nil {
 		logrus.Fatal(err)
 	}
-	logrus.SetLevel(cfg.Core.LogLevel)
+	cfg.ConfigureLogger(logrus.StandardLogger())
 
-	list, _, err := app.InitMemberList(cfg.Core.Name, cfg.Core.Port, cfg.Core.SeedServers, cfg.Core.SeedPort)
+	var events *app.MemberEvents
+	if cfg.Core.DeadNodeCleanup {
+		events = app.NewMemberEvents(func(nodeName string) {
+			cfg.Queues.ReclaimNode(cfg, nodeName)
+		})
+	}
+	// Tell the other nodes whenever this one changes the config, so they sync it right away
+	versions := app.NewConfigVersions(func() {
+		cfg.Queues.SyncNow(cfg)
+		cfg.Topics.SyncNow(cfg)
+	})
+	cfg.ConfigMaps.OnStore(versions.Bump)
+	list, _, err := app.InitMemberList(cfg.Core.Name, cfg.Core.Port, cfg.SeedServers(), cfg.Core.SeedPort, cfg.Core.ClusterProfile, events, versions)
+	app.ScheduleSeedRejoin(cfg, list)
+	cfg.Queues.ScheduleExpiry(cfg, list)
 	httpAPI := app.HTTPApiV1{}
 
+	// Stop the config syncs, and flush any stats, before exiting
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		cfg.Queues.Stop()
+		cfg.Topics.Stop()
+		os.Exit(0)
+	}()
+
 	httpAPI.InitWebserver(list, cfg)
 }
@@ -2,3 +2,5 @@ riak-admin bucket-type create maps '{"props":{"datatype":"map"}}'
 riak-admin bucket-type activate maps
 riak-admin bucket-type create messages
 riak-admin bucket-type activate messages
+riak-admin bucket-type create counters '{"props":{"datatype":"counter"}}'
+riak-admin bucket-type activate counters